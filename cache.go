@@ -1,30 +1,57 @@
 package yum
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
+// Cache is a directory in which the metadata of each repo is cached in a
+// subdirectory named by the repo ID.
+//
+// A cache may span several directories, such as on different volumes, given
+// as a list separated by os.PathListSeparator. Each repo is cached in the
+// directory which already caches it or, for a new repo, in the directory with
+// the most free space.
 type Cache struct {
+	// Path is the first cache directory.
 	Path string
+
+	// Paths are all of the cache directories.
+	Paths []string
 }
 
 func NewCache(path string) (*Cache, error) {
+	paths := make([]string, 0)
+	for _, p := range filepath.SplitList(path) {
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+
+	if len(paths) == 0 {
+		paths = append(paths, path)
+	}
+
 	cache := &Cache{
-		Path: path,
+		Path:  paths[0],
+		Paths: paths,
 	}
 
-	// create cache folder
-	if err := cache.mkdir(path); err != nil {
-		return nil, err
+	// create cache folders
+	for _, p := range paths {
+		if err := cache.mkdir(p); err != nil {
+			return nil, err
+		}
 	}
 
 	return cache, nil
 }
 
 func (c *Cache) NewRepoCache(repo *Repo) (*RepoCache, error) {
-	cachedir := filepath.Join(c.Path, repo.ID)
+	cachedir := c.cachedir(repo)
 
 	// create cache directory tree
 	if err := c.mkdir(cachedir); err != nil {
@@ -36,8 +63,9 @@ func (c *Cache) NewRepoCache(repo *Repo) (*RepoCache, error) {
 	}
 
 	return &RepoCache{
-		Repo: repo,
-		Path: cachedir,
+		Repo:    repo,
+		Path:    cachedir,
+		mirrors: append([]string(nil), repo.Mirrors...),
 	}, nil
 }
 
@@ -51,6 +79,115 @@ func (c *Cache) mkdir(path string) error {
 	return nil
 }
 
+// diskFree returns the number of bytes available on the volume of the given
+// path. It may be replaced by tests.
+var diskFree = freeSpace
+
+// cachedir returns the cache directory of the given repo. If the cache spans
+// several directories, this is the existing cache directory of the repo or,
+// if the repo is not cached yet, a new directory in the cache directory with
+// the most free space.
 func (c *Cache) cachedir(repo *Repo) string {
-	return filepath.Join(c.Path, repo.ID)
+	if len(c.Paths) <= 1 {
+		return filepath.Join(c.Path, repo.ID)
+	}
+
+	for _, p := range c.Paths {
+		dir := filepath.Join(p, repo.ID)
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+	}
+
+	best, most := c.Path, uint64(0)
+	for _, p := range c.Paths {
+		free, err := diskFree(p)
+		if err != nil {
+			Dprintf("Error reading free space of cache directory %s: %v\n", p, err)
+			continue
+		}
+
+		if free > most {
+			best, most = p, free
+		}
+	}
+
+	Dprintf("Caching repo %v in %s\n", repo, best)
+	return filepath.Join(best, repo.ID)
+}
+
+// PruneCache removes the cached metadata of each repo in the given cache
+// directory which is not one of the given active repos, such as repos which
+// were removed from a Yumfile, and returns the number of bytes freed. As with
+// NewCache, the cache directory may be a list of directories.
+//
+// Only subdirectories which contain cached metadata are removed, so that other
+// files in the cache directory are never deleted. The cache of a repo which is
+// locked by another process is not removed.
+func PruneCache(cachedir string, activeRepos []*Repo) (freed uint64, err error) {
+	active := make(map[string]bool, len(activeRepos))
+	for _, repo := range activeRepos {
+		active[repo.ID] = true
+	}
+
+	for _, path := range filepath.SplitList(cachedir) {
+		files, err := ioutil.ReadDir(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return freed, err
+		}
+
+		for _, fi := range files {
+			if !fi.IsDir() || active[fi.Name()] {
+				continue
+			}
+
+			n, err := pruneRepoCache(filepath.Join(path, fi.Name()))
+			freed += n
+			if err != nil {
+				return freed, err
+			}
+		}
+	}
+
+	return freed, nil
+}
+
+// pruneRepoCache removes the given repo cache directory, if it contains cached
+// metadata and is not locked, and returns the number of bytes freed.
+func pruneRepoCache(dir string) (uint64, error) {
+	if _, err := os.Stat(filepath.Join(dir, "repomd.xml")); err != nil {
+		if _, err := os.Stat(filepath.Join(dir, "gen")); err != nil {
+			Dprintf("Not pruning %s, which is not a repo cache\n", dir)
+			return 0, nil
+		}
+	}
+
+	lock, err := lockDir(dir, false)
+	if errors.Is(err, ErrRepoLocked) {
+		Dprintf("Not pruning locked repo cache %s\n", dir)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+
+	var size uint64
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	Dprintf("Pruning repo cache %s\n", dir)
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, fmt.Errorf("Error pruning repo cache %s: %v", dir, err)
+	}
+
+	return size, nil
 }
@@ -0,0 +1,191 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestDiff lists the packages which were added, updated or removed between
+// two sync manifests.
+type ManifestDiff struct {
+	Added   []ManifestPackage
+	Updated []ManifestUpdate
+	Removed []ManifestPackage
+}
+
+// ManifestUpdate is a package which was replaced by another version of the
+// same name and architecture.
+type ManifestUpdate struct {
+	From ManifestPackage
+	To   ManifestPackage
+}
+
+func (c ManifestUpdate) String() string {
+	return fmt.Sprintf("%s %s -> %s (%s)", c.To.Name, c.From.EVR(), c.To.EVR(), c.To.Arch)
+}
+
+// EVR returns the epoch, version and release of the package in the form
+// epoch:version-release. The epoch is omitted if it is zero.
+func (c ManifestPackage) EVR() string {
+	if c.Epoch != 0 {
+		return fmt.Sprintf("%d:%s-%s", c.Epoch, c.Version, c.Release)
+	}
+
+	return fmt.Sprintf("%s-%s", c.Version, c.Release)
+}
+
+// packageEntry returns a PackageEntry with the name, version and architecture
+// of the manifest package, so that it may be compared with CompareEVR.
+func (c ManifestPackage) packageEntry() *PackageEntry {
+	p := &PackageEntry{
+		PackageName: c.Name,
+		Arch:        c.Arch,
+	}
+	p.Versions = PackageEntryVersion{Epoch: c.Epoch, Version: c.Version, Release: c.Release}
+	return p
+}
+
+// DiffManifests compares the packages listed in two sync manifests. A package
+// in current of the same name and architecture as a package in previous, but
+// a different version, is listed as an update. If several versions of a
+// package are kept, the newest versions are paired as updates and any
+// remaining versions are listed as added or removed.
+func DiffManifests(previous, current *SyncManifest) *ManifestDiff {
+	diff := &ManifestDiff{
+		Added:   make([]ManifestPackage, 0),
+		Updated: make([]ManifestUpdate, 0),
+		Removed: make([]ManifestPackage, 0),
+	}
+
+	index := func(packages []ManifestPackage) map[string]bool {
+		m := make(map[string]bool, len(packages))
+		for _, p := range packages {
+			m[p.NEVRA()] = true
+		}
+		return m
+	}
+
+	// group the packages which are only in one manifest by name and arch
+	group := func(packages []ManifestPackage, other map[string]bool) (map[string][]ManifestPackage, []string) {
+		groups := make(map[string][]ManifestPackage)
+		keys := make([]string, 0)
+		for _, p := range packages {
+			if other[p.NEVRA()] {
+				continue
+			}
+
+			key := p.Name + "." + p.Arch
+			if _, ok := groups[key]; !ok {
+				keys = append(keys, key)
+			}
+			groups[key] = append(groups[key], p)
+		}
+
+		// newest first
+		for _, g := range groups {
+			sort.SliceStable(g, func(i, j int) bool {
+				return CompareEVR(g[i].packageEntry(), g[j].packageEntry()) > 0
+			})
+		}
+
+		return groups, keys
+	}
+
+	removed, removedKeys := group(previous.Packages, index(current.Packages))
+	added, addedKeys := group(current.Packages, index(previous.Packages))
+
+	for _, key := range addedKeys {
+		from, to := removed[key], added[key]
+		for len(from) > 0 && len(to) > 0 {
+			diff.Updated = append(diff.Updated, ManifestUpdate{From: from[0], To: to[0]})
+			from, to = from[1:], to[1:]
+		}
+		removed[key] = from
+		diff.Added = append(diff.Added, to...)
+	}
+
+	for _, key := range removedKeys {
+		diff.Removed = append(diff.Removed, removed[key]...)
+	}
+
+	return diff
+}
+
+// Empty returns true if no packages were added, updated or removed.
+func (c *ManifestDiff) Empty() bool {
+	return len(c.Added) == 0 && len(c.Updated) == 0 && len(c.Removed) == 0
+}
+
+// changelogPrefix and changelogSuffix form the names of the changelogs written
+// to a package directory by Sync if GenerateChangelog is set, with the time of
+// the sync between them.
+const (
+	changelogPrefix     = "CHANGES-"
+	changelogSuffix     = ".txt"
+	changelogTimeFormat = "20060102T150405Z"
+)
+
+// isChangelogFilename returns true if the given filename is a changelog
+// written by Sync.
+func isChangelogFilename(name string) bool {
+	return strings.HasPrefix(name, changelogPrefix) && strings.HasSuffix(name, changelogSuffix)
+}
+
+// writeChangelog writes a human-readable list of the packages which changed
+// between the given manifests to CHANGES-<timestamp>.txt in the given package
+// directory, where timestamp is the UTC creation time of the current
+// manifest. Nothing is written if no packages changed.
+func (c *Repo) writeChangelog(packagedir string, previous, current *SyncManifest) error {
+	diff := DiffManifests(previous, current)
+	if diff.Empty() {
+		Dprintf("No packages changed in repo %v since %v\n", c, previous.Created)
+		return nil
+	}
+
+	path := filepath.Join(packagedir, changelogPrefix+current.Created.UTC().Format(changelogTimeFormat)+changelogSuffix)
+	Dprintf("Writing changelog %s\n", path)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "Changes to repo %s since %s\n", c.ID, previous.Created.UTC().Format(time.RFC1123))
+	fmt.Fprintf(w, "%d updated, %d added, %d removed\n", len(diff.Updated), len(diff.Added), len(diff.Removed))
+
+	if len(diff.Updated) > 0 {
+		fmt.Fprintf(w, "\nUpdated:\n")
+		for _, u := range diff.Updated {
+			fmt.Fprintf(w, "  %v\n", u)
+		}
+	}
+
+	for _, section := range []struct {
+		title    string
+		packages []ManifestPackage
+	}{
+		{"Added", diff.Added},
+		{"Removed", diff.Removed},
+	} {
+		if len(section.packages) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(w, "\n%s:\n", section.title)
+		for _, p := range section.packages {
+			fmt.Fprintf(w, "  %s %s (%s)\n", p.Name, p.EVR(), p.Arch)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
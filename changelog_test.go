@@ -0,0 +1,90 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteChangelog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pkg := func(name, version, release, arch string) ManifestPackage {
+		return ManifestPackage{Name: name, Version: version, Release: release, Arch: arch}
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+
+	// first sync
+	previous := &SyncManifest{
+		Repo:    "base",
+		Created: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC),
+		Packages: []ManifestPackage{
+			pkg("foo", "1.2", "1", "x86_64"),
+			pkg("bar", "2.0", "1", "noarch"),
+			pkg("baz", "1.0", "1", "noarch"),
+		},
+	}
+
+	// second sync updates foo, removes baz and adds qux
+	current := &SyncManifest{
+		Repo:    "base",
+		Created: time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Packages: []ManifestPackage{
+			pkg("foo", "1.3", "1", "x86_64"),
+			pkg("bar", "2.0", "1", "noarch"),
+			pkg("qux", "0.1", "2", "x86_64"),
+		},
+	}
+
+	if err := repo.writeChangelog(dir, previous, current); err != nil {
+		t.Fatalf("Error writing changelog: %v", err)
+	}
+
+	path := filepath.Join(dir, "CHANGES-20170102T030405Z.txt")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading changelog: %v", err)
+	}
+
+	expect := `Changes to repo base since Sun, 01 Jan 2017 00:00:00 UTC
+1 updated, 1 added, 1 removed
+
+Updated:
+  foo 1.2-1 -> 1.3-1 (x86_64)
+
+Added:
+  qux 0.1-2 (x86_64)
+
+Removed:
+  baz 1.0-1 (noarch)
+`
+	if string(b) != expect {
+		t.Errorf("Unexpected changelog:\n%s\nexpected:\n%s", b, expect)
+	}
+
+	if orphans, _ := orphanedFiles(dir); len(orphans) > 0 {
+		t.Errorf("Changelog reported as orphaned: %v", orphans)
+	}
+
+	// nothing is written if nothing changed
+	os.Remove(path)
+	if err := repo.writeChangelog(dir, current, current); err != nil {
+		t.Fatalf("Error writing changelog: %v", err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), changelogPrefix) {
+			t.Errorf("Unexpected changelog for unchanged repo: %s", fi.Name())
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package yum
 
 import (
+	"crypto/md5"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 )
@@ -12,6 +16,35 @@ import (
 // match.
 var ErrChecksumMismatch = fmt.Errorf("Checksum mismatch")
 
+// ChecksumError is returned when content fails checksum validation. It
+// describes the expected and actual checksums and, if the content was read
+// from a file, the path of the file. It matches ErrChecksumMismatch with
+// errors.Is.
+type ChecksumError struct {
+	// Path is the path of the file which failed validation, or empty if the
+	// content was not read from a file.
+	Path string
+
+	// Type is the checksum algorithm, such as "sha256".
+	Type string
+
+	Expected string
+	Actual   string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%v for %s: expected %s %s, got %s", ErrChecksumMismatch, e.Path, e.Type, e.Expected, e.Actual)
+	}
+
+	return fmt.Sprintf("%v: expected %s %s, got %s", ErrChecksumMismatch, e.Type, e.Expected, e.Actual)
+}
+
+// Is reports whether the target is ErrChecksumMismatch.
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
 // RepoDatabaseChecksum is the XML element of a repo metadata file which
 // describes the checksum required to validate a repository database.
 type RepoDatabaseChecksum struct {
@@ -21,7 +54,7 @@ type RepoDatabaseChecksum struct {
 
 // Check creates a checksum of the given io.Reader content and compares it the
 // the expected checksum value. If the checksums match, nil is returned. If the
-// checksums do not match, ErrChecksumMismatch is returned. If any other error
+// checksums do not match, a *ChecksumError is returned. If any other error
 // occurs, the error is returned.
 func (c *RepoDatabaseChecksum) Check(r io.Reader) error {
 	return ValidateChecksum(r, c.Hash, c.Type)
@@ -29,45 +62,182 @@ func (c *RepoDatabaseChecksum) Check(r io.Reader) error {
 
 // CheckFile creates a checksum of the given file content and compares it the
 // the expected checksum value. If the checksums match, nil is returned. If the
-// checksums do not match, ErrChecksumMismatch is returned. If any other error
+// checksums do not match, a *ChecksumError is returned. If any other error
 // occurs, the error is returned.
 func (c *RepoDatabaseChecksum) CheckFile(name string) error {
 	return ValidateFileChecksum(name, c.Hash, c.Type)
 }
 
+// ChecksumPolicy decides which checksum algorithms may be relied upon to
+// validate repository metadata and packages, such as to enforce a FIPS crypto
+// policy under which MD5 and SHA1 are not permitted.
+type ChecksumPolicy interface {
+	// CheckAlgorithm returns an ErrWeakChecksum error if the given checksum
+	// type, as named in repository metadata, is not permitted.
+	CheckAlgorithm(checksum_type string) error
+}
+
+// checksumStrength ranks each supported checksum type by strength.
+var checksumStrength = map[string]int{
+	"md5":    1,
+	"sha":    2,
+	"sha1":   2,
+	"sha224": 3,
+	"sha256": 4,
+	"sha384": 5,
+	"sha512": 6,
+}
+
+// MinimumChecksumPolicy is a ChecksumPolicy which permits only the checksum
+// types which are at least as strong as the named checksum type.
+type MinimumChecksumPolicy string
+
+// SHA256ChecksumPolicy permits only SHA256 checksums or stronger. It is the
+// policy of a repo with RequireSHA256 set.
+const SHA256ChecksumPolicy = MinimumChecksumPolicy("sha256")
+
+func (c MinimumChecksumPolicy) CheckAlgorithm(checksum_type string) error {
+	if checksumStrength[checksum_type] < checksumStrength[string(c)] {
+		return newError(ErrWeakChecksum, "Checksum type %s is not permitted, %s or stronger is required", checksum_type, string(c))
+	}
+
+	return nil
+}
+
+// DefaultChecksumPolicy, if not nil, is consulted by ValidateChecksum for
+// every checksum and is the policy of every repo which does not set its own
+// ChecksumPolicy. The checksums of a repo are validated under the repo's own
+// policy only, so a repo's ChecksumPolicy takes precedence.
+var DefaultChecksumPolicy ChecksumPolicy
+
 // ValidateChecksum creates a checksum of the given io.Reader content and
 // compares it the the given checksum value. If the checksums match, nil is
-// returned. If the checksums do not match, ErrChecksumMismatch is returned. If
-// any other error occurs, the error is returned.
+// returned. If the checksums do not match, a *ChecksumError is returned. If
+// the checksum type is not permitted by DefaultChecksumPolicy, an
+// ErrWeakChecksum error is returned. If any other error occurs, the error is
+// returned.
 func ValidateChecksum(r io.Reader, checksum string, checksum_type string) error {
-	// get checksum value based by type
-	actual := ""
-	switch checksum_type {
-	case "sha256":
-		s := sha256.New()
-		if _, err := io.Copy(s, r); err != nil {
+	if DefaultChecksumPolicy != nil {
+		if err := DefaultChecksumPolicy.CheckAlgorithm(checksum_type); err != nil {
 			return err
 		}
+	}
 
-		actual = hex.EncodeToString(s.Sum(nil))
+	return validateChecksum(r, checksum, checksum_type)
+}
 
-	default:
-		return fmt.Errorf("Unsupported checksum type: %s", checksum_type)
+// validateChecksum validates the given io.Reader content as per
+// ValidateChecksum, without consulting DefaultChecksumPolicy. It validates the
+// checksums of a repo, whose checksum types are checked by the repo's own
+// policy when its metadata is read.
+func validateChecksum(r io.Reader, checksum string, checksum_type string) error {
+	actual, err := ComputeChecksum(r, checksum_type)
+	if err != nil {
+		return err
 	}
 
 	// check against expected value
 	if checksum != actual {
-		return ErrChecksumMismatch
+		return &ChecksumError{Type: checksum_type, Expected: checksum, Actual: actual}
 	}
 
 	return nil
 }
 
-// ValidateChecksum creates a checksum of the given file content and compares it
-// the the given checksum value. If the checksums match, nil is returned. If the
-// checksums do not match, ErrChecksumMismatch is returned. If any other error
-// occurs, the error is returned.
+// ComputeChecksum returns the hex encoded checksum of the given io.Reader
+// content, using the given checksum type.
+func ComputeChecksum(r io.Reader, checksum_type string) (string, error) {
+	s, err := newChecksumHash(checksum_type)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(s, r); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(s.Sum(nil)), nil
+}
+
+// newChecksumHash returns a hash.Hash for the given checksum type, as named in
+// repository metadata. "sha" is an alias for "sha1" used by older versions of
+// createrepo.
+func newChecksumHash(checksum_type string) (hash.Hash, error) {
+	switch checksum_type {
+	case "md5":
+		return md5.New(), nil
+
+	case "sha", "sha1":
+		return sha1.New(), nil
+
+	case "sha224":
+		return sha256.New224(), nil
+
+	case "sha256":
+		return sha256.New(), nil
+
+	case "sha384":
+		return sha512.New384(), nil
+
+	case "sha512":
+		return sha512.New(), nil
+	}
+
+	return nil, fmt.Errorf("Unsupported checksum type: %s", checksum_type)
+}
+
+// decodeChecksum returns a hash.Hash for the given checksum type and the
+// given hex encoded checksum, decoded, with which downloaded content is
+// validated. An error is returned if the checksum type is not supported or if
+// the checksum is not a hex encoded digest of that type, so that content is
+// never downloaded without being validated.
+func decodeChecksum(checksum string, checksum_type string) (hash.Hash, []byte, error) {
+	h, err := newChecksumHash(checksum_type)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := hex.DecodeString(checksum)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid %s checksum '%s': %v", checksum_type, checksum, err)
+	}
+
+	if len(b) != h.Size() {
+		return nil, nil, fmt.Errorf("Invalid %s checksum '%s': expected %d hex digits, got %d", checksum_type, checksum, 2*h.Size(), len(checksum))
+	}
+
+	return h, b, nil
+}
+
+// ComputeFileChecksum returns the hex encoded checksum of the given file
+// content, using the given checksum type.
+func ComputeFileChecksum(name string, checksum_type string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	return ComputeChecksum(f, checksum_type)
+}
+
+// ValidateFileChecksum creates a checksum of the given file content and
+// compares it the the given checksum value, as per ValidateChecksum.
 func ValidateFileChecksum(name string, checksum string, checksum_type string) error {
+	if DefaultChecksumPolicy != nil {
+		if err := DefaultChecksumPolicy.CheckAlgorithm(checksum_type); err != nil {
+			return err
+		}
+	}
+
+	return validateFileChecksum(name, checksum, checksum_type)
+}
+
+// validateFileChecksum validates the given file content as per
+// ValidateFileChecksum, without consulting DefaultChecksumPolicy, as per
+// validateChecksum.
+func validateFileChecksum(name string, checksum string, checksum_type string) error {
 	f, err := os.Open(name)
 	if err != nil {
 		return err
@@ -75,5 +245,10 @@ func ValidateFileChecksum(name string, checksum string, checksum_type string) er
 
 	defer f.Close()
 
-	return ValidateChecksum(f, checksum, checksum_type)
+	err = validateChecksum(f, checksum, checksum_type)
+	if e, ok := err.(*ChecksumError); ok {
+		e.Path = name
+	}
+
+	return err
 }
@@ -2,6 +2,11 @@ package yum
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -16,13 +21,199 @@ func TestValidateChecksum(t *testing.T) {
 		ChecksumTest{"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "sha256", []byte{}},
 		ChecksumTest{"054edec1d0211f624fed0cbca9d4f9400b0e491c43742af2c5b0abebf0c990d8", "sha256", []byte{0x00, 0x01, 0x02, 0x03}},
 		ChecksumTest{"1e584b5a9a8387cadf4449efa6a632fd31b307d9d5cdf6cf70ac2bf9d1cb9513", "sha256", []byte{0xFF, 0xEE, 0xDD, 0xCC, 0xBB, 0xAA}},
+		ChecksumTest{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "sha", []byte{}},
+		ChecksumTest{"da39a3ee5e6b4b0d3255bfef95601890afd80709", "sha1", []byte{}},
+		ChecksumTest{"d41d8cd98f00b204e9800998ecf8427e", "md5", []byte{}},
+		ChecksumTest{"cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e", "sha512", []byte{}},
 	}
 
 	for i, test := range tests {
-		if err := ValidateChecksum(bytes.NewReader(test.Value), test.Checksum, test.ChecksumType); err == ErrChecksumMismatch {
-			t.Errorf("Checksum validation failed for test %d", i+1)
+		if err := ValidateChecksum(bytes.NewReader(test.Value), test.Checksum, test.ChecksumType); err != nil {
+			t.Errorf("Checksum validation failed for test %d: %v", i+1, err)
 		}
 	}
 
 	t.Logf("%d checksums validated", len(tests))
 }
+
+func TestChecksumMismatchError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(path, []byte{}, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "054edec1d0211f624fed0cbca9d4f9400b0e491c43742af2c5b0abebf0c990d8"
+	actual := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	err = ValidateFileChecksum(path, expected, "sha256")
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch, got: %v", err)
+	}
+
+	var e *ChecksumError
+	if !errors.As(err, &e) || e.Path != path || e.Type != "sha256" || e.Expected != expected || e.Actual != actual {
+		t.Errorf("Unexpected checksum error: %#v", err)
+	}
+
+	for _, s := range []string{path, "sha256", expected, actual} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("Expected checksum error to include %s, got: %v", s, err)
+		}
+	}
+}
+
+func TestDecodeChecksum(t *testing.T) {
+	// every supported algorithm yields a hash with which grab validates
+	for _, checksum_type := range []string{"md5", "sha", "sha1", "sha224", "sha256", "sha384", "sha512"} {
+		sum, err := ComputeChecksum(bytes.NewReader([]byte("test")), checksum_type)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h, b, err := decodeChecksum(sum, checksum_type)
+		if err != nil {
+			t.Errorf("Error decoding %s checksum: %v", checksum_type, err)
+			continue
+		}
+
+		h.Write([]byte("test"))
+		if !bytes.Equal(h.Sum(nil), b) {
+			t.Errorf("Decoded %s checksum does not match its hash", checksum_type)
+		}
+	}
+
+	for _, sum := range []string{
+		"abc",
+		"zz0edec1d0211f624fed0cbca9d4f9400b0e491c43742af2c5b0abebf0c990d8",
+		"054edec1d0211f624fed0cbca9d4f940",
+		"",
+	} {
+		if _, _, err := decodeChecksum(sum, "sha256"); err == nil {
+			t.Errorf("Expected error decoding invalid sha256 checksum '%s'", sum)
+		}
+	}
+
+	if _, _, err := decodeChecksum("abcd", "crc32"); err == nil {
+		t.Errorf("Expected error decoding unsupported checksum type")
+	}
+}
+
+func TestDownloadInvalidChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := newTestPackage("foo", "1.0", "x86_64", 0)
+	p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: "abc"}
+
+	// the package is never requested, so the upstream need not exist
+	repo := NewRepo()
+	repo.ID = "test"
+	repo.BaseURL = "http://127.0.0.1:1/"
+	report := &SyncReport{Errors: make([]error, 0)}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, dir, nil, report)
+
+	if report.Failed != 1 || report.Downloaded != 0 || !strings.Contains(report.Errors[0].Error(), "Invalid sha256 checksum 'abc'") {
+		t.Errorf("Expected an invalid checksum error, got: %+v", report)
+	}
+}
+
+func TestChecksumPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a repo which publishes only sha1 checksums
+	primary := []byte(`<metadata packages="1">
+<package type="rpm">
+  <name>bash</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="4.2.46" rel="34.el7"/>
+  <checksum type="sha" pkgid="YES">da39a3ee5e6b4b0d3255bfef95601890afd80709</checksum>
+  <location href="Packages/bash-4.2.46-34.el7.x86_64.rpm"/>
+</package>
+</metadata>`)
+	sha1sum := func(b []byte) RepoDatabaseChecksum {
+		sum, err := ComputeChecksum(bytes.NewReader(b), "sha")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return RepoDatabaseChecksum{Type: "sha", Hash: sum}
+	}
+
+	writeTestRepodataWith(t, filepath.Join(dir, "base"), 1, primary, sha1sum)
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "file://" + filepath.Join(dir, "base")
+
+	// permitted by default
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Error caching sha1 repo without a checksum policy: %v", err)
+	}
+	repocache.Close()
+
+	// rejected under the strict policy
+	repo.RequireSHA256 = true
+	repo.ForceRefresh = true
+	if _, err := repo.CacheLocal(filepath.Join(dir, "cache")); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected ErrWeakChecksum caching sha1 repo, got: %v", err)
+	}
+
+	// packages are checked too
+	repo.RequireSHA256 = false
+	repo.ChecksumPolicy = MinimumChecksumPolicy("sha1")
+	repocache, err = repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Error caching sha1 repo with sha1 policy: %v", err)
+	}
+	defer repocache.Close()
+
+	repo.ChecksumPolicy = SHA256ChecksumPolicy
+	run := newSyncRun(repo)
+	if _, err := run.selectPackages(repocache, ""); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected ErrWeakChecksum selecting sha1 packages, got: %v", err)
+	}
+
+	// the default policy applies to every checksum
+	defer func() { DefaultChecksumPolicy = nil }()
+	DefaultChecksumPolicy = SHA256ChecksumPolicy
+	if err := ValidateChecksum(bytes.NewReader(nil), "da39a3ee5e6b4b0d3255bfef95601890afd80709", "sha1"); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected ErrWeakChecksum validating sha1 checksum, got: %v", err)
+	}
+
+	// except for repos with their own policy
+	repo.ChecksumPolicy = MinimumChecksumPolicy("sha1")
+	repocache, err = repo.CacheLocal(filepath.Join(dir, "default"))
+	if err != nil {
+		t.Fatalf("Error caching sha1 repo with sha1 policy under a strict default: %v", err)
+	}
+	defer repocache.Close()
+
+	if _, err := run.selectPackages(repocache, ""); err != nil {
+		t.Errorf("Error selecting sha1 packages with sha1 policy under a strict default: %v", err)
+	}
+
+	repo.ChecksumPolicy = nil
+	repo.ForceRefresh = true
+	if _, err := repo.CacheLocal(filepath.Join(dir, "default")); !errors.Is(err, ErrWeakChecksum) {
+		t.Errorf("Expected ErrWeakChecksum caching sha1 repo under the default policy, got: %v", err)
+	}
+
+	// unknown checksum types are rejected
+	repo.ChecksumPolicy = MinimumChecksumPolicy("sha3")
+	if err := repo.Validate(); err == nil || !strings.Contains(err.Error(), "Unknown checksum type") {
+		t.Errorf("Expected error validating unknown checksum policy, got: %v", err)
+	}
+}
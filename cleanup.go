@@ -0,0 +1,249 @@
+package yum
+
+import (
+	"fmt"
+	"github.com/cavaliercoder/go-rpm"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// retainPackages applies the repo's KeepVersions and DeleteOlderThan
+// retention policy to the given packages at the given time. It returns the
+// packages which are retained and the packages which have expired.
+//
+// If KeepVersions is set, the newest KeepVersions versions of each package are
+// retained, even if they are older than DeleteOlderThan. If DeleteOlderThan is
+// set, every package built since DeleteOlderThan is retained. If both are set,
+// a package expires only if it is both older than the newest KeepVersions
+// versions and built before DeleteOlderThan.
+func retainPackages(repo *Repo, packages PackageEntries, now time.Time) (retained, expired PackageEntries) {
+	retained = make(PackageEntries, 0, len(packages))
+	expired = make(PackageEntries, 0)
+	if repo.KeepVersions <= 0 && repo.DeleteOlderThan <= 0 {
+		return append(retained, packages...), expired
+	}
+
+	// rank the versions of each package from newest to oldest
+	versions := make(map[string][]*PackageEntry)
+	for i, p := range packages {
+		id := fmt.Sprintf("%s.%s", p.Name(), p.Architecture())
+		versions[id] = append(versions[id], &packages[i])
+	}
+
+	rank := make(map[*PackageEntry]int, len(packages))
+	for _, v := range versions {
+		sort.SliceStable(v, func(i, j int) bool {
+			return CompareEVR(v[i], v[j]) > 0
+		})
+
+		for i, p := range v {
+			rank[p] = i
+		}
+	}
+
+	cutoff := now.Add(-repo.DeleteOlderThan)
+	for i, p := range packages {
+		newest := repo.KeepVersions > 0 && rank[&packages[i]] < repo.KeepVersions
+		recent := repo.DeleteOlderThan > 0 && !p.BuildTime().Before(cutoff)
+		keep := newest || recent
+
+		if keep {
+			retained = append(retained, p)
+		} else {
+			expired = append(expired, p)
+		}
+	}
+
+	return retained, expired
+}
+
+// localPackages returns a PackageEntry for each package file in the given
+// package directory. Files which match one of the given upstream packages are
+// described by the upstream metadata; other files are read from disk. The
+// location of each returned package is its filename.
+func localPackages(packagedir string, upstream PackageEntries) (PackageEntries, error) {
+	rpms, err := filepath.Glob(filepath.Join(packagedir, "*.rpm"))
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]PackageEntry, len(upstream))
+	for _, p := range upstream {
+		known[p.filename()] = p
+	}
+
+	packages := make(PackageEntries, 0, len(rpms))
+	for _, path := range rpms {
+		filename := filepath.Base(path)
+		p, ok := known[filename]
+		if !ok {
+			f, err := rpm.OpenPackageFile(path)
+			if err != nil {
+				Errorf(err, "Error reading package %s", path)
+				continue
+			}
+
+			p = PackageEntry{
+				PackageName: f.Name(),
+				Arch:        f.Architecture(),
+			}
+			p.Versions = PackageEntryVersion{Epoch: f.Epoch(), Version: f.Version(), Release: f.Release()}
+			p.Time.Build = f.BuildTime().Unix()
+		}
+
+		p.Location = PackageEntryLocation{Href: filename}
+		packages = append(packages, p)
+	}
+
+	return packages, nil
+}
+
+// expiredPackages returns the paths of the packages in the given package
+// directory which should be deleted during the cleanup phase of a sync,
+// according to the repo's DeleteRemoved, KeepVersions and DeleteOlderThan
+// options. The given packages are those selected from the upstream repo.
+func (c *syncRun) expiredPackages(packagedir string, selected PackageEntries) ([]string, error) {
+	if !c.DeleteRemoved && c.KeepVersions <= 0 && c.DeleteOlderThan <= 0 {
+		return nil, nil
+	}
+
+	local, err := localPackages(packagedir, selected)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := make(map[string]bool, len(selected))
+	for _, p := range selected {
+		upstream[p.filename()] = true
+	}
+
+	paths := make([]string, 0)
+	if c.DeleteRemoved {
+		current := make(PackageEntries, 0, len(local))
+		for _, p := range local {
+			if upstream[p.LocationHref()] {
+				current = append(current, p)
+			} else {
+				Dprintf("Package %v was removed upstream\n", p)
+				paths = append(paths, filepath.Join(packagedir, p.LocationHref()))
+			}
+		}
+		local = current
+	}
+
+	// rank local packages with the selected packages which will be
+	// downloaded, so the newest versions after the sync are kept
+	present := make(map[string]bool, len(local))
+	all := make(PackageEntries, 0, len(local)+len(selected))
+	for _, p := range local {
+		present[p.LocationHref()] = true
+		all = append(all, p)
+	}
+
+	for _, p := range selected {
+		if !present[p.filename()] {
+			all = append(all, p)
+		}
+	}
+
+	// packages selected regardless of the retention policy, such as locked
+	// packages, are never deleted
+	_, expired := retainPackages(c.Repo, all, time.Now())
+	for _, p := range expired {
+		if !present[p.LocationHref()] || c.retained[p.NEVRA()] {
+			continue
+		}
+
+		Dprintf("Package %v has expired\n", p)
+		paths = append(paths, filepath.Join(packagedir, p.LocationHref()))
+	}
+
+	return paths, nil
+}
+
+// removePackages deletes each of the given package files and returns the
+// number of files deleted.
+func removePackages(paths []string) int {
+	n := 0
+	for _, path := range paths {
+		Dprintf("Deleting %s\n", path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			Errorf(err, "Error deleting %s", path)
+			continue
+		}
+		n++
+	}
+
+	return n
+}
+
+// packagedirFiles are the names of files and directories in a package
+// directory which are created by this package and are not orphans.
+var packagedirFiles = map[string]bool{
+	debugRepoDirname:      true,
+	lockFilename:          true,
+	manifestFilename:      true,
+	quarantineDirname:     true,
+	repodataDirname:       true,
+	repodataTmpDirname:    true,
+	repodataOldDirname:    true,
+	repodataStampFilename: true,
+	resignedFilename:      true,
+	resyncDirname:         true,
+}
+
+// orphanedFiles returns the names of the files and directories in the given
+// package directory which are neither packages nor repository metadata, such
+// as stray archives, READMEs or partial downloads.
+func orphanedFiles(packagedir string) ([]string, error) {
+	files, err := ioutil.ReadDir(packagedir)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make([]string, 0)
+	for _, fi := range files {
+		if packagedirFiles[fi.Name()] || isChangelogFilename(fi.Name()) {
+			continue
+		}
+
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".rpm") {
+			continue
+		}
+
+		orphans = append(orphans, fi.Name())
+	}
+
+	return orphans, nil
+}
+
+// reportOrphans logs each orphaned file in the given package directory and
+// records it in the given report. If DeleteRemoved is set, orphaned files are
+// deleted. Orphaned directories are never deleted.
+func (c *Repo) reportOrphans(packagedir string, report *SyncReport) error {
+	orphans, err := orphanedFiles(packagedir)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range orphans {
+		path := filepath.Join(packagedir, name)
+		Printf("Orphaned file in repo %v: %s\n", c, path)
+		report.Orphans = append(report.Orphans, path)
+
+		if c.DeleteRemoved {
+			if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+				Dprintf("Deleting orphaned file %s\n", path)
+				if err := os.Remove(path); err != nil {
+					Errorf(err, "Error deleting orphaned file %s", path)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetainPackages(t *testing.T) {
+	now := time.Unix(100*86400, 0)
+	old := now.Add(-60 * 24 * time.Hour).Unix()
+	packages := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", old),
+		newTestPackage("foo", "1.2", "x86_64", old),
+		newTestPackage("foo", "1.1", "x86_64", old),
+		newTestPackage("bar", "1.0", "x86_64", now.Unix()),
+	}
+
+	names := func(packages PackageEntries) map[string]bool {
+		m := make(map[string]bool)
+		for _, p := range packages {
+			m[p.String()] = true
+		}
+		return m
+	}
+
+	// old packages expire
+	repo := NewRepo()
+	repo.DeleteOlderThan = 30 * 24 * time.Hour
+	retained, expired := retainPackages(repo, packages, now)
+	if len(retained) != 1 || !names(retained)["bar-1.0-1.x86_64"] || len(expired) != 3 {
+		t.Errorf("Expected only bar to be retained, got %v", retained)
+	}
+
+	// the newest versions are retained even if they are old
+	repo.KeepVersions = 2
+	retained, expired = retainPackages(repo, packages, now)
+	kept := names(retained)
+	if len(retained) != 3 || !kept["foo-1.2-1.x86_64"] || !kept["foo-1.1-1.x86_64"] || !kept["bar-1.0-1.x86_64"] {
+		t.Errorf("Expected the two newest versions of foo and bar to be retained, got %v", retained)
+	}
+
+	if len(expired) != 1 || expired[0].String() != "foo-1.0-1.x86_64" {
+		t.Errorf("Expected only foo-1.0 to expire, got %v", expired)
+	}
+
+	// recent packages are retained even if they are not the newest versions
+	recent := append(packages, newTestPackage("bar", "0.9", "x86_64", now.Add(-24*time.Hour).Unix()))
+	repo.KeepVersions = 1
+	retained, expired = retainPackages(repo, recent, now)
+	kept = names(retained)
+	if len(retained) != 3 || !kept["foo-1.2-1.x86_64"] || !kept["bar-1.0-1.x86_64"] || !kept["bar-0.9-1.x86_64"] {
+		t.Errorf("Expected the newest version of foo and both recent versions of bar to be retained, got %v", retained)
+	}
+
+	// without DeleteOlderThan, only the newest versions are retained
+	repo.DeleteOlderThan = 0
+	retained, expired = retainPackages(repo, recent, now)
+	kept = names(retained)
+	if len(retained) != 2 || !kept["foo-1.2-1.x86_64"] || !kept["bar-1.0-1.x86_64"] || len(expired) != 3 {
+		t.Errorf("Expected only the newest versions of foo and bar to be retained, got %v", retained)
+	}
+
+	// no policy
+	retained, expired = retainPackages(NewRepo(), packages, now)
+	if len(retained) != len(packages) || len(expired) != 0 {
+		t.Errorf("Expected all packages to be retained with no retention policy")
+	}
+}
+
+func TestExpiredPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-60 * 24 * time.Hour).Unix()
+	local := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", old),
+		newTestPackage("foo", "1.1", "x86_64", old),
+	}
+
+	for _, p := range local {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(p.LocationHref())), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// foo-1.2 will be downloaded, so foo-1.0 is no longer one of the two
+	// newest versions
+	selected := append(local, newTestPackage("foo", "1.2", "x86_64", old))
+	repo := NewRepo()
+	repo.KeepVersions = 2
+	repo.DeleteOlderThan = 30 * 24 * time.Hour
+	run := newSyncRun(repo)
+	paths, err := run.expiredPackages(dir, selected)
+	if err != nil {
+		t.Fatalf("Error finding expired packages: %v", err)
+	}
+
+	if len(paths) != 1 || filepath.Base(paths[0]) != "foo-1.0-1.x86_64.rpm" {
+		t.Fatalf("Expected only foo-1.0 to expire, got %v", paths)
+	}
+
+	// packages selected regardless of the retention policy never expire
+	run.retained = map[string]bool{local[0].NEVRA(): true}
+	if retained, err := run.expiredPackages(dir, selected); err != nil || len(retained) != 0 {
+		t.Errorf("Expected retained package not to expire, got %v: %v", retained, err)
+	}
+	run.retained = nil
+
+	if n := removePackages(paths); n != 1 {
+		t.Errorf("Expected 1 package to be deleted, got %d", n)
+	}
+
+	if _, err := os.Stat(paths[0]); !os.IsNotExist(err) {
+		t.Errorf("Expired package was not deleted")
+	}
+}
+
+func TestReportOrphans(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"foo-1.0-1.x86_64.rpm", lockFilename, manifestFilename, "README", "partial.tmp"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{repodataDirname, quarantineDirname, "stray"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// orphans are reported but not deleted
+	repo := NewRepo()
+	repo.ReportOrphans = true
+	report := &SyncReport{}
+	if err := repo.reportOrphans(dir, report); err != nil {
+		t.Fatalf("Error reporting orphans: %v", err)
+	}
+
+	if len(report.Orphans) != 3 {
+		t.Errorf("Expected 3 orphans, got %v", report.Orphans)
+	}
+
+	for _, name := range []string{"README", "partial.tmp", "stray"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Orphan %s was deleted: %v", name, err)
+		}
+	}
+
+	// orphaned files are deleted with DeleteRemoved
+	repo.DeleteRemoved = true
+	if err := repo.reportOrphans(dir, &SyncReport{}); err != nil {
+		t.Fatalf("Error deleting orphans: %v", err)
+	}
+
+	orphans, err := orphanedFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(orphans) != 1 || orphans[0] != "stray" {
+		t.Errorf("Expected only the stray directory to remain, got %v", orphans)
+	}
+}
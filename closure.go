@@ -0,0 +1,510 @@
+package yum
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dependency is a capability which a package requires or provides, such as
+// "libc.so.6()(64bit)" or "python3 >= 3.6".
+type dependency struct {
+	Name    string `xml:"name,attr"`
+	Flags   string `xml:"flags,attr"`
+	Epoch   string `xml:"epoch,attr"`
+	Version string `xml:"ver,attr"`
+	Release string `xml:"rel,attr"`
+}
+
+// dependencyOperators are the comparison operators of the dependency flags
+// used in repository metadata.
+var dependencyOperators = map[string]string{
+	"EQ": "=",
+	"LT": "<",
+	"LE": "<=",
+	"GE": ">=",
+	"GT": ">",
+}
+
+func (c dependency) String() string {
+	if c.Flags == "" {
+		return c.Name
+	}
+
+	evr := c.Version
+	if c.Epoch != "" && c.Epoch != "0" {
+		evr = c.Epoch + ":" + evr
+	}
+	if c.Release != "" {
+		evr += "-" + c.Release
+	}
+
+	return fmt.Sprintf("%s %s %s", c.Name, dependencyOperators[c.Flags], evr)
+}
+
+// satisfiedBy returns true if the given provided capability satisfies the
+// required capability. A provide without a version satisfies every version
+// of a requirement. Only provides of an exact version, as created by
+// createrepo for each package, are compared with versioned requirements;
+// provides of a version range are assumed to satisfy them.
+func (c dependency) satisfiedBy(p dependency) bool {
+	if c.Name != p.Name {
+		return false
+	}
+
+	if c.Flags == "" || p.Flags != "EQ" {
+		return true
+	}
+
+	epoch := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+
+	cmp := epoch(p.Epoch) - epoch(c.Epoch)
+	if cmp == 0 {
+		cmp = compareVersion(p.Version, c.Version)
+	}
+
+	// a requirement without a release matches every release
+	if cmp == 0 && c.Release != "" && p.Release != "" {
+		cmp = compareVersion(p.Release, c.Release)
+	}
+
+	switch c.Flags {
+	case "EQ":
+		return cmp == 0
+	case "LT":
+		return cmp < 0
+	case "LE":
+		return cmp <= 0
+	case "GT":
+		return cmp > 0
+	case "GE":
+		return cmp >= 0
+	}
+
+	return true
+}
+
+// packageDependencies are the capabilities which a package requires and
+// provides, and the files which it contains.
+type packageDependencies struct {
+	Requires []dependency `xml:"requires>entry"`
+	Provides []dependency `xml:"provides>entry"`
+	Files    []string     `xml:"file"`
+}
+
+// closure indexes the capabilities and files provided by a set of packages so
+// that the requirements of each package may be resolved against them.
+type closure struct {
+	deps     map[string]*packageDependencies
+	provides map[string][]dependency
+	files    map[string]bool
+}
+
+func newClosure(deps map[string]*packageDependencies) *closure {
+	return &closure{
+		deps:     deps,
+		provides: make(map[string][]dependency),
+		files:    make(map[string]bool),
+	}
+}
+
+// dependencies returns the dependencies of the given package, or nil if the
+// package is not listed in the primary database.
+func (c *closure) dependencies(p PackageEntry) *packageDependencies {
+	sum, _ := p.Checksum()
+	return c.deps[sum]
+}
+
+// add adds the capabilities and files of the given package to the closure.
+// Each package implicitly provides its own name and version.
+func (c *closure) add(p PackageEntry) {
+	c.provides[p.Name()] = append(c.provides[p.Name()], dependency{
+		Name:    p.Name(),
+		Flags:   "EQ",
+		Epoch:   strconv.Itoa(p.Epoch()),
+		Version: p.Version(),
+		Release: p.Release(),
+	})
+
+	d := c.dependencies(p)
+	if d == nil {
+		return
+	}
+
+	for _, prov := range d.Provides {
+		c.provides[prov.Name] = append(c.provides[prov.Name], prov)
+	}
+	for _, f := range d.Files {
+		c.files[f] = true
+	}
+}
+
+// satisfied returns true if the given requirement is provided by a package
+// in the closure.
+func (c *closure) satisfied(req dependency) bool {
+	if strings.HasPrefix(req.Name, "/") && c.files[req.Name] {
+		return true
+	}
+
+	for _, prov := range c.provides[req.Name] {
+		if req.satisfiedBy(prov) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unsatisfied returns each requirement of the given package which no package
+// in the closure provides. Requirements of rpm itself, rpmlib(...), and rich
+// boolean dependencies are not evaluated.
+func (c *closure) unsatisfied(p PackageEntry) []dependency {
+	d := c.dependencies(p)
+	if d == nil {
+		return nil
+	}
+
+	unsatisfied := make([]dependency, 0)
+	seen := make(map[string]bool)
+	for _, req := range d.Requires {
+		if strings.HasPrefix(req.Name, "rpmlib(") || strings.HasPrefix(req.Name, "(") {
+			continue
+		}
+
+		if s := req.String(); !seen[s] && !c.satisfied(req) {
+			seen[s] = true
+			unsatisfied = append(unsatisfied, req)
+		}
+	}
+
+	return unsatisfied
+}
+
+// brokenDependencies returns a description of each requirement of the given
+// packages which none of the given packages provides, given the dependencies
+// of each package by pkgid.
+func brokenDependencies(packages PackageEntries, deps map[string]*packageDependencies) []string {
+	cl := newClosure(deps)
+	for _, p := range packages {
+		cl.add(p)
+	}
+
+	broken := make([]string, 0)
+	for _, p := range packages {
+		for _, req := range cl.unsatisfied(p) {
+			broken = append(broken, fmt.Sprintf("Package %v requires %v, which no selected package provides", p, req))
+		}
+	}
+
+	sort.Strings(broken)
+	return broken
+}
+
+// satisfyDependencies adds to the given selected packages the candidate
+// packages which provide their unsatisfied requirements, and the requirements
+// of the packages which are added in turn, given the dependencies of each
+// package by pkgid. Each requirement is satisfied by the newest candidate
+// which provides it, preferring the architecture of the requiring package.
+// The added packages are returned along with the package which required each
+// of them and the requirement it satisfies.
+func satisfyDependencies(selected, candidates PackageEntries, deps map[string]*packageDependencies) (PackageEntries, []string) {
+	cl := newClosure(deps)
+	chosen := make(map[string]bool, len(selected))
+	for _, p := range selected {
+		cl.add(p)
+		chosen[p.NEVRA()] = true
+	}
+
+	// index the candidates by the capabilities and files they provide
+	index := make(map[string][]int)
+	for i, p := range candidates {
+		index[p.Name()] = append(index[p.Name()], i)
+		if d := cl.dependencies(p); d != nil {
+			for _, prov := range d.Provides {
+				index[prov.Name] = append(index[prov.Name], i)
+			}
+			for _, f := range d.Files {
+				index[f] = append(index[f], i)
+			}
+		}
+	}
+
+	provider := func(p PackageEntry, req dependency) int {
+		best := -1
+		for _, i := range index[req.Name] {
+			c := candidates[i]
+			if chosen[c.NEVRA()] {
+				continue
+			}
+
+			// the index matches names only
+			single := newClosure(deps)
+			single.add(c)
+			if !single.satisfied(req) {
+				continue
+			}
+
+			if best < 0 {
+				best = i
+				continue
+			}
+
+			cmp := CompareEVR(&c, &candidates[best])
+			if cmp > 0 || (cmp == 0 && c.Architecture() == p.Architecture() && candidates[best].Architecture() != p.Architecture()) {
+				best = i
+			}
+		}
+
+		return best
+	}
+
+	added := make(PackageEntries, 0)
+	reasons := make([]string, 0)
+	queue := append(PackageEntries{}, selected...)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		for _, req := range cl.unsatisfied(p) {
+			i := provider(p, req)
+			if i < 0 {
+				continue
+			}
+
+			c := candidates[i]
+			cl.add(c)
+			chosen[c.NEVRA()] = true
+			added = append(added, c)
+			reasons = append(reasons, fmt.Sprintf("required by %v for %v", p, req))
+			queue = append(queue, c)
+		}
+	}
+
+	return added, reasons
+}
+
+// autoSatisfyDependencies adds the packages which are required by the given
+// selected packages from the given upstream packages, regardless of the
+// repo's NewOnly, includepkgs, IncludeRegex and build date rules. Packages
+// excluded by name with Exclude, ExcludeRegex or a global exclude, or of another
+// architecture, are never added.
+func (c *Repo) autoSatisfyDependencies(repocache *RepoCache, upstream, selected PackageEntries) (PackageEntries, error) {
+	deps, err := repocache.dependencies()
+	if err != nil {
+		return nil, c.wrapErr(err, "reading package dependencies")
+	}
+
+	exclude := packageRegexp(c.ExcludeRegex)
+	candidates := make(PackageEntries, 0)
+	for _, p := range upstream {
+		if matchPattern(&p, c.globalExclude) != "" || matchPattern(&p, c.Exclude) != "" {
+			continue
+		}
+		if exclude != nil && matchRegexp(exclude, &p) {
+			continue
+		}
+		if c.Architecture != "" && !matchArchitecture(c, p.Architecture()) {
+			continue
+		}
+
+		candidates = append(candidates, p)
+	}
+
+	added, reasons := satisfyDependencies(selected, candidates, deps)
+	for i, p := range added {
+		Dprintf("Adding package %v %s\n", p, reasons[i])
+		if c.FilterAuditFunc != nil {
+			c.FilterAuditFunc(p, true, reasons[i])
+		}
+	}
+	if len(added) > 0 {
+		Printf("Added %d packages to satisfy the dependencies of repo %v\n", len(added), c)
+	}
+
+	return append(selected, added...), nil
+}
+
+// checkClosure verifies that every requirement of the given packages selected
+// from the given repo cache is provided by another selected package, and logs
+// and records each broken dependency in the given report.
+func (c *syncRun) checkClosure(repocache *RepoCache, packages PackageEntries, report *SyncReport) error {
+	Dprintf("Checking dependency closure of %d packages in repo %v\n", len(packages), c)
+	deps, err := repocache.dependencies()
+	if err != nil {
+		return c.wrapErr(err, "reading package dependencies")
+	}
+
+	// packages merged from other repos are resolved with their metadata
+	for _, src := range c.merged {
+		merged, err := src.repocache.dependencies()
+		if err != nil {
+			return src.run.wrapErr(err, "reading package dependencies")
+		}
+
+		for pkgid, d := range merged {
+			deps[pkgid] = d
+		}
+	}
+
+	broken := brokenDependencies(packages, deps)
+	for _, b := range broken {
+		Warnf("Broken dependency in repo %v: %s\n", c, b)
+	}
+	report.BrokenDependencies = broken
+
+	return nil
+}
+
+// dependencies returns the dependencies and files of each package in the
+// cached primary database, by pkgid. The files listed in the primary database
+// are complemented by the cached filelists database, if any.
+func (c *RepoCache) dependencies() (map[string]*packageDependencies, error) {
+	lock, err := rlockDir(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	var deps map[string]*packageDependencies
+	if c.primary == "" || strings.HasSuffix(c.primary, ".sqlite") {
+		primarydb, err := c.openPrimaryDB()
+		if err != nil {
+			return nil, err
+		}
+		defer primarydb.Close()
+
+		if deps, err = primarydb.packageDependencies(); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.Open(c.primary)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if deps, err = readPrimaryDependencies(f); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.filelists == "" {
+		return deps, nil
+	}
+
+	var files map[string][]string
+	if strings.HasSuffix(c.filelists, ".sqlite") {
+		if files, err = readFilelistsDB(c.filelists); err != nil {
+			return nil, err
+		}
+	} else {
+		f, err := os.Open(c.filelists)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if files, err = readFilelists(f); err != nil {
+			return nil, err
+		}
+	}
+
+	for pkgid, f := range files {
+		if d := deps[pkgid]; d != nil {
+			d.Files = append(d.Files, f...)
+		}
+	}
+
+	return deps, nil
+}
+
+// readPrimaryDependencies reads the dependencies and files of each package in
+// a primary.xml file, by pkgid.
+func readPrimaryDependencies(r io.Reader) (map[string]*packageDependencies, error) {
+	md := struct {
+		Packages []struct {
+			Checksum PackageEntryChecksum `xml:"checksum"`
+			Format   packageDependencies  `xml:"format"`
+		} `xml:"package"`
+	}{}
+
+	if err := xml.NewDecoder(r).Decode(&md); err != nil {
+		return nil, fmt.Errorf("Error decoding primary metadata: %v", err)
+	}
+
+	deps := make(map[string]*packageDependencies, len(md.Packages))
+	for i := range md.Packages {
+		deps[md.Packages[i].Checksum.Hash] = &md.Packages[i].Format
+	}
+
+	return deps, nil
+}
+
+// readFilelists reads the files of each package in a filelists.xml file, by
+// pkgid. Packages are decoded one at a time as filelists may be very large.
+func readFilelists(r io.Reader) (map[string][]string, error) {
+	files := make(map[string][]string)
+	decoder := xml.NewDecoder(r)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding filelists: %v", err)
+		}
+
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "package" {
+			continue
+		}
+
+		p := struct {
+			Pkgid string   `xml:"pkgid,attr"`
+			Files []string `xml:"file"`
+		}{}
+		if err := decoder.DecodeElement(&p, &start); err != nil {
+			return nil, fmt.Errorf("Error decoding filelists: %v", err)
+		}
+		files[p.Pkgid] = append(files[p.Pkgid], p.Files...)
+	}
+}
+
+// readFilelistsDB reads the files of each package in a filelists_db SQLite
+// database, by pkgid. Each row lists the '/' separated names of the files in
+// one directory of a package.
+func readFilelistsDB(path string) (map[string][]string, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT packages.pkgId, filelist.dirname, filelist.filenames FROM filelist JOIN packages ON filelist.pkgKey = packages.pkgKey")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading filelists: %v", err)
+	}
+	defer rows.Close()
+
+	files := make(map[string][]string)
+	for rows.Next() {
+		var pkgid, dirname, filenames string
+		if err := rows.Scan(&pkgid, &dirname, &filenames); err != nil {
+			return nil, fmt.Errorf("Error reading filelists: %v", err)
+		}
+
+		for _, name := range strings.Split(filenames, "/") {
+			files[pkgid] = append(files[pkgid], strings.TrimSuffix(dirname, "/")+"/"+name)
+		}
+	}
+
+	return files, rows.Err()
+}
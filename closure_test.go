@@ -0,0 +1,338 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDependencySatisfiedBy(t *testing.T) {
+	for _, test := range []struct {
+		req      dependency
+		prov     dependency
+		expected bool
+	}{
+		{dependency{Name: "foo"}, dependency{Name: "foo", Flags: "EQ", Version: "1.0", Release: "1"}, true},
+		{dependency{Name: "foo"}, dependency{Name: "bar"}, false},
+		{dependency{Name: "foo", Flags: "GE", Version: "2.0"}, dependency{Name: "foo"}, true},
+		{dependency{Name: "foo", Flags: "GE", Version: "2.0"}, dependency{Name: "foo", Flags: "EQ", Version: "2.0", Release: "3"}, true},
+		{dependency{Name: "foo", Flags: "GE", Version: "2.0"}, dependency{Name: "foo", Flags: "EQ", Version: "1.10", Release: "3"}, false},
+		{dependency{Name: "foo", Flags: "LT", Version: "2.0"}, dependency{Name: "foo", Flags: "EQ", Version: "1.10", Release: "3"}, true},
+		{dependency{Name: "foo", Flags: "EQ", Version: "2.0", Release: "1"}, dependency{Name: "foo", Flags: "EQ", Version: "2.0", Release: "2"}, false},
+		{dependency{Name: "foo", Flags: "EQ", Version: "2.0"}, dependency{Name: "foo", Flags: "EQ", Version: "2.0", Release: "2"}, true},
+		{dependency{Name: "foo", Flags: "GT", Version: "2.0"}, dependency{Name: "foo", Flags: "EQ", Epoch: "1", Version: "1.0", Release: "1"}, true},
+		{dependency{Name: "foo", Flags: "LE", Epoch: "1", Version: "1.0"}, dependency{Name: "foo", Flags: "EQ", Version: "9.0", Release: "1"}, true},
+	} {
+		if ok := test.req.satisfiedBy(test.prov); ok != test.expected {
+			t.Errorf("Expected %v satisfied by %v to be %v", test.req, test.prov, test.expected)
+		}
+	}
+}
+
+// newTestDependencyServer starts a HTTP server which serves a repository with
+// the given primary.xml and filelists.xml, if not nil.
+func newTestDependencyServer(t *testing.T, primary, filelists []byte) *httptest.Server {
+	files := map[string][]byte{
+		"primary.xml.gz": gzipBytes(t, primary),
+	}
+	repomd := &RepoMetadata{
+		Revision: 1,
+		Databases: []RepoDatabase{
+			{
+				Type:         "primary",
+				Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum:     checksumBytes(t, files["primary.xml.gz"]),
+				OpenChecksum: checksumBytes(t, primary),
+			},
+		},
+	}
+
+	if filelists != nil {
+		files["filelists.xml.gz"] = gzipBytes(t, filelists)
+		repomd.Databases = append(repomd.Databases, RepoDatabase{
+			Type:         "filelists",
+			Location:     RepoDatabaseLocation{Href: "repodata/filelists.xml.gz"},
+			Checksum:     checksumBytes(t, files["filelists.xml.gz"]),
+			OpenChecksum: checksumBytes(t, filelists),
+		})
+	}
+
+	buf := &bytes.Buffer{}
+	if err := repomd.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	files["repomd.xml"] = buf.Bytes()
+
+	mux := http.NewServeMux()
+	for filename, b := range files {
+		b := b
+		mux.HandleFunc("/repodata/"+filename, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(b)
+		})
+	}
+
+	return httptest.NewServer(mux)
+}
+
+func TestCheckClosure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// foo requires bar, which provides libbar, and a file of baz which is only
+	// listed in the filelists
+	primary := []byte(`<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="3">
+<package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">1111111111111111111111111111111111111111111111111111111111111111</checksum>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="foo" flags="EQ" epoch="0" ver="1.0" rel="1"/>
+    </rpm:provides>
+    <rpm:requires>
+      <rpm:entry name="rpmlib(CompressedFileNames)" flags="LE" epoch="0" ver="3.0.4" rel="1"/>
+      <rpm:entry name="libbar.so.2()(64bit)"/>
+      <rpm:entry name="bar" flags="GE" epoch="0" ver="2.0"/>
+      <rpm:entry name="/usr/libexec/baz-helper"/>
+      <rpm:entry name="/bin/sh"/>
+      <rpm:entry name="(qux if quux)"/>
+    </rpm:requires>
+  </format>
+</package>
+<package type="rpm">
+  <name>bar</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="2.1" rel="1"/>
+  <checksum type="sha256" pkgid="YES">2222222222222222222222222222222222222222222222222222222222222222</checksum>
+  <location href="Packages/bar-2.1-1.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="bar" flags="EQ" epoch="0" ver="2.1" rel="1"/>
+      <rpm:entry name="libbar.so.2()(64bit)"/>
+    </rpm:provides>
+  </format>
+</package>
+<package type="rpm">
+  <name>baz</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">3333333333333333333333333333333333333333333333333333333333333333</checksum>
+  <location href="Packages/baz-1.0-1.x86_64.rpm"/>
+  <format>
+    <file>/bin/sh</file>
+  </format>
+</package>
+</metadata>`)
+	filelists := []byte(`<filelists xmlns="http://linux.duke.edu/metadata/filelists" packages="3">
+<package pkgid="1111111111111111111111111111111111111111111111111111111111111111" name="foo" arch="x86_64">
+  <version epoch="0" ver="1.0" rel="1"/>
+  <file>/usr/bin/foo</file>
+</package>
+<package pkgid="3333333333333333333333333333333333333333333333333333333333333333" name="baz" arch="x86_64">
+  <version epoch="0" ver="1.0" rel="1"/>
+  <file>/bin/sh</file>
+  <file>/usr/libexec/baz-helper</file>
+</package>
+</filelists>`)
+
+	ts := newTestDependencyServer(t, primary, filelists)
+	defer ts.Close()
+
+	for _, test := range []struct {
+		exclude  []string
+		expected []string
+	}{
+		{nil, []string{}},
+		{[]string{"bar"}, []string{
+			"Package foo-1.0-1.x86_64 requires bar >= 2.0, which no selected package provides",
+			"Package foo-1.0-1.x86_64 requires libbar.so.2()(64bit), which no selected package provides",
+		}},
+		{[]string{"baz"}, []string{
+			"Package foo-1.0-1.x86_64 requires /bin/sh, which no selected package provides",
+			"Package foo-1.0-1.x86_64 requires /usr/libexec/baz-helper, which no selected package provides",
+		}},
+	} {
+		repo := NewRepo()
+		repo.ID = "base"
+		repo.BaseURL = ts.URL
+		repo.CheckClosure = true
+		repo.Exclude = test.exclude
+		repocache, err := repo.CacheLocal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run := newSyncRun(repo)
+		packages, err := run.selectPackages(repocache, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report := &SyncReport{}
+		err = run.checkClosure(repocache, packages, report)
+		repocache.Close()
+		if err != nil {
+			t.Fatalf("Error checking dependency closure: %v", err)
+		}
+
+		if !reflect.DeepEqual(report.BrokenDependencies, test.expected) {
+			t.Errorf("Expected broken dependencies %q excluding %v, got %q", test.expected, test.exclude, report.BrokenDependencies)
+		}
+	}
+}
+
+func TestAutoSatisfyDeps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// foo requires the old libbar, which bar-1.0 provides but NewOnly drops
+	// and which i686 bar-1.0 provides but is of another architecture; bar-1.0
+	// requires baz, which is excluded
+	primary := []byte(`<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="5">
+<package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="2.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">1111111111111111111111111111111111111111111111111111111111111111</checksum>
+  <location href="Packages/foo-2.0-1.x86_64.rpm"/>
+  <format>
+    <rpm:requires>
+      <rpm:entry name="libbar.so.1()(64bit)"/>
+    </rpm:requires>
+  </format>
+</package>
+<package type="rpm">
+  <name>bar</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">2222222222222222222222222222222222222222222222222222222222222222</checksum>
+  <location href="Packages/bar-1.0-1.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="libbar.so.1()(64bit)"/>
+    </rpm:provides>
+    <rpm:requires>
+      <rpm:entry name="baz"/>
+    </rpm:requires>
+  </format>
+</package>
+<package type="rpm">
+  <name>bar</name>
+  <arch>i686</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">3333333333333333333333333333333333333333333333333333333333333333</checksum>
+  <location href="Packages/bar-1.0-1.i686.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="libbar.so.1()(64bit)"/>
+    </rpm:provides>
+  </format>
+</package>
+<package type="rpm">
+  <name>bar</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="2.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">4444444444444444444444444444444444444444444444444444444444444444</checksum>
+  <location href="Packages/bar-2.0-1.x86_64.rpm"/>
+  <format>
+    <rpm:provides>
+      <rpm:entry name="libbar.so.2()(64bit)"/>
+    </rpm:provides>
+  </format>
+</package>
+<package type="rpm">
+  <name>baz</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">5555555555555555555555555555555555555555555555555555555555555555</checksum>
+  <location href="Packages/baz-1.0-1.x86_64.rpm"/>
+</package>
+</metadata>`)
+
+	ts := newTestDependencyServer(t, primary, nil)
+	defer ts.Close()
+
+	// the dependency is added even if it would expire by KeepVersions
+	for _, test := range []struct {
+		auto     bool
+		keep     int
+		expected []string
+		broken   []string
+	}{
+		{false, 0, []string{"foo-2.0-1.x86_64", "bar-2.0-1.x86_64"}, []string{
+			"Package foo-2.0-1.x86_64 requires libbar.so.1()(64bit), which no selected package provides",
+		}},
+		{true, 0, []string{"foo-2.0-1.x86_64", "bar-2.0-1.x86_64", "bar-1.0-1.x86_64"}, []string{
+			"Package bar-1.0-1.x86_64 requires baz, which no selected package provides",
+		}},
+		{true, 1, []string{"foo-2.0-1.x86_64", "bar-2.0-1.x86_64", "bar-1.0-1.x86_64"}, []string{
+			"Package bar-1.0-1.x86_64 requires baz, which no selected package provides",
+		}},
+	} {
+		audited := make(map[string]string)
+		repo := NewRepo()
+		repo.ID = "base"
+		repo.BaseURL = ts.URL
+		repo.NewOnly = true
+		repo.Architecture = "x86_64"
+		repo.Exclude = []string{"baz"}
+		repo.AutoSatisfyDeps = test.auto
+		repo.KeepVersions = test.keep
+		repo.FilterAuditFunc = func(p PackageEntry, kept bool, reason string) {
+			if kept {
+				audited[p.String()] = reason
+			}
+		}
+
+		repocache, err := repo.CacheLocal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		run := newSyncRun(repo)
+		packages, err := run.selectPackages(repocache, "")
+		if err != nil {
+			repocache.Close()
+			t.Fatal(err)
+		}
+
+		report := &SyncReport{}
+		err = run.checkClosure(repocache, packages, report)
+		repocache.Close()
+		if err != nil {
+			t.Fatalf("Error checking dependency closure: %v", err)
+		}
+
+		names := make([]string, 0)
+		for _, p := range packages {
+			names = append(names, p.String())
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Expected packages %v with AutoSatisfyDeps %v, got %v", test.expected, test.auto, names)
+		}
+
+		if !reflect.DeepEqual(report.BrokenDependencies, test.broken) {
+			t.Errorf("Expected broken dependencies %q with AutoSatisfyDeps %v, got %q", test.broken, test.auto, report.BrokenDependencies)
+		}
+
+		if test.auto && !run.retained["bar-0:1.0-1.x86_64"] {
+			t.Errorf("Expected added package to be exempt from the retention policy")
+		}
+
+		if reason := audited["bar-1.0-1.x86_64"]; test.auto && reason != "required by foo-2.0-1.x86_64 for libbar.so.1()(64bit)" {
+			t.Errorf("Unexpected audit reason for the added package: %s", reason)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// Comps represents a comps.xml groupfile which describes the package groups
+// of a yum repository.
+type Comps struct {
+	XMLName xml.Name     `xml:"comps"`
+	Groups  []CompsGroup `xml:"group"`
+
+	// prolog is the groupfile up to and including the comps start tag and
+	// elements are the child elements of the comps element, as they were
+	// read, so that Write reproduces the groupfile, including translations
+	// and elements such as categories which are not decoded.
+	prolog   []byte
+	elements []compsElement
+}
+
+// compsElement is a child element of the comps element of a groupfile, its
+// name and the ID of the group it defines, if it is a group.
+type compsElement struct {
+	name  string
+	group string
+	text  []byte
+}
+
+// compsGroupIDPattern matches a groupid element of a category or environment
+// and the whitespace before it.
+var compsGroupIDPattern = regexp.MustCompile(`\s*<groupid(?:\s[^>]*)?>\s*([^<]*?)\s*</groupid>`)
+
+// compsLangpackPattern matches a match element of the langpacks element and
+// the whitespace before it.
+var compsLangpackPattern = regexp.MustCompile(`\s*<match\s[^>]*?\bname="([^"]*)"[^>]*?/>`)
+
+// CompsGroup is a package group defined in a comps.xml groupfile. Name and
+// Description are given in the default language and NameTranslations and
+// DescriptionTranslations give their translations, by language, such as
+// "de" or "pt_BR".
+type CompsGroup struct {
+	ID                      string
+	Name                    string
+	Description             string
+	NameTranslations        map[string]string
+	DescriptionTranslations map[string]string
+	Packages                []CompsPackageReq
+}
+
+// compsText is a translatable element of a groupfile.
+type compsText struct {
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Text string `xml:",chardata"`
+}
+
+// compsGroupXML is the group element of a groupfile.
+type compsGroupXML struct {
+	ID           string            `xml:"id"`
+	Names        []compsText       `xml:"name"`
+	Descriptions []compsText       `xml:"description"`
+	Packages     []CompsPackageReq `xml:"packagelist>packagereq"`
+}
+
+// UnmarshalXML decodes a group element, with the <name> and <description>
+// elements of every language.
+func (c *CompsGroup) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var g compsGroupXML
+	if err := d.DecodeElement(&g, &start); err != nil {
+		return err
+	}
+
+	translate := func(texts []compsText, translations map[string]string) string {
+		var s string
+		for _, t := range texts {
+			if t.Lang == "" {
+				s = t.Text
+			} else {
+				translations[t.Lang] = t.Text
+			}
+		}
+		return s
+	}
+
+	*c = CompsGroup{
+		ID:                      g.ID,
+		NameTranslations:        make(map[string]string),
+		DescriptionTranslations: make(map[string]string),
+		Packages:                g.Packages,
+	}
+	c.Name = translate(g.Names, c.NameTranslations)
+	c.Description = translate(g.Descriptions, c.DescriptionTranslations)
+	return nil
+}
+
+// CompsPackageReq is a package which is a member of a package group. Type may
+// be one of 'mandatory', 'default', 'optional' or 'conditional'.
+type CompsPackageReq struct {
+	Type string `xml:"type,attr"`
+	Name string `xml:",chardata"`
+}
+
+// ReadComps loads a comps.xml groupfile from the given io.Reader and returns
+// a pointer to the resulting Comps struct.
+func ReadComps(r io.Reader) (*Comps, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading groupfile: %v", err)
+	}
+
+	comps := Comps{
+		Groups:   make([]CompsGroup, 0),
+		elements: make([]compsElement, 0),
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	root := false
+	for {
+		offset := decoder.InputOffset()
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error decoding groupfile: %v", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if !root {
+				if t.Name.Local != "comps" {
+					return nil, fmt.Errorf("Error decoding groupfile: unexpected element <%s>", t.Name.Local)
+				}
+				root = true
+				comps.XMLName = t.Name
+				comps.prolog = b[:decoder.InputOffset()]
+				continue
+			}
+
+			e := compsElement{name: t.Name.Local}
+			if t.Name.Local == "group" {
+				var g CompsGroup
+				if err := decoder.DecodeElement(&g, &t); err != nil {
+					return nil, fmt.Errorf("Error decoding groupfile: %v", err)
+				}
+				comps.Groups = append(comps.Groups, g)
+				e.group = g.ID
+			} else if err := decoder.Skip(); err != nil {
+				return nil, fmt.Errorf("Error decoding groupfile: %v", err)
+			}
+
+			e.text = b[offset:decoder.InputOffset()]
+			comps.elements = append(comps.elements, e)
+		}
+	}
+
+	if !root {
+		return nil, fmt.Errorf("Error decoding groupfile: no comps element")
+	}
+
+	return &comps, nil
+}
+
+// Write writes the groupfile to the given io.Writer. Each element is written
+// as it was read by ReadComps, so that the translations of every group, and
+// the categories, environments and langpacks of the groupfile, are retained.
+func (c *Comps) Write(w io.Writer) error {
+	prolog := c.prolog
+	if len(prolog) == 0 {
+		prolog = []byte(xml.Header + "<comps>")
+	}
+
+	if _, err := w.Write(prolog); err != nil {
+		return err
+	}
+
+	for _, e := range c.elements {
+		if _, err := fmt.Fprintf(w, "\n  %s", e.text); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(w, "\n</comps>\n")
+	return err
+}
+
+// Filter returns only the given groups, as with Group, along with the other
+// elements of the groupfile, such as categories, which are retained. The
+// groups which are not selected are removed from categories and environments,
+// which are removed if none of their groups are selected, and langpacks for
+// packages which are not in the selected groups are removed. An error is
+// returned if any group is not defined.
+func (c *Comps) Filter(groups ...string) (*Comps, error) {
+	selected := make(map[string]bool, len(groups))
+	filtered := &Comps{
+		XMLName:  c.XMLName,
+		Groups:   make([]CompsGroup, 0, len(groups)),
+		prolog:   c.prolog,
+		elements: make([]compsElement, 0, len(c.elements)),
+	}
+
+	for _, name := range groups {
+		g := c.Group(name)
+		if g == nil {
+			return nil, fmt.Errorf("Package group not found: %s", name)
+		}
+
+		if !selected[g.ID] {
+			selected[g.ID] = true
+			filtered.Groups = append(filtered.Groups, *g)
+		}
+	}
+
+	names, err := c.PackageNames(groups...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range c.elements {
+		switch e.name {
+		case "group":
+			if !selected[e.group] {
+				continue
+			}
+
+		case "category", "environment":
+			kept := false
+			e.text = compsGroupIDPattern.ReplaceAllFunc(e.text, func(b []byte) []byte {
+				if selected[string(compsGroupIDPattern.FindSubmatch(b)[1])] {
+					kept = true
+					return b
+				}
+				return nil
+			})
+			if !kept {
+				continue
+			}
+
+		case "langpacks":
+			e.text = compsLangpackPattern.ReplaceAllFunc(e.text, func(b []byte) []byte {
+				if names[string(compsLangpackPattern.FindSubmatch(b)[1])] {
+					return b
+				}
+				return nil
+			})
+		}
+
+		filtered.elements = append(filtered.elements, e)
+	}
+
+	return filtered, nil
+}
+
+// Group returns the group with the given ID or name, in any language. A
+// leading '@' is ignored, as in 'yum install @development'.
+func (c *Comps) Group(name string) *CompsGroup {
+	name = strings.TrimPrefix(name, "@")
+	for i, g := range c.Groups {
+		if g.ID == name || g.Name == name {
+			return &c.Groups[i]
+		}
+	}
+
+	for i, g := range c.Groups {
+		for _, translation := range g.NameTranslations {
+			if translation == name {
+				return &c.Groups[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// PackageNames returns the names of all mandatory and default packages in the
+// given groups. An error is returned if any group is not defined.
+func (c *Comps) PackageNames(groups ...string) (map[string]bool, error) {
+	names := make(map[string]bool, 0)
+	for _, name := range groups {
+		g := c.Group(name)
+		if g == nil {
+			return nil, fmt.Errorf("Package group not found: %s", name)
+		}
+
+		for _, p := range g.Packages {
+			switch p.Type {
+			case "", "mandatory", "default":
+				names[strings.TrimSpace(p.Name)] = true
+			}
+		}
+	}
+
+	return names, nil
+}
@@ -0,0 +1,263 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testComps = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE comps PUBLIC "-//CentOS//DTD Comps info//EN" "comps.dtd">
+<comps>
+  <group>
+    <id>development</id>
+    <name>Development Tools</name>
+    <packagelist>
+      <packagereq type="mandatory">gcc</packagereq>
+      <packagereq type="default">make</packagereq>
+      <packagereq type="optional">ElectricFence</packagereq>
+      <packagereq>autoconf</packagereq>
+    </packagelist>
+  </group>
+  <group>
+    <id>base</id>
+    <name>Base</name>
+    <packagelist>
+      <packagereq type="mandatory">bash</packagereq>
+    </packagelist>
+  </group>
+</comps>`
+
+func TestCompsPackageNames(t *testing.T) {
+	comps, err := ReadComps(strings.NewReader(testComps))
+	if err != nil {
+		t.Fatalf("Error reading comps: %v", err)
+	}
+
+	names, err := comps.PackageNames("@development")
+	if err != nil {
+		t.Fatalf("Error expanding groups: %v", err)
+	}
+
+	for _, name := range []string{"gcc", "make", "autoconf"} {
+		if !names[name] {
+			t.Errorf("Expected %s in @development", name)
+		}
+	}
+
+	if names["ElectricFence"] || names["bash"] || len(names) != 3 {
+		t.Errorf("Unexpected packages in @development: %v", names)
+	}
+
+	packages := PackageEntries{
+		newTestPackage("gcc", "4.8.5", "x86_64", 0),
+		newTestPackage("bash", "4.2.46", "x86_64", 0),
+		newTestPackage("make", "3.82", "x86_64", 0),
+	}
+
+	filtered := FilterPackagesByName(packages, names)
+	if len(filtered) != 2 || filtered[0].Name() != "gcc" || filtered[1].Name() != "make" {
+		t.Errorf("Unexpected packages after group filter: %v", filtered)
+	}
+
+	if _, err := comps.PackageNames("missing"); err == nil {
+		t.Errorf("Expected an error expanding an undefined group")
+	}
+}
+
+const testCompsTranslations = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE comps PUBLIC "-//CentOS//DTD Comps info//EN" "comps.dtd">
+<comps>
+  <group>
+    <id>development</id>
+    <name>Development Tools</name>
+    <name xml:lang="de">Entwicklungswerkzeuge</name>
+    <name xml:lang="pt_BR">Ferramentas de Desenvolvimento</name>
+    <description>A basic development environment.</description>
+    <description xml:lang="de">Eine grundlegende Entwicklungsumgebung.</description>
+    <packagelist>
+      <packagereq type="mandatory">gcc</packagereq>
+    </packagelist>
+  </group>
+  <group>
+    <id>base</id>
+    <name xml:lang="de">Basis</name>
+    <name>Base</name>
+    <packagelist>
+      <packagereq type="mandatory">bash</packagereq>
+    </packagelist>
+  </group>
+  <category>
+    <id>development</id>
+    <name>Development</name>
+    <name xml:lang="de">Entwicklung</name>
+    <grouplist>
+      <groupid>development</groupid>
+    </grouplist>
+  </category>
+</comps>`
+
+func TestCompsTranslations(t *testing.T) {
+	comps, err := ReadComps(strings.NewReader(testCompsTranslations))
+	if err != nil {
+		t.Fatalf("Error reading comps: %v", err)
+	}
+
+	// the untranslated name is the default, wherever it is listed
+	if g := comps.Group("base"); g == nil || g.Name != "Base" || g.NameTranslations["de"] != "Basis" {
+		t.Errorf("Unexpected names of group base: %+v", g)
+	}
+
+	if g := comps.Group("@Entwicklungswerkzeuge"); g == nil || g.ID != "development" || g.Description != "A basic development environment." {
+		t.Errorf("Expected group development by its translated name, got: %+v", g)
+	}
+
+	filtered, err := comps.Filter("development")
+	if err != nil {
+		t.Fatalf("Error filtering groups: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the groupfile written by createrepo retains the translations
+	w, err := createrepo(filepath.Join(dir, repodataDirname), nil, false)
+	if err != nil {
+		t.Fatalf("Error creating repository metadata: %v", err)
+	}
+	w.comps = filtered
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error writing repository metadata: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, repodataDirname, "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if repomd.Database("group_gz") == nil {
+		t.Errorf("Expected group_gz database in repomd.xml")
+	}
+
+	db := repomd.Database("group")
+	if db == nil {
+		t.Fatalf("Expected group database in repomd.xml")
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, db.Location.Href))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{
+		`<!DOCTYPE comps`,
+		`<name xml:lang="pt_BR">Ferramentas de Desenvolvimento</name>`,
+		`<description xml:lang="de">Eine grundlegende Entwicklungsumgebung.</description>`,
+		`<name xml:lang="de">Entwicklung</name>`,
+	} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("Expected %s in groupfile:\n%s", s, b)
+		}
+	}
+
+	if bytes.Contains(b, []byte("<id>base</id>")) {
+		t.Errorf("Expected unselected group to be omitted from groupfile:\n%s", b)
+	}
+
+	written, err := ReadComps(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Error reading written groupfile: %v", err)
+	}
+
+	if g := written.Group("development"); g == nil || len(written.Groups) != 1 || g.NameTranslations["de"] != "Entwicklungswerkzeuge" || g.DescriptionTranslations["de"] == "" {
+		t.Errorf("Expected translations of group development to survive, got: %+v", written.Groups)
+	}
+}
+
+func TestCompsFilterReferences(t *testing.T) {
+	comps, err := ReadComps(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<comps>
+  <group>
+    <id>development</id>
+    <packagelist>
+      <packagereq type="mandatory">gcc</packagereq>
+    </packagelist>
+  </group>
+  <group>
+    <id>base</id>
+    <packagelist>
+      <packagereq type="mandatory">bash</packagereq>
+    </packagelist>
+  </group>
+  <category>
+    <id>system</id>
+    <grouplist>
+      <groupid>base</groupid>
+      <groupid>development</groupid>
+    </grouplist>
+  </category>
+  <category>
+    <id>core</id>
+    <grouplist>
+      <groupid>base</groupid>
+    </grouplist>
+  </category>
+  <environment>
+    <id>workstation</id>
+    <grouplist>
+      <groupid>base</groupid>
+    </grouplist>
+    <optionlist>
+      <groupid default="true">development</groupid>
+    </optionlist>
+  </environment>
+  <langpacks>
+    <match name="bash" install="bash-doc-%s"/>
+    <match name="gcc" install="gcc-locale-%s"/>
+  </langpacks>
+</comps>`))
+	if err != nil {
+		t.Fatalf("Error reading comps: %v", err)
+	}
+
+	filtered, err := comps.Filter("development")
+	if err != nil {
+		t.Fatalf("Error filtering groups: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := filtered.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.String()
+
+	// references to the dropped group are removed
+	for _, s := range []string{"<id>base</id>", "<groupid>base</groupid>", "<id>core</id>", `name="bash"`} {
+		if strings.Contains(b, s) {
+			t.Errorf("Expected %s to be removed from groupfile:\n%s", s, b)
+		}
+	}
+
+	for _, s := range []string{"<id>system</id>", "<groupid>development</groupid>", "<id>workstation</id>", `<groupid default="true">development</groupid>`, `<match name="gcc" install="gcc-locale-%s"/>`} {
+		if !strings.Contains(b, s) {
+			t.Errorf("Expected %s in groupfile:\n%s", s, b)
+		}
+	}
+
+	if _, err := ReadComps(strings.NewReader(b)); err != nil {
+		t.Errorf("Error reading filtered groupfile: %v", err)
+	}
+}
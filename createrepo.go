@@ -1,28 +1,542 @@
 package yum
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
 	"github.com/cavaliercoder/go-rpm"
+	"golang.org/x/crypto/openpgp"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
 )
 
 // PrimaryDatabaseWriter writes packages to a Primary Database. It is the
-// callers responsibility to close the channel when all packages have been sent.
-type PrimaryDatabaseWriter chan<- *rpm.PackageFile
+// callers responsibility to call Close when all packages have been sent.
+type PrimaryDatabaseWriter struct {
+	ch     chan *rpm.PackageFile
+	done   chan error
+	path   string
+	signer *openpgp.Entity
 
-func (w PrimaryDatabaseWriter) Write(p *rpm.PackageFile) {
-	w <- p
+	// sqlite is true if the primary_db, filelists_db and other_db sqlite
+	// databases are written along with primary.xml, filelists.xml and
+	// other.xml
+	sqlite bool
+
+	// comps are written to comps.xml and comps.xml.gz, if not nil
+	comps *Comps
+
+	// modules are written to modules.yaml.gz, if not nil
+	modules *Modules
+
+	// passthrough are upstream databases copied into the metadata directory
+	passthrough []passthroughDatabase
+}
+
+func (w *PrimaryDatabaseWriter) Write(p *rpm.PackageFile) {
+	w.ch <- p
+}
+
+// Close waits for all packages to be written to the Primary Database and
+// writes the repository metadata file which references it. If a signing key
+// was given to createrepo, the metadata file is also signed.
+func (w *PrimaryDatabaseWriter) Close() error {
+	close(w.ch)
+	if err := <-w.done; err != nil {
+		return err
+	}
+
+	return w.writeMetadata()
+}
+
+// writeMetadata compresses primary.xml, filelists.xml and other.xml, their
+// sqlite databases, if they were written, and any groups and modules and
+// writes repomd.xml.
+func (w *PrimaryDatabaseWriter) writeMetadata() error {
+	timestamp := int(time.Now().Unix())
+	db, err := w.writeDatabase("primary", "primary.xml", timestamp)
+	if err != nil {
+		return err
+	}
+
+	databases := []RepoDatabase{*db}
+	for _, typ := range []string{"filelists", "other"} {
+		db, err := w.writeDatabase(typ, typ+".xml", timestamp)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, *db)
+	}
+
+	if w.sqlite {
+		for _, typ := range []string{"primary", "filelists", "other"} {
+			db, err := w.writeDatabase(typ+"_db", typ+"_db.sqlite", timestamp)
+			if err != nil {
+				return err
+			}
+			db.DatabaseVersion = 10
+			databases = append(databases, *db)
+		}
+	}
+
+	if w.comps != nil {
+		groups, err := w.writeGroupfile(timestamp)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, groups...)
+	}
+
+	if w.modules != nil {
+		f, err := os.Create(filepath.Join(w.path, "/gen/modules.yaml"))
+		if err != nil {
+			return err
+		}
+
+		if err := w.modules.Write(f); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		db, err := w.writeDatabase("modules", "modules.yaml", timestamp)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, *db)
+	}
+
+	for _, p := range w.passthrough {
+		db, err := w.copyDatabase(p)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, *db)
+	}
+
+	// write repomd.xml
+	repomd := &RepoMetadata{
+		Revision:  timestamp,
+		Databases: databases,
+	}
+
+	repomdPath := filepath.Join(w.path, "/repomd.xml")
+	f, err := os.Create(repomdPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := repomd.Write(f); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// sign repomd.xml
+	if w.signer != nil {
+		if err := signRepoMetadata(repomdPath, w.signer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeDatabase compresses the database of the given type with the given
+// filename in the gen/ subdirectory of the metadata directory and returns its
+// entry for repomd.xml.
+func (w *PrimaryDatabaseWriter) writeDatabase(typ, filename string, timestamp int) (*RepoDatabase, error) {
+	path := filepath.Join(w.path, "gen", filename)
+	gzPath := filepath.Join(w.path, filename+".gz")
+
+	// compress database
+	if err := gzipFile(gzPath, path); err != nil {
+		return nil, err
+	}
+
+	// compute checksums
+	db := &RepoDatabase{
+		Type:      typ,
+		Location:  RepoDatabaseLocation{Href: "repodata/" + filename + ".gz"},
+		Timestamp: timestamp,
+	}
+
+	for _, f := range []struct {
+		path string
+		size *int
+		sum  *RepoDatabaseChecksum
+	}{
+		{gzPath, &db.Size, &db.Checksum},
+		{path, &db.OpenSize, &db.OpenChecksum},
+	} {
+		fi, err := os.Stat(f.path)
+		if err != nil {
+			return nil, err
+		}
+
+		sum, err := ComputeFileChecksum(f.path, "sha256")
+		if err != nil {
+			return nil, err
+		}
+
+		*f.size = int(fi.Size())
+		*f.sum = RepoDatabaseChecksum{Type: "sha256", Hash: sum}
+	}
+
+	return db, nil
 }
 
-func (w PrimaryDatabaseWriter) Close() {
-	close(w)
+// writeGroupfile writes the groups to comps.xml, which yum reads uncompressed,
+// and compresses it, and returns the group and group_gz entries for
+// repomd.xml.
+func (w *PrimaryDatabaseWriter) writeGroupfile(timestamp int) ([]RepoDatabase, error) {
+	path := filepath.Join(w.path, "/gen/comps.xml")
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.comps.Write(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	gz, err := w.writeDatabase("group_gz", "comps.xml", timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := copyFile(filepath.Join(w.path, "comps.xml"), path); err != nil {
+		return nil, err
+	}
+
+	group := RepoDatabase{
+		Type:      "group",
+		Location:  RepoDatabaseLocation{Href: "repodata/comps.xml"},
+		Timestamp: timestamp,
+		Size:      gz.OpenSize,
+		Checksum:  gz.OpenChecksum,
+	}
+
+	return []RepoDatabase{group, *gz}, nil
+}
+
+// copyDatabase copies the given upstream database into the metadata directory
+// and returns its entry for repomd.xml. The database is not modified so its
+// upstream checksums, sizes and timestamp are retained.
+func (w *PrimaryDatabaseWriter) copyDatabase(p passthroughDatabase) (*RepoDatabase, error) {
+	filename := filepath.Base(p.db.Location.Href)
+	if _, err := copyFile(filepath.Join(w.path, filename), p.path); err != nil {
+		return nil, err
+	}
+
+	db := p.db
+	db.Location = RepoDatabaseLocation{Href: "repodata/" + filename}
+	return &db, nil
+}
+
+// signRepoMetadata writes an ASCII armored, detached signature of the given
+// repomd.xml file to repomd.xml.asc, as required by yum clients configured
+// with repo_gpgcheck.
+func signRepoMetadata(path string, signer *openpgp.Entity) error {
+	Dprintf("Signing repo metadata %s...\n", path)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	w, err := os.Create(path + ".asc")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	if err := openpgp.ArmoredDetachSign(w, signer, bytes.NewReader(b), nil); err != nil {
+		return NewErrorf("Error signing repo metadata: %v", err)
+	}
+
+	return w.Close()
+}
+
+// gzipFile writes a gzip compressed copy of src to dst.
+func gzipFile(dst, src string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := gzip.NewWriter(f)
+	if _, err := io.Copy(z, r); err != nil {
+		return err
+	}
+
+	if err := z.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Names of the directories used to replace the repodata directory of a
+// package repository without exposing partially written metadata.
+const (
+	repodataDirname    = "repodata"
+	repodataTmpDirname = ".repodata.tmp"
+	repodataOldDirname = ".repodata.old"
+)
+
+// recoverRepodata cleans up the temporary artifacts left in the given package
+// directory by an interrupted createrepo and restores the previous repodata if
+// it was interrupted while being replaced. It returns true if the remaining
+// repomd.xml is valid. Invalid repodata is removed so it will be rebuilt.
+func recoverRepodata(packagedir string) (bool, error) {
+	repodata := filepath.Join(packagedir, repodataDirname)
+	tmp := filepath.Join(packagedir, repodataTmpDirname)
+	old := filepath.Join(packagedir, repodataOldDirname)
+
+	// remove partially written metadata
+	if _, err := os.Stat(tmp); err == nil {
+		Dprintf("Removing incomplete repository metadata in %s\n", tmp)
+		if err := os.RemoveAll(tmp); err != nil {
+			return false, err
+		}
+	}
+
+	// restore previous metadata if interrupted while promoting new metadata
+	if _, err := os.Stat(old); err == nil {
+		if _, err := os.Stat(repodata); os.IsNotExist(err) {
+			Dprintf("Restoring previous repository metadata from %s\n", old)
+			if err := os.Rename(old, repodata); err != nil {
+				return false, err
+			}
+		} else if err := os.RemoveAll(old); err != nil {
+			return false, err
+		}
+	}
+
+	// validate existing metadata
+	f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := ReadRepoMetadata(f); err != nil {
+		Errorf(err, "Existing repository metadata in %s is invalid and will be rebuilt", repodata)
+		f.Close()
+		return false, os.RemoveAll(repodata)
+	}
+
+	return true, nil
+}
+
+// promoteRepodata replaces the repodata directory of the given package
+// directory with the metadata written by createrepo to its temporary
+// directory. The replacement is not atomic: the previous metadata is renamed
+// aside before the new metadata is renamed into place, so clients may briefly
+// find no repodata directory. If interrupted between the two renames,
+// recoverRepodata restores the previous metadata.
+func promoteRepodata(packagedir string) error {
+	repodata := filepath.Join(packagedir, repodataDirname)
+	tmp := filepath.Join(packagedir, repodataTmpDirname)
+	old := filepath.Join(packagedir, repodataOldDirname)
+
+	if err := os.Rename(repodata, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(tmp, repodata); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(old)
+}
+
+// repodataStampFilename is the name of the file in a package directory which
+// records the packages that were present when its repository metadata was
+// last built.
+const repodataStampFilename = ".repodata.stamp"
+
+// packageStamp returns a digest of the name, size and modification time of
+// every package in the given package directory, which changes whenever a
+// package is added, removed or replaced.
+func packageStamp(packagedir string) (string, error) {
+	rpms, err := filepath.Glob(filepath.Join(packagedir, "*.rpm"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(rpms)
+
+	h := sha256.New()
+	for _, path := range rpms {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s %d %d\n", filepath.Base(path), fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeRepodataStamp records the packages currently in the given package
+// directory as those described by its repository metadata.
+func writeRepodataStamp(packagedir string) error {
+	stamp, err := packageStamp(packagedir)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(packagedir, repodataStampFilename), []byte(stamp+"\n"), 0640)
+}
+
+// repodataCurrent returns true if the repository metadata in the given package
+// directory is complete, is signed only if signed is true, lists each of the
+// given passthrough databases as is, and was built from exactly the packages
+// which are currently in the package directory.
+func repodataCurrent(packagedir string, signed bool, passthrough []passthroughDatabase) bool {
+	repodata := filepath.Join(packagedir, repodataDirname)
+	f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		return false
+	}
+
+	for _, db := range repomd.Databases {
+		if _, err := os.Stat(filepath.Join(packagedir, filepath.FromSlash(db.Location.Href))); err != nil {
+			Dprintf("Repository metadata in %s is missing %v database\n", repodata, &db)
+			return false
+		}
+	}
+
+	for _, p := range passthrough {
+		if db := repomd.Database(p.db.Type); db == nil || db.Checksum != p.db.Checksum {
+			Dprintf("Repository metadata in %s has an outdated %v database\n", repodata, &p.db)
+			return false
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(repodata, "repomd.xml.asc")); (err == nil) != signed {
+		Dprintf("Repository metadata in %s must be signed again\n", repodata)
+		return false
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(packagedir, repodataStampFilename))
+	if err != nil {
+		return false
+	}
+
+	stamp, err := packageStamp(packagedir)
+	if err != nil {
+		return false
+	}
+
+	return strings.TrimSpace(string(b)) == stamp
+}
+
+// CreaterepoThreads is the number of package files whose headers are read
+// concurrently while repository metadata is built. If zero, one package file
+// is read for each CPU.
+var CreaterepoThreads int
+
+// readPackageFiles reads the header of each of the given package files, with
+// CreaterepoThreads concurrent readers, and calls fn with each package in the
+// given order. Packages which cannot be read are logged and skipped. Only a few
+// packages are read ahead of fn, so that fn, such as writing to a primary
+// database, limits the packages held in memory.
+func readPackageFiles(paths []string, fn func(path string, p *rpm.PackageFile)) {
+	workers := CreaterepoThreads
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	type result struct {
+		p   *rpm.PackageFile
+		err error
+	}
+
+	results := make([]chan result, len(paths))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+
+	// schedule each package once a slot is released by fn
+	jobs := make(chan int)
+	slots := make(chan struct{}, 2*workers)
+	go func() {
+		for i := range paths {
+			slots <- struct{}{}
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for i := range jobs {
+				p, err := rpm.OpenPackageFile(paths[i])
+				results[i] <- result{p: p, err: err}
+			}
+		}()
+	}
+
+	for i, ch := range results {
+		r := <-ch
+		<-slots
+		if r.err != nil {
+			Errorf(r.err, "Error reading package %s", paths[i])
+			continue
+		}
+
+		fn(paths[i], r.p)
+	}
 }
 
 // createrepo create the required databases and metadata for a package
-// repository.
+// repository. If signer is not nil, the generated repomd.xml is signed.
+//
+// The primary.xml, filelists.xml and other.xml databases, which every client
+// reads, are always written. If sqlite is true, the primary_db, filelists_db
+// and other_db sqlite databases, which older yum clients prefer, are written
+// too, as with `createrepo --database`.
 //
-// `/repodata` is always appended to the given path.
-func createrepo(path string) (PrimaryDatabaseWriter, error) {
+// The metadata is written to the given path, which should be renamed to
+// `repodata` once complete.
+func createrepo(path string, signer *openpgp.Entity, sqlite bool) (*PrimaryDatabaseWriter, error) {
 	Dprintf("Creating new package repository: %v\n", path)
 
 	// create repodata directory
@@ -31,33 +545,145 @@ func createrepo(path string) (PrimaryDatabaseWriter, error) {
 		return nil, err
 	}
 
-	// create primary db
-	pdbPath := filepath.Join(dbPath, "/primary_db.sqlite")
-	db, err := CreatePrimaryDB(pdbPath)
+	// create primary.xml, filelists.xml and other.xml
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	primary, err := createPrimaryXML(filepath.Join(dbPath, "primary.xml"))
 	if err != nil {
 		return nil, err
 	}
+	closers = append(closers, primary)
 
-	// start a transaction
-	tx, err := db.Begin()
+	filelists, err := createFilelistsXML(filepath.Join(dbPath, "filelists.xml"))
 	if err != nil {
+		closeAll()
 		return nil, err
 	}
+	closers = append(closers, filelists)
 
-	// create package channel
-	w := make(chan *rpm.PackageFile, 0)
-	go func(w chan *rpm.PackageFile) {
-		defer func() {
-			tx.Commit()
+	other, err := createOtherXML(filepath.Join(dbPath, "other.xml"))
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	closers = append(closers, other)
+
+	// create primary db, filelists db and other db
+	var db *PrimaryDatabase
+	var tx *sql.Tx
+	var filelistsDB, otherDB *detailsDatabase
+	if sqlite {
+		db, err = CreatePrimaryDB(filepath.Join(dbPath, "/primary_db.sqlite"))
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		// start a transaction
+		tx, err = db.Begin()
+		if err != nil {
+			closeAll()
 			db.Close()
-		}()
+			return nil, err
+		}
 
-		for p := range w {
-			if err := db.InsertPackage(p); err != nil {
+		filelistsDB, err = createDetailsDB(filepath.Join(dbPath, "filelists_db.sqlite"), sqlCreateFilelistsTables)
+		if err != nil {
+			closeAll()
+			tx.Rollback()
+			db.Close()
+			return nil, err
+		}
+		closers = append(closers, filelistsDB)
+
+		otherDB, err = createDetailsDB(filepath.Join(dbPath, "other_db.sqlite"), sqlCreateOtherTables)
+		if err != nil {
+			closeAll()
+			tx.Rollback()
+			db.Close()
+			return nil, err
+		}
+		closers = append(closers, otherDB)
+	}
+
+	// create package channel
+	w := &PrimaryDatabaseWriter{
+		ch:     make(chan *rpm.PackageFile, 0),
+		done:   make(chan error, 1),
+		path:   path,
+		signer: signer,
+		sqlite: sqlite,
+	}
+
+	go func(ch chan *rpm.PackageFile) {
+		for p := range ch {
+			// packages are listed in every database or in none
+			e, err := newPrimaryXMLPackage(p)
+			if err != nil {
 				Errorf(err, "Failed to insert %v", p)
+				continue
+			}
+
+			contents, err := readPackageContents(p.Path())
+			if err != nil {
+				Errorf(err, "Failed to insert %v", p)
+				continue
+			}
+			files, changelogs := newFilelistsXMLPackage(e, contents), newOtherXMLPackage(e, contents)
+
+			if db != nil {
+				if err := db.InsertPackage(p); err != nil {
+					Errorf(err, "Failed to insert %v", p)
+					continue
+				}
+
+				if err := filelistsDB.InsertFiles(files); err != nil {
+					Errorf(err, "Failed to insert %v", p)
+					continue
+				}
+
+				if err := otherDB.InsertChangelogs(changelogs); err != nil {
+					Errorf(err, "Failed to insert %v", p)
+					continue
+				}
+			}
+
+			for _, x := range []struct {
+				w *metadataXMLWriter
+				p interface{}
+			}{{primary, e}, {filelists, files}, {other, changelogs}} {
+				if err := x.w.Write(x.p); err != nil {
+					Errorf(err, "Failed to insert %v", p)
+				}
+			}
+		}
+
+		var err error
+		for _, c := range closers {
+			if cerr := c.Close(); err == nil {
+				err = cerr
 			}
 		}
-	}(w)
+
+		if db != nil {
+			if txErr := tx.Commit(); txErr != nil {
+				db.Close()
+				w.done <- txErr
+				return
+			}
+
+			if dbErr := db.Close(); err == nil {
+				err = dbErr
+			}
+		}
+
+		w.done <- err
+	}(w.ch)
 
 	return w, nil
 }
@@ -0,0 +1,800 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/cavaliercoder/go-rpm"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecoverRepodata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// leftover partial metadata and an unparseable repomd.xml
+	tmp := filepath.Join(dir, repodataTmpDirname)
+	repodata := filepath.Join(dir, repodataDirname)
+	for _, path := range []string{filepath.Join(tmp, "gen"), repodata} {
+		if err := os.MkdirAll(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmp, "gen", "primary_db.sqlite"), []byte("partial"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(repodata, "repomd.xml"), []byte("<repomd><revis"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err := recoverRepodata(dir)
+	if err != nil {
+		t.Fatalf("Error recovering repodata: %v", err)
+	}
+
+	if valid {
+		t.Errorf("Truncated repomd.xml reported as valid")
+	}
+
+	for _, path := range []string{tmp, repodata} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", path)
+		}
+	}
+
+	// interrupted while promoting new metadata
+	old := filepath.Join(dir, repodataOldDirname)
+	if err := os.MkdirAll(old, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(old, "repomd.xml"), []byte("<repomd><revision>1</revision></repomd>"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	valid, err = recoverRepodata(dir)
+	if err != nil {
+		t.Fatalf("Error recovering repodata: %v", err)
+	}
+
+	if !valid {
+		t.Errorf("Expected previous repodata to be restored")
+	}
+
+	if _, err := os.Stat(filepath.Join(repodata, "repomd.xml")); err != nil {
+		t.Errorf("Previous repodata was not restored: %v", err)
+	}
+}
+
+// writeTestPackage writes a RPM package with the given signature header
+// entries, main header entries and payload.
+func writeTestPackage(t testing.TB, path string, signature, header []rpmHeaderEntry, payload []byte) {
+	sigHeader := encodeRPMHeader(signature, rpmTagHeaderSignatures)
+
+	buf := &bytes.Buffer{}
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, rpmLeadMagic)
+	buf.Write(lead)
+	buf.Write(sigHeader)
+	buf.Write(make([]byte, rpmSignaturePadding(len(sigHeader))))
+	buf.Write(encodeRPMHeader(header, 0))
+	buf.Write(payload)
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testHeaderString returns a header entry for the given string tag.
+func testHeaderString(tag uint32, value string) rpmHeaderEntry {
+	return rpmHeaderEntry{Tag: tag, Type: rpmTypeString, Count: 1, Data: []byte(value + "\x00")}
+}
+
+// testHeaderInt returns a header entry for the given 32-bit or 64-bit
+// integer tag.
+func testHeaderInt(tag uint32, value uint64, bits int) rpmHeaderEntry {
+	if bits == 64 {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, value)
+		return rpmHeaderEntry{Tag: tag, Type: rpmTypeInt64, Count: 1, Data: b}
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(value))
+	return rpmHeaderEntry{Tag: tag, Type: rpmTypeInt32, Count: 1, Data: b}
+}
+
+// writeTestGenerated writes the given primary.xml and empty filelists.xml and
+// other.xml files to the gen/ subdirectory of the given metadata directory, as
+// if written by createrepo.
+func writeTestGenerated(t testing.TB, repodata string, primary []byte) {
+	files := map[string][]byte{
+		"primary.xml":   primary,
+		"filelists.xml": []byte(`<filelists packages="0"></filelists>`),
+		"other.xml":     []byte(`<otherdata packages="0"></otherdata>`),
+	}
+
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(repodata, "gen", name), b, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeTestPackages writes the given number of packages, each with a payload
+// of the given size, to the given directory and returns their paths.
+func writeTestPackages(t testing.TB, dir string, n, size int) []string {
+	paths := make([]string, n)
+	payload := bytes.Repeat([]byte{0}, size)
+	for i := range paths {
+		name := fmt.Sprintf("test%d", i)
+		paths[i] = filepath.Join(dir, name+"-1.0-1.x86_64.rpm")
+		writeTestPackage(t, paths[i], []rpmHeaderEntry{
+			testHeaderInt(1000, uint64(size), 32),
+		}, []rpmHeaderEntry{
+			testHeaderString(1000, name),
+			testHeaderString(1001, "1.0"),
+			testHeaderString(1002, "1"),
+			testHeaderString(1022, "x86_64"),
+		}, payload)
+	}
+
+	return paths
+}
+
+func TestReadPackageFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(n int) { CreaterepoThreads = n }(CreaterepoThreads)
+	CreaterepoThreads = 4
+
+	// packages are passed on in order, however many are read at once
+	paths := writeTestPackages(t, dir, 50, 1024)
+	read := make([]string, 0, len(paths))
+	readPackageFiles(paths, func(path string, p *rpm.PackageFile) {
+		read = append(read, path)
+	})
+
+	if !reflect.DeepEqual(read, paths) {
+		t.Errorf("Expected packages in order:\n%v\ngot:\n%v", paths, read)
+	}
+}
+
+// benchmarkReadPackageFiles reads a fixture set of packages with the given
+// number of threads.
+func benchmarkReadPackageFiles(b *testing.B, threads int) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(n int) { CreaterepoThreads = n }(CreaterepoThreads)
+	CreaterepoThreads = threads
+
+	paths := writeTestPackages(b, dir, 200, 64*1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readPackageFiles(paths, func(string, *rpm.PackageFile) {})
+	}
+}
+
+func BenchmarkReadPackageFilesSerial(b *testing.B) {
+	benchmarkReadPackageFiles(b, 1)
+}
+
+func BenchmarkReadPackageFilesParallel(b *testing.B) {
+	benchmarkReadPackageFiles(b, 0)
+}
+
+func TestCreaterepoZstdPayload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a package built by rpm 4.14 or later, with a zstd payload, the archive
+	// size in the signature header and a 64-bit installed size
+	payload := append([]byte{0x28, 0xB5, 0x2F, 0xFD}, bytes.Repeat([]byte("zstd"), 256)...)
+	path := filepath.Join(dir, "test-1.0-1.x86_64.rpm")
+	writeTestPackage(t, path, []rpmHeaderEntry{
+		testHeaderInt(1000, uint64(len(payload)), 32),
+		testHeaderInt(rpmSigTagPayloadSize, 4096, 32),
+	}, []rpmHeaderEntry{
+		testHeaderString(1000, "test"),
+		testHeaderString(1001, "1.0"),
+		testHeaderString(1002, "1"),
+		testHeaderString(1022, "x86_64"),
+		testHeaderString(1124, "cpio"),
+		testHeaderString(rpmTagPayloadCompressor, "zstd"),
+		testHeaderInt(rpmTagLongSize, 5*1024*1024*1024, 64),
+	}, payload)
+
+	info, err := readPackageInfo(path)
+	if err != nil {
+		t.Fatalf("Error reading zstd package: %v", err)
+	}
+
+	if info.PayloadCompressor != "zstd" || info.InstalledSize != 5*1024*1024*1024 || info.ArchiveSize != 4096 {
+		t.Errorf("Unexpected package info: %+v", info)
+	}
+
+	// build metadata
+	w, err := createrepo(filepath.Join(dir, repodataDirname), nil, true)
+	if err != nil {
+		t.Fatalf("Error creating repository metadata: %v", err)
+	}
+
+	p, err := rpm.OpenPackageFile(path)
+	if err != nil {
+		t.Fatalf("Error reading zstd package: %v", err)
+	}
+	w.Write(p)
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error writing repository metadata: %v", err)
+	}
+
+	db, err := OpenPrimaryDB(filepath.Join(dir, repodataDirname, "gen", "primary_db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	packages, err := db.Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packages) != 1 {
+		t.Fatalf("Expected 1 package in primary_db, got %d", len(packages))
+	}
+
+	if p := packages[0]; p.Name() != "test" || p.InstallSize() != 5*1024*1024*1024 || p.ArchiveSize() != 4096 {
+		t.Errorf("Unexpected package in primary_db: %v (installed %d, archive %d)", p, p.InstallSize(), p.ArchiveSize())
+	}
+
+	// packages read from primary_db implement Package
+	var pkg Package = &packages[0]
+	if pkg.String() != "test-1.0-1.x86_64" || pkg.LocationHref() != "test-1.0-1.x86_64.rpm" {
+		t.Errorf("Unexpected Package from primary_db: %v at %s", pkg, pkg.LocationHref())
+	}
+}
+
+func TestPrimaryXMLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "primary.xml")
+	w, err := createPrimaryXML(path)
+	if err != nil {
+		t.Fatalf("Error creating primary.xml: %v", err)
+	}
+
+	foo := &primaryXMLPackage{
+		Type:     "rpm",
+		Name:     "foo",
+		Arch:     "x86_64",
+		Version:  PackageEntryVersion{Epoch: 1, Version: "1.0", Release: "1"},
+		Checksum: PackageEntryChecksum{Type: "sha256", Pkgid: "YES", Hash: "abc"},
+		Size:     PackageEntrySize{Package: 11},
+	}
+	foo.Location.Href = "foo-1.0-1.x86_64.rpm"
+	foo.Format.Provides = &primaryXMLDependencies{Entries: []primaryXMLDependency{{Name: "foo", Flags: "EQ", Epoch: "1", Version: "1.0", Release: "1"}}}
+	foo.Format.Requires = &primaryXMLDependencies{Entries: []primaryXMLDependency{{Name: "libbar.so.1()(64bit)"}}}
+	foo.Format.Files = []string{"/usr/bin/foo"}
+
+	bar := &primaryXMLPackage{Type: "rpm", Name: "bar", Arch: "noarch", Checksum: PackageEntryChecksum{Type: "sha256", Pkgid: "YES", Hash: "def"}}
+	bar.Location.Href = "bar-1.0-1.noarch.rpm"
+
+	for _, p := range []*primaryXMLPackage{foo, bar} {
+		if err := w.Write(p); err != nil {
+			t.Fatalf("Error writing package %s: %v", p.Name, err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing primary.xml: %v", err)
+	}
+
+	if _, err := os.Stat(path + ".packages"); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary package list to be removed")
+	}
+
+	// packages and dependencies are read back as from upstream metadata
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	md, err := ReadPrimaryMetadata(f)
+	if err != nil {
+		t.Fatalf("Error reading primary.xml: %v", err)
+	}
+
+	if md.PackagesCount != 2 || len(md.Packages) != 2 || md.Packages[0].String() != "foo-1:1.0-1.x86_64" || md.Packages[1].LocationHref() != "bar-1.0-1.noarch.rpm" {
+		t.Fatalf("Unexpected packages in primary.xml: %d %v", md.PackagesCount, md.Packages)
+	}
+
+	f.Seek(0, 0)
+	deps, err := readPrimaryDependencies(f)
+	if err != nil {
+		t.Fatalf("Error reading dependencies from primary.xml: %v", err)
+	}
+
+	expected := &packageDependencies{
+		Requires: []dependency{{Name: "libbar.so.1()(64bit)"}},
+		Provides: []dependency{{Name: "foo", Flags: "EQ", Epoch: "1", Version: "1.0", Release: "1"}},
+		Files:    []string{"/usr/bin/foo"},
+	}
+	if !reflect.DeepEqual(deps["abc"], expected) {
+		t.Errorf("Expected dependencies %+v, got %+v", expected, deps["abc"])
+	}
+}
+
+func TestCreaterepoSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	paths := writeTestPackages(t, dir, 3, 1024)
+	for _, sqlite := range []bool{false, true} {
+		repodata := filepath.Join(dir, fmt.Sprintf("repodata-%v", sqlite))
+		w, err := createrepo(repodata, nil, sqlite)
+		if err != nil {
+			t.Fatalf("Error creating repository metadata: %v", err)
+		}
+
+		readPackageFiles(paths, func(_ string, p *rpm.PackageFile) {
+			w.Write(p)
+		})
+
+		if err := w.Close(); err != nil {
+			t.Fatalf("Error writing repository metadata: %v", err)
+		}
+
+		f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		repomd, err := ReadRepoMetadata(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// each database matches its checksum in repomd.xml
+		types := make([]string, 0)
+		for _, db := range repomd.Databases {
+			types = append(types, db.Type)
+			if err := db.Checksum.CheckFile(filepath.Join(repodata, filepath.Base(db.Location.Href))); err != nil {
+				t.Errorf("Database %s failed validation: %v", db.Type, err)
+			}
+
+			if db.IsSQLite() != (db.DatabaseVersion == 10) {
+				t.Errorf("Unexpected database_version %d for %s", db.DatabaseVersion, db.Type)
+			}
+		}
+
+		expected := []string{"primary", "filelists", "other"}
+		if sqlite {
+			expected = append(expected, "primary_db", "filelists_db", "other_db")
+		}
+		if !reflect.DeepEqual(types, expected) {
+			t.Errorf("Expected databases %v, got %v", expected, types)
+		}
+
+		// both databases list the same packages
+		f, err = os.Open(filepath.Join(repodata, "gen", "primary.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := ReadPrimaryMetadata(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(md.Packages) != len(paths) {
+			t.Errorf("Expected %d packages in primary.xml, got %d", len(paths), len(md.Packages))
+		}
+
+		if !sqlite {
+			continue
+		}
+
+		db, err := OpenPrimaryDB(filepath.Join(repodata, "gen", "primary_db.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		packages, err := db.Packages()
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, p := range packages {
+			xsum, _ := md.Packages[i].Checksum()
+			sum, _ := p.Checksum()
+			if p.String() != md.Packages[i].String() || sum != xsum {
+				t.Errorf("Expected %v in primary_db to match %v in primary.xml", p, md.Packages[i])
+			}
+		}
+	}
+}
+
+func TestPreserveProductID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	compressedPrimary := gzipBytes(t, primary)
+	productid := []byte("productid certificate")
+	compressedProductID := gzipBytes(t, productid)
+
+	upstream := &RepoMetadata{
+		Revision: 1,
+		Databases: []RepoDatabase{
+			{
+				Type:         "primary",
+				Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum:     checksumBytes(t, compressedPrimary),
+				OpenChecksum: checksumBytes(t, primary),
+			},
+			{
+				Type:         "productid",
+				Location:     RepoDatabaseLocation{Href: "repodata/productid.gz"},
+				Checksum:     checksumBytes(t, compressedProductID),
+				OpenChecksum: checksumBytes(t, productid),
+				Size:         len(compressedProductID),
+				Timestamp:    1588340000,
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := upstream.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	})
+	mux.HandleFunc("/repodata/primary.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressedPrimary)
+	})
+	mux.HandleFunc("/repodata/productid.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressedProductID)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "rhel"
+	repo.BaseURL = ts.URL
+	repo.PreserveProductID = true
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repocache.Close()
+
+	if len(repocache.passthrough) != 1 {
+		t.Fatalf("Expected productid to be cached, got %d databases", len(repocache.passthrough))
+	}
+
+	// the productid is copied into the generated metadata
+	repodata := filepath.Join(dir, "repodata")
+	if err := os.MkdirAll(filepath.Join(repodata, "gen"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestGenerated(t, repodata, []byte(`<metadata packages="0"></metadata>`))
+
+	w := &PrimaryDatabaseWriter{path: repodata, passthrough: repocache.passthrough}
+	if err := w.writeMetadata(); err != nil {
+		t.Fatalf("Error writing repository metadata: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := repomd.Database("productid")
+	if db == nil {
+		t.Fatalf("Expected productid in generated repomd.xml")
+	}
+
+	if db.Location.Href != "repodata/productid.gz" || db.Checksum != upstream.Databases[1].Checksum || db.Timestamp != 1588340000 {
+		t.Errorf("Unexpected productid entry in generated repomd.xml: %+v", db)
+	}
+
+	if err := db.Checksum.CheckFile(filepath.Join(repodata, "productid.gz")); err != nil {
+		t.Errorf("Expected productid to be copied into repodata: %v", err)
+	}
+}
+
+func TestUnknownMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	files := map[string][]byte{
+		"primary.xml.gz":     gzipBytes(t, primary),
+		"pkgtags.sqlite.gz":  gzipBytes(t, []byte("pkgtags")),
+		"productid.gz":       gzipBytes(t, []byte("productid certificate")),
+		"primary.xml.zck":    []byte("zchunk primary"),
+		"suseinfo.xml.gz":    gzipBytes(t, []byte("<suseinfo/>")),
+		"updateinfo.xml.zck": []byte("zchunk updateinfo"),
+		"comps.xml":          []byte("<comps/>"),
+	}
+
+	upstream := &RepoMetadata{Revision: 1}
+	for _, db := range []struct {
+		typ      string
+		filename string
+	}{
+		{"primary", "primary.xml.gz"},
+		{"pkgtags", "pkgtags.sqlite.gz"},
+		{"productid", "productid.gz"},
+		{"primary_zck", "primary.xml.zck"},
+		{"suseinfo", "suseinfo.xml.gz"},
+		{"updateinfo_zck", "updateinfo.xml.zck"},
+		{"group", "comps.xml"},
+	} {
+		upstream.Databases = append(upstream.Databases, RepoDatabase{
+			Type:      db.typ,
+			Location:  RepoDatabaseLocation{Href: "repodata/" + db.filename},
+			Checksum:  checksumBytes(t, files[db.filename]),
+			Size:      len(files[db.filename]),
+			Timestamp: 1588340000,
+		})
+	}
+	upstream.Databases[0].OpenChecksum = checksumBytes(t, primary)
+
+	buf := &bytes.Buffer{}
+	if err := upstream.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	})
+	for filename, b := range files {
+		b := b
+		mux.HandleFunc("/repodata/"+filename, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(b)
+		})
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	for i, test := range []struct {
+		drop      bool
+		productid bool
+		expected  []string
+	}{
+		{false, false, []string{"pkgtags", "productid", "suseinfo", "updateinfo_zck", "group"}},
+		{true, false, []string{"updateinfo_zck", "group"}},
+		{true, true, []string{"productid", "updateinfo_zck", "group"}},
+	} {
+		repo := NewRepo()
+		repo.ID = "sles"
+		repo.BaseURL = ts.URL
+		repo.DropUnknownMetadata = test.drop
+		repo.PreserveProductID = test.productid
+		repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		repocache.Close()
+
+		types := make([]string, 0)
+		for _, p := range repocache.passthrough {
+			types = append(types, p.db.Type)
+		}
+		if !reflect.DeepEqual(types, test.expected) {
+			t.Errorf("Expected databases %v to be preserved with DropUnknownMetadata %v, PreserveProductID %v, got %v", test.expected, test.drop, test.productid, types)
+			continue
+		}
+
+		// preserved databases round-trip into the generated metadata
+		repodata := filepath.Join(dir, fmt.Sprintf("repodata-%d", i))
+		if err := os.MkdirAll(filepath.Join(repodata, "gen"), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		writeTestGenerated(t, repodata, []byte(`<metadata packages="0"></metadata>`))
+
+		w := &PrimaryDatabaseWriter{path: repodata, passthrough: repocache.passthrough}
+		if err := w.writeMetadata(); err != nil {
+			t.Fatalf("Error writing repository metadata: %v", err)
+		}
+
+		f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		repomd, err := ReadRepoMetadata(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(repomd.Databases) != len(test.expected)+3 {
+			t.Errorf("Expected %d databases in generated repomd.xml, got %d", len(test.expected)+3, len(repomd.Databases))
+		}
+
+		for _, typ := range test.expected {
+			db := repomd.Database(typ)
+			if db == nil {
+				t.Errorf("Expected %s in generated repomd.xml", typ)
+				continue
+			}
+
+			if *db != *upstream.Database(typ) {
+				t.Errorf("Expected upstream %s entry in generated repomd.xml, got %+v", typ, db)
+			}
+
+			b, err := ioutil.ReadFile(filepath.Join(repodata, filepath.Base(db.Location.Href)))
+			if err != nil {
+				t.Errorf("Expected %s to be copied into repodata: %v", typ, err)
+			} else if !bytes.Equal(b, files[filepath.Base(db.Location.Href)]) {
+				t.Errorf("Expected %s to be copied unmodified into repodata", typ)
+			}
+		}
+	}
+}
+
+func TestPreserveAppstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	files := map[string][]byte{
+		"primary.xml.gz":         gzipBytes(t, primary),
+		"appstream.xml.gz":       gzipBytes(t, []byte("<components/>")),
+		"appstream-icons.tar.gz": gzipBytes(t, bytes.Repeat([]byte("icon"), 4096)),
+	}
+
+	upstream := &RepoMetadata{Revision: 1}
+	for _, db := range []struct {
+		typ      string
+		filename string
+	}{
+		{"primary", "primary.xml.gz"},
+		{"appstream", "appstream.xml.gz"},
+		{"appstream-icons", "appstream-icons.tar.gz"},
+	} {
+		upstream.Databases = append(upstream.Databases, RepoDatabase{
+			Type:      db.typ,
+			Location:  RepoDatabaseLocation{Href: "repodata/" + db.filename},
+			Checksum:  checksumBytes(t, files[db.filename]),
+			Size:      len(files[db.filename]),
+			Timestamp: 1588340000,
+		})
+	}
+	upstream.Databases[0].OpenChecksum = checksumBytes(t, primary)
+
+	buf := &bytes.Buffer{}
+	if err := upstream.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	})
+	for filename, b := range files {
+		b := b
+		mux.HandleFunc("/repodata/"+filename, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(b)
+		})
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// AppStream metadata is not copied as unknown metadata
+	repo := NewRepo()
+	repo.ID = "fedora"
+	repo.BaseURL = ts.URL
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repocache.Close()
+
+	if len(repocache.passthrough) != 0 {
+		t.Errorf("Expected AppStream metadata not to be cached without PreserveAppstream, got %d databases", len(repocache.passthrough))
+	}
+
+	repo.PreserveAppstream = true
+	if repocache, err = repo.CacheLocal(filepath.Join(dir, "cache")); err != nil {
+		t.Fatal(err)
+	}
+	repocache.Close()
+
+	if len(repocache.passthrough) != 2 {
+		t.Fatalf("Expected AppStream metadata to be cached, got %d databases", len(repocache.passthrough))
+	}
+
+	// the AppStream metadata survives into the generated metadata
+	repodata := filepath.Join(dir, "repodata")
+	if err := os.MkdirAll(filepath.Join(repodata, "gen"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestGenerated(t, repodata, primary)
+
+	w := &PrimaryDatabaseWriter{path: repodata, passthrough: repocache.passthrough}
+	if err := w.writeMetadata(); err != nil {
+		t.Fatalf("Error writing repository metadata: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(repodata, "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, typ := range []string{"appstream", "appstream-icons"} {
+		db := repomd.Database(typ)
+		if db == nil {
+			t.Errorf("Expected %s in generated repomd.xml", typ)
+			continue
+		}
+
+		if *db != *upstream.Database(typ) {
+			t.Errorf("Expected upstream %s entry in generated repomd.xml, got %+v", typ, db)
+		}
+
+		if err := db.Checksum.CheckFile(filepath.Join(repodata, filepath.Base(db.Location.Href))); err != nil {
+			t.Errorf("Expected %s to be copied into repodata: %v", typ, err)
+		}
+	}
+}
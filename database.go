@@ -1,5 +1,26 @@
 package yum
 
+import (
+	"strings"
+)
+
+// databaseTypes are the repository database types recognized in repomd.xml
+// files created by both createrepo and createrepo_c. Databases of other types
+// are preserved in RepoMetadata but are otherwise ignored.
+var databaseTypes = map[string]bool{
+	"primary":      true,
+	"primary_db":   true,
+	"filelists":    true,
+	"filelists_db": true,
+	"other":        true,
+	"other_db":     true,
+	"group":        true,
+	"group_gz":     true,
+	"updateinfo":   true,
+	"modules":      true,
+	"prestodelta":  true,
+}
+
 // RepoDatabase represents an entry in a repository metadata file for an
 // individual database file such as primary_db or filelists_db.
 type RepoDatabase struct {
@@ -10,7 +31,7 @@ type RepoDatabase struct {
 	Checksum        RepoDatabaseChecksum `xml:"checksum"`
 	OpenSize        int                  `xml:"open-size"`
 	OpenChecksum    RepoDatabaseChecksum `xml:"open-checksum"`
-	DatabaseVersion int                  `xml:"database_version"`
+	DatabaseVersion int                  `xml:"database_version,omitempty"`
 }
 
 // RepoDatabaseLocation represents the URI, relative to a package repository,
@@ -22,3 +43,51 @@ type RepoDatabaseLocation struct {
 func (c *RepoDatabase) String() string {
 	return c.Type
 }
+
+// Known returns true if the database is of a type recognized by this package.
+func (c *RepoDatabase) Known() bool {
+	return databaseTypes[c.Type]
+}
+
+// isAppstream returns true if the database is AppStream metadata, such as the
+// appstream and appstream-icons databases of desktop repositories, or a
+// variant, such as appstream_zck, of AppStream metadata.
+func (c *RepoDatabase) isAppstream() bool {
+	return strings.HasPrefix(c.Type, "appstream")
+}
+
+// opaque returns true if the database is of a type which is not recognized by
+// this package and is not a variant, such as primary_zck or updateinfo_xz, of
+// a recognized type, so that it describes neither the packages nor the groups
+// of the repository and may be copied unmodified into a local repository.
+// AppStream metadata is recognized, as it is only copied if PreserveAppstream
+// is set.
+func (c *RepoDatabase) opaque() bool {
+	if c.Known() || c.isAppstream() {
+		return false
+	}
+
+	if i := strings.LastIndex(c.Type, "_"); i > 0 && databaseTypes[c.Type[:i]] {
+		return false
+	}
+
+	return true
+}
+
+// baseType returns the type of which the database is a variant, such as
+// primary for primary_db and primary_zck, or group for group_gz, or the type of
+// the database if it is no variant.
+func (c *RepoDatabase) baseType() string {
+	if i := strings.Index(c.Type, "_"); i > 0 {
+		return c.Type[:i]
+	}
+
+	return c.Type
+}
+
+// IsSQLite returns true if the database is a sqlite database, such as
+// primary_db, rather than an XML file. Older repositories may omit the
+// database_version of sqlite databases.
+func (c *RepoDatabase) IsSQLite() bool {
+	return strings.HasSuffix(c.Type, "_db") || c.DatabaseVersion == 10
+}
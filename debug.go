@@ -0,0 +1,36 @@
+package yum
+
+import (
+	"strings"
+)
+
+// debugRepoDirname is the subdirectory of a package directory to which debug
+// packages are synchronized, with their own repository metadata, if
+// SeparateDebugRepo is set.
+const debugRepoDirname = "debug"
+
+// isDebugPackage returns true if the given package provides debug symbols or
+// sources, such as bash-debuginfo, bash-debugsource or
+// kernel-debuginfo-common-x86_64.
+func isDebugPackage(p PackageEntry) bool {
+	name := p.Name()
+	return strings.HasSuffix(name, "-debuginfo") ||
+		strings.HasSuffix(name, "-debugsource") ||
+		strings.Contains(name, "-debuginfo-")
+}
+
+// splitDebugPackages returns the given packages which are not debug packages,
+// followed by those which are.
+func splitDebugPackages(packages PackageEntries) (PackageEntries, PackageEntries) {
+	main := make(PackageEntries, 0, len(packages))
+	debug := make(PackageEntries, 0)
+	for _, p := range packages {
+		if isDebugPackage(p) {
+			debug = append(debug, p)
+		} else {
+			main = append(main, p)
+		}
+	}
+
+	return main, debug
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package yum
+
+import (
+	"syscall"
+)
+
+func fileDevice(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Dev), nil
+}
@@ -0,0 +1,12 @@
+package yum
+
+import (
+	"fmt"
+)
+
+// Device IDs are not compared on Windows, so the filesystems of a repo's
+// directories are not checked before a sync.
+
+func fileDevice(path string) (uint64, error) {
+	return 0, fmt.Errorf("Device IDs are not supported on Windows")
+}
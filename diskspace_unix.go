@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package yum
+
+import (
+	"syscall"
+)
+
+func freeSpace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
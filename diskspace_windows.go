@@ -0,0 +1,12 @@
+package yum
+
+import (
+	"fmt"
+)
+
+// Free space is not measured on Windows, so new repos are always cached in the
+// first cache directory.
+
+func freeSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("Free space is not supported on Windows")
+}
@@ -0,0 +1,115 @@
+package yum
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error categories which may be matched with errors.Is against any error
+// returned by this package. ErrChecksumMismatch is also a category.
+var (
+	// ErrMetadataFetch indicates that repository metadata or a repository
+	// database could not be downloaded, decoded or decompressed.
+	ErrMetadataFetch = errors.New("Error fetching repository metadata")
+
+	// ErrRepoUnavailable indicates that an upstream repository could not be
+	// reached or did not serve the requested resource.
+	ErrRepoUnavailable = errors.New("Repository unavailable")
+
+	// ErrRepoLocked indicates that a package directory is locked by another
+	// process which is synchronizing it.
+	ErrRepoLocked = errors.New("Repository is locked by another process")
+
+	// ErrGPGFailed indicates that a package failed GPG signature validation.
+	ErrGPGFailed = errors.New("GPG check failed")
+
+	// ErrKeyRing indicates that the GPG keyring given by the gpgkey of a repo
+	// could not be loaded. The error is a *KeyRingError which describes the
+	// cause and how it may be fixed.
+	ErrKeyRing = errors.New("Error loading GPG keyring")
+
+	// ErrPackageUnsigned indicates that a package has no GPG signature. It is
+	// distinct from ErrGPGFailed which indicates a bad signature.
+	ErrPackageUnsigned = errors.New("Package is not signed")
+
+	// ErrInvalidPackage indicates that a downloaded file does not begin with
+	// the lead and header of a RPM package, such as an error page served by a
+	// mirror in place of the package.
+	ErrInvalidPackage = errors.New("File is not a RPM package")
+
+	// ErrDuplicatePackage indicates that the metadata of an upstream
+	// repository lists the same NEVRA more than once and the repo sets
+	// RejectDuplicates.
+	ErrDuplicatePackage = errors.New("Package is listed more than once")
+
+	// ErrCrossDevice indicates that a directory of a repo which must share
+	// files with its package directory, such as StagingDir, is on a different
+	// filesystem.
+	ErrCrossDevice = errors.New("Directories are on different filesystems")
+
+	// ErrWeakChecksum indicates that repository metadata or a package relies
+	// on a checksum algorithm which is not permitted by the ChecksumPolicy.
+	ErrWeakChecksum = errors.New("Checksum algorithm not permitted")
+
+	// ErrTooManyRedirects indicates that a mirror redirected a request in a
+	// loop or more than maxRedirects times.
+	ErrTooManyRedirects = errors.New("Too many redirects")
+
+	// ErrSyncDeclined indicates that a sync was aborted before downloading
+	// any package because its plan was declined by the repo's ConfirmFunc.
+	ErrSyncDeclined = errors.New("Sync was declined")
+)
+
+// Error is an error in one of the categories declared by this package. It
+// wraps the underlying cause of the error, if any, so both the category and
+// the cause may be matched with errors.Is and errors.As.
+type Error struct {
+	// Kind is the category of the error, such as ErrMetadataFetch.
+	Kind error
+
+	// Err is the underlying cause of the error, or nil.
+	Err error
+
+	msg string
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the underlying cause of the error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error belongs to the given category.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newError returns an Error of the given category. The message is formatted
+// with fmt.Errorf so the underlying cause may be given with the %w verb.
+func newError(kind error, format string, a ...interface{}) error {
+	err := fmt.Errorf(format, a...)
+	return &Error{
+		Kind: kind,
+		Err:  errors.Unwrap(err),
+		msg:  err.Error(),
+	}
+}
+
+// Errors is a list of errors which occurred while processing multiple repos.
+type Errors []error
+
+func (e Errors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+
+	s := fmt.Sprintf("%d errors occurred:", len(e))
+	for _, err := range e {
+		s += "\n  " + err.Error()
+	}
+
+	return s
+}
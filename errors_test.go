@@ -0,0 +1,82 @@
+package yum
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestErrorCategories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/garbage/repodata/repomd.xml":
+			w.Write([]byte("this is not xml"))
+
+		case "/corrupt/repodata/primary.xml.gz":
+			w.Write([]byte("corrupt database"))
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	newCache := func(id string) *RepoCache {
+		repo := NewRepo()
+		repo.ID = id
+		repo.BaseURL = ts.URL + "/" + id
+		return &RepoCache{Repo: repo, Path: filepath.Join(dir, id)}
+	}
+
+	// repo not found
+	if _, err := newCache("missing").updateMetadata(); !errors.Is(err, ErrRepoUnavailable) {
+		t.Errorf("Expected ErrRepoUnavailable, got: %v", err)
+	}
+
+	// bad metadata
+	if _, err := newCache("garbage").updateMetadata(); !errors.Is(err, ErrMetadataFetch) {
+		t.Errorf("Expected ErrMetadataFetch, got: %v", err)
+	}
+
+	// corrupt database
+	c := newCache("corrupt")
+	if err := os.MkdirAll(c.Path, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &RepoDatabase{
+		Type:     "primary",
+		Location: RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+		Checksum: RepoDatabaseChecksum{Type: "sha256", Hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+
+	if _, err := c.downloadDatabase(db); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+	}
+
+	// unsigned garbage package
+	path := filepath.Join(dir, "garbage.rpm")
+	if err := ioutil.WriteFile(path, []byte("not a package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gpgCheckFile(path, nil); !errors.Is(err, ErrGPGFailed) {
+		t.Errorf("Expected ErrGPGFailed, got: %v", err)
+	}
+
+	// causes are preserved
+	var yerr *Error
+	if err := gpgCheckFile(filepath.Join(dir, "missing.rpm"), nil); errors.As(err, &yerr) || !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got: %v", err)
+	}
+}
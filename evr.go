@@ -0,0 +1,110 @@
+package yum
+
+import (
+	"strings"
+	"unicode"
+)
+
+// CompareEVR compares the epoch, version and release of two packages and
+// returns 1 if a is newer than b, -1 if b is newer than a or 0 if they are
+// equal. The epoch is always compared first so that 1:2.0-1 is newer than
+// 3.0-1. Versions and releases are compared as per rpmvercmp.
+func CompareEVR(a, b *PackageEntry) int {
+	if a.Epoch() > b.Epoch() {
+		return 1
+	} else if a.Epoch() < b.Epoch() {
+		return -1
+	}
+
+	if n := compareVersion(a.Version(), b.Version()); n != 0 {
+		return n
+	}
+
+	return compareVersion(a.Release(), b.Release())
+}
+
+// compareVersion compares two version or release strings using the same
+// algorithm as rpmvercmp. Each string is split into alternating segments of
+// digits and letters; numeric segments are compared numerically and are
+// always newer than alphabetic segments. A tilde sorts before anything,
+// including the end of the string.
+func compareVersion(a, b string) int {
+	if a == b {
+		return 0
+	}
+
+	isSep := func(r rune) bool {
+		return r != '~' && !unicode.IsDigit(r) && !unicode.IsLetter(r)
+	}
+
+	for {
+		a = strings.TrimLeftFunc(a, isSep)
+		b = strings.TrimLeftFunc(b, isSep)
+
+		// handle tilde separators
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		// take the next segment of the same type from each string
+		numeric := unicode.IsDigit(rune(a[0]))
+		segment := func(s string) (string, string) {
+			i := strings.IndexFunc(s, func(r rune) bool {
+				if numeric {
+					return !unicode.IsDigit(r)
+				}
+				return !unicode.IsLetter(r)
+			})
+			if i < 0 {
+				return s, ""
+			}
+			return s[:i], s[i:]
+		}
+
+		var sa, sb string
+		sa, a = segment(a)
+		sb, b = segment(b)
+
+		// segments of different types; numeric is newer
+		if sb == "" {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		if numeric {
+			sa = strings.TrimLeft(sa, "0")
+			sb = strings.TrimLeft(sb, "0")
+			if len(sa) > len(sb) {
+				return 1
+			} else if len(sa) < len(sb) {
+				return -1
+			}
+		}
+
+		if n := strings.Compare(sa, sb); n != 0 {
+			return n
+		}
+	}
+
+	// the string with remaining segments is newer
+	if a == "" && b == "" {
+		return 0
+	} else if a == "" {
+		return -1
+	}
+
+	return 1
+}
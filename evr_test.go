@@ -0,0 +1,51 @@
+package yum
+
+import (
+	"testing"
+)
+
+func TestCompareEVR(t *testing.T) {
+	tests := []struct {
+		a, b PackageEntryVersion
+		want int
+	}{
+		{PackageEntryVersion{0, "1.0", "1"}, PackageEntryVersion{0, "1.0", "1"}, 0},
+		{PackageEntryVersion{0, "1.0", "2"}, PackageEntryVersion{0, "1.0", "1"}, 1},
+		{PackageEntryVersion{0, "1.10", "1"}, PackageEntryVersion{0, "1.9", "1"}, 1},
+		{PackageEntryVersion{0, "1.0a", "1"}, PackageEntryVersion{0, "1.0", "1"}, 1},
+		{PackageEntryVersion{0, "1.0", "1"}, PackageEntryVersion{0, "1.0a", "1"}, -1},
+		{PackageEntryVersion{0, "1.0.1", "1"}, PackageEntryVersion{0, "1.0a", "1"}, 1},
+		{PackageEntryVersion{0, "1.0~rc1", "1"}, PackageEntryVersion{0, "1.0", "1"}, -1},
+		{PackageEntryVersion{0, "1.01", "1"}, PackageEntryVersion{0, "1.1", "1"}, 0},
+
+		// epoch is dominant
+		{PackageEntryVersion{1, "2.0", "1"}, PackageEntryVersion{0, "2.0", "1"}, 1},
+		{PackageEntryVersion{1, "2.0", "1"}, PackageEntryVersion{0, "3.0", "9"}, 1},
+		{PackageEntryVersion{0, "10.0", "1"}, PackageEntryVersion{2, "1.0", "1"}, -1},
+	}
+
+	for _, test := range tests {
+		a := PackageEntry{PackageName: "foo", Versions: test.a}
+		b := PackageEntry{PackageName: "foo", Versions: test.b}
+		if got := CompareEVR(&a, &b); got != test.want {
+			t.Errorf("Expected CompareEVR(%v, %v) to be %d, got %d", a, b, test.want, got)
+		}
+	}
+}
+
+func TestPackageEntryString(t *testing.T) {
+	p := PackageEntry{
+		PackageName: "foo",
+		Arch:        "x86_64",
+		Versions:    PackageEntryVersion{Version: "2.0", Release: "1"},
+	}
+
+	if s := p.String(); s != "foo-2.0-1.x86_64" {
+		t.Errorf("Expected foo-2.0-1.x86_64, got %s", s)
+	}
+
+	p.Versions.Epoch = 1
+	if s := p.String(); s != "foo-1:2.0-1.x86_64" {
+		t.Errorf("Expected foo-1:2.0-1.x86_64, got %s", s)
+	}
+}
@@ -0,0 +1,72 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// aria2ChecksumTypes are the names used by aria2 for the checksum types of
+// repository metadata.
+var aria2ChecksumTypes = map[string]string{
+	"md5":    "md5",
+	"sha":    "sha-1",
+	"sha1":   "sha-1",
+	"sha224": "sha-224",
+	"sha256": "sha-256",
+	"sha384": "sha-384",
+	"sha512": "sha-512",
+}
+
+// ExportURLs writes the URL from which Sync would download each package
+// selected by the repo's filter rules to the given io.Writer, one per line, so
+// that the packages may be downloaded by an external download manager such as
+// wget or aria2. The repo metadata is cached to the given cache directory, but
+// no package is downloaded.
+//
+// If ExportChecksums is set, the URLs are written as an aria2 input file, with
+// the filename and checksum of each package given as options on the lines
+// following its URL, so that aria2 validates each package as it is downloaded.
+func (c *Repo) ExportURLs(cachedir string, w io.Writer) error {
+	repocache, err := c.CacheLocal(cachedir)
+	if err != nil {
+		return err
+	}
+	defer repocache.Close()
+
+	packages, err := newSyncRun(c).selectPackages(repocache, "")
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	baseurl := c.repoURL(repocache.baseURL())
+	for _, p := range packages {
+		url, err := c.packageURL(p, baseurl)
+		if err != nil {
+			return c.wrapErr(err, "exporting URL of package %v", p)
+		}
+		fmt.Fprintln(bw, url)
+
+		if c.ExportChecksums {
+			sum, err := p.Checksum()
+			if err != nil {
+				return c.wrapErr(err, "reading checksum of package %v", p)
+			}
+
+			typ, ok := aria2ChecksumTypes[strings.ToLower(p.ChecksumType())]
+			if !ok {
+				return c.wrapErr(fmt.Errorf("Unsupported checksum type: %s", p.ChecksumType()), "exporting checksum of package %v", p)
+			}
+
+			fmt.Fprintf(bw, "  out=%s\n  checksum=%s=%s\n", p.filename(), typ, sum)
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return c.wrapErr(err, "writing URLs")
+	}
+
+	return nil
+}
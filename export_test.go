@@ -0,0 +1,95 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExportURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := []byte(`<metadata packages="3">`)
+	for _, name := range []string{"foo", "bar", "baz"} {
+		content := []byte(name + " package")
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		primary = append(primary, []byte(`<package type="rpm">
+  <name>`+name+`</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">`+checksumBytes(t, content).Hash+`</checksum>
+  <size package="11" installed="11" archive="11"/>
+  <location href="Packages/`+name+`-1.0-1.x86_64.rpm"/>
+</package>`)...)
+	}
+	primary = append(primary, []byte(`</metadata>`)...)
+	writeTestRepodata(t, upstream, 1, primary)
+
+	// the metadata is preserved so that the sync completes without createrepo
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 2, primary)
+
+	// record the package URLs resolved by Sync
+	requested := make([]string, 0)
+	repo := NewRepo()
+	repo.ID = "test"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.Exclude = []string{"baz"}
+	repo.PreserveRepodata = true
+	repo.URLRewriteFunc = func(rawurl string) (string, error) {
+		if strings.HasSuffix(rawurl, ".rpm") {
+			requested = append(requested, rawurl)
+		}
+		return rawurl, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err := repo.ExportURLs(filepath.Join(dir, "cache"), buf); err != nil {
+		t.Fatalf("Error exporting URLs: %v", err)
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(packagedir, "*.rpm")); len(matches) != 0 {
+		t.Errorf("Expected no package to be downloaded by ExportURLs, got %v", matches)
+	}
+
+	requested = requested[:0]
+
+	if _, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+
+	exported := strings.Fields(buf.String())
+	sort.Strings(exported)
+	sort.Strings(requested)
+	if len(exported) != 2 || strings.Join(exported, "\n") != strings.Join(requested, "\n") {
+		t.Errorf("Expected exported URLs to match the URLs requested by Sync\nexported: %v\nrequested: %v", exported, requested)
+	}
+
+	// checksums are exported as aria2 options
+	repo.ExportChecksums = true
+	buf.Reset()
+	if err := repo.ExportURLs(filepath.Join(dir, "cache"), buf); err != nil {
+		t.Fatalf("Error exporting URLs with checksums: %v", err)
+	}
+
+	expected := repo.BaseURL + "/Packages/foo-1.0-1.x86_64.rpm\n  out=foo-1.0-1.x86_64.rpm\n  checksum=sha-256=" + checksumBytes(t, []byte("foo package")).Hash + "\n"
+	if !strings.HasPrefix(buf.String(), expected) {
+		t.Errorf("Expected aria2 input file starting with:\n%s\ngot:\n%s", expected, buf)
+	}
+}
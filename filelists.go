@@ -0,0 +1,221 @@
+package yum
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// XML namespaces of filelists.xml and other.xml files.
+const (
+	filelistsXMLNS = "http://linux.duke.edu/metadata/filelists"
+	otherXMLNS     = "http://linux.duke.edu/metadata/other"
+)
+
+// filelistsXMLPackage is the element of a filelists.xml file written by
+// createrepo which lists the files of a package.
+type filelistsXMLPackage struct {
+	XMLName xml.Name            `xml:"package"`
+	Pkgid   string              `xml:"pkgid,attr"`
+	Name    string              `xml:"name,attr"`
+	Arch    string              `xml:"arch,attr"`
+	Version PackageEntryVersion `xml:"version"`
+	Files   []filelistsXMLFile  `xml:"file"`
+}
+
+// filelistsXMLFile is a file of a package in a filelists.xml file.
+type filelistsXMLFile struct {
+	Type string `xml:"type,attr,omitempty"`
+	Path string `xml:",chardata"`
+}
+
+// otherXMLPackage is the element of an other.xml file written by createrepo
+// which lists the changelog entries of a package.
+type otherXMLPackage struct {
+	XMLName    xml.Name            `xml:"package"`
+	Pkgid      string              `xml:"pkgid,attr"`
+	Name       string              `xml:"name,attr"`
+	Arch       string              `xml:"arch,attr"`
+	Version    PackageEntryVersion `xml:"version"`
+	Changelogs []otherXMLChangelog `xml:"changelog"`
+}
+
+// otherXMLChangelog is a changelog entry of a package in an other.xml file.
+type otherXMLChangelog struct {
+	Author string `xml:"author,attr"`
+	Date   int64  `xml:"date,attr"`
+	Text   string `xml:",chardata"`
+}
+
+// newFilelistsXMLPackage returns the entry in a filelists.xml file of the
+// package with the given primary.xml entry and contents.
+func newFilelistsXMLPackage(p *primaryXMLPackage, contents *rpmPackageContents) *filelistsXMLPackage {
+	e := &filelistsXMLPackage{Pkgid: p.Checksum.Hash, Name: p.Name, Arch: p.Arch, Version: p.Version}
+	for _, f := range contents.Files {
+		e.Files = append(e.Files, filelistsXMLFile{Type: f.Type, Path: f.Path})
+	}
+
+	return e
+}
+
+// newOtherXMLPackage returns the entry in an other.xml file of the package
+// with the given primary.xml entry and contents. As with createrepo, the
+// changelog entries are listed oldest first.
+func newOtherXMLPackage(p *primaryXMLPackage, contents *rpmPackageContents) *otherXMLPackage {
+	e := &otherXMLPackage{Pkgid: p.Checksum.Hash, Name: p.Name, Arch: p.Arch, Version: p.Version}
+	for i := len(contents.Changelogs) - 1; i >= 0; i-- {
+		c := contents.Changelogs[i]
+		e.Changelogs = append(e.Changelogs, otherXMLChangelog{Author: c.Author, Date: c.Date, Text: c.Text})
+	}
+
+	return e
+}
+
+// createFilelistsXML creates a writer of the filelists.xml file at the given
+// path.
+func createFilelistsXML(path string) (*metadataXMLWriter, error) {
+	return createMetadataXML(path, "filelists", fmt.Sprintf(`xmlns="%s"`, filelistsXMLNS))
+}
+
+// createOtherXML creates a writer of the other.xml file at the given path.
+func createOtherXML(path string) (*metadataXMLWriter, error) {
+	return createMetadataXML(path, "otherdata", fmt.Sprintf(`xmlns="%s"`, otherXMLNS))
+}
+
+// Queries to create the filelists_db and other_db schemas, as written by
+// createrepo.
+const (
+	sqlCreateFilelistsTables = `CREATE TABLE db_info (dbversion INTEGER, checksum TEXT);
+CREATE TABLE packages ( pkgKey INTEGER PRIMARY KEY, pkgId TEXT);
+CREATE TABLE filelist ( pkgKey INTEGER, dirname TEXT, filenames TEXT, filetypes TEXT);
+CREATE INDEX keyfile ON filelist (pkgKey);
+CREATE INDEX pkgId ON packages (pkgId);
+CREATE INDEX dirnames ON filelist (dirname);
+CREATE TRIGGER remove_filelist AFTER DELETE ON packages  BEGIN    DELETE FROM filelist WHERE pkgKey = old.pkgKey;  END;`
+
+	sqlCreateOtherTables = `CREATE TABLE db_info (dbversion INTEGER, checksum TEXT);
+CREATE TABLE packages ( pkgKey INTEGER PRIMARY KEY, pkgId TEXT);
+CREATE TABLE changelog ( pkgKey INTEGER, author TEXT, date INTEGER, changelog TEXT);
+CREATE INDEX keychange ON changelog (pkgKey);
+CREATE INDEX pkgId ON packages (pkgId);
+CREATE TRIGGER remove_changelogs AFTER DELETE ON packages  BEGIN    DELETE FROM changelog WHERE pkgKey = old.pkgKey;  END;`
+
+	sqlInsertDetailsPackage = `INSERT INTO packages(pkgId) VALUES (?);`
+	sqlInsertFilelist       = `INSERT INTO filelist(pkgKey, dirname, filenames, filetypes) VALUES (?, ?, ?, ?);`
+	sqlInsertChangelog      = `INSERT INTO changelog(pkgKey, author, date, changelog) VALUES (?, ?, ?, ?);`
+)
+
+// detailsDatabase is a filelists_db or other_db SQLite database which is
+// written by createrepo in a single transaction.
+type detailsDatabase struct {
+	db *sql.DB
+	tx *sql.Tx
+}
+
+// createDetailsDB initializes a new SQLite database on disk with the given
+// schema and begins the transaction in which its packages are inserted. Any
+// existing path is deleted.
+func createDetailsDB(path, schema string) (*detailsDatabase, error) {
+	os.Remove(path)
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating %s: %v", path, err)
+	}
+
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error creating tables of %s: %v", path, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &detailsDatabase{db: db, tx: tx}, nil
+}
+
+// insertPackage inserts the package with the given pkgid and returns its key.
+func (c *detailsDatabase) insertPackage(pkgid string) (int64, error) {
+	res, err := c.tx.Exec(sqlInsertDetailsPackage, pkgid)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.LastInsertId()
+}
+
+// InsertFiles inserts the given package of a filelists.xml file into a
+// filelists_db database. Each row lists the '/' separated names and the types
+// of the files in one directory of the package, in which 'f' is a file, 'd' a
+// directory and 'g' a ghost file.
+func (c *detailsDatabase) InsertFiles(p *filelistsXMLPackage) error {
+	key, err := c.insertPackage(p.Pkgid)
+	if err != nil {
+		return err
+	}
+
+	dirs := make([]string, 0)
+	names := make(map[string][]string)
+	types := make(map[string]string)
+	for _, f := range p.Files {
+		dir, name := path.Split(f.Path)
+		if _, ok := names[dir]; !ok {
+			dirs = append(dirs, dir)
+		}
+		names[dir] = append(names[dir], name)
+
+		switch f.Type {
+		case "dir":
+			types[dir] += "d"
+		case "ghost":
+			types[dir] += "g"
+		default:
+			types[dir] += "f"
+		}
+	}
+
+	for _, dir := range dirs {
+		dirname := dir
+		if len(dirname) > 1 {
+			dirname = strings.TrimSuffix(dirname, "/")
+		}
+
+		if _, err := c.tx.Exec(sqlInsertFilelist, key, dirname, strings.Join(names[dir], "/"), types[dir]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertChangelogs inserts the given package of an other.xml file into an
+// other_db database.
+func (c *detailsDatabase) InsertChangelogs(p *otherXMLPackage) error {
+	key, err := c.insertPackage(p.Pkgid)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range p.Changelogs {
+		if _, err := c.tx.Exec(sqlInsertChangelog, key, e.Author, e.Date, e.Text); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close commits the inserted packages and closes the database.
+func (c *detailsDatabase) Close() error {
+	err := c.tx.Commit()
+	if dbErr := c.db.Close(); err == nil {
+		err = dbErr
+	}
+
+	return err
+}
@@ -0,0 +1,180 @@
+package yum
+
+import (
+	"encoding/binary"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHeaderStrings returns a header entry for the given string array tag.
+func testHeaderStrings(tag uint32, values ...string) rpmHeaderEntry {
+	return rpmHeaderEntry{Tag: tag, Type: rpmTypeStringArray, Count: uint32(len(values)), Data: []byte(strings.Join(values, "\x00") + "\x00")}
+}
+
+// testHeaderInts returns a header entry for the given 16-bit or 32-bit integer
+// array tag.
+func testHeaderInts(tag uint32, bits int, values ...uint32) rpmHeaderEntry {
+	e := rpmHeaderEntry{Tag: tag, Type: rpmTypeInt32, Count: uint32(len(values)), Data: make([]byte, bits/8*len(values))}
+	for i, v := range values {
+		if bits == 16 {
+			e.Type = rpmTypeInt16
+			binary.BigEndian.PutUint16(e.Data[2*i:], uint16(v))
+		} else {
+			binary.BigEndian.PutUint32(e.Data[4*i:], v)
+		}
+	}
+
+	return e
+}
+
+func TestReadPackageContents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "foo-1.0-1.x86_64.rpm")
+	writeTestPackage(t, path, nil, []rpmHeaderEntry{
+		testHeaderString(1000, "foo"),
+		testHeaderStrings(rpmTagDirnames, "/usr/bin/", "/usr/share/", "/var/log/"),
+		testHeaderInts(rpmTagDirIndexes, 32, 0, 1, 2),
+		testHeaderStrings(rpmTagBasenames, "foo", "foo", "foo.log"),
+		testHeaderInts(rpmTagFileModes, 16, 0100755, 040755, 0100644),
+		testHeaderInts(rpmTagFileFlags, 32, 0, 0, rpmFileGhost),
+		testHeaderInts(rpmTagChangelogTime, 32, 1600000000, 1500000000),
+		testHeaderStrings(rpmTagChangelogName, "Jo Bloggs <jo@example.com> - 1.0-1", "Jo Bloggs <jo@example.com> - 0.9-1"),
+		testHeaderStrings(rpmTagChangelogText, "- Update to 1.0", "- Initial package"),
+	}, nil)
+
+	contents, err := readPackageContents(path)
+	if err != nil {
+		t.Fatalf("Error reading package contents: %v", err)
+	}
+
+	expected := &rpmPackageContents{
+		Files: []rpmPackageFile{
+			{Path: "/usr/bin/foo"},
+			{Path: "/usr/share/foo", Type: "dir"},
+			{Path: "/var/log/foo.log", Type: "ghost"},
+		},
+		Changelogs: []rpmChangelog{
+			{Author: "Jo Bloggs <jo@example.com> - 1.0-1", Date: 1600000000, Text: "- Update to 1.0"},
+			{Author: "Jo Bloggs <jo@example.com> - 0.9-1", Date: 1500000000, Text: "- Initial package"},
+		},
+	}
+	if !reflect.DeepEqual(contents, expected) {
+		t.Errorf("Expected package contents %+v, got %+v", expected, contents)
+	}
+
+	// older packages list the full path of each file
+	writeTestPackage(t, path, nil, []rpmHeaderEntry{
+		testHeaderString(1000, "foo"),
+		testHeaderStrings(rpmTagOldFilenames, "/usr/bin/foo"),
+	}, nil)
+
+	if contents, err = readPackageContents(path); err != nil || len(contents.Files) != 1 || contents.Files[0].Path != "/usr/bin/foo" || len(contents.Changelogs) != 0 {
+		t.Errorf("Unexpected contents of package with old filenames: %+v: %v", contents, err)
+	}
+}
+
+func TestFilelistsXMLWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &primaryXMLPackage{
+		Name:     "foo",
+		Arch:     "x86_64",
+		Version:  PackageEntryVersion{Epoch: 1, Version: "1.0", Release: "1"},
+		Checksum: PackageEntryChecksum{Type: "sha256", Pkgid: "YES", Hash: "abc"},
+	}
+	contents := &rpmPackageContents{
+		Files: []rpmPackageFile{{Path: "/usr/bin/foo"}, {Path: "/usr/share/foo", Type: "dir"}},
+		Changelogs: []rpmChangelog{
+			{Author: "Jo Bloggs - 1.0-1", Date: 1600000000, Text: "- Update to 1.0"},
+			{Author: "Jo Bloggs - 0.9-1", Date: 1500000000, Text: "- Initial package"},
+		},
+	}
+
+	filelists, err := createFilelistsXML(filepath.Join(dir, "filelists.xml"))
+	if err != nil {
+		t.Fatalf("Error creating filelists.xml: %v", err)
+	}
+
+	other, err := createOtherXML(filepath.Join(dir, "other.xml"))
+	if err != nil {
+		t.Fatalf("Error creating other.xml: %v", err)
+	}
+
+	if err := filelists.Write(newFilelistsXMLPackage(p, contents)); err != nil {
+		t.Fatalf("Error writing filelists.xml: %v", err)
+	}
+
+	if err := other.Write(newOtherXMLPackage(p, contents)); err != nil {
+		t.Fatalf("Error writing other.xml: %v", err)
+	}
+
+	for _, w := range []*metadataXMLWriter{filelists, other} {
+		if err := w.Close(); err != nil {
+			t.Fatalf("Error closing %s: %v", w.path, err)
+		}
+	}
+
+	// files are read back as from upstream filelists
+	f, err := os.Open(filepath.Join(dir, "filelists.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	files, err := readFilelists(f)
+	if err != nil {
+		t.Fatalf("Error reading filelists.xml: %v", err)
+	}
+
+	if expected := []string{"/usr/bin/foo", "/usr/share/foo"}; !reflect.DeepEqual(files["abc"], expected) {
+		t.Errorf("Expected files %v in filelists.xml, got %v", expected, files["abc"])
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "filelists.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), `<filelists xmlns="`+filelistsXMLNS+`" packages="1">`) || !strings.Contains(string(b), `<file type="dir">/usr/share/foo</file>`) {
+		t.Errorf("Unexpected filelists.xml:\n%s", b)
+	}
+
+	// changelog entries are listed oldest first
+	b, err = ioutil.ReadFile(filepath.Join(dir, "other.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md := struct {
+		Packages []otherXMLPackage `xml:"package"`
+	}{}
+	if err := xml.Unmarshal(b, &md); err != nil {
+		t.Fatalf("Error reading other.xml: %v", err)
+	}
+
+	if len(md.Packages) != 1 || md.Packages[0].Pkgid != "abc" || md.Packages[0].Version != p.Version {
+		t.Fatalf("Unexpected packages in other.xml: %+v", md.Packages)
+	}
+
+	expected := []otherXMLChangelog{
+		{Author: "Jo Bloggs - 0.9-1", Date: 1500000000, Text: "- Initial package"},
+		{Author: "Jo Bloggs - 1.0-1", Date: 1600000000, Text: "- Update to 1.0"},
+	}
+	if !reflect.DeepEqual(md.Packages[0].Changelogs, expected) {
+		t.Errorf("Expected changelog entries %+v, got %+v", expected, md.Packages[0].Changelogs)
+	}
+}
@@ -0,0 +1,75 @@
+package yum
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// pathDevice returns the ID of the device of the filesystem of the given path.
+// It may be replaced by tests.
+var pathDevice = fileDevice
+
+// existingPath returns the given path or, if it does not exist yet, its
+// nearest parent directory which does, on whose filesystem the path would be
+// created.
+func existingPath(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// sameFilesystem returns true if the given paths, or the directories in which
+// they would be created, are on the same filesystem, so that files may be
+// renamed or hardlinked from one to the other.
+func sameFilesystem(a, b string) (bool, error) {
+	da, err := pathDevice(existingPath(a))
+	if err != nil {
+		return false, err
+	}
+
+	db, err := pathDevice(existingPath(b))
+	if err != nil {
+		return false, err
+	}
+
+	return da == db, nil
+}
+
+// checkFilesystems validates, before any package is downloaded, that the
+// given package directory is on the same filesystem as the other directories
+// of the repo with which it shares files. Staged packages are renamed into the
+// package directory, so StagingDir must be on the same filesystem, or the sync
+// fails with an ErrCrossDevice error. Packages in a file:// upstream
+// repository on another filesystem cannot be hardlinked, so they are copied
+// instead. If the filesystems cannot be compared, they are not checked.
+func (c *Repo) checkFilesystems(packagedir string) error {
+	if c.StagingDir != "" {
+		same, err := sameFilesystem(c.StagingDir, packagedir)
+		if err != nil {
+			Dprintf("Error comparing filesystems of %s and %s: %v\n", c.StagingDir, packagedir, err)
+		} else if !same {
+			return c.wrapErr(newError(ErrCrossDevice, "Staging directory %s is on a different filesystem than %s, so staged packages cannot be moved into place", c.StagingDir, packagedir), "checking staging directory")
+		}
+	}
+
+	if isFileURL(c.BaseURL) {
+		upstream := fileURLPath(c.BaseURL)
+		same, err := sameFilesystem(upstream, packagedir)
+		if err != nil {
+			Dprintf("Error comparing filesystems of %s and %s: %v\n", upstream, packagedir, err)
+		} else if !same {
+			Printf("Upstream repository %s is on a different filesystem than %s, packages will be copied rather than hardlinked\n", upstream, packagedir)
+		}
+	}
+
+	return nil
+}
@@ -2,16 +2,109 @@ package yum
 
 import (
 	"fmt"
-	"github.com/cavaliercoder/go-rpm"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"code.cloudfoundry.org/bytefmt"
 )
 
+// matchPackage returns true if the name or the full name of the given package
+// matches any of the given shell patterns, such as "kernel*".
+func matchPackage(p *PackageEntry, patterns []string) bool {
+	return matchPattern(p, patterns) != ""
+}
+
+// matchPattern returns the first of the given shell patterns which matches the
+// name or the full name of the given package, or an empty string.
+func matchPattern(p *PackageEntry, patterns []string) string {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, p.Name()); ok {
+			return pattern
+		}
+
+		if ok, _ := path.Match(pattern, p.String()); ok {
+			return pattern
+		}
+	}
+
+	return ""
+}
+
+// excludePackage returns a reason if the given package is excluded by the
+// repo's IncludePackages and Exclude patterns or by the exclude option of the
+// main section of the Yumfile or .repo file which defined the repo. Packages
+// matching the repo's IncludePackages patterns are included regardless of the
+// global excludes. Otherwise, an empty string is returned.
+func excludePackage(repo *Repo, p *PackageEntry) string {
+	if len(repo.IncludePackages) > 0 {
+		if !matchPackage(p, repo.IncludePackages) {
+			return "not matched by includepkgs"
+		}
+	} else if pattern := matchPattern(p, repo.globalExclude); pattern != "" {
+		return fmt.Sprintf("excluded globally by pattern %s", pattern)
+	}
+
+	if pattern := matchPattern(p, repo.Exclude); pattern != "" {
+		return fmt.Sprintf("excluded by pattern %s", pattern)
+	}
+
+	return ""
+}
+
+// packageRegexp compiles the given regular expression for matching package
+// names. An empty expression returns nil. An invalid expression, which Validate
+// reports, matches nothing.
+func packageRegexp(expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		Errorf(err, "Error compiling regular expression %s", expr)
+		return regexp.MustCompile(`$^`)
+	}
+
+	return re
+}
+
+// matchRegexp returns true if the given regular expression matches the name
+// or the full name of the given package.
+func matchRegexp(re *regexp.Regexp, p *PackageEntry) bool {
+	return re.MatchString(p.Name()) || re.MatchString(p.String())
+}
+
+// splitPatterns splits a list of package patterns separated by whitespace or
+// commas, as given for the exclude and includepkgs options of a .repo file.
+func splitPatterns(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
 // FilterPackages returns a list of packages filtered according the repo's
-// settings.
+// settings. If the repo has an Architecture, noarch packages are kept along
+// with packages of that architecture, and src packages are kept only if
+// IncludeSources is set. Only one package of each NEVRA which is listed more
+// than once is kept, as per dedupPackages. If the repo has a FilterAuditFunc,
+// it is called for every package with the rule which decided whether the
+// package was kept.
 func FilterPackages(repo *Repo, packages PackageEntries) PackageEntries {
-	newest := make(map[string]*PackageEntry, 0)
+	audit := func(p PackageEntry, kept bool, reason string) {
+		if repo.FilterAuditFunc != nil {
+			repo.FilterAuditFunc(p, kept, reason)
+		}
+	}
+
+	// keep one package of each NEVRA which is listed more than once
+	packages, _ = dedupPackages(packages, audit)
 
 	// calculate which packages are the latest
 	if repo.NewOnly {
+		newest := make(map[string]*PackageEntry, 0)
 		for i, p := range packages {
 			// index on name and architecture
 			id := fmt.Sprintf("%s.%s", p.Name(), p.Architecture())
@@ -19,7 +112,7 @@ func FilterPackages(repo *Repo, packages PackageEntries) PackageEntries {
 			// lookup previous index
 			if n, ok := newest[id]; ok {
 				// compare version with previous index
-				if 1 == rpm.VersionCompare(rpm.PackageVersion(&p), rpm.PackageVersion(n)) {
+				if 1 == CompareEVR(&p, n) {
 					newest[id] = &packages[i]
 				}
 			} else {
@@ -29,42 +122,241 @@ func FilterPackages(repo *Repo, packages PackageEntries) PackageEntries {
 		}
 
 		// replace packages with only the latest packages
-		i := 0
-		packages = make(PackageEntries, len(newest))
-		for _, p := range newest {
-			packages[i] = *p
-			i++
+		latest := make(PackageEntries, 0, len(newest))
+		for i, p := range packages {
+			n := newest[fmt.Sprintf("%s.%s", p.Name(), p.Architecture())]
+			if n == &packages[i] {
+				latest = append(latest, p)
+			} else {
+				audit(p, false, fmt.Sprintf("superseded by %v", n))
+			}
 		}
+		packages = latest
 	}
 
 	// filter the package list
+	include := packageRegexp(repo.IncludeRegex)
+	exclude := packageRegexp(repo.ExcludeRegex)
 	filtered := make(PackageEntries, 0)
 	for _, p := range packages {
-		include := true
+		// filter by package name
+		reason := excludePackage(repo, &p)
+
+		// filter by regular expression
+		if reason == "" && include != nil && !matchRegexp(include, &p) {
+			reason = fmt.Sprintf("not matched by regular expression %s", repo.IncludeRegex)
+		}
+
+		if reason == "" && exclude != nil && matchRegexp(exclude, &p) {
+			reason = fmt.Sprintf("excluded by regular expression %s", repo.ExcludeRegex)
+		}
 
 		// filter by architecture
-		if repo.Architecture != "" {
-			if p.Architecture() != repo.Architecture {
-				include = false
+		if reason == "" && repo.Architecture != "" {
+			if !matchArchitecture(repo, p.Architecture()) {
+				reason = fmt.Sprintf("architecture %s does not match %s", p.Architecture(), repo.Architecture)
 			}
 		}
 
-		// filter by minimum build date
-		if !repo.MinDate.IsZero() {
-			if p.BuildTime().Before(repo.MinDate) {
-				include = false
-			}
+		// filter by build date
+		if reason == "" {
+			reason = matchDate(repo, p.BuildTime())
 		}
 
-		// filter by maximum build date
-		if !repo.MaxDate.IsZero() {
-			if p.BuildTime().After(repo.MaxDate) {
-				include = false
-			}
+		// filter by package size
+		if reason == "" && repo.MaxPackageSize > 0 && uint64(p.PackageSize()) > repo.MaxPackageSize {
+			reason = fmt.Sprintf("package size %s exceeds maximum %s", bytefmt.ByteSize(uint64(p.PackageSize())), bytefmt.ByteSize(repo.MaxPackageSize))
+		}
+
+		// filter by license
+		if reason == "" {
+			reason = matchLicense(repo, &p)
 		}
 
 		// append to output
-		if include {
+		if reason == "" {
+			audit(p, true, "matched all filters")
+			filtered = append(filtered, p)
+		} else {
+			audit(p, false, reason)
+		}
+	}
+
+	return filtered
+}
+
+// duplicatePackages returns the indexes of the packages of each NEVRA which
+// is listed more than once in the given packages, such as by a broken
+// upstream repository which lists the same package at several locations.
+func duplicatePackages(packages PackageEntries) map[string][]int {
+	indexes := make(map[string][]int, len(packages))
+	for i, p := range packages {
+		nevra := p.NEVRA()
+		indexes[nevra] = append(indexes[nevra], i)
+	}
+
+	for nevra, i := range indexes {
+		if len(i) == 1 {
+			delete(indexes, nevra)
+		}
+	}
+
+	return indexes
+}
+
+// dedupPackages returns the given packages with only one package of each
+// NEVRA, so that duplicates are not downloaded to the same file, and a
+// description of each duplicated NEVRA. Of the packages with the same NEVRA,
+// the package with the first location and then checksum is kept, whatever the
+// order in which they are listed. Each discarded package is passed to the
+// given audit function.
+func dedupPackages(packages PackageEntries, audit func(p PackageEntry, kept bool, reason string)) (PackageEntries, []string) {
+	duplicates := duplicatePackages(packages)
+	if len(duplicates) == 0 {
+		return packages, nil
+	}
+
+	nevras := make([]string, 0, len(duplicates))
+	for nevra := range duplicates {
+		nevras = append(nevras, nevra)
+	}
+	sort.Strings(nevras)
+
+	kept := make(map[string]int, len(duplicates))
+	described := make([]string, 0, len(nevras))
+	for _, nevra := range nevras {
+		indexes := duplicates[nevra]
+		keep := indexes[0]
+		for _, i := range indexes[1:] {
+			a, b := &packages[i], &packages[keep]
+			if a.LocationHref() < b.LocationHref() || (a.LocationHref() == b.LocationHref() && a.Checksums.Hash < b.Checksums.Hash) {
+				keep = i
+			}
+		}
+		kept[nevra] = keep
+
+		described = append(described, fmt.Sprintf("Package %s is listed %d times in the upstream repository metadata, using %s", nevra, len(indexes), packages[keep].LocationHref()))
+	}
+
+	deduped := make(PackageEntries, 0, len(packages))
+	for i, p := range packages {
+		if keep, ok := kept[p.NEVRA()]; ok && keep != i {
+			audit(p, false, fmt.Sprintf("duplicate of %s at %s", p.NEVRA(), packages[keep].LocationHref()))
+			continue
+		}
+		deduped = append(deduped, p)
+	}
+
+	return deduped, described
+}
+
+// matchDate returns the reason a package built at the given time is excluded
+// by the repo's MinDate or MaxDate, or an empty string if it is not. Packages
+// built up to DateSkewTolerance outside the window are kept. The dates are
+// given in UTC in the reason.
+func matchDate(repo *Repo, built time.Time) string {
+	if !repo.MinDate.IsZero() {
+		min := repo.MinDate.UTC()
+		if built.Before(min.Add(-repo.DateSkewTolerance)) {
+			return fmt.Sprintf("built before %s", min.Format(time.RFC3339))
+		}
+	}
+
+	if !repo.MaxDate.IsZero() {
+		max := repo.MaxDate.UTC()
+		if built.After(max.Add(repo.DateSkewTolerance)) {
+			return fmt.Sprintf("built after %s", max.Format(time.RFC3339))
+		}
+	}
+
+	return ""
+}
+
+// matchArchitecture returns true if packages of the given architecture are
+// kept for the repo's Architecture. Architecture independent noarch packages
+// are always kept, as are src packages if IncludeSources is set.
+func matchArchitecture(repo *Repo, arch string) bool {
+	switch arch {
+	case repo.Architecture, "noarch":
+		return true
+
+	case "src":
+		return repo.IncludeSources
+	}
+
+	return false
+}
+
+// FilterNewerThanLocal returns only the packages which were built after the
+// newest of the given packages that is already present in the given list of
+// local files. Gaps in the local package set are not backfilled.
+func FilterNewerThanLocal(packages PackageEntries, files []os.FileInfo) PackageEntries {
+	local := make(map[string]bool, len(files))
+	for _, fi := range files {
+		local[fi.Name()] = true
+	}
+
+	// find the newest local package
+	var newest time.Time
+	for _, p := range packages {
+		if local[p.filename()] && p.BuildTime().After(newest) {
+			newest = p.BuildTime()
+		}
+	}
+
+	if newest.IsZero() {
+		return packages
+	}
+
+	Dprintf("Newest local package was built at %v\n", newest)
+	filtered := make(PackageEntries, 0)
+	for _, p := range packages {
+		if p.BuildTime().After(newest) {
+			filtered = append(filtered, p)
+		}
+	}
+
+	return filtered
+}
+
+// FilterModifiedSince returns only the packages which may have changed since
+// the sync which wrote the given manifest. Packages listed in the manifest
+// with the same location and checksum, which are present in the given list of
+// local files with the same size and whose package file was not modified
+// upstream after the manifest was created, are omitted so they need not be
+// validated again. Other packages, such as those added by a change of filters,
+// are kept whenever they were modified.
+func FilterModifiedSince(packages PackageEntries, manifest *SyncManifest, files []os.FileInfo) PackageEntries {
+	sizes := make(map[string]int64, len(files))
+	for _, fi := range files {
+		sizes[fi.Name()] = fi.Size()
+	}
+
+	synced := make(map[string]string, len(manifest.Packages))
+	for _, mp := range manifest.Packages {
+		synced[mp.Location] = mp.Checksum
+	}
+
+	Dprintf("Selecting packages modified since %v\n", manifest.Created)
+	filtered := make(PackageEntries, 0)
+	for _, p := range packages {
+		sum, _ := p.Checksum()
+		size, ok := sizes[p.filename()]
+		if ok && size == p.PackageSize() && synced[p.LocationHref()] == sum && !p.FileTime().After(manifest.Created) {
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered
+}
+
+// FilterPackagesByName returns only the packages with one of the given names.
+func FilterPackagesByName(packages PackageEntries, names map[string]bool) PackageEntries {
+	filtered := make(PackageEntries, 0)
+	for _, p := range packages {
+		if names[p.Name()] {
 			filtered = append(filtered, p)
 		}
 	}
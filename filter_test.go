@@ -0,0 +1,506 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPackage returns a PackageEntry for tests.
+func newTestPackage(name, version, arch string, buildtime int64) PackageEntry {
+	p := PackageEntry{
+		PackageName: name,
+		Arch:        arch,
+	}
+
+	p.Versions.Version = version
+	p.Versions.Release = "1"
+	p.Time.Build = buildtime
+	p.Location.Href = "Packages/" + p.String() + ".rpm"
+	return p
+}
+
+func TestFilterNewerThanLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packages := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", 100),
+		newTestPackage("foo", "1.1", "x86_64", 200),
+		newTestPackage("bar", "1.0", "x86_64", 150),
+		newTestPackage("foo", "1.2", "x86_64", 300),
+	}
+
+	// nothing local yet
+	if filtered := FilterNewerThanLocal(packages, nil); len(filtered) != len(packages) {
+		t.Errorf("Expected all %d packages with no local packages, got %d", len(packages), len(filtered))
+	}
+
+	// foo-1.1 is the newest local package
+	for _, p := range packages[:2] {
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(p.LocationHref())), nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered := FilterNewerThanLocal(packages, files)
+	if len(filtered) != 1 || filtered[0].String() != "foo-1.2-1.x86_64" {
+		t.Errorf("Expected only foo-1.2-1.x86_64, got %v", filtered)
+	}
+}
+
+func TestFilterGlobalExclude(t *testing.T) {
+	packages := PackageEntries{
+		newTestPackage("kernel", "3.10.0", "x86_64", 0),
+		newTestPackage("kernel-headers", "3.10.0", "x86_64", 0),
+		newTestPackage("bash", "4.2.46", "x86_64", 0),
+		newTestPackage("zsh", "5.0.2", "x86_64", 0),
+	}
+
+	names := func(packages PackageEntries) string {
+		s := make([]string, 0)
+		for _, p := range packages {
+			s = append(s, p.Name())
+		}
+		return strings.Join(s, " ")
+	}
+
+	// global exclude combined with a repo exclude
+	repo := NewRepo()
+	repo.globalExclude = []string{"kernel*"}
+	repo.Exclude = []string{"zsh"}
+	if s := names(FilterPackages(repo, packages)); s != "bash" {
+		t.Errorf("Expected only bash, got: %s", s)
+	}
+
+	// repo includes override the global exclude
+	repo = NewRepo()
+	repo.globalExclude = []string{"kernel*"}
+	repo.IncludePackages = []string{"kernel", "bash"}
+	if s := names(FilterPackages(repo, packages)); s != "kernel bash" {
+		t.Errorf("Expected kernel and bash, got: %s", s)
+	}
+
+	// repo excludes still apply to included packages
+	repo.Exclude = []string{"*-headers-*.x86_64", "bash"}
+	if s := names(FilterPackages(repo, packages)); s != "kernel" {
+		t.Errorf("Expected only kernel, got: %s", s)
+	}
+}
+
+func TestFilterAuditFunc(t *testing.T) {
+	packages := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", 100),
+		newTestPackage("foo", "1.1", "x86_64", 200),
+		newTestPackage("bar", "1.0", "i686", 200),
+		newTestPackage("baz", "1.0", "x86_64", 50),
+		newTestPackage("qux", "1.0", "x86_64", 200),
+	}
+
+	reasons := make(map[string]string)
+	repo := NewRepo()
+	repo.NewOnly = true
+	repo.Architecture = "x86_64"
+	repo.MinDate = time.Unix(75, 0)
+	repo.Exclude = []string{"qu*"}
+	repo.FilterAuditFunc = func(p PackageEntry, kept bool, reason string) {
+		if _, ok := reasons[p.String()]; ok {
+			t.Errorf("Package %v was audited more than once", p)
+		}
+
+		if kept {
+			reason = "kept: " + reason
+		}
+		reasons[p.String()] = reason
+	}
+
+	filtered := FilterPackages(repo, packages)
+	if len(filtered) != 1 {
+		t.Errorf("Expected 1 package, got %v", filtered)
+	}
+
+	expect := map[string]string{
+		"foo-1.0-1.x86_64": "superseded by foo-1.1-1.x86_64",
+		"foo-1.1-1.x86_64": "kept: matched all filters",
+		"bar-1.0-1.i686":   "architecture i686 does not match x86_64",
+		"baz-1.0-1.x86_64": "built before",
+		"qux-1.0-1.x86_64": "excluded by pattern qu*",
+	}
+
+	if len(reasons) != len(expect) {
+		t.Errorf("Expected %d audited packages, got %d", len(expect), len(reasons))
+	}
+
+	for name, want := range expect {
+		if got := reasons[name]; !strings.HasPrefix(got, want) {
+			t.Errorf("Expected reason for %s to be '%s', got '%s'", name, want, got)
+		}
+	}
+}
+
+func TestFilterRegexp(t *testing.T) {
+	packages := PackageEntries{
+		newTestPackage("kernel", "4.18", "x86_64", 100),
+		newTestPackage("kernel-debuginfo", "4.18", "x86_64", 100),
+		newTestPackage("glibc", "2.28", "x86_64", 100),
+	}
+
+	repo := NewRepo()
+	repo.IncludeRegex = "^kernel"
+	repo.ExcludeRegex = "-debuginfo$"
+	filtered := FilterPackages(repo, packages)
+	if len(filtered) != 1 || filtered[0].Name() != "kernel" {
+		t.Errorf("Expected only kernel, got %v", filtered)
+	}
+
+	// invalid expressions match nothing
+	repo.IncludeRegex = "^(kernel"
+	repo.ExcludeRegex = ""
+	if filtered := FilterPackages(repo, packages); len(filtered) != 0 {
+		t.Errorf("Expected no packages for invalid regular expression, got %v", filtered)
+	}
+}
+
+func TestFilterArchitecture(t *testing.T) {
+	packages := PackageEntries{
+		newTestPackage("bash", "4.4", "x86_64", 100),
+		newTestPackage("glibc", "2.28", "i686", 100),
+		newTestPackage("tzdata", "2020a", "noarch", 100),
+		newTestPackage("bash", "4.4", "src", 100),
+	}
+
+	repo := NewRepo()
+	repo.Architecture = "x86_64"
+	filtered := FilterPackages(repo, packages)
+	if len(filtered) != 2 || filtered[0].String() != "bash-4.4-1.x86_64" || filtered[1].String() != "tzdata-2020a-1.noarch" {
+		t.Errorf("Expected x86_64 and noarch packages, got %v", filtered)
+	}
+
+	repo.IncludeSources = true
+	filtered = FilterPackages(repo, packages)
+	if len(filtered) != 3 || filtered[2].String() != "bash-4.4-1.src" {
+		t.Errorf("Expected x86_64, noarch and src packages, got %v", filtered)
+	}
+}
+
+func TestFilterDateSkewTolerance(t *testing.T) {
+	// the window is given in a time zone other than UTC
+	zone := time.FixedZone("UTC+10", 10*60*60)
+	min := time.Date(2020, 5, 1, 10, 0, 0, 0, zone)
+	max := time.Date(2020, 5, 31, 10, 0, 0, 0, zone)
+
+	packages := PackageEntries{
+		newTestPackage("early", "1.0", "x86_64", min.Unix()-60),
+		newTestPackage("skewed-early", "1.0", "x86_64", min.Unix()-3),
+		newTestPackage("first", "1.0", "x86_64", min.Unix()),
+		newTestPackage("last", "1.0", "x86_64", max.Unix()),
+		newTestPackage("skewed-late", "1.0", "x86_64", max.Unix()+3),
+		newTestPackage("late", "1.0", "x86_64", max.Unix()+60),
+	}
+
+	for _, test := range []struct {
+		tolerance time.Duration
+		expected  []string
+	}{
+		{0, []string{"first", "last"}},
+		{5 * time.Second, []string{"skewed-early", "first", "last", "skewed-late"}},
+	} {
+		repo := NewRepo()
+		repo.MinDate = min
+		repo.MaxDate = max
+		repo.DateSkewTolerance = test.tolerance
+
+		names := make([]string, 0)
+		for _, p := range FilterPackages(repo, packages) {
+			names = append(names, p.Name())
+		}
+
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected %v with tolerance %v, got %v", test.expected, test.tolerance, names)
+		}
+	}
+
+	// exclusions are reported in UTC
+	if reason := matchDate(&Repo{MinDate: min}, min.Add(-time.Second)); reason != "built before 2020-05-01T00:00:00Z" {
+		t.Errorf("Expected reason in UTC, got '%s'", reason)
+	}
+}
+
+func TestFilterLicenses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the license of a package missing from the metadata is read upstream
+	writeTestPackage(t, filepath.Join(dir, "unlisted-1.0-1.x86_64.rpm"), nil, []rpmHeaderEntry{
+		testHeaderString(1000, "unlisted"),
+		testHeaderString(rpmTagLicense, "MIT"),
+	}, nil)
+
+	newLicensedPackage := func(name, license string) PackageEntry {
+		p := newTestPackage(name, "1.0", "x86_64", 0)
+		p.Format.License = license
+		p.Location.Href = p.filename()
+		return p
+	}
+
+	packages := PackageEntries{
+		newLicensedPackage("gpl", "GPLv2+"),
+		newLicensedPackage("mit", "MIT"),
+		newLicensedPackage("dual", "MIT and BSD"),
+		newLicensedPackage("choice", "(GPLv3 or mit)"),
+		newLicensedPackage("unlisted", ""),
+	}
+
+	for _, test := range []struct {
+		exclude  []string
+		include  []string
+		expected []string
+	}{
+		{nil, nil, []string{"gpl", "mit", "dual", "choice", "unlisted"}},
+		{[]string{"GPL*"}, nil, []string{"mit", "dual", "unlisted"}},
+		{nil, []string{"MIT"}, []string{"mit", "unlisted"}},
+		{[]string{"bsd"}, []string{"MIT", "BSD", "GPL*"}, []string{"gpl", "mit", "choice", "unlisted"}},
+	} {
+		repo := NewRepo()
+		repo.BaseURL = "file://" + dir
+		repo.ExcludeLicenses = test.exclude
+		repo.IncludeLicenses = test.include
+
+		names := make([]string, 0)
+		resolved := append(PackageEntries{}, packages...)
+		repo.resolveLicenses(resolved, &RepoCache{Repo: repo, Path: filepath.Join(dir, "cache")}, "")
+		for _, p := range FilterPackages(repo, resolved) {
+			names = append(names, p.Name())
+		}
+
+		if strings.Join(names, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("Expected %v with exclude %v and include %v, got %v", test.expected, test.exclude, test.include, names)
+		}
+	}
+
+	// packages whose license cannot be read are excluded by IncludeLicenses
+	repo := NewRepo()
+	repo.BaseURL = "file://" + filepath.Join(dir, "missing")
+	repo.IncludeLicenses = []string{"MIT"}
+	resolved := append(PackageEntries{}, packages...)
+	repo.resolveLicenses(resolved, &RepoCache{Repo: repo, Path: filepath.Join(dir, "empty")}, "")
+	if reason := matchLicense(repo, &resolved[4]); reason != "license unknown" {
+		t.Errorf("Expected unknown license to be excluded, got '%s'", reason)
+	}
+
+	// licenses are read from local packages, and cached, instead of upstream
+	if err := os.MkdirAll(filepath.Join(dir, "local"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(filepath.Join(dir, "unlisted-1.0-1.x86_64.rpm"), filepath.Join(dir, "local", "unlisted-1.0-1.x86_64.rpm")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, packagedir := range []string{filepath.Join(dir, "local"), ""} {
+		resolved := append(PackageEntries{}, packages...)
+		repo.resolveLicenses(resolved, &RepoCache{Repo: repo, Path: filepath.Join(dir, "local-cache")}, packagedir)
+		if license := resolved[4].License(); license != "MIT" {
+			t.Errorf("Expected license MIT of package in %s, got '%s'", packagedir, license)
+		}
+	}
+
+	// FilterPackages reads no packages
+	if packages[4].License() != "" {
+		t.Errorf("Expected license of given packages not to be modified")
+	}
+}
+
+func TestLicenseTerms(t *testing.T) {
+	for license, expected := range map[string][]string{
+		"GPLv2+ and (MIT or BSD)":                         {"GPLv2+", "MIT", "BSD"},
+		"GPL-2.0-or-later AND MIT":                        {"GPL-2.0-or-later", "MIT"},
+		"GPLv2+ with exceptions":                          {"GPLv2+"},
+		"GPL-2.0-only WITH Classpath-exception-2.0":       {"GPL-2.0-only"},
+		"(GPL-2.0 WITH Linux-syscall-note) OR MIT":        {"GPL-2.0", "MIT"},
+		"LGPLv2 with exceptions or GPLv2 with exceptions": {"LGPLv2", "GPLv2"},
+	} {
+		if terms := licenseTerms(license); !reflect.DeepEqual(terms, expected) {
+			t.Errorf("Expected licenses %v in %s, got %v", expected, license, terms)
+		}
+	}
+}
+
+func TestFilterMaxPackageSize(t *testing.T) {
+	repos, _, err := readRepoFile(strings.NewReader(`[base]
+baseurl=http://mirror.centos.org/centos/7/os/x86_64/
+maxpkgsize=500M
+`), "test.repo")
+	if err != nil {
+		t.Fatalf("Error reading repo file: %v", err)
+	}
+
+	repo := repos[0]
+	if repo.MaxPackageSize != 500<<20 {
+		t.Fatalf("Expected maxpkgsize of 500M, got %d", repo.MaxPackageSize)
+	}
+
+	small := newTestPackage("bash", "4.4", "x86_64", 0)
+	small.Size.Package = 500 << 20
+	large := newTestPackage("game-data", "1.0", "noarch", 0)
+	large.Size.Package = 500<<20 + 1
+
+	// oversized packages are reported through the FilterAuditFunc only
+	defer func(l *log.Logger) { logger = l }(logger)
+	buf := &bytes.Buffer{}
+	logger = log.New(buf, "", 0)
+
+	reasons := make([]string, 0)
+	repo.FilterAuditFunc = func(p PackageEntry, kept bool, reason string) {
+		if !kept {
+			reasons = append(reasons, reason)
+		}
+	}
+
+	filtered := FilterPackages(repo, PackageEntries{small, large})
+	if len(filtered) != 1 || filtered[0].Name() != "bash" {
+		t.Errorf("Expected package over the maximum size to be excluded, got %v", filtered)
+	}
+
+	if len(reasons) != 1 || !strings.HasPrefix(reasons[0], "package size ") || buf.Len() != 0 {
+		t.Errorf("Expected oversized package to be audited but not logged, got %v and log '%s'", reasons, buf.String())
+	}
+
+	for value, expected := range map[string]uint64{"1024": 1024, "2G": 2 << 30, "1.5K": 1536} {
+		if size, err := parseSize(value); err != nil || size != expected {
+			t.Errorf("Expected size %d for %s, got %d: %v", expected, value, size, err)
+		}
+	}
+
+	if _, err := parseSize("large"); err == nil {
+		t.Errorf("Expected an error for an invalid size")
+	}
+}
+
+func TestFilterDuplicatePackages(t *testing.T) {
+	defer func(l *log.Logger) { logger = l }(logger)
+	buf := &bytes.Buffer{}
+	logger = log.New(buf, "", 0)
+
+	newDuplicate := func(href, sum string) PackageEntry {
+		p := newTestPackage("bash", "4.4", "x86_64", 0)
+		p.Location.Href = href
+		p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: sum}
+		return p
+	}
+
+	packages := PackageEntries{
+		newDuplicate("Packages/b/bash-4.4-1.x86_64.rpm", "bbbb"),
+		newTestPackage("zsh", "5.0", "x86_64", 0),
+		newDuplicate("Packages/a/bash-4.4-1.x86_64.rpm", "aaaa"),
+	}
+
+	// the same package is kept whatever the order of the duplicates
+	for _, order := range []PackageEntries{packages, {packages[2], packages[1], packages[0]}} {
+		buf.Reset()
+		repo := NewRepo()
+		discarded := make([]string, 0)
+		repo.FilterAuditFunc = func(p PackageEntry, kept bool, reason string) {
+			if !kept {
+				discarded = append(discarded, p.LocationHref()+": "+reason)
+			}
+		}
+
+		filtered := FilterPackages(repo, order)
+		if len(filtered) != 2 {
+			t.Fatalf("Expected duplicated NEVRA to be deduplicated, got %v", filtered)
+		}
+
+		for _, p := range filtered {
+			if p.Name() == "bash" && p.LocationHref() != "Packages/a/bash-4.4-1.x86_64.rpm" {
+				t.Errorf("Expected the first location of the duplicates, got %s", p.LocationHref())
+			}
+		}
+
+		if len(discarded) != 1 || !strings.HasPrefix(discarded[0], "Packages/b/") || !strings.Contains(discarded[0], "duplicate of") {
+			t.Errorf("Expected the other duplicate to be audited, got %v", discarded)
+		}
+
+		// FilterPackages logs nothing; syncs report the duplicates
+		if buf.Len() != 0 {
+			t.Errorf("Expected no warning from FilterPackages, got: %s", buf)
+		}
+
+		_, duplicates := dedupPackages(order, func(PackageEntry, bool, string) {})
+		if len(duplicates) != 1 || !strings.Contains(duplicates[0], "bash-0:4.4-1.x86_64 is listed 2 times") || !strings.HasSuffix(duplicates[0], "using Packages/a/bash-4.4-1.x86_64.rpm") {
+			t.Errorf("Expected the duplicated NEVRA to be described, got %v", duplicates)
+		}
+	}
+}
+
+func TestFilterModifiedSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	synced := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	newSyncedPackage := func(name string, modified time.Time) PackageEntry {
+		p := newTestPackage(name, "1.0", "x86_64", 0)
+		p.Time.File = modified.Unix()
+		p.Size.Package = int64(len(name))
+		p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: name}
+		return p
+	}
+
+	packages := PackageEntries{
+		newSyncedPackage("unchanged", synced.Add(-time.Hour)),
+		newSyncedPackage("modified", synced.Add(time.Hour)),
+		newSyncedPackage("deleted", synced.Add(-time.Hour)),
+		newSyncedPackage("added", synced.Add(-time.Hour)),
+	}
+
+	// every package but the last was synced, and one was deleted since
+	manifest := &SyncManifest{Created: synced}
+	for _, p := range packages[:3] {
+		manifest.Packages = append(manifest.Packages, ManifestPackage{Name: p.Name(), Checksum: p.Checksums.Hash, Location: p.LocationHref()})
+		if p.Name() != "deleted" {
+			if err := ioutil.WriteFile(filepath.Join(dir, p.filename()), []byte(p.Name()), 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, p := range FilterModifiedSince(packages, manifest, files) {
+		names = append(names, p.Name())
+	}
+
+	if strings.Join(names, ",") != "modified,deleted,added" {
+		t.Errorf("Expected only packages changed since the last sync, got %v", names)
+	}
+
+	// a package whose checksum changed upstream is selected
+	packages[0].Checksums.Hash = "rebuilt"
+	if filtered := FilterModifiedSince(packages[:1], manifest, files); len(filtered) != 1 {
+		t.Errorf("Expected package with a new checksum to be selected, got %v", filtered)
+	}
+}
@@ -1,28 +1,327 @@
 package yum
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/cavaliercoder/go-rpm"
 	"golang.org/x/crypto/openpgp"
+	"io"
+	"io/ioutil"
+	"os"
 	"strings"
+	"time"
 )
 
-// OpenKeyRing returns the GPG keyring for the given gpgkey file.
+// KeyExpiryWarning is the period before a GPG key expires during which a
+// warning is logged each time the key is opened by OpenKeyRing or
+// OpenSigningKey, so that it may be rotated before it expires.
+var KeyExpiryWarning = 30 * 24 * time.Hour
+
+// RejectExpiredKeys causes OpenKeyRing and OpenSigningKey to return an error,
+// rather than log a warning, if a key has expired.
+var RejectExpiredKeys bool
+
+// KeyRingFailure is the cause of a KeyRingError.
+type KeyRingFailure int
+
+const (
+	// KeyRingMissing indicates that the gpgkey file does not exist.
+	KeyRingMissing KeyRingFailure = iota + 1
+
+	// KeyRingUnreadable indicates that the gpgkey file exists but could not
+	// be read, such as for lack of permission or because it is a directory.
+	KeyRingUnreadable
+
+	// KeyRingNotArmored indicates that the gpgkey file is not an ASCII
+	// armored public key block, such as a binary key exported without
+	// --armor.
+	KeyRingNotArmored
+
+	// KeyRingNoKeys indicates that the gpgkey file is ASCII armored but
+	// contains no public key which could be read.
+	KeyRingNoKeys
+)
+
+func (f KeyRingFailure) String() string {
+	switch f {
+	case KeyRingMissing:
+		return "file not found"
+	case KeyRingUnreadable:
+		return "file is not readable"
+	case KeyRingNotArmored:
+		return "file is not an ASCII armored public key"
+	case KeyRingNoKeys:
+		return "file contains no usable public keys"
+	}
+
+	return "unknown failure"
+}
+
+// hint returns advice on how to fix the failure.
+func (f KeyRingFailure) hint() string {
+	switch f {
+	case KeyRingMissing:
+		return "check the gpgkey path of the repo or download the key published by the upstream repository"
+	case KeyRingUnreadable:
+		return "check that gpgkey is a regular file readable by the user running the sync"
+	case KeyRingNotArmored:
+		return "export the key in ASCII armored form with 'gpg --armor --export <key-id>'"
+	case KeyRingNoKeys:
+		return "check that the file contains a PGP PUBLIC KEY BLOCK rather than a private key or signature"
+	}
+
+	return ""
+}
+
+// KeyRingError is returned by OpenKeyRing when a gpgkey file cannot be loaded.
+// It describes the path of the file, the cause of the failure and a hint on
+// how to fix it. It matches ErrKeyRing with errors.Is.
+type KeyRingError struct {
+	// Path is the path of the gpgkey file.
+	Path string
+
+	// Failure is the cause of the error, such as KeyRingMissing.
+	Failure KeyRingFailure
+
+	// Err is the underlying error, or nil.
+	Err error
+}
+
+func (e *KeyRingError) Error() string {
+	s := fmt.Sprintf("%v %s: %v", ErrKeyRing, e.Path, e.Failure)
+	if e.Err != nil {
+		s += fmt.Sprintf(" (%v)", e.Err)
+	}
+
+	return s + "; " + e.Failure.hint()
+}
+
+// Unwrap returns the underlying error.
+func (e *KeyRingError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is ErrKeyRing.
+func (e *KeyRingError) Is(target error) bool {
+	return target == ErrKeyRing
+}
+
+// inlineKeyPath is the Path of a KeyRingError for an inline gpgkey.
+const inlineKeyPath = "(inline gpgkey)"
+
+// isInlineKey returns true if the given gpgkey is an ASCII armored public key
+// block given inline, rather than the path of a file.
+func isInlineKey(gpgkey string) bool {
+	return strings.HasPrefix(strings.TrimSpace(gpgkey), "-----BEGIN "+openpgp.PublicKeyType+"-----")
+}
+
+// parseInlineKey returns the ASCII armored public key block given inline as
+// the multi-line gpgkey option of a Yumfile. Option values lose their blank
+// lines, so the blank line which ends the armor headers, such as Version, is
+// restored.
+func parseInlineKey(value string) string {
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	block := make([]string, 0, len(lines)+1)
+	block = append(block, lines[0])
+
+	i := 1
+	for ; i < len(lines) && strings.Contains(lines[i], ": "); i++ {
+		block = append(block, lines[i])
+	}
+	block = append(block, "")
+	block = append(block, lines[i:]...)
+
+	return strings.Join(block, "\n") + "\n"
+}
+
+// OpenKeyRing returns the GPG keyring for the given gpgkey file, which must
+// contain one or more ASCII armored public keys. The gpgkey may also be an
+// ASCII armored public key block given inline. If the keyring cannot be
+// loaded, a *KeyRingError is returned.
 func OpenKeyRing(path string) (openpgp.KeyRing, error) {
 	// check gpgkey is specified
 	if path == "" {
 		return nil, fmt.Errorf("gpgkey not specified")
 	}
 
+	var b []byte
+	if isInlineKey(path) {
+		b, path = []byte(path), inlineKeyPath
+	} else {
+		// trim file:// prefix
+		if strings.HasPrefix(strings.ToLower(path), "file://") {
+			path = path[7:]
+		}
+
+		var err error
+		b, err = ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return nil, &KeyRingError{Path: path, Failure: KeyRingMissing}
+		} else if err != nil {
+			return nil, &KeyRingError{Path: path, Failure: KeyRingUnreadable, Err: err}
+		}
+	}
+
+	if !bytes.Contains(b, []byte("-----BEGIN "+openpgp.PublicKeyType+"-----")) {
+		return nil, &KeyRingError{Path: path, Failure: KeyRingNotArmored}
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return nil, &KeyRingError{Path: path, Failure: KeyRingNoKeys, Err: err}
+	}
+
+	if len(entities) == 0 {
+		return nil, &KeyRingError{Path: path, Failure: KeyRingNoKeys}
+	}
+
+	if err := checkKeyExpiry(entities, path, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+// keyExpiry returns the time at which the given key expires, according to the
+// latest expiry of its identities, or the zero time if it does not expire.
+func keyExpiry(e *openpgp.Entity) time.Time {
+	var expiry time.Time
+	for _, id := range e.Identities {
+		sig := id.SelfSignature
+		if sig == nil {
+			continue
+		}
+
+		if sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+			return time.Time{}
+		}
+
+		t := e.PrimaryKey.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+		if t.After(expiry) {
+			expiry = t
+		}
+	}
+
+	return expiry
+}
+
+// checkKeyExpiry logs a warning for each of the given keys, read from the
+// given path, which has expired or expires within KeyExpiryWarning of the
+// given time. If RejectExpiredKeys is set, an error is returned for the first
+// expired key instead.
+func checkKeyExpiry(entities openpgp.EntityList, path string, now time.Time) error {
+	for _, e := range entities {
+		expiry := keyExpiry(e)
+		if expiry.IsZero() {
+			continue
+		}
+
+		id := e.PrimaryKey.KeyIdString()
+		if !expiry.After(now) {
+			if RejectExpiredKeys {
+				return fmt.Errorf("GPG key %s in %s expired on %s", id, path, expiry.Format("2006-01-02"))
+			}
+
+			Warnf("GPG key %s in %s expired on %s; signatures made with it may fail verification\n", id, path, expiry.Format("2006-01-02"))
+		} else if expiry.Sub(now) < KeyExpiryWarning {
+			Warnf("GPG key %s in %s expires on %s\n", id, path, expiry.Format("2006-01-02"))
+		}
+	}
+
+	return nil
+}
+
+// gpgCheckFile validates the GPG signature of the given package file using the
+// given keyring. If the package is not signed, an ErrPackageUnsigned error is
+// returned. If the signature is invalid, an ErrGPGFailed error is returned.
+func gpgCheckFile(path string, keyring openpgp.KeyRing) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	signed, err := isSigned(f)
+	if err != nil {
+		return newError(ErrGPGFailed, "GPG check failed for %s: %w", path, err)
+	}
+
+	if !signed {
+		return newError(ErrPackageUnsigned, "GPG check failed for %s: package is not signed", path)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := rpm.GPGCheck(f, keyring); err != nil {
+		return newError(ErrGPGFailed, "GPG check failed for %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// gpgCheck validates the GPG signature of the given package file according to
+// the repo's settings. Unsigned packages are permitted if AllowUnsigned is
+// set, but packages with a bad signature are always rejected. Packages which
+// passed validation and are unchanged since are not validated again.
+func (c *syncRun) gpgCheck(path string, keyring openpgp.KeyRing) error {
+	err := c.gpgCache.Check(path, func(path string) error { return gpgCheckFile(path, keyring) })
+	if c.AllowUnsigned && errors.Is(err, ErrPackageUnsigned) {
+		Dprintf("Permitting unsigned package %s\n", path)
+		return nil
+	}
+
+	return err
+}
+
+// OpenSigningKey returns the first private key found in the given ASCII
+// armored secret keyring. If the key is encrypted, it is decrypted with the
+// given passphrase.
+func OpenSigningKey(path, passphrase string) (*openpgp.Entity, error) {
 	// trim file:// prefix
 	if strings.HasPrefix(strings.ToLower(path), "file://") {
 		path = path[7:]
 	}
 
-	keyring, err := rpm.KeyRingFromFile(path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading signing key: %v", err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading GPG key: %v", err)
+		return nil, fmt.Errorf("Error decoding signing key: %v", err)
+	}
+
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+
+		// decrypt private keys
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("Error decrypting signing key: %v", err)
+			}
+		}
+
+		for _, subkey := range e.Subkeys {
+			if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+				if err := subkey.PrivateKey.Decrypt([]byte(passphrase)); err != nil {
+					return nil, fmt.Errorf("Error decrypting signing subkey: %v", err)
+				}
+			}
+		}
+
+		if err := checkKeyExpiry(openpgp.EntityList{e}, path, time.Now()); err != nil {
+			return nil, err
+		}
+
+		return e, nil
 	}
 
-	return keyring, nil
+	return nil, fmt.Errorf("No private key found in %s", path)
 }
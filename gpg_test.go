@@ -0,0 +1,427 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestSigningKey generates a new signing key and writes it, ASCII
+// armored, to a file in the given directory.
+func writeTestSigningKey(t *testing.T, dir string) (*openpgp.Entity, string) {
+	e, err := openpgp.NewEntity("go-yum test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Error generating signing key: %v", err)
+	}
+
+	path := filepath.Join(dir, "signkey.asc")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Error creating signing key file: %v", err)
+	}
+	defer f.Close()
+
+	w, err := armor.Encode(f, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatalf("Error encoding signing key: %v", err)
+	}
+
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatalf("Error serializing signing key: %v", err)
+	}
+
+	w.Close()
+	return e, path
+}
+
+func TestSignRepoMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, keypath := writeTestSigningKey(t, dir)
+
+	signer, err := OpenSigningKey(keypath, "")
+	if err != nil {
+		t.Fatalf("Error opening signing key: %v", err)
+	}
+
+	repomd := filepath.Join(dir, "repomd.xml")
+	if err := ioutil.WriteFile(repomd, []byte("<repomd></repomd>"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signRepoMetadata(repomd, signer); err != nil {
+		t.Fatalf("Error signing repo metadata: %v", err)
+	}
+
+	// verify against the public key
+	signed, err := os.Open(repomd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signed.Close()
+
+	sig, err := os.Open(repomd + ".asc")
+	if err != nil {
+		t.Fatalf("Error opening repo metadata signature: %v", err)
+	}
+	defer sig.Close()
+
+	if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{e}, signed, sig); err != nil {
+		t.Errorf("Repo metadata signature failed validation: %v", err)
+	}
+}
+
+// writeTestRPM writes a file containing a RPM lead and a signature header with
+// the given tags, but no valid signatures or package header.
+func writeTestRPM(t *testing.T, path string, tags ...int) {
+	buf := &bytes.Buffer{}
+	lead := make([]byte, rpmLeadSize)
+	copy(lead, rpmLeadMagic)
+	buf.Write(lead)
+
+	buf.Write(rpmHeaderMagic)
+	binary.Write(buf, binary.BigEndian, []uint32{0, uint32(len(tags)), 0})
+	for _, tag := range tags {
+		binary.Write(buf, binary.BigEndian, []uint32{uint32(tag), 7, 0, 1})
+	}
+
+	buf.Write(make([]byte, 256))
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGPGCheckUnsigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	unsigned := filepath.Join(dir, "unsigned.rpm")
+	writeTestRPM(t, unsigned, 1000, 1004) // size and md5 only
+
+	badsig := filepath.Join(dir, "badsig.rpm")
+	writeTestRPM(t, badsig, 1000, 268, 1004)
+
+	repo := NewRepo()
+	run := newSyncRun(repo)
+	if err := run.gpgCheck(unsigned, openpgp.EntityList{}); !errors.Is(err, ErrPackageUnsigned) {
+		t.Errorf("Expected ErrPackageUnsigned, got: %v", err)
+	}
+
+	if err := run.gpgCheck(badsig, openpgp.EntityList{}); !errors.Is(err, ErrGPGFailed) {
+		t.Errorf("Expected ErrGPGFailed, got: %v", err)
+	}
+
+	// unsigned packages are permitted but bad signatures are not
+	repo.AllowUnsigned = true
+	if err := run.gpgCheck(unsigned, openpgp.EntityList{}); err != nil {
+		t.Errorf("Expected unsigned package to be permitted, got: %v", err)
+	}
+
+	if err := run.gpgCheck(badsig, openpgp.EntityList{}); !errors.Is(err, ErrGPGFailed) {
+		t.Errorf("Expected ErrGPGFailed with AllowUnsigned, got: %v", err)
+	}
+}
+
+func TestGPGCheckSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, keypath := writeTestSigningKey(t, dir)
+	signer, err := OpenSigningKey(keypath, "")
+	if err != nil {
+		t.Fatalf("Error opening signing key: %v", err)
+	}
+
+	otherdir := filepath.Join(dir, "other")
+	if err := os.MkdirAll(otherdir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := writeTestSigningKey(t, otherdir)
+
+	// package signed with a valid signature of the test key
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, 1234)
+	path := filepath.Join(dir, "test-1.0-1.noarch.rpm")
+	writeTestPackage(t, path, []rpmHeaderEntry{
+		{Tag: 1000, Type: rpmTypeInt32, Count: 1, Data: size},
+	}, []rpmHeaderEntry{testHeaderString(1000, "test")}, bytes.Repeat([]byte("payload"), 1024))
+
+	if err := resignPackage(path, signer); err != nil {
+		t.Fatalf("Error signing package: %v", err)
+	}
+
+	repo := NewRepo()
+	repo.GPGCheck = true
+	run := newSyncRun(repo)
+	if err := run.gpgCheck(path, openpgp.EntityList{e}); err != nil {
+		t.Errorf("Expected package signed by a trusted key to pass GPG check, got: %v", err)
+	}
+
+	if err := run.gpgCheck(path, openpgp.EntityList{other}); !errors.Is(err, ErrGPGFailed) {
+		t.Errorf("Expected ErrGPGFailed for a package signed by an untrusted key, got: %v", err)
+	}
+
+	// a downloaded package with a good signature is kept and recorded
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := &SyncReport{Errors: make([]error, 0)}
+	p := newTestPackage("test", "1.0", "noarch", 0)
+	if !run.checkPackage(p, path, p.String(), uint64(fi.Size()), openpgp.EntityList{e}, report) {
+		t.Fatalf("Expected package with a good signature to be accepted: %v", report.Errors)
+	}
+
+	if report.Downloaded != 1 || report.Failed != 0 {
+		t.Errorf("Expected 1 package to be downloaded, got: %+v", report)
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Expected package with a good signature to be kept: %v", err)
+	}
+}
+
+func TestResignPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, keypath := writeTestSigningKey(t, dir)
+	signer, err := OpenSigningKey(keypath, "")
+	if err != nil {
+		t.Fatalf("Error opening signing key: %v", err)
+	}
+
+	// package with an upstream signature, a name and a payload
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, 1234)
+	header := encodeRPMHeader([]rpmHeaderEntry{testHeaderString(1000, "test")}, 0)
+	payload := bytes.Repeat([]byte("payload"), 1024)
+
+	path := filepath.Join(dir, "test-1.0-1.noarch.rpm")
+	writeTestPackage(t, path, []rpmHeaderEntry{
+		{Tag: 1000, Type: rpmTypeInt32, Count: 1, Data: size},
+		{Tag: rpmSigTagPGP, Type: rpmTypeBin, Count: 3, Data: []byte("bad")},
+	}, []rpmHeaderEntry{testHeaderString(1000, "test")}, payload)
+
+	if err := resignPackage(path, signer); err != nil {
+		t.Fatalf("Error re-signing package: %v", err)
+	}
+
+	// read the re-signed package
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(rpmLeadSize, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, raw, err := readRPMHeader(f)
+	if err != nil {
+		t.Fatalf("Error reading re-signed signature header: %v", err)
+	}
+
+	if _, err := f.Seek(int64(rpmSignaturePadding(len(raw))), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	rest, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(rest, append(header, payload...)) {
+		t.Fatalf("Re-signed package header or payload was modified")
+	}
+
+	tags := make(map[uint32][]byte)
+	for _, entry := range entries {
+		tags[entry.Tag] = entry.Data
+	}
+
+	if entries[0].Tag != rpmTagHeaderSignatures {
+		t.Errorf("Expected region tag first in signature header, got: %d", entries[0].Tag)
+	}
+
+	if !bytes.Equal(tags[1000], size) {
+		t.Errorf("Expected size tag to be retained, got: %v", tags[1000])
+	}
+
+	// verify against the public key of the new signing key
+	keyring := openpgp.EntityList{e}
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(header), bytes.NewReader(tags[rpmSigTagRSA])); err != nil {
+		t.Errorf("Re-signed header signature failed validation: %v", err)
+	}
+
+	if _, err := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(rest), bytes.NewReader(tags[rpmSigTagPGP])); err != nil {
+		t.Errorf("Re-signed header and payload signature failed validation: %v", err)
+	}
+}
+
+func TestKeyExpiry(t *testing.T) {
+	defer func(l *log.Logger, reject bool) { logger, RejectExpiredKeys = l, reject }(logger, RejectExpiredKeys)
+	buf := &bytes.Buffer{}
+	logger = log.New(buf, "", 0)
+
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	newKey := func(lifetime time.Duration) *openpgp.Entity {
+		secs := uint32(lifetime / time.Second)
+		return &openpgp.Entity{
+			PrimaryKey: &packet.PublicKey{CreationTime: now.AddDate(-1, 0, 0)},
+			Identities: map[string]*openpgp.Identity{
+				"test": {Name: "test", SelfSignature: &packet.Signature{KeyLifetimeSecs: &secs}},
+			},
+		}
+	}
+
+	year := 365 * 24 * time.Hour
+	expired := newKey(year - 24*time.Hour)
+	expiring := newKey(year + 7*24*time.Hour)
+	valid := newKey(2 * year)
+	forever := newKey(0)
+
+	if err := checkKeyExpiry(openpgp.EntityList{valid, forever}, "RPM-GPG-KEY", now); err != nil || buf.Len() != 0 {
+		t.Errorf("Expected no warning for valid keys, got: %v: %s", err, buf)
+	}
+
+	if err := checkKeyExpiry(openpgp.EntityList{expired}, "RPM-GPG-KEY", now); err != nil || !strings.Contains(buf.String(), "in RPM-GPG-KEY expired on 2020-05-30") {
+		t.Errorf("Expected a warning for an expired key, got: %v: %s", err, buf)
+	}
+
+	buf.Reset()
+	if err := checkKeyExpiry(openpgp.EntityList{expiring}, "RPM-GPG-KEY", now); err != nil || !strings.Contains(buf.String(), "expires on 2020-06-07") {
+		t.Errorf("Expected a warning for an expiring key, got: %v: %s", err, buf)
+	}
+
+	RejectExpiredKeys = true
+	if err := checkKeyExpiry(openpgp.EntityList{expiring, expired}, "RPM-GPG-KEY", now); err == nil || !strings.Contains(err.Error(), "expired on 2020-05-30") {
+		t.Errorf("Expected an error for an expired key, got: %v", err)
+	}
+}
+
+func TestOpenKeyRingErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, test := range []struct {
+		path    string
+		failure KeyRingFailure
+		hint    string
+	}{
+		{filepath.Join(dir, "missing"), KeyRingMissing, "check the gpgkey path"},
+		{dir, KeyRingUnreadable, "readable by the user"},
+		{write("binary", "\x99\x01\x0d\x04binary key"), KeyRingNotArmored, "gpg --armor --export"},
+		{write("empty", "-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n-----END PGP PUBLIC KEY BLOCK-----\n"), KeyRingNoKeys, "PGP PUBLIC KEY BLOCK"},
+	} {
+		_, err := OpenKeyRing("file://" + test.path)
+		if !errors.Is(err, ErrKeyRing) {
+			t.Errorf("Expected ErrKeyRing for %v, got: %v", test.failure, err)
+			continue
+		}
+
+		var kerr *KeyRingError
+		if !errors.As(err, &kerr) || kerr.Failure != test.failure || kerr.Path != test.path {
+			t.Errorf("Expected %v for %s, got: %v", test.failure, test.path, err)
+			continue
+		}
+
+		if msg := err.Error(); !strings.Contains(msg, test.path) || !strings.Contains(msg, test.failure.String()) || !strings.Contains(msg, test.hint) {
+			t.Errorf("Expected message to describe %v with a hint, got: %s", test.failure, msg)
+		}
+	}
+}
+
+func TestInlineKeyRing(t *testing.T) {
+	e, err := openpgp.NewEntity("go-yum test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, map[string]string{"Version": "go-yum test"})
+	if err != nil {
+		t.Fatalf("Error encoding key: %v", err)
+	}
+
+	if err := e.Serialize(w); err != nil {
+		t.Fatalf("Error serializing key: %v", err)
+	}
+	w.Close()
+
+	// the key block is indented as a multi-line option value
+	yumfile := "[base]\nbaseurl=http://mirror.centos.org/centos/7/os/x86_64/\ngpgcheck=1\ngpgkey="
+	yumfile += strings.Replace(strings.TrimSpace(buf.String()), "\n", "\n  ", -1) + "\n"
+
+	repos, err := ParseYumfile(strings.NewReader(yumfile), "/etc/Yumfile")
+	if err != nil {
+		t.Fatalf("Error parsing Yumfile: %v", err)
+	}
+
+	keyring, err := OpenKeyRing(repos[0].GPGKey)
+	if err != nil {
+		t.Fatalf("Error opening inline key: %v", err)
+	}
+
+	if keys := keyring.KeysById(e.PrimaryKey.KeyId); len(keys) != 1 {
+		t.Errorf("Expected inline key %s in keyring, got %d keys", e.PrimaryKey.KeyIdString(), len(keys))
+	}
+
+	// inline keys are not resolved as paths and are written back to the
+	// Yumfile as they are read
+	out := &bytes.Buffer{}
+	for _, opt := range repoOptions(repos[0]) {
+		fmt.Fprintf(out, "%s = %s\n", opt[0], opt[1])
+	}
+
+	again, err := ParseYumfile(strings.NewReader("[base]\n"+out.String()), "/etc/Yumfile")
+	if err != nil {
+		t.Fatalf("Error parsing written Yumfile: %v", err)
+	}
+
+	if again[0].GPGKey != repos[0].GPGKey {
+		t.Errorf("Expected inline key to survive writing the Yumfile, got:\n%s", again[0].GPGKey)
+	}
+
+	// errors do not include the key
+	if _, err := OpenKeyRing("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n-----END PGP PUBLIC KEY BLOCK-----\n"); !errors.Is(err, ErrKeyRing) || !strings.Contains(err.Error(), inlineKeyPath) {
+		t.Errorf("Expected ErrKeyRing for inline key without keys, got: %v", err)
+	}
+}
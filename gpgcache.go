@@ -0,0 +1,210 @@
+package yum
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// gpgCacheFilename is the name of the file in the cache directory of a repo
+// which records the local packages which passed GPG validation, so that each
+// sync need not validate unchanged packages again.
+const gpgCacheFilename = "gpg-verified"
+
+// gpgCache records the path, size and modification time of each package file
+// which passed GPG validation with a keyring. A package is validated again if
+// its file changes in any way, and every package is validated again if the
+// keyring changes.
+//
+// A nil gpgCache records nothing and validates every package.
+type gpgCache struct {
+	path     string
+	keyring  string
+	verified map[string]bool
+}
+
+// keyringFingerprint returns a digest of the fingerprints of every key in the
+// given keyring, or an empty string if the keys of the keyring cannot be
+// listed.
+func keyringFingerprint(keyring openpgp.KeyRing) string {
+	entities, ok := keyring.(openpgp.EntityList)
+	if !ok || len(entities) == 0 {
+		return ""
+	}
+
+	ids := make([]string, 0, len(entities))
+	for _, e := range entities {
+		ids = append(ids, hex.EncodeToString(e.PrimaryKey.Fingerprint[:]))
+		for _, subkey := range e.Subkeys {
+			ids = append(ids, hex.EncodeToString(subkey.PublicKey.Fingerprint[:]))
+		}
+	}
+	sort.Strings(ids)
+
+	sum := sha256.Sum256([]byte(strings.Join(ids, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// openGPGCache reads the GPG cache at the given path, if it exists. Packages
+// recorded with a different keyring than the given keyring are discarded. If
+// the keys of the keyring cannot be listed, nil is returned so that every
+// package is validated.
+func openGPGCache(path string, keyring openpgp.KeyRing) (*gpgCache, error) {
+	fingerprint := keyringFingerprint(keyring)
+	if fingerprint == "" {
+		return nil, nil
+	}
+
+	c := &gpgCache{
+		path:     path,
+		keyring:  fingerprint,
+		verified: make(map[string]bool),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// the first line identifies the keyring
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != fingerprint {
+		Dprintf("GPG keyring changed, validating all packages again\n")
+		return c, scanner.Err()
+	}
+
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			c.verified[line] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// gpgCacheKey returns the line which identifies the given package file in a
+// GPG cache file.
+func gpgCacheKey(path string, fi os.FileInfo) string {
+	return fmt.Sprintf("%d %d %s", fi.Size(), fi.ModTime().UnixNano(), path)
+}
+
+// Check validates the GPG signature of the given package file with the given
+// function, unless the file passed validation and is unchanged since. Files
+// which pass validation are recorded.
+func (c *gpgCache) Check(path string, check func(path string) error) error {
+	if c == nil {
+		return check(path)
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	key := gpgCacheKey(path, fi)
+	if c.verified[key] {
+		Dprintf("Skipping GPG check of unchanged package %s\n", path)
+		return nil
+	}
+
+	if err := check(path); err != nil {
+		return err
+	}
+
+	c.verified[key] = true
+	return nil
+}
+
+// Save writes the cache to its file. Files which have changed or been deleted
+// since they were recorded are discarded.
+func (c *gpgCache) Save() error {
+	if c == nil {
+		return nil
+	}
+
+	lines := make([]string, 0, len(c.verified))
+	for key := range c.verified {
+		fields := strings.SplitN(key, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+
+		fi, err := os.Stat(fields[2])
+		if err != nil || gpgCacheKey(fields[2], fi) != key {
+			continue
+		}
+
+		lines = append(lines, key)
+	}
+	sort.Strings(lines)
+
+	tmp := c.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, c.keyring)
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// gpgCheckLocal validates the GPG signatures of the given packages, which
+// exist in the given package directory, and returns the packages which fail
+// validation. Packages which passed validation in an earlier sync and have not
+// changed since are not validated again. Packages merged from other repos are
+// validated with the GPG keys of the repo which provides them, if it requires
+// it.
+func (c *syncRun) gpgCheckLocal(packages PackageEntries, packagedir string, keyring openpgp.KeyRing) PackageEntries {
+	bad := make(PackageEntries, 0)
+	packages, merged := c.splitMerged(packages)
+	for i, src := range c.merged {
+		if src.run.GPGCheck && len(merged[i]) > 0 {
+			bad = append(bad, src.run.gpgCheckLocal(merged[i], packagedir, src.keyring)...)
+		}
+	}
+
+	for _, p := range packages {
+		path := filepath.Join(packagedir, p.filename())
+		if err := c.gpgCheck(path, keyring); errors.Is(err, ErrGPGFailed) || errors.Is(err, ErrPackageUnsigned) {
+			Errorf(err, "Existing file failed GPG check validation for package %v", p)
+			bad = append(bad, p)
+		} else if err != nil {
+			Errorf(err, "Error reading package %v for GPG check", p)
+		}
+	}
+
+	return bad
+}
@@ -0,0 +1,92 @@
+package yum
+
+import (
+	"errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGPGCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &openpgp.Entity{PrimaryKey: &packet.PublicKey{Fingerprint: [20]byte{1}}}
+	keyring := openpgp.EntityList{e}
+
+	path := filepath.Join(dir, "foo-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(path, []byte("foo package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	checks := 0
+	check := func(string) error {
+		checks++
+		return nil
+	}
+
+	cachepath := filepath.Join(dir, gpgCacheFilename)
+	run := func(keyring openpgp.KeyRing, expected int) {
+		t.Helper()
+		cache, err := openGPGCache(cachepath, keyring)
+		if err != nil {
+			t.Fatalf("Error opening GPG cache: %v", err)
+		}
+
+		if err := cache.Check(path, check); err != nil {
+			t.Fatalf("Unexpected error checking package: %v", err)
+		}
+
+		if err := cache.Save(); err != nil {
+			t.Fatalf("Error saving GPG cache: %v", err)
+		}
+
+		if checks != expected {
+			t.Errorf("Expected %d GPG checks, got %d", expected, checks)
+		}
+	}
+
+	// unchanged packages are only checked by the first sync
+	run(keyring, 1)
+	run(keyring, 1)
+
+	// changed packages are checked again
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	run(keyring, 2)
+	run(keyring, 2)
+
+	// every package is checked again with a new keyring
+	other := &openpgp.Entity{PrimaryKey: &packet.PublicKey{Fingerprint: [20]byte{2}}}
+	run(openpgp.EntityList{e, other}, 3)
+	run(openpgp.EntityList{e, other}, 3)
+
+	// packages which fail validation are not recorded
+	cache, err := openGPGCache(cachepath, keyring)
+	if err != nil {
+		t.Fatalf("Error opening GPG cache: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err := cache.Check(path, func(string) error {
+			checks++
+			return newError(ErrGPGFailed, "GPG check failed for %s", path)
+		})
+		if !errors.Is(err, ErrGPGFailed) {
+			t.Errorf("Expected ErrGPGFailed, got: %v", err)
+		}
+	}
+
+	if checks != 5 {
+		t.Errorf("Expected failed packages to be checked again, got %d GPG checks", checks)
+	}
+}
@@ -1,13 +1,23 @@
 package yum
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/cavaliercoder/grab"
 	"code.cloudfoundry.org/bytefmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -33,8 +43,112 @@ var (
 	TmpYumLogFile   string
 	TmpYumCachePath string
 	DownloadThreads int
+	CacheThreads    int
 )
 
+// DefaultTempDir is the directory in which databases are decompressed for
+// repos which do not set Repo.TempDir. If empty, databases are decompressed
+// into the cache directory.
+var DefaultTempDir string
+
+// defaultCacheThreads is the number of repos cached concurrently by CacheAll
+// if CacheThreads is not set.
+const defaultCacheThreads = 4
+
+// HTTP transport options. These must be set before the first download as the
+// HTTP client is created once and shared by all downloads so connections to
+// each mirror are reused across the many small package requests.
+var (
+	// MaxIdleConnsPerHost is the number of idle connections to each host which
+	// are kept open for reuse. If zero, defaultMaxIdleConnsPerHost is used.
+	MaxIdleConnsPerHost int
+
+	// DisableHTTP2 disables HTTP/2 for HTTPS mirrors.
+	DisableHTTP2 bool
+)
+
+// Version is the version of this package, as sent in the default UserAgent.
+const Version = "1.0.0"
+
+// UserAgent is the User-Agent header sent with every HTTP request for repo
+// metadata and packages, unless a repo overrides it with Repo.UserAgent.
+var UserAgent = "go-yum/" + Version
+
+// defaultMaxIdleConnsPerHost allows every download thread to keep a
+// connection open to the same mirror.
+const defaultMaxIdleConnsPerHost = 16
+
+var (
+	sharedHTTPClient     *http.Client
+	sharedHTTPClientOnce sync.Once
+)
+
+// httpClient returns the HTTP client shared by all downloads, creating it with
+// the configured transport options on first use.
+func httpClient() *http.Client {
+	sharedHTTPClientOnce.Do(func() {
+		sharedHTTPClient = newHTTPClient(MaxIdleConnsPerHost, DisableHTTP2)
+	})
+
+	return sharedHTTPClient
+}
+
+// maxRedirects is the number of redirects which are followed for a single
+// request before it fails with an ErrTooManyRedirects error.
+const maxRedirects = 10
+
+// checkRedirect stops following the redirects of a misconfigured mirror if
+// the given request revisits a URL which was already requested, or if too many
+// redirects have already been followed.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return newError(ErrTooManyRedirects, "Redirect loop detected at %s", req.URL)
+		}
+	}
+
+	if len(via) >= maxRedirects {
+		return newError(ErrTooManyRedirects, "Stopped after %d redirects from %s", len(via), via[0].URL)
+	}
+
+	return nil
+}
+
+// newHTTPClient returns a HTTP client with the given transport options. The
+// client retries requests refused with 429 Too Many Requests and throttles
+// requests to the host which refused them, and retries GET requests which fail
+// with a transient connection error and resumes responses which are cut off,
+// as per resumeTransport.
+func newHTTPClient(maxIdleConnsPerHost int, disableHTTP2 bool) *http.Client {
+	if maxIdleConnsPerHost < 1 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     !disableHTTP2,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if disableHTTP2 {
+		// a non-nil, empty map disables HTTP/2
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+
+	return &http.Client{
+		Transport:     &resumeTransport{transport: &throttleTransport{transport: transport}},
+		CheckRedirect: checkRedirect,
+	}
+}
+
 func InitLogFile() {
 	if LogFilePath == "" {
 		return
@@ -72,8 +186,34 @@ func Logf(category int, format string, a ...interface{}) {
 	logger.Printf("%s %s", cat, fmt.Sprintf(format, a...))
 }
 
-// Printf prints output to STDOUT or the logfile
+// Verbosity is the level of output printed by this package.
+type Verbosity int
+
+const (
+	// VerbosityQuiet prints only errors.
+	VerbosityQuiet Verbosity = iota
+
+	// VerbosityNormal prints errors and progress, but not debug output.
+	VerbosityNormal
+
+	// VerbosityDebug prints errors, progress and debug output.
+	VerbosityDebug
+)
+
+// SetVerbosity sets the level of output printed by Printf, Dprintf and Errorf,
+// such as to silence this package when it is embedded in another program. It
+// sets QuietMode and DebugMode accordingly. Errors are printed at every level.
+func SetVerbosity(level Verbosity) {
+	QuietMode = level <= VerbosityQuiet
+	DebugMode = level >= VerbosityDebug
+}
+
+// Printf prints output to STDOUT or the logfile, unless quiet mode is enabled
 func Printf(format string, a ...interface{}) {
+	if QuietMode {
+		return
+	}
+
 	if logger == nil {
 		fmt.Printf(format, a...)
 	} else {
@@ -81,6 +221,19 @@ func Printf(format string, a ...interface{}) {
 	}
 }
 
+// Warnf prints a warning to log or STDERR, unless quiet mode is enabled
+func Warnf(format string, a ...interface{}) {
+	if QuietMode {
+		return
+	}
+
+	if logger == nil {
+		fmt.Fprintf(os.Stderr, "WARNING: "+format, a...)
+	} else {
+		Logf(LOG_CAT_WARN, format, a...)
+	}
+}
+
 // Errorf prints an error message to log or STDOUT
 func Errorf(err error, format string, a ...interface{}) {
 	if logger == nil {
@@ -105,9 +258,10 @@ func Fatalf(err error, format string, a ...interface{}) {
 	os.Exit(1)
 }
 
-// Dprintf prints verbose output only if debug mode is enabled
+// Dprintf prints verbose output only if debug mode is enabled and quiet mode
+// is not
 func Dprintf(format string, a ...interface{}) {
-	if DebugMode {
+	if DebugMode && !QuietMode {
 		if logger == nil {
 			fmt.Fprintf(os.Stderr, fmt.Sprintf("DEBUG: %s", format), a...)
 		} else {
@@ -117,24 +271,317 @@ func Dprintf(format string, a ...interface{}) {
 }
 
 // URLJoin naively joins paths of a URL to enforce a single '/' separator
-// between each segment.
+// between each segment. Any query string of the first segment, such as a CDN
+// signature, is moved to the end of the joined URL.
 func urljoin(v ...string) string {
 	url := ""
+	query := ""
 
 	for _, s := range v {
 		if url == "" {
 			url = s
+			if i := strings.Index(url, "?"); i >= 0 {
+				url, query = url[:i], url[i:]
+			}
 		} else if s != "" {
 			url = fmt.Sprintf("%s/%s", strings.TrimRight(url, "/"), strings.TrimLeft(s, "/"))
 		}
 	}
 
-	return url
+	return url + query
+}
+
+// isFileURL returns true if the given URL is a file:// URL for a local path.
+func isFileURL(url string) bool {
+	return strings.HasPrefix(strings.ToLower(url), "file://")
+}
+
+// fileURLPath returns the local path of the given file:// URL. A URL with the
+// host localhost, such as file://localhost/srv/repo, refers to a local path and
+// a URL with any other host, such as file://server/share, refers to the UNC
+// path //server/share.
+func fileURLPath(url string) string {
+	path := url[len("file://"):]
+	if !strings.HasPrefix(path, "/") {
+		host := path
+		path = "/"
+		if i := strings.Index(host, "/"); i >= 0 {
+			host, path = host[:i], host[i:]
+		}
+
+		if !strings.EqualFold(host, "localhost") {
+			path = "//" + host + path
+		}
+	}
+
+	// file:///C:/repo refers to the Windows path C:/repo
+	if runtime.GOOS == "windows" && len(path) > 2 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+
+	return filepath.FromSlash(path)
 }
 
-// download transfers multiple file requests simultaneously and sends the
-// responses through the returned channel once each transfer is complete.
-func download(reqs []*grab.Request, workers int) <-chan *grab.Response {
+// headerTransport is a http.RoundTripper which adds the given headers to each
+// request to one of the given hosts. Requests to other hosts, such as
+// redirects to a CDN, are made without the headers. Environment variables in
+// header values, given as $NAME or ${NAME}, are substituted when each request
+// is made so that secrets such as API keys need not be written to a Yumfile.
+type headerTransport struct {
+	transport http.RoundTripper
+	headers   map[string]string
+	hosts     map[string]bool
+}
+
+func (c *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !c.hosts[strings.ToLower(req.URL.Host)] {
+		return c.transport.RoundTrip(req)
+	}
+
+	// a RoundTripper must not modify the given request
+	req = req.Clone(req.Context())
+	for name, value := range c.headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	return c.transport.RoundTrip(req)
+}
+
+// connectionRetries is the number of times a GET request which fails with a
+// transient connection error is retried, and the number of times a response
+// body which is cut off is resumed, by a resumeTransport.
+const connectionRetries = 2
+
+// isTransientError returns true if the given error from a HTTP request or
+// response body is a connection error which may not recur if the request is
+// made again, such as a connection reset by a proxy or a response which ends
+// before its Content-Length.
+func isTransientError(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// resumeTransport is a http.RoundTripper which retries GET and HEAD requests
+// which fail with a transient connection error and resumes response bodies
+// which fail with a transient connection error part way through, by
+// requesting the rest of the response with a Range request. These retries
+// are made within a single transfer, so they are distinct from, and do not
+// count against, the retries of packages from other mirrors.
+//
+// Responses are only resumed if they have an ETag or Last-Modified header,
+// sent with the Range request as If-Range, so that a resource which changed
+// is not spliced onto the start of the old one, and if they were not
+// decompressed by the transport.
+type resumeTransport struct {
+	transport http.RoundTripper
+}
+
+func (c *resumeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests with a body cannot be replayed
+	idempotent := req.Method == "" || req.Method == http.MethodGet || req.Method == http.MethodHead
+	if !idempotent || (req.Body != nil && req.Body != http.NoBody) {
+		return c.transport.RoundTrip(req)
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, err = c.transport.RoundTrip(req)
+		if err == nil || attempt >= connectionRetries || !isTransientError(err) || req.Context().Err() != nil {
+			break
+		}
+		Dprintf("Connection error requesting %s, retrying: %v\n", req.URL, err)
+	}
+
+	if err != nil || req.Method == http.MethodHead || resp.Uncompressed {
+		return resp, err
+	}
+
+	body := &resumableBody{
+		transport: c.transport,
+		req:       req,
+		body:      resp.Body,
+		validator: resp.Header.Get("ETag"),
+	}
+
+	if body.validator == "" || strings.HasPrefix(body.validator, "W/") {
+		body.validator = resp.Header.Get("Last-Modified")
+	}
+
+	if body.validator == "" {
+		return resp, nil
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+
+	case http.StatusPartialContent:
+		// resume within the range which was served
+		var end int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &body.offset, &end); err != nil {
+			return resp, nil
+		}
+		body.end = strconv.FormatInt(end, 10)
+
+	default:
+		return resp, nil
+	}
+
+	resp.Body = body
+	return resp, nil
+}
+
+// resumableBody is a response body which is resumed by a resumeTransport if
+// it fails with a transient connection error.
+type resumableBody struct {
+	transport http.RoundTripper
+	req       *http.Request
+	body      io.ReadCloser
+	validator string
+	retries   int
+
+	// offset is the offset of the next byte of the resource to be read and
+	// end is the offset of the last byte of the requested range, if any
+	offset int64
+	end    string
+}
+
+func (c *resumableBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	c.offset += int64(n)
+	for err != nil && err != io.EOF && isTransientError(err) && c.retries < connectionRetries && c.req.Context().Err() == nil {
+		c.retries++
+		Dprintf("Connection error reading %s at byte %d, resuming: %v\n", c.req.URL, c.offset, err)
+		if rerr := c.resume(); rerr != nil {
+			Dprintf("Error resuming %s: %v\n", c.req.URL, rerr)
+			return n, err
+		}
+
+		// return what was read before the error, if anything
+		if n > 0 {
+			return n, nil
+		}
+
+		n, err = c.body.Read(p)
+		c.offset += int64(n)
+	}
+
+	return n, err
+}
+
+// resume requests the rest of the response from the next byte to be read.
+func (c *resumableBody) resume() error {
+	req := c.req.Clone(c.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", c.offset, c.end))
+	req.Header.Set("If-Range", c.validator)
+
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", c.offset)) {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return fmt.Errorf("Range request was not resumed at byte %d: %s", c.offset, resp.Status)
+	}
+
+	c.body.Close()
+	c.body = resp.Body
+	return nil
+}
+
+func (c *resumableBody) Close() error {
+	return c.body.Close()
+}
+
+// openURL opens the resource at the given HTTP or file:// URL for reading with
+// the given HTTP client, identifying as the given user agent. The caller must
+// close the returned io.ReadCloser.
+func openURL(client *http.Client, url, useragent string) (io.ReadCloser, error) {
+	if isFileURL(url) {
+		return os.Open(fileURLPath(url))
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", useragent)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// drain the body so the connection may be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Bad response code: %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// copyFile creates a hardlink at dst to the file at src or, if a hardlink
+// cannot be created, copies the file. Any existing file at dst is replaced
+// only once the link or copy is complete, so it is never left partially
+// written. The number of bytes in the file is returned.
+func copyFile(dst, src string) (int64, error) {
+	fi, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := dst + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	if err := os.Link(src, tmp); err == nil {
+		// renaming a link to a file which is already at dst leaves the link
+		if dfi, err := os.Stat(dst); err == nil && os.SameFile(fi, dfi) {
+			return fi.Size(), nil
+		}
+
+		return fi.Size(), os.Rename(tmp, dst)
+	}
+
+	r, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	w, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return 0, err
+	}
+
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	return n, os.Rename(tmp, dst)
+}
+
+// download transfers multiple file requests simultaneously with the given HTTP
+// client, identifying as the given user agent, and sends the responses through
+// the returned channel once each transfer is complete. The progress of each
+// transfer is redrawn on STDOUT unless quiet mode is enabled, while failed
+// transfers are reported with Errorf.
+func download(reqs []*grab.Request, workers int, httpclient *http.Client, useragent string) <-chan *grab.Response {
 	ret := make(chan *grab.Response, workers)
 
 	go func() {
@@ -143,7 +590,10 @@ func download(reqs []*grab.Request, workers int) <-chan *grab.Response {
 		defer ticker.Stop()
 
 		// client to download files
-		respch := grab.DefaultClient.DoBatch(workers, reqs...)
+		client := grab.NewClient()
+		client.HTTPClient = httpclient
+		client.UserAgent = useragent
+		respch := client.DoBatch(workers, reqs...)
 
 		// progress indicators
 		completed := 0
@@ -160,8 +610,10 @@ func download(reqs []*grab.Request, workers int) <-chan *grab.Response {
 				}
 
 			case <-ticker.C:
+				progress := !QuietMode
+
 				// clear lines
-				if inProgress > 0 {
+				if progress && inProgress > 0 {
 					fmt.Printf("\033[%dA\033[K", inProgress)
 				}
 
@@ -170,8 +622,11 @@ func download(reqs []*grab.Request, workers int) <-chan *grab.Response {
 					if resp != nil && resp.IsComplete() {
 						// print final result
 						if resp.Error != nil {
-							fmt.Fprintf(os.Stderr, "Error downloading %s: %v\033[K\n", resp.Request.Label, resp.Error)
-						} else {
+							if progress {
+								fmt.Printf("\033[K")
+							}
+							Errorf(resp.Error, "Error downloading %s", resp.Request.Label)
+						} else if progress {
 							fmt.Printf("Finished %s (%s in %v)\033[K\n", resp.Request.Label, bytefmt.ByteSize(resp.BytesTransferred()), resp.Duration())
 						}
 
@@ -187,7 +642,7 @@ func download(reqs []*grab.Request, workers int) <-chan *grab.Response {
 				// update downloads in progress
 				inProgress = 0
 				for _, resp := range responses {
-					if resp != nil {
+					if resp != nil && progress {
 						inProgress++
 						fmt.Printf("Downloading %s (%d%% of %s)...\033[K\n", resp.Request.Label, int(100*resp.Progress()), bytefmt.ByteSize(resp.Size))
 					}
@@ -0,0 +1,357 @@
+package yum
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/cavaliercoder/grab"
+)
+
+// newConnCountingServer starts a HTTP server which serves a small package
+// body and counts the number of new connections it accepts.
+func newConnCountingServer(conns *int32) *httptest.Server {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("package"))
+	}))
+
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+
+	ts.Start()
+	return ts
+}
+
+func fetch(tb testing.TB, url string) {
+	body, err := openURL(httpClient(), url, UserAgent)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	io.Copy(ioutil.Discard, body)
+	body.Close()
+}
+
+func TestHTTPClientReusesConnections(t *testing.T) {
+	var conns int32
+	ts := newConnCountingServer(&conns)
+	defer ts.Close()
+
+	for i := 0; i < 50; i++ {
+		fetch(t, ts.URL+"/Packages/foo.rpm")
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected 1 connection for 50 requests, got %d", n)
+	}
+}
+
+func BenchmarkHTTPClientConnectionReuse(b *testing.B) {
+	var conns int32
+	ts := newConnCountingServer(&conns)
+	defer ts.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			fetch(b, ts.URL+"/Packages/foo.rpm")
+		}
+	})
+
+	b.ReportMetric(float64(atomic.LoadInt32(&conns)), "conns")
+}
+
+func TestUserAgent(t *testing.T) {
+	agents := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents <- r.Header.Get("User-Agent")
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL
+	c := &RepoCache{Repo: repo, Path: "."}
+
+	// package default
+	c.updateMetadata()
+	if ua := <-agents; ua != "go-yum/"+Version {
+		t.Errorf("Expected User-Agent go-yum/%s, got %s", Version, ua)
+	}
+
+	// repo override
+	repo.UserAgent = "mirror-bot/1.0"
+	c.updateMetadata()
+	if ua := <-agents; ua != "mirror-bot/1.0" {
+		t.Errorf("Expected User-Agent mirror-bot/1.0, got %s", ua)
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var hops int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a/foo.rpm", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hops, 1)
+		http.Redirect(w, r, "/b/foo.rpm", http.StatusFound)
+	})
+	mux.HandleFunc("/b/foo.rpm", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hops, 1)
+		http.Redirect(w, r, "/a/foo.rpm", http.StatusFound)
+	})
+
+	// every redirect is to a new URL
+	mux.HandleFunc("/next/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hops, 1)
+		http.Redirect(w, r, fmt.Sprintf("/next/%d", atomic.LoadInt32(&hops)), http.StatusFound)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	_, err := openURL(httpClient(), ts.URL+"/a/foo.rpm", UserAgent)
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("Expected ErrTooManyRedirects for a redirect loop, got: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&hops); n != 2 {
+		t.Errorf("Expected redirect loop to be detected after 2 requests, got %d", n)
+	}
+
+	atomic.StoreInt32(&hops, 0)
+	_, err = openURL(httpClient(), ts.URL+"/next/0", UserAgent)
+	if !errors.Is(err, ErrTooManyRedirects) {
+		t.Errorf("Expected ErrTooManyRedirects for excessive redirects, got: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&hops); n != maxRedirects {
+		t.Errorf("Expected %d requests before giving up, got %d", maxRedirects, n)
+	}
+}
+
+func TestSetVerbosity(t *testing.T) {
+	defer func(l *log.Logger, quiet, debug bool) {
+		logger, QuietMode, DebugMode = l, quiet, debug
+	}(logger, QuietMode, DebugMode)
+
+	buf := &bytes.Buffer{}
+	logger = log.New(buf, "", 0)
+
+	SetVerbosity(VerbosityQuiet)
+	Dprintf("debug\n")
+	Printf("info\n")
+	Errorf(errors.New("cause"), "error")
+	if s := buf.String(); s != "ERROR error: cause\n" {
+		t.Errorf("Expected only errors in quiet mode, got: %q", s)
+	}
+
+	buf.Reset()
+	SetVerbosity(VerbosityNormal)
+	Dprintf("debug\n")
+	Printf("info\n")
+	if s := buf.String(); s != "INFO info\n" {
+		t.Errorf("Expected no debug output in normal mode, got: %q", s)
+	}
+
+	buf.Reset()
+	SetVerbosity(VerbosityDebug)
+	Dprintf("debug\n")
+	Printf("info\n")
+	if s := buf.String(); s != "DEBUG debug\nINFO info\n" {
+		t.Errorf("Expected debug output in debug mode, got: %q", s)
+	}
+}
+
+func TestDownloadQuiet(t *testing.T) {
+	defer func(l *log.Logger, quiet bool, stdout *os.File) {
+		logger, QuietMode, os.Stdout = l, quiet, stdout
+	}(logger, QuietMode, os.Stdout)
+
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.rpm" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("package"))
+	}))
+	defer ts.Close()
+
+	// capture STDOUT and the log
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	os.Stdout = w
+
+	buf := &bytes.Buffer{}
+	logger = log.New(buf, "", 0)
+	SetVerbosity(VerbosityQuiet)
+
+	reqs := make([]*grab.Request, 0)
+	for _, name := range []string{"foo.rpm", "missing.rpm"} {
+		req, err := grab.NewRequest(ts.URL + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Label = name
+		req.Filename = filepath.Join(dir, name)
+		reqs = append(reqs, req)
+	}
+
+	failed := 0
+	for resp := range download(reqs, 2, httpClient(), UserAgent) {
+		if resp.Error != nil {
+			failed++
+		}
+	}
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if failed != 1 {
+		t.Errorf("Expected 1 failed download, got %d", failed)
+	}
+
+	if len(out) > 0 {
+		t.Errorf("Expected no output in quiet mode, got: %q", out)
+	}
+
+	if s := buf.String(); !strings.Contains(s, "ERROR Error downloading missing.rpm") {
+		t.Errorf("Expected the failed download to be logged as an error, got: %q", s)
+	}
+}
+
+func TestResumeTransport(t *testing.T) {
+	content := bytes.Repeat([]byte("foo package\n"), 10000)
+	modtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	// the first request for each file is reset before or during the response
+	var requests, resets int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if n == 1 {
+			atomic.AddInt32(&resets, 1)
+			switch r.URL.Path {
+			case "/reset.rpm":
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+
+			case "/cut.rpm":
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				w.Header().Set("Last-Modified", modtime.Format(http.TimeFormat))
+				w.Write(content[:len(content)/3])
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+		}
+
+		if r.Header.Get("Range") != "" && r.Header.Get("If-Range") == "" {
+			t.Errorf("Expected resumed request to be conditional")
+		}
+		http.ServeContent(w, r, "foo.rpm", modtime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/reset.rpm", "/cut.rpm"} {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&resets, 0)
+
+		body, err := openURL(newHTTPClient(0, false), ts.URL+path, UserAgent)
+		if err != nil {
+			t.Errorf("Expected %s to be retried, got: %v", path, err)
+			continue
+		}
+
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(b, content) {
+			t.Errorf("Expected %s to be recovered, got %d of %d bytes: %v", path, len(b), len(content), err)
+		}
+
+		if n := atomic.LoadInt32(&requests); n != 2 || atomic.LoadInt32(&resets) != 1 {
+			t.Errorf("Expected %s to be requested once more after a reset, got %d requests", path, n)
+		}
+	}
+}
+
+func TestFileURLPath(t *testing.T) {
+	for url, expected := range map[string]string{
+		"file:///srv/repo":          "/srv/repo",
+		"file://localhost/srv/repo": "/srv/repo",
+		"file://LOCALHOST":          "/",
+		"file://server/share/repo":  "//server/share/repo",
+	} {
+		if path := fileURLPath(url); path != filepath.FromSlash(expected) {
+			t.Errorf("Expected path %s for %s, got %s", expected, url, path)
+		}
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, dst := filepath.Join(dir, "src.rpm"), filepath.Join(dir, "dst.rpm")
+	if err := ioutil.WriteFile(src, []byte("new package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// a missing source does not replace the existing file
+	if err := ioutil.WriteFile(dst, []byte("old package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := copyFile(dst, filepath.Join(dir, "missing.rpm")); err == nil {
+		t.Errorf("Expected error copying a missing file")
+	}
+
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "old package" {
+		t.Errorf("Expected existing file to be kept: %v", err)
+	}
+
+	// the existing file is replaced, and copying again is a no-op
+	for i := 0; i < 2; i++ {
+		n, err := copyFile(dst, src)
+		if err != nil || n != int64(len("new package")) {
+			t.Fatalf("Error copying file: %d, %v", n, err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "new package" {
+		t.Errorf("Expected file to be replaced: %v", err)
+	}
+
+	if _, err := os.Stat(dst + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be removed: %v", err)
+	}
+}
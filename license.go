@@ -0,0 +1,234 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// licenseTerms splits the given license expression, such as
+// "GPLv2+ and (MIT or BSD)" or "GPL-2.0-or-later AND MIT", into the names of
+// its licenses. Exceptions to a license, such as the SPDX exception in
+// "GPL-2.0-only WITH Classpath-exception-2.0" or the "exceptions" of
+// "GPLv2+ with exceptions", are not licenses and are ignored.
+func licenseTerms(license string) []string {
+	fields := strings.FieldsFunc(license, func(r rune) bool {
+		return r == ' ' || r == '(' || r == ')' || r == ','
+	})
+
+	terms := make([]string, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		switch strings.ToLower(fields[i]) {
+		case "and", "or", "exceptions":
+			continue
+
+		case "with":
+			// skip the exception
+			i++
+			continue
+		}
+		terms = append(terms, fields[i])
+	}
+
+	return terms
+}
+
+// matchLicensePattern returns the first of the given glob patterns which the
+// given license name matches, ignoring case, or an empty string.
+func matchLicensePattern(term string, patterns []string) string {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(term)); ok {
+			return pattern
+		}
+	}
+
+	return ""
+}
+
+// matchLicense returns the reason the given package is excluded by the repo's
+// ExcludeLicenses or IncludeLicenses, or an empty string if it is not. A
+// package is excluded if any license in its license expression matches an
+// ExcludeLicenses pattern or, if IncludeLicenses is set, if any license does
+// not match an IncludeLicenses pattern or the package has no license. Licenses
+// missing from the repository metadata must be read by resolveLicenses first.
+func matchLicense(repo *Repo, p *PackageEntry) string {
+	if len(repo.IncludeLicenses) == 0 && len(repo.ExcludeLicenses) == 0 {
+		return ""
+	}
+
+	terms := licenseTerms(p.License())
+	for _, term := range terms {
+		if pattern := matchLicensePattern(term, repo.ExcludeLicenses); pattern != "" {
+			return fmt.Sprintf("license %s excluded by pattern %s", term, pattern)
+		}
+	}
+
+	if len(repo.IncludeLicenses) == 0 {
+		return ""
+	}
+
+	if len(terms) == 0 {
+		return "license unknown"
+	}
+
+	for _, term := range terms {
+		if matchLicensePattern(term, repo.IncludeLicenses) == "" {
+			return fmt.Sprintf("license %s not matched by included licenses", term)
+		}
+	}
+
+	return ""
+}
+
+// licenseCacheFilename is the name of the file in the cache directory of a
+// repo which records the licenses read from the headers of packages whose
+// license is missing from the repository metadata.
+const licenseCacheFilename = "licenses"
+
+// licenseCacheKey returns the key which identifies the given package in a
+// license cache file.
+func licenseCacheKey(p *PackageEntry) string {
+	sum, _ := p.Checksum()
+	return fmt.Sprintf("%s:%s %s", p.ChecksumType(), sum, p.NEVRA())
+}
+
+// readLicenseCache reads the licenses recorded in the license cache file at
+// the given path, if it exists, by licenseCacheKey.
+func readLicenseCache(path string) (map[string]string, error) {
+	licenses := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return licenses, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.SplitN(scanner.Text(), "\t", 2); len(fields) == 2 {
+			licenses[fields[0]] = fields[1]
+		}
+	}
+
+	return licenses, scanner.Err()
+}
+
+// writeLicenseCache writes the given licenses to the license cache file at the
+// given path.
+func writeLicenseCache(path string, licenses map[string]string) error {
+	keys := make([]string, 0, len(licenses))
+	for key := range licenses {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", key, licenses[key])
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// resolveLicenses fills in the license of each of the given packages whose
+// license is missing from the repository metadata, if the repo filters
+// packages by license, so that FilterPackages need not read any package.
+//
+// Licenses are read from the license cache in the directory of the given repo
+// cache or, if a package was not read before, from the header of the package
+// file in the given package directory, if present, or from the BaseURL of the
+// repo cache. The cache is rewritten with the licenses of the given packages
+// only. A package whose license cannot be
+// read is logged and left without a license.
+func (c *Repo) resolveLicenses(packages PackageEntries, repocache *RepoCache, packagedir string) {
+	if len(c.IncludeLicenses) == 0 && len(c.ExcludeLicenses) == 0 {
+		return
+	}
+
+	path := filepath.Join(repocache.Path, licenseCacheFilename)
+	cached, err := readLicenseCache(path)
+	if err != nil {
+		Errorf(err, "Error reading license cache %s", path)
+		cached = make(map[string]string)
+	}
+
+	licenses := make(map[string]string)
+	for i := range packages {
+		p := &packages[i]
+		if p.Format.License != "" {
+			continue
+		}
+
+		key := licenseCacheKey(p)
+		license, ok := cached[key]
+		if !ok {
+			if license, err = c.readLicense(p, repocache.baseURL(), packagedir); err != nil {
+				Errorf(err, "Error reading license of package %v", p)
+				continue
+			}
+		}
+
+		licenses[key] = license
+		p.Format.License = license
+	}
+
+	if err := writeLicenseCache(path, licenses); err != nil {
+		Errorf(err, "Error writing license cache %s", path)
+	}
+}
+
+// readLicense reads the license of the given package from the header of the
+// package file in the given package directory or, if it is not present, in
+// the upstream repository at the given base URL. Only the headers are read, so only the start of
+// the package file is downloaded.
+func (c *Repo) readLicense(p *PackageEntry, baseurl, packagedir string) (string, error) {
+	if packagedir != "" {
+		if f, err := os.Open(filepath.Join(packagedir, p.filename())); err == nil {
+			Dprintf("Reading license of package %v from %s\n", p, f.Name())
+			license, err := readPackageLicense(f)
+			f.Close()
+			if err == nil {
+				return license, nil
+			}
+			Dprintf("Error reading license of local package %v: %v\n", p, err)
+		}
+	}
+
+	url, err := c.packageURL(*p, c.repoURL(baseurl))
+	if err != nil {
+		return "", err
+	}
+
+	Dprintf("Reading license of package %v from %s\n", p, url)
+	body, err := openURL(c.downloadClient(), url, c.userAgent())
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	return readPackageLicense(body)
+}
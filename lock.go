@@ -0,0 +1,54 @@
+package yum
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// lockFilename is the name of the lock file created in a package directory
+// while it is being synchronized, and in a repo cache directory while its
+// metadata is updated or read.
+const lockFilename = ".go-yum.lock"
+
+// dirLock is an advisory lock held on a directory.
+type dirLock struct {
+	f *os.File
+}
+
+// lockDir acquires an exclusive advisory lock on the given directory. If the
+// lock is held by another process and wait is false, an ErrRepoLocked error is
+// returned. Otherwise lockDir blocks until the lock is released.
+func lockDir(path string, wait bool) (*dirLock, error) {
+	return openLock(path, true, wait)
+}
+
+// rlockDir acquires a shared advisory lock on the given directory, blocking
+// until any exclusive lock is released. Any number of shared locks may be held
+// at once, such as by hosts reading a cache directory on a network share.
+func rlockDir(path string) (*dirLock, error) {
+	return openLock(path, false, true)
+}
+
+func openLock(path string, exclusive, wait bool) (*dirLock, error) {
+	f, err := os.OpenFile(filepath.Join(path, lockFilename), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flock(f, exclusive, wait); err != nil {
+		f.Close()
+		return nil, newError(ErrRepoLocked, "Error locking %s: %w", path, err)
+	}
+
+	return &dirLock{f: f}, nil
+}
+
+// Unlock releases the lock.
+func (c *dirLock) Unlock() error {
+	if err := funlock(c.f); err != nil {
+		c.f.Close()
+		return err
+	}
+
+	return c.f.Close()
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package yum
+
+import (
+	"os"
+	"syscall"
+)
+
+func flock(f *os.File, exclusive, wait bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+func funlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+package yum
+
+import (
+	"os"
+)
+
+// Advisory file locks are not supported on Windows. Concurrent syncs of the
+// same package directory or cache directory are not prevented.
+
+func flock(f *os.File, exclusive, wait bool) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
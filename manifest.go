@@ -0,0 +1,226 @@
+package yum
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestFilename is the name of the manifest written to a package directory
+// by Sync.
+const manifestFilename = "sync-manifest.json"
+
+// SyncManifest records the exact set of packages present in a package
+// directory after a sync, and the upstream repository metadata revision they
+// were synchronized from.
+type SyncManifest struct {
+	Repo     string            `json:"repo"`
+	Revision int               `json:"revision"`
+	Created  time.Time         `json:"created"`
+	Packages []ManifestPackage `json:"packages"`
+}
+
+// ManifestPackage is a package listed in a SyncManifest.
+type ManifestPackage struct {
+	Name         string `json:"name"`
+	Epoch        int    `json:"epoch"`
+	Version      string `json:"version"`
+	Release      string `json:"release"`
+	Arch         string `json:"arch"`
+	Checksum     string `json:"checksum"`
+	ChecksumType string `json:"checksum_type"`
+	Location     string `json:"location"`
+	Size         int64  `json:"size"`
+}
+
+// NEVRA returns the name, epoch, version, release and architecture of the
+// package in the form name-epoch:version-release.arch.
+func (c ManifestPackage) NEVRA() string {
+	return fmt.Sprintf("%s-%d:%s-%s.%s", c.Name, c.Epoch, c.Version, c.Release, c.Arch)
+}
+
+func (c ManifestPackage) String() string {
+	return c.NEVRA()
+}
+
+// newSyncManifest returns a manifest listing each of the given packages which
+// is present and complete in the given package directory.
+func newSyncManifest(repo *Repo, revision int, packages PackageEntries, packagedir string) (*SyncManifest, error) {
+	manifest := &SyncManifest{
+		Repo:     repo.ID,
+		Revision: revision,
+		Created:  time.Now().UTC(),
+		Packages: make([]ManifestPackage, 0),
+	}
+
+	resigned := readResignedPackages(packagedir)
+	for _, p := range packages {
+		fi, err := os.Stat(filepath.Join(packagedir, p.filename()))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		size, _, _, err := localPackageFile(p, resigned)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi.Size() != size {
+			continue
+		}
+
+		sum, err := p.Checksum()
+		if err != nil {
+			return nil, err
+		}
+
+		manifest.Packages = append(manifest.Packages, ManifestPackage{
+			Name:         p.Name(),
+			Epoch:        p.Epoch(),
+			Version:      p.Version(),
+			Release:      p.Release(),
+			Arch:         p.Architecture(),
+			Checksum:     sum,
+			ChecksumType: p.ChecksumType(),
+			Location:     p.LocationHref(),
+			Size:         p.PackageSize(),
+		})
+	}
+
+	return manifest, nil
+}
+
+// ReadSyncManifest reads a manifest written by Sync from the given path.
+func ReadSyncManifest(path string) (*SyncManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := &SyncManifest{}
+	if err := json.NewDecoder(f).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("Error decoding sync manifest %s: %v", path, err)
+	}
+
+	return manifest, nil
+}
+
+// WriteFile writes the manifest to the given path. The file is replaced
+// atomically so an interrupted write never leaves a partial manifest.
+func (c *SyncManifest) WriteFile(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// manifestPackages returns the upstream package for each package listed in the
+// given manifest, matched by NEVRA and checksum. Packages which are no longer
+// available upstream are located in the repo's VaultURL. If VaultURL is not
+// set, an error is returned listing every unavailable package.
+func (c *Repo) manifestPackages(manifest *SyncManifest, upstream PackageEntries) (PackageEntries, error) {
+	index := make(map[string]PackageEntry, len(upstream))
+	for _, p := range upstream {
+		sum, _ := p.Checksum()
+		index[p.NEVRA()+" "+sum] = p
+	}
+
+	packages := make(PackageEntries, 0, len(manifest.Packages))
+	unavailable := make([]string, 0)
+	for _, mp := range manifest.Packages {
+		if p, ok := index[mp.NEVRA()+" "+mp.Checksum]; ok {
+			packages = append(packages, p)
+			continue
+		}
+
+		if c.VaultURL == "" {
+			unavailable = append(unavailable, mp.NEVRA())
+			continue
+		}
+
+		Dprintf("Pinned package %v is not available upstream, using %s\n", mp, c.VaultURL)
+		p := PackageEntry{
+			PackageName: mp.Name,
+			Arch:        mp.Arch,
+		}
+		p.Versions = PackageEntryVersion{Epoch: mp.Epoch, Version: mp.Version, Release: mp.Release}
+		p.Checksums = PackageEntryChecksum{Type: mp.ChecksumType, Hash: mp.Checksum}
+		p.Location = PackageEntryLocation{Href: mp.Location, Base: c.VaultURL}
+		p.Size.Package = mp.Size
+		packages = append(packages, p)
+	}
+
+	if len(unavailable) > 0 {
+		return nil, fmt.Errorf("%d pinned packages are no longer available upstream and no vault URL is configured: %s", len(unavailable), strings.Join(unavailable, ", "))
+	}
+
+	return packages, nil
+}
+
+// selectManifest returns the upstream packages listed in the given manifest,
+// read from the cached primary database of the given repo cache, as per
+// manifestPackages. Filter rules are not applied.
+func (c *syncRun) selectManifest(repocache *RepoCache, manifest *SyncManifest) (PackageEntries, error) {
+	upstream, err := repocache.Packages()
+	if err != nil {
+		return nil, c.wrapErr(err, "reading packages from primary database")
+	}
+
+	packages, err := c.manifestPackages(manifest, upstream)
+	if err != nil {
+		return nil, c.wrapErr(err, "resolving sync manifest")
+	}
+
+	// keep upstream metadata such as productid for createrepo
+	c.comps, c.modules, c.passthrough = nil, nil, repocache.passthrough
+
+	if err := c.nameFiles(packages); err != nil {
+		return nil, c.wrapErr(err, "naming packages")
+	}
+
+	return packages, nil
+}
+
+// SyncFromManifest downloads exactly the packages listed in the sync manifest
+// at the given path to the given package directory, verifying the checksum of
+// each, and rebuilds the repository metadata. Packages which are no longer
+// available from the upstream repository are downloaded from VaultURL, such as
+// a CentOS vault mirror. Filter rules are not applied and other packages
+// already in the package directory are not removed.
+//
+// Otherwise, the packages are synchronized as per Sync, so StagingDir,
+// ResumeState, ConfirmFunc and the repo's Notifier apply, and a new manifest
+// is written to the package directory once every package is synchronized.
+func (c *Repo) SyncFromManifest(manifestPath, cachedir, packagedir string) error {
+	// read manifest before touching the package directory
+	manifest, err := ReadSyncManifest(manifestPath)
+	if err != nil {
+		return c.wrapErr(err, "reading sync manifest")
+	}
+
+	_, err = c.notify(c.sync(cachedir, packagedir, syncOptions{manifest: manifest}))
+	return err
+}
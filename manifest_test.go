@@ -0,0 +1,248 @@
+package yum
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packages := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", 0),
+		newTestPackage("bar", "2.0", "noarch", 0),
+		newTestPackage("missing", "1.0", "x86_64", 0),
+	}
+
+	for i := range packages {
+		p := &packages[i]
+		b := []byte(p.String())
+		p.Versions.Epoch = i
+		p.Size.Package = int64(len(b))
+		p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: checksumBytes(t, b).Hash}
+		if p.Name() != "missing" {
+			if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(p.LocationHref())), b, 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	manifest, err := newSyncManifest(repo, 1483225200, packages, dir)
+	if err != nil {
+		t.Fatalf("Error creating manifest: %v", err)
+	}
+
+	path := filepath.Join(dir, manifestFilename)
+	if err := manifest.WriteFile(path); err != nil {
+		t.Fatalf("Error writing manifest: %v", err)
+	}
+
+	manifest, err = ReadSyncManifest(path)
+	if err != nil {
+		t.Fatalf("Error reading manifest: %v", err)
+	}
+
+	if manifest.Repo != "base" || manifest.Revision != 1483225200 {
+		t.Errorf("Unexpected manifest repo or revision: %s %d", manifest.Repo, manifest.Revision)
+	}
+
+	if len(manifest.Packages) != 2 {
+		t.Fatalf("Expected 2 packages in manifest, got %d", len(manifest.Packages))
+	}
+
+	for i, nevra := range []string{"foo-0:1.0-1.x86_64", "bar-1:2.0-1.noarch"} {
+		mp := manifest.Packages[i]
+		if mp.NEVRA() != nevra {
+			t.Errorf("Expected %s in manifest, got %s", nevra, mp.NEVRA())
+		}
+
+		if mp.ChecksumType != "sha256" || mp.Checksum != packages[i].Checksums.Hash {
+			t.Errorf("Unexpected checksum for %s: %s %s", mp, mp.ChecksumType, mp.Checksum)
+		}
+	}
+}
+
+func TestManifestPackages(t *testing.T) {
+	foo := newTestPackage("foo", "1.0", "x86_64", 0)
+	foo.Checksums.Hash = "aaaa"
+	bar := newTestPackage("bar", "1.0", "x86_64", 0)
+	bar.Checksums.Hash = "bbbb"
+	gone := newTestPackage("gone", "1.0", "x86_64", 0)
+	gone.Checksums.Hash = "cccc"
+
+	manifest := &SyncManifest{}
+	for _, p := range []PackageEntry{foo, bar, gone} {
+		manifest.Packages = append(manifest.Packages, ManifestPackage{
+			Name:     p.Name(),
+			Version:  p.Version(),
+			Release:  p.Release(),
+			Arch:     p.Architecture(),
+			Checksum: p.Checksums.Hash,
+			Location: p.LocationHref(),
+		})
+	}
+
+	// bar was rebuilt upstream with a different checksum and gone was removed
+	rebuilt := bar
+	rebuilt.Checksums.Hash = "dddd"
+	upstream := PackageEntries{foo, rebuilt}
+
+	repo := NewRepo()
+	if _, err := repo.manifestPackages(manifest, upstream); err == nil || !strings.Contains(err.Error(), "gone-0:1.0-1.x86_64") {
+		t.Errorf("Expected an error listing unavailable packages, got: %v", err)
+	}
+
+	repo.VaultURL = "http://vault.example.com/base"
+	packages, err := repo.manifestPackages(manifest, upstream)
+	if err != nil {
+		t.Fatalf("Error resolving manifest: %v", err)
+	}
+
+	if len(packages) != 3 {
+		t.Fatalf("Expected 3 packages, got %d", len(packages))
+	}
+
+	if packages[0].LocationBase() != "" {
+		t.Errorf("Expected %v to be resolved upstream", packages[0])
+	}
+
+	for _, p := range packages[1:] {
+		if p.LocationBase() != repo.VaultURL {
+			t.Errorf("Expected %v to be resolved in the vault, got %s", p, p.LocationBase())
+		}
+	}
+
+	if sum, _ := packages[1].Checksum(); sum != "bbbb" {
+		t.Errorf("Expected pinned checksum for %v, got %s", packages[1], sum)
+	}
+}
+
+// notifierFunc is a Notifier which calls itself.
+type notifierFunc func(report *SyncReport, err error) error
+
+func (c notifierFunc) Notify(report *SyncReport, err error) error {
+	return c(report, err)
+}
+
+func TestSyncFromManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := `<metadata packages="2">`
+	manifest := &SyncManifest{Repo: "local"}
+	for _, name := range []string{"foo", "bar"} {
+		content := []byte(name + " package")
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		sum := checksumBytes(t, content).Hash
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, sum, len(content), len(content), len(content), name)
+
+		// only foo is pinned
+		if name == "foo" {
+			manifest.Packages = append(manifest.Packages, ManifestPackage{
+				Name:         name,
+				Version:      "1.0",
+				Release:      "1",
+				Arch:         "x86_64",
+				Checksum:     sum,
+				ChecksumType: "sha256",
+				Location:     "Packages/" + name + "-1.0-1.x86_64.rpm",
+				Size:         int64(len(content)),
+			})
+		}
+	}
+	primary += `</metadata>`
+	writeTestRepodata(t, upstream, 1, []byte(primary))
+
+	manifestPath := filepath.Join(dir, "pinned.json")
+	if err := manifest.WriteFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// the metadata is preserved so that the sync completes without createrepo
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 2, []byte(primary))
+	old := filepath.Join(packagedir, "old-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(old, []byte("old package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var plans []SyncPlan
+	var reports []*SyncReport
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.PreserveRepodata = true
+	repo.DeleteRemoved = true
+	repo.StagingDir = filepath.Join(dir, "staging")
+	repo.ConfirmFunc = func(plan SyncPlan) bool {
+		plans = append(plans, plan)
+		return true
+	}
+	repo.Notifier = notifierFunc(func(report *SyncReport, err error) error {
+		reports = append(reports, report)
+		return nil
+	})
+
+	if err := repo.SyncFromManifest(manifestPath, filepath.Join(dir, "cache"), packagedir); err != nil {
+		t.Fatalf("Error syncing from manifest: %v", err)
+	}
+
+	// the pinned package is planned, staged and reported like any sync
+	if len(plans) != 1 || plans[0].Packages != 1 || plans[0].Delete != 0 {
+		t.Errorf("Unexpected sync plans: %+v", plans)
+	}
+
+	if len(reports) != 1 || reports[0].Packages != 1 || reports[0].Downloaded != 1 {
+		t.Fatalf("Unexpected sync reports: %+v", reports)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")); err != nil {
+		t.Errorf("Expected pinned package to be downloaded: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "bar-1.0-1.x86_64.rpm")); !os.IsNotExist(err) {
+		t.Errorf("Expected unpinned package not to be downloaded")
+	}
+
+	// other local packages are kept, even with DeleteRemoved
+	if _, err := os.Stat(old); err != nil {
+		t.Errorf("Expected unpinned local package to be kept: %v", err)
+	}
+
+	written, err := ReadSyncManifest(filepath.Join(packagedir, manifestFilename))
+	if err != nil {
+		t.Fatalf("Error reading sync manifest: %v", err)
+	}
+
+	if len(written.Packages) != 1 || written.Packages[0].NEVRA() != "foo-0:1.0-1.x86_64" {
+		t.Errorf("Expected only the pinned package in the sync manifest, got %v", written.Packages)
+	}
+}
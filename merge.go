@@ -0,0 +1,245 @@
+package yum
+
+import (
+	"golang.org/x/crypto/openpgp"
+	"path/filepath"
+	"sort"
+)
+
+// MergeSync synchronizes the union of the packages selected from each of the
+// given repos into a single local package repository in the given package
+// directory and builds one set of repository metadata for the combined
+// packages, such as to serve base, updates and EPEL packages from a single
+// repo. Repo metadata is cached in each repo's CachePath or the given cache
+// directory.
+//
+// Packages are de-duplicated by NEVRA. If several repos provide the same
+// NEVRA, the package is downloaded from the repo with the lowest Priority or,
+// if their priorities are equal, from the repo which is first in the given
+// slice. Each package is downloaded and validated as per the repo which
+// provides it. Local packages which are not selected from any repo are
+// deleted only if DeleteRemoved is set for every repo.
+//
+// Otherwise, the packages are synchronized as per Sync of the first repo, so
+// its StagingDir, ResumeState, ConfirmFunc, SignKey, ResignKey and Notifier
+// apply to the merged repository. As with Sync, packages which fail to
+// download are excluded from the repository metadata, and an error listing
+// each failure is returned.
+func MergeSync(repos []*Repo, packagedir, cachedir string) error {
+	if len(repos) == 0 {
+		return NewErrorf("No repos to merge into %s", packagedir)
+	}
+
+	// validate all repos before syncing any
+	for _, repo := range repos {
+		if err := repo.Validate(); err != nil {
+			return err
+		}
+	}
+	primary := repos[0]
+
+	primarycachedir := cachedir
+	if primary.CachePath != "" {
+		primarycachedir = primary.CachePath
+	}
+
+	report, err := primary.sync(primarycachedir, packagedir, syncOptions{merge: repos[1:]})
+	if err == nil && report.Failed > 0 {
+		err = primary.wrapErr(Errors(report.Errors), "merging %d of %d packages into %s", report.Failed, report.Missing+report.Corrupt, packagedir)
+	}
+
+	_, err = primary.notify(report, err)
+	return err
+}
+
+// mergeSource is a repo whose packages are merged into the package directory
+// of another repo by MergeSync.
+type mergeSource struct {
+	run       *syncRun
+	repocache *RepoCache
+	keyring   openpgp.KeyRing
+
+	// packages are the filenames of the packages merged from the repo.
+	packages map[string]bool
+}
+
+// selectMerged returns the packages selected from the given repo cache of the
+// repo and from each of the given repos, de-duplicated by mergePackages. The
+// metadata of each of the given repos is cached in its CachePath or the given
+// cache directory. The given repos and the packages merged from each are
+// recorded, with a sync run of each repo which holds its state for the sync,
+// so that each package is downloaded from the repo which provides it and the
+// given repos are not modified.
+func (c *syncRun) selectMerged(repocache *RepoCache, repos []*Repo, cachedir, packagedir string) (PackageEntries, error) {
+	for _, repo := range repos {
+		c.merged = append(c.merged, &mergeSource{run: newSyncRun(repo), packages: make(map[string]bool)})
+	}
+
+	caches, err := CacheAll(repos, cachedir)
+	for i, repocache := range caches {
+		c.merged[i].repocache = repocache
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]PackageEntries, len(repos)+1)
+	if selected[0], err = c.selectPackages(repocache, packagedir); err != nil {
+		return nil, err
+	}
+
+	for i, src := range c.merged {
+		if selected[i+1], err = src.run.selectPackages(src.repocache, packagedir); err != nil {
+			return nil, err
+		}
+		c.duplicates = append(c.duplicates, src.run.duplicates...)
+
+		if src.run.GPGCheck {
+			if src.keyring, err = OpenKeyRing(src.run.GPGKey); err != nil {
+				return nil, src.run.wrapErr(err, "loading GPG keys")
+			}
+		}
+
+		// download packages first from the mirror which served the metadata
+		src.run.mirror = src.repocache.baseURL()
+	}
+
+	merged := mergePackages(append([]*Repo{c.Repo}, repos...), selected)
+	packages := merged[0]
+	for i, src := range c.merged {
+		for _, p := range merged[i+1] {
+			src.packages[p.filename()] = true
+		}
+		packages = append(packages, merged[i+1]...)
+	}
+
+	return packages, nil
+}
+
+// closeMerged closes the repo caches of the repos recorded by selectMerged.
+func (c *syncRun) closeMerged() {
+	for _, src := range c.merged {
+		if src.repocache != nil {
+			src.repocache.Close()
+		}
+	}
+}
+
+// splitMerged returns the given packages which are not merged from another
+// repo, followed by the given packages merged from each repo recorded by
+// selectMerged, in the same order.
+func (c *syncRun) splitMerged(packages PackageEntries) (PackageEntries, []PackageEntries) {
+	own := make(PackageEntries, 0, len(packages))
+	merged := make([]PackageEntries, len(c.merged))
+	for _, p := range packages {
+		found := false
+		for i, src := range c.merged {
+			if src.packages[p.filename()] {
+				merged[i] = append(merged[i], p)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			own = append(own, p)
+		}
+	}
+
+	return own, merged
+}
+
+// downloadMerged downloads each of the given packages which is merged from
+// another repo from that repo, as per downloadPackages, and returns the other
+// packages. Merged packages are recorded in the sync state and re-signed as
+// the packages of the repo.
+func (c *syncRun) downloadMerged(packages PackageEntries, packagedir string, report *SyncReport) PackageEntries {
+	packages, merged := c.splitMerged(packages)
+	for i, src := range c.merged {
+		if len(merged[i]) == 0 {
+			continue
+		}
+
+		src.run.state, src.run.resigner, src.run.seeddir = c.state, c.resigner, c.seeddir
+		src.run.downloadPackages(merged[i], packagedir, src.keyring, report)
+	}
+
+	return packages
+}
+
+// expiredMerged returns the paths of the packages in the given package
+// directory which are not among the given packages selected from the repo and
+// the repos merged into it, if DeleteRemoved is set for every repo. The
+// KeepVersions and DeleteOlderThan options of each repo are applied as its
+// packages are selected.
+func (c *syncRun) expiredMerged(packagedir string, selected PackageEntries) ([]string, error) {
+	if !c.DeleteRemoved {
+		return nil, nil
+	}
+
+	for _, src := range c.merged {
+		if !src.run.DeleteRemoved {
+			return nil, nil
+		}
+	}
+
+	keep := make(map[string]bool, len(selected))
+	for _, p := range selected {
+		keep[p.filename()] = true
+	}
+
+	rpms, err := filepath.Glob(filepath.Join(packagedir, "*.rpm"))
+	if err != nil {
+		return nil, err
+	}
+
+	remove := make([]string, 0)
+	for _, path := range rpms {
+		if !keep[filepath.Base(path)] {
+			Dprintf("Package %s is not selected from any merged repo\n", path)
+			remove = append(remove, path)
+		}
+	}
+
+	return remove, nil
+}
+
+// mergePackages de-duplicates the given packages selected from each of the
+// given repos by NEVRA and returns the packages to be downloaded from each
+// repo, in the same order as the given repos. Each NEVRA is taken from the
+// repo with the lowest Priority or, for equal priorities, the first repo.
+func mergePackages(repos []*Repo, selected []PackageEntries) []PackageEntries {
+	order := make([]int, len(repos))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return repos[order[i]].Priority < repos[order[j]].Priority
+	})
+
+	type source struct {
+		repo     *Repo
+		checksum string
+	}
+
+	seen := make(map[string]source)
+	merged := make([]PackageEntries, len(repos))
+	for _, i := range order {
+		merged[i] = make(PackageEntries, 0, len(selected[i]))
+		for _, p := range selected[i] {
+			nevra := p.NEVRA()
+			sum, _ := p.Checksum()
+			if s, ok := seen[nevra]; ok {
+				if s.checksum != sum {
+					Printf("Package %v differs in repos %v and %v, using repo %v\n", p, s.repo, repos[i], s.repo)
+				}
+				continue
+			}
+
+			seen[nevra] = source{repo: repos[i], checksum: sum}
+			merged[i] = append(merged[i], p)
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,165 @@
+package yum
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergePackages(t *testing.T) {
+	shared := newTestPackage("bash", "4.4", "x86_64", 100)
+	shared.Checksums = PackageEntryChecksum{Type: "sha256", Hash: "aaaa"}
+	rebuilt := shared
+	rebuilt.Checksums = PackageEntryChecksum{Type: "sha256", Hash: "bbbb"}
+
+	base := NewRepo()
+	base.ID = "base"
+	epel := NewRepo()
+	epel.ID = "epel"
+
+	selected := []PackageEntries{
+		{shared, newTestPackage("glibc", "2.28", "x86_64", 100)},
+		{rebuilt, newTestPackage("htop", "3.2", "x86_64", 100)},
+	}
+
+	// equal priorities prefer the first repo
+	merged := mergePackages([]*Repo{base, epel}, selected)
+	if len(merged[0]) != 2 || len(merged[1]) != 1 {
+		t.Fatalf("Expected 2 packages from base and 1 from epel, got %v and %v", merged[0], merged[1])
+	}
+
+	if merged[1][0].Name() != "htop" {
+		t.Errorf("Expected only htop from epel, got %v", merged[1])
+	}
+
+	// a lower priority takes precedence on conflicts
+	epel.Priority = 10
+	merged = mergePackages([]*Repo{base, epel}, selected)
+	if len(merged[0]) != 1 || len(merged[1]) != 2 {
+		t.Fatalf("Expected 1 package from base and 2 from epel, got %v and %v", merged[0], merged[1])
+	}
+
+	for _, p := range merged[1] {
+		if sum, _ := p.Checksum(); p.Name() == "bash" && sum != "bbbb" {
+			t.Errorf("Expected bash from epel, got checksum %s", sum)
+		}
+	}
+}
+
+func TestMergeSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// writeRepo writes an upstream repo of packages with the given names and
+	// contents
+	writeRepo := func(name string, packages map[string]string) *Repo {
+		upstream := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		primary := fmt.Sprintf(`<metadata packages="%d">`, len(packages))
+		for name, content := range packages {
+			if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), []byte(content), 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, checksumBytes(t, []byte(content)).Hash, len(content), len(content), len(content), name)
+		}
+		writeTestRepodata(t, upstream, 1, []byte(primary+`</metadata>`))
+
+		repo := NewRepo()
+		repo.ID = name
+		repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+		repo.EmitSQLite = false
+		repo.DeleteRemoved = true
+		return repo
+	}
+
+	// both repos provide bash, which is taken from base
+	base := writeRepo("base", map[string]string{"bash": "base bash", "glibc": "base glibc"})
+	epel := writeRepo("epel", map[string]string{"bash": "epel bash", "htop": "epel htop"})
+
+	packagedir := filepath.Join(dir, "merged")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	old := filepath.Join(packagedir, "old-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(old, []byte("old package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var plans []SyncPlan
+	var reports []*SyncReport
+	base.StagingDir = filepath.Join(dir, "staging")
+	base.ConfirmFunc = func(plan SyncPlan) bool {
+		plans = append(plans, plan)
+		return true
+	}
+	base.Notifier = notifierFunc(func(report *SyncReport, err error) error {
+		reports = append(reports, report)
+		return nil
+	})
+
+	want := *epel
+	if err := MergeSync([]*Repo{base, epel}, packagedir, filepath.Join(dir, "cache")); err != nil {
+		t.Fatalf("Error merging repos: %v", err)
+	}
+
+	// the merged packages are planned, staged and reported as one sync
+	if len(plans) != 1 || plans[0].Packages != 3 || plans[0].Delete != 1 {
+		t.Errorf("Unexpected sync plans: %+v", plans)
+	}
+
+	if len(reports) != 1 || reports[0].Packages != 3 || reports[0].Downloaded != 3 || reports[0].Deleted != 1 {
+		t.Fatalf("Unexpected sync reports: %+v", reports)
+	}
+
+	for name, content := range map[string]string{"bash": "base bash", "glibc": "base glibc", "htop": "epel htop"} {
+		b, err := ioutil.ReadFile(filepath.Join(packagedir, name+"-1.0-1.x86_64.rpm"))
+		if err != nil || string(b) != content {
+			t.Errorf("Expected %s with content %q, got %q: %v", name, content, b, err)
+		}
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expected package not selected from any repo to be deleted")
+	}
+
+	// one set of metadata and one manifest describe the merged repo
+	if _, err := os.Stat(filepath.Join(packagedir, repodataDirname, "repomd.xml")); err != nil {
+		t.Errorf("Expected repository metadata for the merged repo: %v", err)
+	}
+
+	manifest, err := ReadSyncManifest(filepath.Join(packagedir, manifestFilename))
+	if err != nil {
+		t.Fatalf("Error reading sync manifest: %v", err)
+	}
+
+	if len(manifest.Packages) != 3 {
+		t.Errorf("Expected 3 packages in the sync manifest, got %v", manifest.Packages)
+	}
+
+	// the state of the sync is not written to the merged repos
+	if base.StagingDir != filepath.Join(dir, "staging") {
+		t.Errorf("Expected staging directory to be unchanged, got %s", base.StagingDir)
+	}
+
+	if !reflect.DeepEqual(*epel, want) {
+		t.Errorf("Expected merged repo to be unchanged, got %+v", *epel)
+	}
+}
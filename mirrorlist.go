@@ -0,0 +1,86 @@
+package yum
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// ReadMirrorList reads a yum mirror list from the given io.Reader and returns
+// the base URL of each mirror, in order of preference. Each line lists one
+// mirror URL and may be followed by trailing metadata, such as a weight, which
+// is ignored. Blank lines, comments and mirrors which are not HTTP or HTTPS
+// URLs are ignored.
+func ReadMirrorList(r io.Reader) ([]string, error) {
+	urls := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		url := fields[0]
+		scheme := strings.ToLower(url)
+		if !strings.HasPrefix(scheme, "http://") && !strings.HasPrefix(scheme, "https://") {
+			Dprintf("Ignoring mirror with unsupported scheme: %s\n", url)
+			continue
+		}
+
+		urls = append(urls, url)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// ResolveMirrors downloads the repo's mirror list from MirrorURL and appends
+// each mirror to Mirrors. If BaseURL is not set, the first mirror is used as
+// the BaseURL. The mirror list is only downloaded once for each Repo.
+func (c *Repo) ResolveMirrors() error {
+	if c.MirrorURL == "" || c.mirrorsResolved {
+		return nil
+	}
+
+	url, err := c.resolveURL(c.MirrorURL)
+	if err != nil {
+		return err
+	}
+
+	Dprintf("Downloading mirror list from %s...\n", url)
+	body, err := openURL(c.client(), url, c.userAgent())
+	if err != nil {
+		return newError(ErrRepoUnavailable, "Error retrieving mirror list from URL: %w", err)
+	}
+	defer body.Close()
+
+	urls, err := ReadMirrorList(body)
+	if err != nil {
+		return newError(ErrMetadataFetch, "Error reading mirror list: %w", err)
+	}
+
+	if len(urls) == 0 {
+		return newError(ErrRepoUnavailable, "Mirror list %s has no mirrors", c.MirrorURL)
+	}
+
+	c.listedMirrors = make(map[string]bool, len(urls))
+	for _, u := range urls {
+		c.listedMirrors[u] = true
+	}
+
+	if c.BaseURL == "" {
+		c.BaseURL, urls = urls[0], urls[1:]
+	}
+
+	c.Mirrors = append(c.Mirrors, urls...)
+	c.mirrorsResolved = true
+	return nil
+}
@@ -0,0 +1,75 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mirrorlist")
+	mirrorlist := `# mirrors for base
+http://mirror1.example.com/centos/7/os/x86_64/
+
+http://mirror2.example.com/centos/7/os/x86_64/
+http://mirror3.example.com/centos/7/os/x86_64/
+`
+	if err := ioutil.WriteFile(path, []byte(mirrorlist), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.MirrorURL = "file://" + filepath.ToSlash(path)
+	if err := repo.ResolveMirrors(); err != nil {
+		t.Fatalf("Error resolving mirrors: %v", err)
+	}
+
+	if repo.BaseURL != "http://mirror1.example.com/centos/7/os/x86_64/" {
+		t.Errorf("Unexpected base URL: %s", repo.BaseURL)
+	}
+
+	if len(repo.Mirrors) != 2 || !strings.HasPrefix(repo.Mirrors[1], "http://mirror3") {
+		t.Errorf("Unexpected mirrors: %v", repo.Mirrors)
+	}
+
+	// mirrors are only resolved once
+	if err := repo.ResolveMirrors(); err != nil || len(repo.Mirrors) != 2 {
+		t.Errorf("Expected mirrors to be resolved once, got %v: %v", repo.Mirrors, err)
+	}
+}
+
+func TestReadMirrorList(t *testing.T) {
+	mirrorlist := "# CentOS mirrors for os/x86_64\r\n" +
+		"\r\n" +
+		"  http://mirror1.example.com/centos/7/os/x86_64/  \r\n" +
+		"https://mirror2.example.com/centos/7/os/x86_64/ 100 # preferred\n" +
+		"\t# http://disabled.example.com/centos/7/os/x86_64/\n" +
+		"ftp://ftp.example.com/centos/7/os/x86_64/\n" +
+		"rsync://rsync.example.com/centos/7/os/x86_64/\n" +
+		"\n" +
+		"HTTP://mirror3.example.com/centos/7/os/x86_64/\tweight=20\n"
+
+	urls, err := ReadMirrorList(strings.NewReader(mirrorlist))
+	if err != nil {
+		t.Fatalf("Error reading mirror list: %v", err)
+	}
+
+	expect := []string{
+		"http://mirror1.example.com/centos/7/os/x86_64/",
+		"https://mirror2.example.com/centos/7/os/x86_64/",
+		"HTTP://mirror3.example.com/centos/7/os/x86_64/",
+	}
+
+	if strings.Join(urls, " ") != strings.Join(expect, " ") {
+		t.Errorf("Expected mirrors %v, got %v", expect, urls)
+	}
+}
@@ -0,0 +1,274 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Modules represents a modules.yaml file which describes the module streams
+// of a modular yum repository. Each YAML document of the file is preserved
+// verbatim so that the file may be rewritten with a subset of its documents.
+type Modules struct {
+	Documents []ModuleDocument
+}
+
+// ModuleDocument is a single YAML document of a modules.yaml file, such as a
+// modulemd stream definition or the modulemd-defaults of a module.
+type ModuleDocument struct {
+	// Type is the document type, such as 'modulemd' or 'modulemd-defaults'.
+	Type string
+
+	// Module is the name of the module described by the document.
+	Module string
+
+	// Stream is the stream of a modulemd document or the default stream of a
+	// modulemd-defaults document.
+	Stream string
+
+	// RPMs are the NEVRA of each package which is an artifact of a modulemd
+	// stream, in the form name-epoch:version-release.arch.
+	RPMs []string
+
+	text string
+}
+
+func (c ModuleDocument) String() string {
+	if c.Stream == "" {
+		return fmt.Sprintf("%s %s", c.Type, c.Module)
+	}
+
+	return fmt.Sprintf("%s %s:%s", c.Type, c.Module, c.Stream)
+}
+
+// ReadModules loads a modules.yaml file from the given io.Reader and returns
+// a pointer to the resulting Modules struct.
+func ReadModules(r io.Reader) (*Modules, error) {
+	modules := &Modules{
+		Documents: make([]ModuleDocument, 0),
+	}
+
+	lines := make([]string, 0)
+	flush := func() {
+		text := strings.Join(lines, "\n")
+		if strings.TrimSpace(text) != "" {
+			modules.Documents = append(modules.Documents, parseModuleDocument(text+"\n"))
+		}
+		lines = lines[:0]
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "...") {
+			flush()
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	flush()
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error decoding modules: %v", err)
+	}
+
+	return modules, nil
+}
+
+// parseModuleDocument reads the fields of a ModuleDocument from the given
+// YAML document. Only the fields required to select module streams are read.
+func parseModuleDocument(text string) ModuleDocument {
+	doc := ModuleDocument{
+		RPMs: make([]string, 0),
+		text: text,
+	}
+
+	inData := false
+	dataIndent, artifactsIndent, rpmsIndent := -1, -1, -1
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if indent == 0 {
+			key, value := yamlKeyValue(trimmed)
+			if key == "document" {
+				doc.Type = value
+			}
+			inData = key == "data"
+			artifactsIndent, rpmsIndent = -1, -1
+			continue
+		}
+
+		if !inData {
+			continue
+		}
+
+		if dataIndent < 0 {
+			dataIndent = indent
+		}
+
+		// list of artifact rpms
+		if rpmsIndent >= 0 {
+			if indent >= rpmsIndent && strings.HasPrefix(trimmed, "- ") {
+				doc.RPMs = append(doc.RPMs, yamlUnquote(trimmed[2:]))
+				continue
+			}
+
+			if indent > rpmsIndent {
+				continue
+			}
+			rpmsIndent = -1
+		}
+
+		if artifactsIndent >= 0 && indent <= artifactsIndent {
+			artifactsIndent = -1
+		}
+
+		key, value := yamlKeyValue(trimmed)
+		if indent == dataIndent {
+			switch key {
+			case "name", "module":
+				doc.Module = value
+
+			case "stream":
+				doc.Stream = value
+
+			case "artifacts":
+				artifactsIndent = indent
+			}
+		} else if artifactsIndent >= 0 && key == "rpms" && value == "" {
+			rpmsIndent = indent
+		}
+	}
+
+	return doc
+}
+
+// yamlKeyValue splits a YAML mapping entry into its key and unquoted scalar
+// value.
+func yamlKeyValue(s string) (string, string) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return "", ""
+	}
+
+	return strings.TrimSpace(s[:i]), yamlUnquote(s[i+1:])
+}
+
+// yamlUnquote removes any trailing comment and the quotes from a YAML scalar.
+func yamlUnquote(s string) string {
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+
+	return s
+}
+
+// Write writes the modules as a modules.yaml file to the given io.Writer.
+func (c *Modules) Write(w io.Writer) error {
+	for _, doc := range c.Documents {
+		if _, err := fmt.Fprintf(w, "---\n%s...\n", doc.text); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchModuleStream returns true if the given module stream matches any of
+// the given shell patterns, such as 'nodejs:18', 'nodejs:*' or 'nodejs'. A
+// pattern without a stream matches every stream of the module.
+func matchModuleStream(module, stream string, patterns []string) bool {
+	for _, pattern := range patterns {
+		target := module
+		if strings.Contains(pattern, ":") {
+			target = module + ":" + stream
+		}
+
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Filter returns only the module streams which match any of the given
+// patterns, such as 'nodejs:18', along with the other documents, such as
+// translations, which describe the selected streams. The modulemd-defaults
+// document of a module is only retained if its default stream is selected, so
+// that clients are never directed to a stream which is not mirrored. Documents
+// which do not describe a module are always retained.
+func (c *Modules) Filter(patterns ...string) *Modules {
+	filtered := &Modules{
+		Documents: make([]ModuleDocument, 0),
+	}
+
+	for _, doc := range c.Documents {
+		keep := true
+		if doc.Module != "" {
+			keep = matchModuleStream(doc.Module, doc.Stream, patterns)
+			if doc.Type == "modulemd-defaults" && doc.Stream == "" {
+				keep = matchModuleStream(doc.Module, "", patterns)
+			}
+		}
+
+		if keep {
+			filtered.Documents = append(filtered.Documents, doc)
+		} else {
+			Dprintf("Excluding module document %v\n", doc)
+		}
+	}
+
+	return filtered
+}
+
+// RPMs returns the NEVRA of every package which is an artifact of a module
+// stream.
+func (c *Modules) RPMs() map[string]bool {
+	rpms := make(map[string]bool)
+	for _, doc := range c.Documents {
+		if doc.Type != "modulemd" {
+			continue
+		}
+
+		for _, nevra := range doc.RPMs {
+			rpms[nevra] = true
+		}
+	}
+
+	return rpms
+}
+
+// FilterModularPackages returns the given packages, excluding packages which
+// are artifacts of a module stream in the given modules but not in the given
+// selected modules. Packages which are not modular are retained.
+func FilterModularPackages(packages PackageEntries, modules, selected *Modules) PackageEntries {
+	modular := modules.RPMs()
+	keep := selected.RPMs()
+
+	filtered := make(PackageEntries, 0, len(packages))
+	for _, p := range packages {
+		nevra := p.NEVRA()
+		if modular[nevra] && !keep[nevra] {
+			Dprintf("Excluding package %v from an excluded module stream\n", p)
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered
+}
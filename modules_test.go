@@ -0,0 +1,127 @@
+package yum
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testModules = `---
+document: modulemd
+version: 2
+data:
+  name: nodejs
+  stream: "18"
+  version: 8070020220803123033
+  context: ad008a3a
+  arch: x86_64
+  summary: Javascript runtime
+  artifacts:
+    rpms:
+    - nodejs-1:18.7.0-1.module+el8.7.0+16170+b1bc3d2a.x86_64
+    - npm-1:8.15.0-1.18.7.0.1.module+el8.7.0+16170+b1bc3d2a.x86_64
+...
+---
+document: modulemd
+version: 2
+data:
+  name: nodejs
+  stream: '16'
+  version: 8060020220527105645
+  context: ad008a3a
+  arch: x86_64
+  summary: Javascript runtime
+  artifacts:
+    rpms:
+      - nodejs-1:16.14.0-3.module+el8.6.0+14721+11d0e536.x86_64 # latest
+      - npm-1:8.3.1-1.16.14.0.3.module+el8.6.0+14721+11d0e536.x86_64
+  profiles:
+    common:
+      rpms:
+      - nodejs
+...
+---
+document: modulemd-defaults
+version: 1
+data:
+  module: nodejs
+  stream: "18"
+  profiles:
+    18: [common]
+    16: [common]
+...
+---
+document: modulemd-translations
+version: 1
+data:
+  module: nodejs
+  stream: "16"
+  modified: 201812061209
+...
+`
+
+func TestFilterModules(t *testing.T) {
+	modules, err := ReadModules(strings.NewReader(testModules))
+	if err != nil {
+		t.Fatalf("Error reading modules: %v", err)
+	}
+
+	if len(modules.Documents) != 4 {
+		t.Fatalf("Expected 4 module documents, got %d", len(modules.Documents))
+	}
+
+	for i, s := range []string{
+		"modulemd nodejs:18",
+		"modulemd nodejs:16",
+		"modulemd-defaults nodejs:18",
+		"modulemd-translations nodejs:16",
+	} {
+		if modules.Documents[i].String() != s {
+			t.Errorf("Expected module document %s, got %v", s, modules.Documents[i])
+		}
+	}
+
+	if len(modules.Documents[1].RPMs) != 2 || modules.Documents[1].RPMs[0] != "nodejs-1:16.14.0-3.module+el8.6.0+14721+11d0e536.x86_64" {
+		t.Errorf("Unexpected artifacts for nodejs:16: %v", modules.Documents[1].RPMs)
+	}
+
+	// filter to a single stream
+	selected := modules.Filter("nodejs:16")
+	if len(selected.Documents) != 2 || selected.Documents[0].String() != "modulemd nodejs:16" || selected.Documents[1].Type != "modulemd-translations" {
+		t.Fatalf("Expected only documents for nodejs:16, got %v", selected.Documents)
+	}
+
+	// rewritten documents are unchanged
+	var buf bytes.Buffer
+	if err := selected.Write(&buf); err != nil {
+		t.Fatalf("Error writing modules: %v", err)
+	}
+
+	rewritten, err := ReadModules(&buf)
+	if err != nil {
+		t.Fatalf("Error reading rewritten modules: %v", err)
+	}
+
+	if len(rewritten.Documents) != 2 || rewritten.Documents[0].text != modules.Documents[1].text {
+		t.Errorf("Expected rewritten modules to be unchanged, got:\n%s", buf.String())
+	}
+
+	// the default stream is retained if selected
+	if defaults := modules.Filter("nodejs:1*"); len(defaults.Documents) != 4 {
+		t.Errorf("Expected all documents for nodejs:1*, got %v", defaults.Documents)
+	}
+
+	// only packages of the selected stream and non-modular packages are kept
+	packages := PackageEntries{
+		newTestPackage("nodejs", "18.7.0", "x86_64", 0),
+		newTestPackage("nodejs", "16.14.0", "x86_64", 0),
+		newTestPackage("bash", "4.4.20", "x86_64", 0),
+	}
+	packages[0].Versions = PackageEntryVersion{Epoch: 1, Version: "18.7.0", Release: "1.module+el8.7.0+16170+b1bc3d2a"}
+	packages[1].Versions = PackageEntryVersion{Epoch: 1, Version: "16.14.0", Release: "3.module+el8.6.0+14721+11d0e536"}
+
+	filtered := FilterModularPackages(packages, modules, selected)
+	if len(filtered) != 2 || filtered[0].Version() != "16.14.0" || filtered[1].Name() != "bash" {
+		t.Errorf("Expected nodejs 16 and bash, got %v", filtered)
+	}
+}
@@ -0,0 +1,158 @@
+package yum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Notifier is notified of the outcome of every sync of a repo, whether it
+// succeeded or failed.
+type Notifier interface {
+	// Notify is called with the report and returned error of each sync.
+	Notify(report *SyncReport, err error) error
+}
+
+// SyncNotification is the JSON document sent by a WebhookNotifier.
+type SyncNotification struct {
+	Repo            string    `json:"repo"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Packages        int       `json:"packages"`
+	Missing         int       `json:"missing"`
+	Corrupt         int       `json:"corrupt"`
+	Downloaded      int       `json:"downloaded"`
+	BytesDownloaded uint64    `json:"bytes_downloaded"`
+	Deleted         int       `json:"deleted"`
+	Failed          int       `json:"failed"`
+	Orphans         []string  `json:"orphans"`
+	Duplicates      []string  `json:"duplicates,omitempty"`
+	Drift           []string  `json:"drift,omitempty"`
+	Errors          []string  `json:"errors"`
+}
+
+// NewSyncNotification summarizes the given sync report and returned error.
+func NewSyncNotification(report *SyncReport, err error) *SyncNotification {
+	n := &SyncNotification{
+		Repo:            report.Repo,
+		Success:         err == nil,
+		Started:         report.Started,
+		Finished:        report.Finished,
+		DurationSeconds: report.Duration().Seconds(),
+		Packages:        report.Packages,
+		Missing:         report.Missing,
+		Corrupt:         report.Corrupt,
+		Downloaded:      report.Downloaded,
+		BytesDownloaded: report.BytesDownloaded,
+		Deleted:         report.Deleted,
+		Failed:          report.Failed,
+		Orphans:         make([]string, 0),
+		Errors:          make([]string, 0, len(report.Errors)),
+	}
+
+	if err != nil {
+		n.Error = err.Error()
+	}
+
+	n.Orphans = append(n.Orphans, report.Orphans...)
+	n.Duplicates = report.Duplicates
+	n.Drift = report.Drift
+	for _, err := range report.Errors {
+		n.Errors = append(n.Errors, err.Error())
+	}
+
+	return n
+}
+
+// WebhookNotifier is a Notifier which POSTs a SyncNotification as JSON to a
+// URL, such as a Slack or PagerDuty integration. The request fails if the
+// webhook does not respond within Timeout, or DefaultWebhookTimeout if zero,
+// so that an unresponsive webhook does not stall the sync.
+type WebhookNotifier struct {
+	URL       string
+	UserAgent string
+	Timeout   time.Duration
+}
+
+// DefaultWebhookTimeout is the time a WebhookNotifier waits for a response
+// from its webhook, unless it has its own Timeout.
+const DefaultWebhookTimeout = 30 * time.Second
+
+// Notify implements Notifier.
+func (c *WebhookNotifier) Notify(report *SyncReport, err error) error {
+	b, err := json.Marshal(NewSyncNotification(report, err))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeout
+	}
+
+	// share the connections of the shared HTTP client, with a timeout
+	client := &http.Client{
+		Transport:     httpClient().Transport,
+		CheckRedirect: checkRedirect,
+		Timeout:       timeout,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// drain the body so the connection may be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Bad response code: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// notifier returns the repo's Notifier or, if NotifyWebhook is set, a
+// WebhookNotifier for the webhook URL.
+func (c *Repo) notifier() Notifier {
+	if c.Notifier != nil {
+		return c.Notifier
+	}
+
+	if c.NotifyWebhook != "" {
+		return &WebhookNotifier{URL: c.NotifyWebhook, UserAgent: c.userAgent()}
+	}
+
+	return nil
+}
+
+// notify sends the given sync report and error to the repo's notifier, if
+// any, and returns them unchanged. A failure to notify is logged but does not
+// fail the sync.
+func (c *Repo) notify(report *SyncReport, err error) (*SyncReport, error) {
+	notifier := c.notifier()
+	if notifier == nil {
+		return report, err
+	}
+
+	Dprintf("Sending sync report for repo %v\n", c)
+	if nerr := notifier.Notify(report, err); nerr != nil {
+		Errorf(nerr, "Error sending sync report for repo %v", c)
+	}
+
+	return report, err
+}
@@ -0,0 +1,95 @@
+package yum
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	notifications := make(chan *SyncNotification, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected webhook request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+
+		n := &SyncNotification{}
+		if err := json.NewDecoder(r.Body).Decode(n); err != nil {
+			t.Errorf("Error decoding webhook request: %v", err)
+		}
+		notifications <- n
+	}))
+	defer ts.Close()
+
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	report := &SyncReport{
+		Repo:            "base",
+		Started:         started,
+		Finished:        started.Add(90 * time.Second),
+		Packages:        10,
+		Missing:         3,
+		Downloaded:      2,
+		BytesDownloaded: 2048,
+		Failed:          1,
+		Errors:          []error{errors.New("Bad response code: 404 Not Found")},
+	}
+
+	notifier := &WebhookNotifier{URL: ts.URL}
+	if err := notifier.Notify(report, errors.New("1 package failed")); err != nil {
+		t.Fatalf("Error sending webhook: %v", err)
+	}
+
+	n := <-notifications
+	if n.Repo != "base" || n.Success || n.Error != "1 package failed" {
+		t.Errorf("Unexpected outcome in webhook: %+v", n)
+	}
+
+	if n.Packages != 10 || n.Missing != 3 || n.Downloaded != 2 || n.BytesDownloaded != 2048 || n.Failed != 1 || n.DurationSeconds != 90 {
+		t.Errorf("Unexpected counts in webhook: %+v", n)
+	}
+
+	if len(n.Errors) != 1 || n.Errors[0] != "Bad response code: 404 Not Found" {
+		t.Errorf("Unexpected errors in webhook: %v", n.Errors)
+	}
+
+	// unresponsive webhooks time out
+	done := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer slow.Close()
+	defer close(done)
+
+	notifier = &WebhookNotifier{URL: slow.URL, Timeout: 50 * time.Millisecond}
+	if err := notifier.Notify(report, nil); err == nil {
+		t.Errorf("Expected unresponsive webhook to time out")
+	}
+
+	// failed syncs are reported
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewRepo()
+	repo.ID = "updates"
+	repo.BaseURL = "http://127.0.0.1:0/updates"
+	repo.NotifyWebhook = ts.URL
+
+	if err := repo.Sync(filepath.Join(dir, "cache"), filepath.Join(dir, "updates")); err == nil {
+		t.Fatalf("Expected an error syncing unavailable repo")
+	}
+
+	n = <-notifications
+	if n.Repo != "updates" || n.Success || !strings.Contains(n.Error, "repo updates") || n.Finished.IsZero() {
+		t.Errorf("Unexpected webhook for failed sync: %+v", n)
+	}
+}
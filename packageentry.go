@@ -2,13 +2,61 @@ package yum
 
 import (
 	"fmt"
+	"path/filepath"
 	"time"
 )
 
+// Package is a RPM package listed in the metadata of a yum repository, such as
+// each package selected by a repo's filters, which may be read by tools other
+// than this package. It is implemented by *PackageEntry, for packages read from
+// both primary_db sqlite databases and primary.xml files.
+type Package interface {
+	// Name returns the name of the package.
+	Name() string
+
+	// Epoch returns the epoch of the package, which is zero if the package
+	// has none.
+	Epoch() int
+
+	// Version returns the version of the package.
+	Version() string
+
+	// Release returns the release of the package.
+	Release() string
+
+	// Architecture returns the architecture of the package, such as x86_64 or
+	// noarch.
+	Architecture() string
+
+	// LocationHref returns the location of the package file, relative to its
+	// repository.
+	LocationHref() string
+
+	// PackageSize returns the size in bytes of the package file.
+	PackageSize() int64
+
+	// Checksum returns the hex encoded checksum of the package file.
+	Checksum() (string, error)
+
+	// ChecksumType returns the algorithm of the checksum of the package file,
+	// such as sha256.
+	ChecksumType() string
+
+	// String returns the name, epoch, version, release and architecture of
+	// the package, omitting the epoch if it is zero.
+	String() string
+}
+
+var _ Package = (*PackageEntry)(nil)
+
 // PackageEntry is a RPM package as defined in a yum repository database.
 type PackageEntry struct {
 	db *PrimaryDatabase
 
+	// localName is the filename given to the package by the repo's
+	// FilenameFunc, if any
+	localName string
+
 	Key         int
 	Arch        string               `xml:"arch"`
 	Size        PackageEntrySize     `xml:"size"`
@@ -20,10 +68,11 @@ type PackageEntry struct {
 	Summary     string               `xml:"summary"`
 	Url         string               `xml:"url"`
 	Packager    string               `xml:"packager"`
+	Format      PackageEntryFormat   `xml:"format"`
 }
 
 type PackageEntrySize struct {
-	Package   int64 `xml:"type,attr"`
+	Package   int64 `xml:"package,attr"`
 	Installed int64 `xml:"installed,attr"`
 	Archive   int64 `xml:"archive,attr"`
 }
@@ -49,66 +98,125 @@ type PackageEntryTime struct {
 	Build int64 `xml:"build,attr"`
 }
 
+// PackageEntryFormat is the XML element of a package metadata file which
+// describes the RPM header of a package.
+type PackageEntryFormat struct {
+	License string `xml:"license"`
+}
+
 // RepoDatabaseLocation represents the URI, relative to a package repository,
 // of a repository database.
 type PackageEntryLocation struct {
 	Href string `xml:"href,attr"`
+	Base string `xml:"base,attr"`
 }
 
 // PackageEntries is a slice of PackageEntry structs.
 type PackageEntries []PackageEntry
 
 // String reassembles package metadata to form a standard rpm package name;
-// including the package name, version, release and architecture.
+// including the package name, epoch, version, release and architecture. The
+// epoch is omitted if it is zero, as per the canonical NEVRA form.
 func (c PackageEntry) String() string {
+	if c.Epoch() != 0 {
+		return fmt.Sprintf("%s-%d:%s-%s.%s", c.Name(), c.Epoch(), c.Version(), c.Release(), c.Architecture())
+	}
+
 	return fmt.Sprintf("%s-%s-%s.%s", c.Name(), c.Version(), c.Release(), c.Architecture())
 }
 
+// NEVRA returns the name, epoch, version, release and architecture of the
+// package in the form name-epoch:version-release.arch.
+func (c PackageEntry) NEVRA() string {
+	return fmt.Sprintf("%s-%d:%s-%s.%s", c.Name(), c.Epoch(), c.Version(), c.Release(), c.Architecture())
+}
+
+// LocationBase is the base URL of the package, if it is not located in the
+// parent repository.
+func (c *PackageEntry) LocationBase() string {
+	return c.Location.Base
+}
+
 // LocationHref is the location of the package, relative to the parent
 // repository.
 func (c *PackageEntry) LocationHref() string {
 	return c.Location.Href
 }
 
+// filename returns the name of the package file in a local package
+// directory. This is the base name of the LocationHref of the package, unless
+// it was renamed by the repo's FilenameFunc.
+func (c *PackageEntry) filename() string {
+	if c.localName != "" {
+		return c.localName
+	}
+
+	return filepath.Base(c.Location.Href)
+}
+
+// Checksum returns the hex encoded checksum of the package file.
 func (c *PackageEntry) Checksum() (string, error) {
 	return c.Checksums.Hash, nil
 }
 
+// ChecksumType returns the algorithm of the checksum of the package file.
 func (c *PackageEntry) ChecksumType() string {
 	return c.Checksums.Type
 }
 
+// PackageSize returns the size in bytes of the package file.
 func (c *PackageEntry) PackageSize() int64 {
 	return c.Size.Package
 }
 
+// InstallSize returns the size in bytes of the files installed by the package.
 func (c *PackageEntry) InstallSize() int64 {
 	return c.Size.Installed
 }
 
+// ArchiveSize returns the size in bytes of the payload of the package.
 func (c *PackageEntry) ArchiveSize() int64 {
 	return c.Size.Archive
 }
 
+// Name returns the name of the package.
 func (c *PackageEntry) Name() string {
 	return c.PackageName
 }
 
+// Version returns the version of the package.
 func (c *PackageEntry) Version() string {
 	return c.Versions.Version
 }
 
+// Release returns the release of the package.
 func (c *PackageEntry) Release() string {
 	return c.Versions.Release
 }
 
+// Architecture returns the architecture of the package.
 func (c *PackageEntry) Architecture() string {
 	return c.Arch
 }
+
+// Epoch returns the epoch of the package, or zero if it has none.
 func (c *PackageEntry) Epoch() int {
 	return c.Versions.Epoch
 }
 
+// BuildTime returns the time at which the package was built.
 func (c *PackageEntry) BuildTime() time.Time {
 	return time.Unix(c.Time.Build, 0)
 }
+
+// FileTime returns the modification time of the package file, as recorded
+// when the repository metadata was built.
+func (c *PackageEntry) FileTime() time.Time {
+	return time.Unix(c.Time.File, 0)
+}
+
+// License returns the license of the package, such as "GPLv2+", as listed in
+// the repository metadata, or an empty string if none is listed.
+func (c *PackageEntry) License() string {
+	return c.Format.License
+}
@@ -0,0 +1,39 @@
+package yum
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPackageInterface(t *testing.T) {
+	// packages read from primary.xml implement Package
+	md, err := ReadPrimaryMetadata(strings.NewReader(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="1" ver="1.0" rel="2"/>
+  <checksum type="sha256" pkgid="YES">abc123</checksum>
+  <size package="11" installed="22" archive="33"/>
+  <location href="Packages/foo-1.0-2.x86_64.rpm"/>
+</package></metadata>`))
+	if err != nil {
+		t.Fatalf("Error reading primary metadata: %v", err)
+	}
+
+	if len(md.Packages) != 1 {
+		t.Fatalf("Expected 1 package, got %d", len(md.Packages))
+	}
+
+	var p Package = &md.Packages[0]
+	sum, err := p.Checksum()
+	if err != nil {
+		t.Fatalf("Error reading checksum: %v", err)
+	}
+
+	actual := []interface{}{p.Name(), p.Epoch(), p.Version(), p.Release(), p.Architecture(), p.LocationHref(), p.PackageSize(), sum, p.ChecksumType(), p.String()}
+	expected := []interface{}{"foo", 1, "1.0", "2", "x86_64", "Packages/foo-1.0-2.x86_64.rpm", int64(11), "abc123", "sha256", "foo-1:1.0-2.x86_64"}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], actual[i])
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readPackageLockFile reads the NEVRAs listed in the package lockfile at the
+// given path, one per line, such as the output of:
+//
+//	dnf repoquery --installed --qf '%{name}-%{epoch}:%{version}-%{release}.%{arch}'
+//
+// The epoch may be omitted if it is zero. Blank lines and lines beginning with
+// '#' are ignored. Each NEVRA is returned in the form of PackageEntry.NEVRA.
+func readPackageLockFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nevras := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		nevra, ok := normalizeNEVRA(line)
+		if !ok {
+			return nil, NewErrorf("Invalid NEVRA '%s' (in %s:%d)", line, path, lineno)
+		}
+		nevras = append(nevras, nevra)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nevras, nil
+}
+
+// normalizeNEVRA returns the given name-[epoch:]version-release.arch in the
+// form of PackageEntry.NEVRA, with an epoch of zero if it is omitted.
+func normalizeNEVRA(s string) (string, bool) {
+	i := strings.LastIndex(s, ".")
+	if i <= 0 || i == len(s)-1 {
+		return "", false
+	}
+	nevr, arch := s[:i], s[i+1:]
+
+	i = strings.LastIndex(nevr, "-")
+	if i <= 0 || i == len(nevr)-1 {
+		return "", false
+	}
+	nev, release := nevr[:i], nevr[i+1:]
+
+	i = strings.LastIndex(nev, "-")
+	if i <= 0 || i == len(nev)-1 {
+		return "", false
+	}
+	name, ev := nev[:i], nev[i+1:]
+
+	if !strings.Contains(ev, ":") {
+		ev = "0:" + ev
+	}
+
+	return fmt.Sprintf("%s-%s-%s.%s", name, ev, release, arch), true
+}
+
+// lockedPackages returns the upstream packages whose NEVRAs are listed in the
+// repo's PackageLockFile, in the order they are listed. An error is returned
+// if any listed NEVRA is not found upstream.
+func (c *Repo) lockedPackages(upstream PackageEntries) (PackageEntries, error) {
+	nevras, err := readPackageLockFile(c.PackageLockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]PackageEntry, len(upstream))
+	for _, p := range upstream {
+		index[p.NEVRA()] = p
+	}
+
+	packages := make(PackageEntries, 0, len(nevras))
+	seen := make(map[string]bool, len(nevras))
+	missing := make([]string, 0)
+	for _, nevra := range nevras {
+		if seen[nevra] {
+			continue
+		}
+		seen[nevra] = true
+
+		p, ok := index[nevra]
+		if !ok {
+			missing = append(missing, nevra)
+			continue
+		}
+		packages = append(packages, p)
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("%d locked packages are not available upstream: %s", len(missing), strings.Join(missing, ", "))
+	}
+
+	return packages, nil
+}
@@ -0,0 +1,105 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPackageLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testPrimaryPackage := func(name, epoch, ver string) string {
+		return `<package type="rpm">
+  <name>` + name + `</name>
+  <arch>x86_64</arch>
+  <version epoch="` + epoch + `" ver="` + ver + `" rel="1"/>
+  <checksum type="sha256" pkgid="YES">e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855</checksum>
+  <location href="Packages/` + name + `-` + ver + `-1.x86_64.rpm"/>
+</package>`
+	}
+
+	upstream := filepath.Join(dir, "upstream")
+	// foo-1.0 is listed twice, with the first location listed first
+	writeTestRepodata(t, upstream, 1, []byte(`<metadata packages="5">`+
+		testPrimaryPackage("foo", "0", "1.0")+
+		testPrimaryPackage("foo", "0", "2.0")+
+		testPrimaryPackage("bar", "1", "1.0")+
+		testPrimaryPackage("baz", "0", "1.0")+
+		strings.Replace(testPrimaryPackage("foo", "0", "1.0"), "Packages/", "Packages/z/", 1)+
+		`</metadata>`))
+
+	lockfile := filepath.Join(dir, "packages.lock")
+	if err := ioutil.WriteFile(lockfile, []byte("# golden host\nfoo-1.0-1.x86_64\n\nbar-1:1.0-1.x86_64\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "locked"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.IncludePackages = []string{"baz"}
+	repo.PackageLockFile = lockfile
+
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repocache.Close()
+
+	// exactly the locked packages are selected, ignoring filter rules
+	run := newSyncRun(repo)
+	packages, err := run.selectPackages(repocache, "")
+	if err != nil {
+		t.Fatalf("Error selecting locked packages: %v", err)
+	}
+
+	nevras := make([]string, len(packages))
+	for i, p := range packages {
+		nevras[i] = p.NEVRA()
+	}
+
+	if !reflect.DeepEqual(nevras, []string{"foo-0:1.0-1.x86_64", "bar-1:1.0-1.x86_64"}) {
+		t.Errorf("Unexpected locked packages: %v", nevras)
+	}
+
+	// duplicates are resolved as by the filter rules, and reported
+	if href := packages[0].LocationHref(); href != "Packages/foo-1.0-1.x86_64.rpm" {
+		t.Errorf("Expected the first location of the duplicated locked package, got %s", href)
+	}
+
+	if len(run.duplicates) != 1 || !strings.Contains(run.duplicates[0], "foo-0:1.0-1.x86_64 is listed 2 times") {
+		t.Errorf("Expected duplicated package to be reported, got %v", run.duplicates)
+	}
+
+	// locked packages are retained however old they are
+	repo.DeleteOlderThan = time.Hour
+	if packages, err = run.selectPackages(repocache, ""); err != nil || len(packages) != 2 {
+		t.Errorf("Expected retention policy to be ignored for locked packages, got %v: %v", packages, err)
+	}
+
+	// a locked package which is not available upstream is an error
+	if err := ioutil.WriteFile(lockfile, []byte("foo-3.0-1.x86_64\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := run.selectPackages(repocache, ""); err == nil || !strings.Contains(err.Error(), "foo-0:3.0-1.x86_64") {
+		t.Errorf("Expected error for unavailable locked package, got: %v", err)
+	}
+
+	// invalid NEVRAs are rejected
+	if err := ioutil.WriteFile(lockfile, []byte("foo\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := run.selectPackages(repocache, ""); err == nil {
+		t.Errorf("Expected error for invalid NEVRA")
+	}
+}
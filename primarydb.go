@@ -7,11 +7,10 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-// TODO: Add support for XML primary dbs
-
 // Queries to create primary_db schema
 const (
 	sqlCreateTables = `CREATE TABLE db_info (dbversion INTEGER, checksum TEXT);
@@ -49,7 +48,9 @@ const sqlSelectPackages = `SELECT
  , location_href
  , pkgId
  , checksum_type
+ , time_file
  , time_build
+ , rpm_license
 FROM packages;`
 
 const (
@@ -176,6 +177,23 @@ func (c *PrimaryDatabase) InsertPackage(packages ...*rpm.PackageFile) error {
 			return err
 		}
 
+		// sizes not read by go-rpm from newer packages
+		installed, archive := p.Size(), p.ArchiveSize()
+		if installed == 0 || archive == 0 {
+			info, err := readPackageInfo(p.Path())
+			if err != nil {
+				return fmt.Errorf("Error reading package %s: %v", p.Path(), err)
+			}
+
+			if installed == 0 {
+				installed = info.InstalledSize
+			}
+
+			if archive == 0 {
+				archive = info.ArchiveSize
+			}
+		}
+
 		href := filepath.Base(p.Path())
 		res, err := stmt.Exec(
 			p.Name(),
@@ -188,8 +206,8 @@ func (c *PrimaryDatabase) InsertPackage(packages ...*rpm.PackageFile) error {
 			p.URL(),
 			p.FileTime().Unix(),
 			p.FileSize(),
-			p.Size(),
-			p.ArchiveSize(),
+			installed,
+			archive,
 			href,
 			sum,
 			p.ChecksumType(),
@@ -239,9 +257,18 @@ func (c *PrimaryDatabase) Packages() (PackageEntries, error) {
 		}
 
 		// scan the values into the slice
-		if err = rows.Scan(&p.Key, &p.PackageName, &p.Arch, &p.Versions.Epoch, &p.Versions.Version, &p.Versions.Release, &p.Size.Package, &p.Size.Installed, &p.Size.Archive, &p.Location.Href, &p.Checksums.Hash, &p.Checksums.Type, &p.Time.Build); err != nil {
+		var epoch, license sql.NullString
+		if err = rows.Scan(&p.Key, &p.PackageName, &p.Arch, &epoch, &p.Versions.Version, &p.Versions.Release, &p.Size.Package, &p.Size.Installed, &p.Size.Archive, &p.Location.Href, &p.Checksums.Hash, &p.Checksums.Type, &p.Time.File, &p.Time.Build, &license); err != nil {
 			return nil, fmt.Errorf("Error scanning packages: %v", err)
 		}
+		p.Format.License = license.String
+
+		// epoch is stored as text and may be empty
+		if epoch.Valid && epoch.String != "" {
+			if p.Versions.Epoch, err = strconv.Atoi(epoch.String); err != nil {
+				return nil, fmt.Errorf("Error parsing epoch of package %v: %v", p, err)
+			}
+		}
 
 		packages = append(packages, p)
 	}
@@ -295,6 +322,85 @@ func (c *PrimaryDatabase) DependenciesByPackage(pkgKey int, typ string) (rpm.Dep
 	return deps, nil
 }
 
+// packageDependencies returns the requires, provides and files of every
+// package in the primary_db, by pkgid.
+func (c *PrimaryDatabase) packageDependencies() (map[string]*packageDependencies, error) {
+	rows, err := c.db.Query("SELECT pkgKey, pkgId FROM packages")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[int]*packageDependencies)
+	deps := make(map[string]*packageDependencies)
+	for rows.Next() {
+		var key int
+		var pkgid string
+		if err := rows.Scan(&key, &pkgid); err != nil {
+			return nil, fmt.Errorf("Error scanning packages: %v", err)
+		}
+
+		d := &packageDependencies{}
+		keys[key] = d
+		deps[pkgid] = d
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, typ := range []string{"requires", "provides"} {
+		rows, err := c.db.Query(fmt.Sprintf("SELECT pkgKey, name, flags, epoch, version, release FROM %s", typ))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key int
+			var name string
+			var flags, epoch, version, release sql.NullString
+			if err := rows.Scan(&key, &name, &flags, &epoch, &version, &release); err != nil {
+				return nil, fmt.Errorf("Error reading dependencies: %v", err)
+			}
+
+			d := keys[key]
+			if d == nil {
+				continue
+			}
+
+			dep := dependency{Name: name, Flags: flags.String, Epoch: epoch.String, Version: version.String, Release: release.String}
+			if typ == "requires" {
+				d.Requires = append(d.Requires, dep)
+			} else {
+				d.Provides = append(d.Provides, dep)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err = c.db.Query("SELECT pkgKey, name FROM files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key int
+		var name string
+		if err := rows.Scan(&key, &name); err != nil {
+			return nil, fmt.Errorf("Error reading files: %v", err)
+		}
+
+		if d := keys[key]; d != nil {
+			d.Files = append(d.Files, name)
+		}
+	}
+
+	return deps, rows.Err()
+}
+
 // FilesByPackage returns all known files included in the package of the given
 // package key.
 func (c *PrimaryDatabase) FilesByPackage(pkgKey int) ([]string, error) {
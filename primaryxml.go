@@ -0,0 +1,273 @@
+package yum
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"github.com/cavaliercoder/go-rpm"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// XML namespaces of primary.xml files.
+const (
+	primaryXMLNS    = "http://linux.duke.edu/metadata/common"
+	primaryXMLNSRPM = "http://linux.duke.edu/metadata/rpm"
+)
+
+// primaryXMLPackage is the element of a primary.xml file written by createrepo
+// which describes a package.
+type primaryXMLPackage struct {
+	XMLName     xml.Name             `xml:"package"`
+	Type        string               `xml:"type,attr"`
+	Name        string               `xml:"name"`
+	Arch        string               `xml:"arch"`
+	Version     PackageEntryVersion  `xml:"version"`
+	Checksum    PackageEntryChecksum `xml:"checksum"`
+	Summary     string               `xml:"summary"`
+	Description string               `xml:"description"`
+	Packager    string               `xml:"packager"`
+	URL         string               `xml:"url"`
+	Time        PackageEntryTime     `xml:"time"`
+	Size        PackageEntrySize     `xml:"size"`
+	Location    struct {
+		Href string `xml:"href,attr"`
+	} `xml:"location"`
+	Format primaryXMLFormat `xml:"format"`
+}
+
+// primaryXMLFormat is the element of a package in a primary.xml file which
+// describes its RPM header.
+type primaryXMLFormat struct {
+	License     string `xml:"rpm:license"`
+	Vendor      string `xml:"rpm:vendor"`
+	Group       string `xml:"rpm:group"`
+	BuildHost   string `xml:"rpm:buildhost"`
+	SourceRPM   string `xml:"rpm:sourcerpm"`
+	HeaderRange struct {
+		Start uint64 `xml:"start,attr"`
+		End   uint64 `xml:"end,attr"`
+	} `xml:"rpm:header-range"`
+	Provides  *primaryXMLDependencies `xml:"rpm:provides,omitempty"`
+	Requires  *primaryXMLDependencies `xml:"rpm:requires,omitempty"`
+	Conflicts *primaryXMLDependencies `xml:"rpm:conflicts,omitempty"`
+	Obsoletes *primaryXMLDependencies `xml:"rpm:obsoletes,omitempty"`
+	Files     []string                `xml:"file"`
+}
+
+// primaryXMLDependencies lists the dependencies of one type of a package in a
+// primary.xml file.
+type primaryXMLDependencies struct {
+	Entries []primaryXMLDependency `xml:"rpm:entry"`
+}
+
+// primaryXMLDependency is a dependency in a primary.xml file. Unlike
+// dependency, the version attributes are omitted if the dependency has no
+// version.
+type primaryXMLDependency struct {
+	Name    string `xml:"name,attr"`
+	Flags   string `xml:"flags,attr,omitempty"`
+	Epoch   string `xml:"epoch,attr,omitempty"`
+	Version string `xml:"ver,attr,omitempty"`
+	Release string `xml:"rel,attr,omitempty"`
+}
+
+// dependencyFlags returns the flags used in repository metadata, such as GE,
+// for the comparison flags of a RPM dependency, or an empty string if the
+// dependency is not versioned.
+func dependencyFlags(flags int) string {
+	switch flags & (rpm.DepFlagLesser | rpm.DepFlagGreater | rpm.DepFlagEqual) {
+	case rpm.DepFlagEqual:
+		return "EQ"
+
+	case rpm.DepFlagLesser:
+		return "LT"
+
+	case rpm.DepFlagLesserOrEqual:
+		return "LE"
+
+	case rpm.DepFlagGreaterOrEqual:
+		return "GE"
+
+	case rpm.DepFlagGreater:
+		return "GT"
+	}
+
+	return ""
+}
+
+// newPrimaryXMLDependencies returns the given RPM dependencies as listed in a
+// primary.xml file, or nil if there are none. As with createrepo, rpmlib()
+// dependencies, which are satisfied by rpm itself, are omitted.
+func newPrimaryXMLDependencies(deps rpm.Dependencies) *primaryXMLDependencies {
+	entries := make([]primaryXMLDependency, 0, len(deps))
+	for _, d := range deps {
+		if strings.HasPrefix(d.Name(), "rpmlib(") {
+			continue
+		}
+
+		e := primaryXMLDependency{Name: d.Name(), Flags: dependencyFlags(d.Flags())}
+		if e.Flags != "" {
+			e.Epoch, e.Version, e.Release = strconv.Itoa(d.Epoch()), d.Version(), d.Release()
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return &primaryXMLDependencies{Entries: entries}
+}
+
+// isPrimaryFile returns true if the given file of a package is listed in
+// primary.xml, rather than only in filelists.xml, as with createrepo, so that
+// the most commonly required files may be resolved from primary.xml alone.
+func isPrimaryFile(path string) bool {
+	return strings.HasPrefix(path, "/etc/") || strings.Contains(path, "bin/") || path == "/usr/lib/sendmail"
+}
+
+// newPrimaryXMLPackage returns the entry of the given package file in a
+// primary.xml file.
+func newPrimaryXMLPackage(p *rpm.PackageFile) (*primaryXMLPackage, error) {
+	sum, err := p.Checksum()
+	if err != nil {
+		return nil, err
+	}
+
+	// sizes not read by go-rpm from newer packages
+	installed, archive := p.Size(), p.ArchiveSize()
+	if installed == 0 || archive == 0 {
+		info, err := readPackageInfo(p.Path())
+		if err != nil {
+			return nil, fmt.Errorf("Error reading package %s: %v", p.Path(), err)
+		}
+
+		if installed == 0 {
+			installed = info.InstalledSize
+		}
+
+		if archive == 0 {
+			archive = info.ArchiveSize
+		}
+	}
+
+	e := &primaryXMLPackage{
+		Type:        "rpm",
+		Name:        p.Name(),
+		Arch:        p.Architecture(),
+		Version:     PackageEntryVersion{Epoch: p.Epoch(), Version: p.Version(), Release: p.Release()},
+		Checksum:    PackageEntryChecksum{Type: p.ChecksumType(), Pkgid: "YES", Hash: sum},
+		Summary:     p.Summary(),
+		Description: p.Description(),
+		Packager:    p.Packager(),
+		URL:         p.URL(),
+		Time:        PackageEntryTime{File: p.FileTime().Unix(), Build: p.BuildTime().Unix()},
+		Size:        PackageEntrySize{Package: int64(p.FileSize()), Installed: int64(installed), Archive: int64(archive)},
+	}
+	e.Location.Href = filepath.Base(p.Path())
+
+	e.Format.License = p.License()
+	e.Format.Vendor = p.Vendor()
+	e.Format.Group = strings.Join(p.Groups(), "\n")
+	e.Format.BuildHost = p.BuildHost()
+	e.Format.SourceRPM = p.SourceRPM()
+	e.Format.HeaderRange.Start = p.HeaderStart()
+	e.Format.HeaderRange.End = p.HeaderEnd()
+	e.Format.Provides = newPrimaryXMLDependencies(p.Provides())
+	e.Format.Requires = newPrimaryXMLDependencies(p.Requires())
+	e.Format.Conflicts = newPrimaryXMLDependencies(p.Conflicts())
+	e.Format.Obsoletes = newPrimaryXMLDependencies(p.Obsoletes())
+	for _, f := range p.Files() {
+		if isPrimaryFile(f) {
+			e.Format.Files = append(e.Format.Files, f)
+		}
+	}
+
+	return e, nil
+}
+
+// metadataXMLWriter writes a package metadata file, such as primary.xml. The
+// number of packages must be given in the root element, so packages are
+// written to a temporary file until the metadata file is written by Close.
+type metadataXMLWriter struct {
+	path  string
+	root  string
+	xmlns string
+	tmp   *os.File
+	w     *bufio.Writer
+	enc   *xml.Encoder
+	count int
+}
+
+// createMetadataXML creates a writer of the package metadata file at the given
+// path, with the given root element and namespace attributes.
+func createMetadataXML(path, root, xmlns string) (*metadataXMLWriter, error) {
+	tmp, err := os.Create(path + ".packages")
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(tmp)
+	return &metadataXMLWriter{
+		path:  path,
+		root:  root,
+		xmlns: xmlns,
+		tmp:   tmp,
+		w:     w,
+		enc:   xml.NewEncoder(w),
+	}, nil
+}
+
+// createPrimaryXML creates a writer of the primary.xml file at the given path.
+func createPrimaryXML(path string) (*metadataXMLWriter, error) {
+	return createMetadataXML(path, "metadata", fmt.Sprintf(`xmlns="%s" xmlns:rpm="%s"`, primaryXMLNS, primaryXMLNSRPM))
+}
+
+// Write writes the given package entry.
+func (c *metadataXMLWriter) Write(p interface{}) error {
+	if err := c.enc.Encode(p); err != nil {
+		return err
+	}
+
+	c.count++
+	_, err := c.w.WriteString("\n")
+	return err
+}
+
+// Close writes the metadata file, with each package which was written, and
+// removes the temporary file.
+func (c *metadataXMLWriter) Close() error {
+	defer os.Remove(c.tmp.Name())
+	defer c.tmp.Close()
+
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := c.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	f, err := os.Create(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s<%s %s packages=\"%d\">\n", xml.Header, c.root, c.xmlns, c.count)
+	if _, err := io.Copy(w, c.tmp); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "</%s>\n", c.root)
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
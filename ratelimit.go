@@ -0,0 +1,481 @@
+package yum
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// BandwidthWindow is a daily time window during which package downloads for a
+// repo are limited to the given rate. Start and End are the time since
+// midnight, in local time. A window which ends before it starts spans
+// midnight.
+type BandwidthWindow struct {
+	Start          time.Duration
+	End            time.Duration
+	BytesPerSecond int64
+}
+
+// Contains returns true if the time of day of the given time is within the
+// window.
+func (c BandwidthWindow) Contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if c.Start <= c.End {
+		return tod >= c.Start && tod < c.End
+	}
+
+	return tod >= c.Start || tod < c.End
+}
+
+func (c BandwidthWindow) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+
+	return fmt.Sprintf("%s-%s=%s", clock(c.Start), clock(c.End), formatRate(c.BytesPerSecond))
+}
+
+// parseRate parses a rate in bytes per second such as 5M or 512K. Zero
+// disables rate limiting.
+func parseRate(s string) (int64, error) {
+	if s == "0" {
+		return 0, nil
+	}
+
+	n, err := bytefmt.ToBytes(s)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
+
+// formatRate formats a rate in bytes per second as accepted by parseRate.
+func formatRate(n int64) string {
+	units := []string{"T", "G", "M", "K"}
+	for i, unit := range units {
+		size := int64(1) << uint(10*(len(units)-i))
+		if n >= size && n%size == 0 {
+			return fmt.Sprintf("%d%s", n/size, unit)
+		}
+	}
+
+	return fmt.Sprintf("%dB", n)
+}
+
+// ParseBandwidthSchedule parses a bandwidth schedule of whitespace or comma
+// separated windows, such as "08:00-18:00=5M 18:00-22:00=20M". Each window is
+// a start and end time of day followed by the rate limit in bytes per second
+// during the window.
+func ParseBandwidthSchedule(s string) ([]BandwidthWindow, error) {
+	parseClock := func(s string) (time.Duration, error) {
+		t, err := time.Parse("15:04", s)
+		if err != nil {
+			return 0, err
+		}
+
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+
+	schedule := make([]BandwidthWindow, 0)
+	for _, field := range splitPatterns(s) {
+		i := strings.Index(field, "=")
+		j := strings.Index(field, "-")
+		if i < 0 || j < 0 || j > i {
+			return nil, fmt.Errorf("Expected 'hh:mm-hh:mm=rate' in bandwidth schedule: %s", field)
+		}
+
+		start, err := parseClock(field[:j])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid start time in bandwidth schedule: %s", field)
+		}
+
+		end, err := parseClock(field[j+1 : i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid end time in bandwidth schedule: %s", field)
+		}
+
+		rate, err := parseRate(field[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rate in bandwidth schedule: %s: %v", field, err)
+		}
+
+		schedule = append(schedule, BandwidthWindow{Start: start, End: end, BytesPerSecond: rate})
+	}
+
+	return schedule, nil
+}
+
+// bandwidthLimit returns the download rate limit of the repo in bytes per
+// second at the given time, according to the first window of its
+// BandwidthSchedule which contains the time, or otherwise MaxBytesPerSecond.
+// Zero means unlimited.
+func (c *Repo) bandwidthLimit(t time.Time) int64 {
+	for _, window := range c.BandwidthSchedule {
+		if window.Contains(t) {
+			return window.BytesPerSecond
+		}
+	}
+
+	return c.MaxBytesPerSecond
+}
+
+// rateLimiter limits the rate at which bytes are read by all downloads of a
+// repo. The limit is evaluated each time bytes are read so that it may change
+// during a long sync.
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit func(time.Time) int64
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	// next is the time at which the next byte may be read
+	next time.Time
+}
+
+func newRateLimiter(limit func(time.Time) int64) *rateLimiter {
+	return &rateLimiter{
+		limit: limit,
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// wait blocks until n more bytes may be read without exceeding the current
+// rate limit.
+func (c *rateLimiter) wait(n int) {
+	c.mu.Lock()
+	now := c.now()
+	rate := c.limit(now)
+	if rate <= 0 || c.next.Before(now) {
+		c.next = now
+	}
+
+	if rate > 0 {
+		c.next = c.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	}
+	d := c.next.Sub(now)
+	c.mu.Unlock()
+
+	if d > 0 {
+		c.sleep(d)
+	}
+}
+
+// rateLimitedBody limits the rate at which a HTTP response body is read.
+type rateLimitedBody struct {
+	io.ReadCloser
+	limiter *rateLimiter
+}
+
+// rateLimitChunk is the maximum number of bytes read at once from a rate
+// limited response body, so that the limiter is consulted regularly.
+const rateLimitChunk = 32 * 1024
+
+func (c *rateLimitedBody) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.limiter.wait(n)
+	}
+
+	return n, err
+}
+
+// rateLimitedTransport is a http.RoundTripper which limits the rate at which
+// response bodies are read.
+type rateLimitedTransport struct {
+	transport http.RoundTripper
+	limiter   *rateLimiter
+}
+
+func (c *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = &rateLimitedBody{ReadCloser: resp.Body, limiter: c.limiter}
+	return resp, nil
+}
+
+// downloadClient returns the HTTP client used to download packages for the
+// repo. If the repo has a rate limit or bandwidth schedule, the client shares
+// the connections of the repo's HTTP client but limits the rate of all
+// downloads for the repo.
+func (c *Repo) downloadClient() *http.Client {
+	if c.MaxBytesPerSecond <= 0 && len(c.BandwidthSchedule) == 0 {
+		return c.client()
+	}
+
+	if c.limiter == nil {
+		c.limiter = newRateLimiter(c.bandwidthLimit)
+	}
+
+	return &http.Client{
+		Transport: &rateLimitedTransport{
+			transport: c.client().Transport,
+			limiter:   c.limiter,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// metadataSlotKey identifies the metadata requests to a host which share a
+// limit of concurrent requests.
+type metadataSlotKey struct {
+	host  string
+	limit int
+}
+
+// metadataSlots limit the number of concurrent metadata requests to each host
+// for repos which set MetadataThreads, independently of package downloads.
+var (
+	metadataSlotsMu sync.Mutex
+	metadataSlots   = make(map[metadataSlotKey]chan struct{})
+)
+
+// openMetadataURL opens the repository metadata at the given URL as per
+// openURL. If the repo has MetadataThreads, no more than that many metadata
+// requests are made to the host of the URL at once, until each returned body
+// is closed. The limit is shared by every repo whose metadata is on the same
+// host and which has the same MetadataThreads.
+func (c *Repo) openMetadataURL(rawurl string) (io.ReadCloser, error) {
+	if c.MetadataThreads <= 0 || isFileURL(rawurl) {
+		return openURL(c.client(), rawurl, c.userAgent())
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	key := metadataSlotKey{host: u.Host, limit: c.MetadataThreads}
+	metadataSlotsMu.Lock()
+	slots, ok := metadataSlots[key]
+	if !ok {
+		slots = make(chan struct{}, c.MetadataThreads)
+		metadataSlots[key] = slots
+	}
+	metadataSlotsMu.Unlock()
+
+	slots <- struct{}{}
+	body, err := openURL(c.client(), rawurl, c.userAgent())
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+
+	return &metadataBody{ReadCloser: body, slots: slots}, nil
+}
+
+// metadataBody is the body of a metadata request, which releases its slot
+// when it is first closed.
+type metadataBody struct {
+	io.ReadCloser
+	slots chan struct{}
+	once  sync.Once
+}
+
+func (c *metadataBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { <-c.slots })
+	return err
+}
+
+// throttleRetries is the number of times a request which is refused with 429
+// Too Many Requests is retried before the response is returned to the caller.
+const throttleRetries = 5
+
+// maxRetryAfter is the longest a request is delayed after a 429 response,
+// regardless of the server's Retry-After header.
+const maxRetryAfter = 5 * time.Minute
+
+// throttleSerialRequests is the number of requests to a host which are made
+// one at a time after a 429 response, before concurrent requests resume.
+const throttleSerialRequests = 10
+
+// throttle pauses and then serializes the requests to a host which has
+// refused a request with 429 Too Many Requests, so that every download thread
+// backs off rather than only the thread which was refused.
+type throttle struct {
+	mu    sync.Mutex
+	now   func() time.Time
+	sleep func(time.Duration)
+	slot  chan struct{}
+
+	// until is the time before which no request may be made
+	until time.Time
+
+	// serial is the number of requests which remain to be made one at a time
+	serial int
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		now:   time.Now,
+		sleep: time.Sleep,
+		slot:  make(chan struct{}, 1),
+	}
+}
+
+// throttles are the throttles of each host to which requests have been made.
+var (
+	throttlesMu sync.Mutex
+	throttles   = make(map[string]*throttle)
+)
+
+// hostThrottle returns the throttle shared by all requests to the given host.
+func hostThrottle(host string) *throttle {
+	throttlesMu.Lock()
+	defer throttlesMu.Unlock()
+
+	t, ok := throttles[host]
+	if !ok {
+		t = newThrottle()
+		throttles[host] = t
+	}
+
+	return t
+}
+
+// wait blocks until a request may be made and returns true if the request
+// must be made alone, in which case release must be called once its response
+// has been read.
+func (c *throttle) wait() bool {
+	c.mu.Lock()
+	d := c.until.Sub(c.now())
+	serial := c.serial > 0
+	c.mu.Unlock()
+
+	if d > 0 {
+		c.sleep(d)
+	}
+
+	if serial {
+		c.slot <- struct{}{}
+	}
+
+	return serial
+}
+
+// release ends a request started by wait. If the request was not refused,
+// the number of serial requests is reduced.
+func (c *throttle) release(serial, refused bool) {
+	if serial {
+		<-c.slot
+	}
+
+	if refused {
+		return
+	}
+
+	c.mu.Lock()
+	if c.serial > 0 {
+		c.serial--
+	}
+	c.mu.Unlock()
+}
+
+// backoff delays all further requests by the given duration and serializes
+// the requests which follow.
+func (c *throttle) backoff(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if until := c.now().Add(d); until.After(c.until) {
+		c.until = until
+	}
+	c.serial = throttleSerialRequests
+}
+
+// retryAfter returns the delay requested by the given Retry-After header,
+// which is either a number of seconds or a HTTP date. If the header is empty
+// or invalid, the delay doubles from one second with each attempt. The delay
+// is capped at maxRetryAfter.
+func retryAfter(header string, attempt int, now time.Time) time.Duration {
+	d := time.Second << uint(attempt-1)
+	if header != "" {
+		if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+			d = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(header); err == nil {
+			d = t.Sub(now)
+		}
+	}
+
+	if d < 0 {
+		d = 0
+	} else if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+
+	return d
+}
+
+// throttleTransport is a http.RoundTripper which retries requests refused
+// with 429 Too Many Requests after the delay given by the server and throttles
+// the other requests to the same host meanwhile.
+type throttleTransport struct {
+	transport http.RoundTripper
+}
+
+func (c *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := hostThrottle(req.URL.Host)
+	for attempt := 1; ; attempt++ {
+		serial := t.wait()
+		resp, err := c.transport.RoundTrip(req)
+		if err != nil {
+			t.release(serial, false)
+			return nil, err
+		}
+
+		// serial requests hold the slot until the response is read
+		refused := resp.StatusCode == http.StatusTooManyRequests
+		if !refused {
+			if serial {
+				resp.Body = &throttleBody{ReadCloser: resp.Body, throttle: t}
+			} else {
+				t.release(serial, false)
+			}
+			return resp, nil
+		}
+		t.release(serial, true)
+
+		// requests with a body cannot be replayed
+		if attempt > throttleRetries || (req.Body != nil && req.Body != http.NoBody) {
+			return resp, nil
+		}
+
+		d := retryAfter(resp.Header.Get("Retry-After"), attempt, t.now())
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		t.backoff(d)
+		Printf("Too many requests to %s, retrying %s in %v\n", req.URL.Host, req.URL.Path, d)
+	}
+}
+
+// throttleBody is the body of a serial request, which releases the throttle's
+// slot when it is first closed.
+type throttleBody struct {
+	io.ReadCloser
+	throttle *throttle
+	once     sync.Once
+}
+
+func (c *throttleBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.once.Do(func() { c.throttle.release(true, false) })
+	return err
+}
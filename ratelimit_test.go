@@ -0,0 +1,366 @@
+package yum
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule("08:00-18:00=5M, 22:00-06:00=0")
+	if err != nil {
+		t.Fatalf("Error parsing bandwidth schedule: %v", err)
+	}
+
+	if len(schedule) != 2 || schedule[0].String() != "08:00-18:00=5M" || schedule[1].String() != "22:00-06:00=0B" {
+		t.Fatalf("Unexpected bandwidth schedule: %v", schedule)
+	}
+
+	repo := NewRepo()
+	repo.MaxBytesPerSecond = 20 << 20
+	repo.BandwidthSchedule = schedule
+
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04:05", "2020-01-01 "+clock, time.Local)
+		return t
+	}
+
+	tests := []struct {
+		clock string
+		rate  int64
+	}{
+		{"07:59:59", 20 << 20},
+		{"08:00:00", 5 << 20},
+		{"17:59:59", 5 << 20},
+		{"18:00:00", 20 << 20},
+		{"23:30:00", 0},
+		{"05:59:59", 0},
+		{"06:00:00", 20 << 20},
+	}
+
+	for _, test := range tests {
+		if rate := repo.bandwidthLimit(at(test.clock)); rate != test.rate {
+			t.Errorf("Expected rate limit %d at %s, got %d", test.rate, test.clock, rate)
+		}
+	}
+
+	for _, s := range []string{"08:00=5M", "8am-6pm=5M", "08:00-18:00=fast"} {
+		if _, err := ParseBandwidthSchedule(s); err == nil {
+			t.Errorf("Expected error parsing bandwidth schedule: %s", s)
+		}
+	}
+}
+
+func TestRateLimiterFollowsSchedule(t *testing.T) {
+	repo := NewRepo()
+	repo.BandwidthSchedule = []BandwidthWindow{
+		{Start: 8 * time.Hour, End: 18 * time.Hour, BytesPerSecond: 1000},
+	}
+
+	// simulated clock which advances when the limiter sleeps
+	clock, _ := time.ParseInLocation("2006-01-02 15:04:05", "2020-01-01 17:59:58", time.Local)
+	slept := time.Duration(0)
+	limiter := newRateLimiter(repo.bandwidthLimit)
+	limiter.now = func() time.Time { return clock }
+	limiter.sleep = func(d time.Duration) {
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	// throttled during business hours
+	limiter.wait(1000)
+	limiter.wait(1000)
+	if slept != 2*time.Second {
+		t.Errorf("Expected to sleep 2s for 2000 bytes at 1000 B/s, slept %v", slept)
+	}
+
+	// unlimited once the clock crosses the end of the window
+	slept = 0
+	limiter.wait(1 << 20)
+	if slept != 0 {
+		t.Errorf("Expected no rate limit after 18:00, slept %v", slept)
+	}
+}
+
+func TestRepoFileThrottle(t *testing.T) {
+	repos, _, err := readRepoFile(strings.NewReader(`[base]
+baseurl=http://mirror.centos.org/centos/7/os/x86_64/
+throttle=20M
+bandwidth_schedule=08:00-18:00=5M
+`), "test.repo")
+	if err != nil {
+		t.Fatalf("Error reading repo file: %v", err)
+	}
+
+	if repos[0].MaxBytesPerSecond != 20<<20 || len(repos[0].BandwidthSchedule) != 1 || repos[0].BandwidthSchedule[0].BytesPerSecond != 5<<20 {
+		t.Errorf("Unexpected rate limits for repo %v: %d %v", repos[0], repos[0].MaxBytesPerSecond, repos[0].BandwidthSchedule)
+	}
+
+	if _, _, err := readRepoFile(strings.NewReader("[base]\nthrottle=fast\n"), "test.repo"); err == nil {
+		t.Errorf("Expected error reading invalid throttle")
+	}
+}
+
+func TestMetadataThreads(t *testing.T) {
+	defer func(n int) { CacheThreads = n }(CacheThreads)
+	CacheThreads = 3
+
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// count concurrent metadata requests; package requests are not delayed
+	ids := []string{"base", "updates", "extras"}
+	upstream := newTestRepoServer(t, ids...)
+	defer upstream.Close()
+
+	var active, peak int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".rpm") {
+			w.Write([]byte("package"))
+			return
+		}
+
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		upstream.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	repos := make([]*Repo, len(ids))
+	for i, id := range ids {
+		repos[i] = NewRepo()
+		repos[i].ID = id
+		repos[i].BaseURL = ts.URL + "/" + id
+		repos[i].MetadataThreads = 1
+	}
+
+	if _, err := CacheAll(repos, dir); err != nil {
+		t.Fatalf("Error caching repos: %v", err)
+	}
+
+	if peak != 1 {
+		t.Errorf("Expected 1 concurrent metadata request, got %d", peak)
+	}
+
+	// package downloads are not limited by metadata requests in progress
+	body, err := repos[0].openMetadataURL(ts.URL + "/base/repodata/repomd.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+
+	// repos with another limit on the same host have their own slots
+	other := NewRepo()
+	other.ID = "other"
+	other.BaseURL = ts.URL + "/updates"
+	other.MetadataThreads = 2
+
+	opened := make(chan error, 1)
+	go func() {
+		body, err := other.openMetadataURL(ts.URL + "/updates/repodata/repomd.xml")
+		if err == nil {
+			body.Close()
+		}
+		opened <- err
+	}()
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			t.Errorf("Error opening metadata: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Metadata request was blocked by the limit of another repo")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := repos[0].downloadClient().Get(ts.URL + "/base/Packages/foo-1.0-1.x86_64.rpm")
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Error downloading package: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Package download was blocked by a metadata request")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		header   string
+		attempt  int
+		expected time.Duration
+	}{
+		{"", 1, time.Second},
+		{"", 3, 4 * time.Second},
+		{"0", 1, 0},
+		{"30", 2, 30 * time.Second},
+		{"Fri, 01 May 2020 12:01:30 GMT", 1, 90 * time.Second},
+		{"Fri, 01 May 2020 11:00:00 GMT", 1, 0},
+		{"soon", 2, 2 * time.Second},
+		{"86400", 1, maxRetryAfter},
+	} {
+		if d := retryAfter(test.header, test.attempt, now); d != test.expected {
+			t.Errorf("Expected delay %v for Retry-After '%s' on attempt %d, got %v", test.expected, test.header, test.attempt, d)
+		}
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	// refuse the first requests with and without a Retry-After header
+	var requests int32
+	refuse := int32(2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if n <= atomic.LoadInt32(&refuse) {
+			if n == 1 {
+				w.Header().Set("Retry-After", "120")
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Write([]byte("package"))
+	}))
+	defer ts.Close()
+
+	// record delays without sleeping
+	var mu sync.Mutex
+	clock := time.Now()
+	delays := make([]time.Duration, 0)
+	throttle := newThrottle()
+	throttle.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return clock
+	}
+	throttle.sleep = func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		delays = append(delays, d)
+		clock = clock.Add(d)
+	}
+
+	host := strings.TrimPrefix(ts.URL, "http://")
+	throttlesMu.Lock()
+	throttles[host] = throttle
+	throttlesMu.Unlock()
+	defer func() {
+		throttlesMu.Lock()
+		delete(throttles, host)
+		throttlesMu.Unlock()
+	}()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.MaxBytesPerSecond = 1 << 20
+	resp, err := repo.downloadClient().Get(ts.URL + "/Packages/foo-1.0-1.x86_64.rpm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK || string(b) != "package" {
+		t.Errorf("Expected package after 429 responses, got %s: %s", resp.Status, b)
+	}
+
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, got %d", requests)
+	}
+
+	expected := []time.Duration{120 * time.Second, 2 * time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("Expected delays %v, got %v", expected, delays)
+	}
+
+	// requests which follow are serialized until the host recovers, including
+	// the transfer of each response body
+	inflight, peak := int32(0), int32(0)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inflight, 1)
+		defer atomic.AddInt32(&inflight, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		w.Write([]byte("pack"))
+		w.(http.Flusher).Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("age"))
+	}))
+	defer slow.Close()
+
+	slowHost := strings.TrimPrefix(slow.URL, "http://")
+	throttlesMu.Lock()
+	throttles[slowHost] = throttle
+	throttlesMu.Unlock()
+	defer func() {
+		throttlesMu.Lock()
+		delete(throttles, slowHost)
+		throttlesMu.Unlock()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := repo.downloadClient().Get(slow.URL + "/Packages/foo-1.0-1.x86_64.rpm")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Errorf("Expected serialized downloads to be made one at a time, got %d at once", peak)
+	}
+
+	// the response is returned once retries are exhausted
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&refuse, throttleRetries+10)
+	if _, err := openURL(repo.client(), ts.URL+"/Packages/foo-1.0-1.x86_64.rpm", repo.userAgent()); err == nil {
+		t.Errorf("Expected an error after %d refused requests", throttleRetries+1)
+	}
+
+	if requests != throttleRetries+1 {
+		t.Errorf("Expected %d requests, got %d", throttleRetries+1, requests)
+	}
+}
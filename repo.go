@@ -1,59 +1,585 @@
 package yum
 
 import (
-	"encoding/hex"
 	"fmt"
-	"github.com/cavaliercoder/go-rpm"
-	"github.com/cavaliercoder/grab"
-	"code.cloudfoundry.org/bytefmt"
-	"golang.org/x/crypto/openpgp"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 // Repo is a package repository defined in a Yumfile
+//
+// Relative LocalPath, CachePath, StagingDir, TempDir, Groupfile, GPGKey,
+// SignKey, ResignKey and PackageLockFile paths in a Yumfile are relative to the directory of the Yumfile, not the working
+// directory. See ResolvePaths.
+//
+// LocalPath, or any package directory given to Sync or Repair, may include the
+// date on which the sync starts, such as to archive a snapshot of the repo
+// each day, as $date, in the form 2006-01-02, or as $(date:format), where
+// format is a strftime format such as %Y/%m/%d. Each dated package directory
+// shares the repo's metadata cache.
+//
+// Package files in LocalPath which are symlinks, such as to a shared package
+// store, are only validated and listed in the repository metadata if
+// FollowSymlinks is set, in which case a symlink to a package which is listed
+// already is ignored so that each package is listed once. Otherwise, each
+// symlinked package is downloaded again in place of its symlink. Downloads
+// always replace a symlink, rather than overwriting the file it links to.
+//
+// MinDate and MaxDate select only the packages built within a window of
+// dates. Build times are Unix timestamps, so they compare as instants whatever
+// the time zone of MinDate and MaxDate, and packages built up to
+// DateSkewTolerance before or after the window are selected too, so that
+// packages built at the boundaries of the window by a build host with a
+// skewed clock are not excluded.
+//
+// CheckMagic validates that each downloaded package begins with the magic
+// numbers of a RPM lead and header before it is GPG checked or indexed, so
+// that a file which is not a package, such as an error page served by a
+// mirror, is rejected even if it passes the size and checksum validation.
+//
+// Packages listed more than once with the same NEVRA by a broken upstream
+// repository, such as at different locations or with different checksums,
+// are logged and only one of them is synchronized, unless RejectDuplicates is
+// set, in which case the sync fails with an ErrDuplicatePackage error.
+//
+// MaxPackageSize skips each package larger than the given number of bytes,
+// such as large documentation or game data packages on a mirror with little
+// space. Unlike the limits on the size of a sync, it excludes only the
+// oversized packages, and the rest of the repo is synced.
+//
+// ExcludeLicenses and IncludeLicenses filter packages by the glob patterns of
+// license names, such as "GPL*", matched without regard to case against each
+// license in the license expression of a package. A package is excluded if any
+// of its licenses matches ExcludeLicenses or, if IncludeLicenses is set, if
+// any does not match IncludeLicenses. Licenses missing from the repository
+// metadata are read from the headers of the packages upstream.
+//
+// CachePath may list several cache directories, such as on different volumes,
+// separated by os.PathListSeparator or, in a Yumfile, given on separate lines.
+// See Cache.
+//
+// BaseURL and Mirrors may be s3://bucket/prefix URLs of repos in private S3
+// buckets, which are read with signed S3 API requests in the S3Region, using
+// the AWS credentials given by the environment, the shared credentials file or
+// the IAM role of the ECS task or EC2 instance, which are loaded when first
+// needed and again before they expire.
+// S3Endpoint may give the URL of an S3-compatible store to use instead of AWS.
 type Repo struct {
-	ID             string
-	Name           string
-	Architecture   string
-	BaseURL        string
-	CachePath      string
-	Checksum       string
-	DeleteRemoved  bool
-	GPGCheck       bool
-	GPGKey         string
-	Groupfile      string
-	IncludeSources bool
-	LocalPath      string
-	MirrorURL      string
-	NewOnly        bool
-	MaxDate        time.Time
-	MinDate        time.Time
-	YumfileLineNo  int
-	YumfilePath    string
+	ID                  string
+	Name                string
+	AllowUnsigned       bool
+	Architecture        string
+	AssumeYes           bool
+	AutoSatisfyDeps     bool
+	BandwidthSchedule   []BandwidthWindow
+	BaseURL             string
+	CachePath           string
+	CheckClosure        bool
+	CheckMagic          bool
+	Checksum            string
+	ChecksumPolicy      ChecksumPolicy
+	ConfirmFunc         func(plan SyncPlan) bool
+	DateSkewTolerance   time.Duration
+	DeleteOlderThan     time.Duration
+	DeleteRemoved       bool
+	DropUnknownMetadata bool
+	EmitSQLite          bool
+	Enabled             bool
+	Exclude             []string
+	ExcludeLicenses     []string
+	ExcludeRegex        string
+	ExportChecksums     bool
+	FailOnPartial       bool
+	FilenameFunc        func(p PackageEntry) string
+	FilterAuditFunc     func(p PackageEntry, kept bool, reason string)
+	FollowSymlinks      bool
+	ForceCreaterepo     bool
+	ForceRefresh        bool
+	Frozen              bool
+	FullResync          bool
+	GenerateChangelog   bool
+	GPGCheck            bool
+	GPGCheckLocal       bool
+	GPGKey              string
+	Groupfile           string
+	HeaderHosts         []string
+	Headers             map[string]string
+	IncludeGroups       []string
+	IncludeLicenses     []string
+	IncludeModules      []string
+	IncludePackages     []string
+	IncludeRegex        string
+	IncludeSources      bool
+	IncrementalByDate   bool
+	IncrementalByMtime  bool
+	KeepVersions        int
+	LocalPath           string
+	LockWait            bool
+	MaxBytesPerSecond   int64
+	MaxPackageSize      uint64
+	MetadataExpire      time.Duration
+	MetadataThreads     int
+	MirrorURL           string
+	Mirrors             []string
+	NewOnly             bool
+	Notifier            Notifier
+	NotifyWebhook       string
+	PackageLockFile     string
+	PinRevision         string
+	PreserveAppstream   bool
+	PreserveProductID   bool
+	PreserveRepodata    bool
+	Priority            int
+	QuarantineOnGPGFail bool
+	RejectDuplicates    bool
+	RequireSHA256       bool
+	ReportOrphans       bool
+	ResignKey           string
+	ResignKeyPassphrase string
+	ResumeState         bool
+	S3Endpoint          string
+	S3Region            string
+	SeparateDebugRepo   bool
+	SignKey             string
+	SignKeyPassphrase   string
+	StagingDir          string
+	TempDir             string
+	URLRewriteFunc      func(rawurl string) (string, error)
+	UserAgent           string
+	VaultURL            string
+	Zsync               bool
+	MaxDate             time.Time
+	MinDate             time.Time
+	YumfileLineNo       int
+	YumfilePath         string
+
+	mirrorsResolved bool
+	listedMirrors   map[string]bool
+	limiter         *rateLimiter
+	globalExclude   []string
 }
 
+// MetadataNeverExpires may be assigned to Repo.MetadataExpire so that cached
+// metadata is never refreshed unless Repo.ForceRefresh is set.
+const MetadataNeverExpires time.Duration = -1
+
+// DefaultPriority is the Priority of a repo which does not set one, as with
+// the yum priorities plugin. Repos with a lower value take precedence.
+const DefaultPriority = 99
+
 // NewRepo initializes a new Repo struct and returns a pointer to it.
 func NewRepo() *Repo {
-	return &Repo{}
+	return &Repo{
+		EmitSQLite:    true,
+		Enabled:       true,
+		FailOnPartial: true,
+		Priority:      DefaultPriority,
+	}
 }
 
 func (c Repo) String() string {
 	return c.ID
 }
 
+// userAgent returns the User-Agent header to send with HTTP requests for the
+// repo.
+func (c *Repo) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+
+	return UserAgent
+}
+
+// client returns the HTTP client used for all requests for the repo. If the
+// repo has Headers or is a S3 bucket, the client shares the connections of the
+// shared HTTP client but sends the headers with each request to one of the
+// repo's headerHosts and makes signed S3 API requests for s3:// URLs.
+func (c *Repo) client() *http.Client {
+	if len(c.Headers) == 0 && !c.usesS3() {
+		return httpClient()
+	}
+
+	transport := httpClient().Transport
+	if c.usesS3() {
+		transport = &s3Transport{
+			transport:   transport,
+			region:      c.s3Region(),
+			endpoint:    c.S3Endpoint,
+			credentials: sharedS3Credentials.get,
+			now:         time.Now,
+		}
+	}
+
+	if len(c.Headers) > 0 {
+		transport = &headerTransport{
+			transport: transport,
+			headers:   c.Headers,
+			hosts:     c.headerHosts(),
+		}
+	}
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// headerHosts returns the hosts to which the repo's Headers are sent: the
+// hosts of BaseURL, MirrorURL and the Mirrors given in the Yumfile, and each of
+// HeaderHosts. Mirrors resolved from the mirror list, and hosts to which
+// requests are redirected, such as CDNs, are not sent the headers unless they
+// are listed in HeaderHosts, so that secrets such as API keys are not sent to
+// third parties.
+func (c *Repo) headerHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, h := range c.HeaderHosts {
+		hosts[strings.ToLower(h)] = true
+	}
+
+	for _, rawurl := range append([]string{c.BaseURL, c.MirrorURL}, c.Mirrors...) {
+		if c.listedMirrors[rawurl] {
+			continue
+		}
+
+		if u, err := url.Parse(rawurl); err == nil && u.Host != "" {
+			hosts[strings.ToLower(u.Host)] = true
+		}
+	}
+
+	return hosts
+}
+
+// checksumPolicy returns the repo's ChecksumPolicy or, if not set,
+// SHA256ChecksumPolicy if RequireSHA256 is set, or DefaultChecksumPolicy.
+func (c *Repo) checksumPolicy() ChecksumPolicy {
+	if c.ChecksumPolicy != nil {
+		return c.ChecksumPolicy
+	}
+
+	if c.RequireSHA256 {
+		return SHA256ChecksumPolicy
+	}
+
+	return DefaultChecksumPolicy
+}
+
+// checkChecksumType returns an ErrWeakChecksum error if the given checksum type
+// is not permitted by the repo's checksumPolicy.
+func (c *Repo) checkChecksumType(checksum_type string) error {
+	policy := c.checksumPolicy()
+	if policy == nil {
+		return nil
+	}
+
+	return policy.CheckAlgorithm(checksum_type)
+}
+
+// snapshotDirname is the directory of an upstream repository from which each
+// snapshot of the repository is served as snapshots/<revision>/, if it keeps
+// historical snapshots.
+const snapshotDirname = "snapshots"
+
+// repoURL returns the URL from which the repo is served by the given mirror.
+// If PinRevision is set, this is the pinned snapshot of the mirror.
+func (c *Repo) repoURL(mirror string) string {
+	if c.PinRevision == "" {
+		return mirror
+	}
+
+	return urljoin(mirror, snapshotDirname, c.PinRevision)
+}
+
+// pinnedRevision returns false if PinRevision is set and is not the given
+// repository metadata revision. Pinned revisions which are not integers, such
+// as snapshot dates, match any revision.
+func (c *Repo) pinnedRevision(revision int) bool {
+	if c.PinRevision == "" {
+		return true
+	}
+
+	pin, err := strconv.Atoi(c.PinRevision)
+	return err != nil || pin == revision
+}
+
+// resolveURL joins the given URL paths and applies the repo's URLRewriteFunc,
+// if any, to the result.
+func (c *Repo) resolveURL(base string, paths ...string) (string, error) {
+	url := urljoin(append([]string{base}, paths...)...)
+	if c.URLRewriteFunc == nil {
+		return url, nil
+	}
+
+	rewritten, err := c.URLRewriteFunc(url)
+	if err != nil {
+		return "", fmt.Errorf("Error rewriting URL %s: %v", url, err)
+	}
+
+	return rewritten, nil
+}
+
+// wrapErr annotates the given error with the action which failed, the repo ID
+// and the location of the repo in its Yumfile. The given error may still be
+// matched with errors.Is.
+func (c *Repo) wrapErr(err error, format string, a ...interface{}) error {
+	location := ""
+	if c.YumfilePath != "" {
+		location = fmt.Sprintf(" (in %s:%d)", c.YumfilePath, c.YumfileLineNo)
+	}
+
+	return fmt.Errorf("Error %s for repo %s%s: %w", fmt.Sprintf(format, a...), c.ID, location, err)
+}
+
+// ResolvePaths resolves each relative LocalPath, CachePath, StagingDir,
+// TempDir, Groupfile, GPGKey, SignKey, ResignKey and PackageLockFile path of
+// the repo against the directory of YumfilePath, so that a Yumfile may be used
+// regardless of the working directory. GPGKey may be a plain path or a
+// file:// URL; other URLs and inline keys are not modified.
+func (c *Repo) ResolvePaths() {
+	if c.YumfilePath == "" {
+		return
+	}
+
+	dir := filepath.Dir(c.YumfilePath)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+
+		return filepath.Join(dir, path)
+	}
+
+	c.LocalPath = resolve(c.LocalPath)
+	cachepaths := filepath.SplitList(c.CachePath)
+	for i, path := range cachepaths {
+		cachepaths[i] = resolve(path)
+	}
+	c.CachePath = strings.Join(cachepaths, string(os.PathListSeparator))
+	c.StagingDir = resolve(c.StagingDir)
+	c.TempDir = resolve(c.TempDir)
+	c.Groupfile = resolve(c.Groupfile)
+	c.SignKey = resolve(c.SignKey)
+	c.ResignKey = resolve(c.ResignKey)
+	c.PackageLockFile = resolve(c.PackageLockFile)
+
+	if strings.HasPrefix(strings.ToLower(c.GPGKey), "file://") {
+		c.GPGKey = "file://" + resolve(c.GPGKey[7:])
+	} else if !strings.Contains(c.GPGKey, "://") && !isInlineKey(c.GPGKey) {
+		c.GPGKey = resolve(c.GPGKey)
+	}
+}
+
 // Validate checks the syntax of a repo defined in a Yumfile and returns an
 // on the first syntax error encountered. If no errors are found, nil is
-// returned.
+// returned. Use ValidateAll to find every error.
 func (c *Repo) Validate() error {
+	if errs := c.ValidateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+// knownArchitectures are the package architectures which may be given as a
+// repo's Architecture.
+var knownArchitectures = map[string]bool{
+	"aarch64": true,
+	"armhfp":  true,
+	"armv7hl": true,
+	"i386":    true,
+	"i486":    true,
+	"i586":    true,
+	"i686":    true,
+	"noarch":  true,
+	"ppc64":   true,
+	"ppc64le": true,
+	"s390x":   true,
+	"src":     true,
+	"x86_64":  true,
+}
+
+// ValidateAll checks a repo defined in a Yumfile and returns every error
+// found, so that a Yumfile may be corrected in one pass. If no errors are
+// found, nil is returned.
+func (c *Repo) ValidateAll() []error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		a = append(a, c.YumfilePath, c.YumfileLineNo)
+		errs = append(errs, NewErrorf(format+" (in %s:%d)", a...))
+	}
+
 	if c.ID == "" {
-		return NewErrorf("Upstream repository has no ID specified (in %s:%d)", c.YumfilePath, c.YumfileLineNo)
+		fail("Upstream repository has no ID specified")
 	}
 
 	if c.MirrorURL == "" && c.BaseURL == "" {
-		return NewErrorf("Upstream repository for '%s' has no mirror list or base URL (in %s:%d)", c.ID, c.YumfilePath, c.YumfileLineNo)
+		fail("Upstream repository for '%s' has no mirror list or base URL", c.ID)
+	}
+
+	if c.Architecture != "" && !knownArchitectures[c.Architecture] {
+		fail("Unknown architecture for repo '%s': %s", c.ID, c.Architecture)
+	}
+
+	for _, patterns := range []struct {
+		key      string
+		patterns []string
+	}{
+		{"exclude", c.Exclude},
+		{"includepkgs", c.IncludePackages},
+		{"include_modules", c.IncludeModules},
+		{"exclude_licenses", c.ExcludeLicenses},
+		{"include_licenses", c.IncludeLicenses},
+	} {
+		for _, pattern := range patterns.patterns {
+			if !validPattern(pattern) {
+				fail("Invalid %s pattern for repo '%s': %s", patterns.key, c.ID, pattern)
+			}
+		}
+	}
+
+	for _, expr := range []struct {
+		key  string
+		expr string
+	}{
+		{"include_regex", c.IncludeRegex},
+		{"exclude_regex", c.ExcludeRegex},
+	} {
+		if _, err := regexp.Compile(expr.expr); err != nil {
+			fail("Invalid %s for repo '%s': %v", expr.key, c.ID, err)
+		}
+	}
+
+	if !c.MinDate.IsZero() && !c.MaxDate.IsZero() && c.MinDate.After(c.MaxDate) {
+		fail("Minimum date for repo '%s' is after its maximum date: %s > %s", c.ID, c.MinDate.Format(time.RFC3339), c.MaxDate.Format(time.RFC3339))
+	}
+
+	if c.DateSkewTolerance < 0 {
+		fail("Date skew tolerance for repo '%s' must not be negative: %v", c.ID, c.DateSkewTolerance)
+	}
+
+	if c.KeepVersions < 0 {
+		fail("Number of versions to keep for repo '%s' must not be negative: %d", c.ID, c.KeepVersions)
+	}
+
+	if c.MetadataThreads < 0 {
+		fail("Number of metadata threads for repo '%s' must not be negative: %d", c.ID, c.MetadataThreads)
+	}
+
+	if DownloadThreads < 0 {
+		fail("Number of download threads for repo '%s' must not be negative: %d", c.ID, DownloadThreads)
+	}
+
+	if CreaterepoThreads < 0 {
+		fail("Number of createrepo threads for repo '%s' must not be negative: %d", c.ID, CreaterepoThreads)
+	}
+
+	if c.GPGCheck && c.GPGKey == "" {
+		fail("GPG check is enabled for repo '%s' but no gpgkey is specified", c.ID)
+	}
+
+	if policy, ok := c.checksumPolicy().(MinimumChecksumPolicy); ok && checksumStrength[string(policy)] == 0 {
+		fail("Unknown checksum type in checksum policy for repo '%s': %s", c.ID, string(policy))
+	}
+
+	return errs
+}
+
+// validPattern returns false if the given shell pattern is malformed, such as
+// with an unterminated character class, and so could never match a package.
+func validPattern(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return false
+			}
+
+		case '[':
+			j := i + 1
+			if j < len(pattern) && pattern[j] == '^' {
+				j++
+			}
+
+			// character classes may not be empty
+			if j < len(pattern) && pattern[j] == ']' {
+				return false
+			}
+
+			for ; j < len(pattern) && pattern[j] != ']'; j++ {
+				if pattern[j] == '\\' {
+					j++
+				}
+			}
+
+			if j >= len(pattern) {
+				return false
+			}
+			i = j
+		}
+	}
+
+	return true
+}
+
+// ValidateReachable confirms that the repo's repomd.xml can be retrieved from
+// its BaseURL, or from the first mirror in its mirror list, so that a mistyped
+// URL is reported before a sync begins. Unlike Validate, it makes a network
+// request. If the repo is not accessible, an ErrRepoUnavailable error is
+// returned.
+func (c *Repo) ValidateReachable() error {
+	if err := c.ResolveMirrors(); err != nil {
+		return c.wrapErr(err, "resolving mirrors")
+	}
+
+	url, err := c.resolveURL(c.repoURL(c.BaseURL), "/repodata/repomd.xml")
+	if err != nil {
+		return c.wrapErr(err, "checking base URL")
+	}
+
+	Dprintf("Checking repo metadata at %s...\n", url)
+	if isFileURL(url) {
+		if _, err := os.Stat(fileURLPath(url)); err != nil {
+			return c.wrapErr(newError(ErrRepoUnavailable, "Repo metadata is not accessible at %s: %w", url, err), "checking base URL")
+		}
+
+		return nil
+	}
+
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return c.wrapErr(err, "checking base URL")
+	}
+	req.Header.Set("User-Agent", c.userAgent())
+
+	resp, err := c.client().Do(req)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		// some servers do not allow HEAD requests
+		if resp.StatusCode == http.StatusMethodNotAllowed {
+			var body io.ReadCloser
+			if body, err = openURL(c.client(), url, c.userAgent()); err == nil {
+				body.Close()
+				return nil
+			}
+		} else if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("Bad response code: %s", resp.Status)
+		}
+	}
+
+	if err != nil {
+		return c.wrapErr(newError(ErrRepoUnavailable, "Repo metadata is not accessible at %s: %w", url, err), "checking base URL")
 	}
 
 	return nil
@@ -62,215 +588,215 @@ func (c *Repo) Validate() error {
 // CacheLocal caches a copy of a Repo's metadata and databases to the given
 // cache directory. If the Repo is already cached, the cache is validated and
 // updated if the source repository has been updated.
+//
+// Databases are decompressed into the cache directory unless TempDir or
+// DefaultTempDir is set, in which case they are decompressed into a temporary
+// directory which is removed when the returned RepoCache is closed.
+//
+// If the metadata of the BaseURL cannot be downloaded, validated or
+// decompressed, or its primary database cannot be read by the returned
+// RepoCache, the metadata is cached from each of the repo's Mirrors in turn
+// instead. The repo is not modified; the mirror which serves usable metadata
+// is the BaseURL of the returned RepoCache, and packages are downloaded from
+// it first during a sync.
 func (c *Repo) CacheLocal(path string) (*RepoCache, error) {
 	Dprintf("Caching %v to %s...\n", c, path)
 
+	if err := c.ResolveMirrors(); err != nil {
+		return nil, c.wrapErr(err, "resolving mirrors")
+	}
+
 	// connect to cache
 	cache, err := NewCache(path)
 	if err != nil {
-		return nil, err
+		return nil, c.wrapErr(err, "opening cache %s", path)
 	}
 
 	// get cache for this repo
 	repocache, err := cache.NewRepoCache(c)
 	if err != nil {
-		return nil, err
+		return nil, c.wrapErr(err, "creating cache")
 	}
 
-	// update cache
-	if err := repocache.Update(); err != nil {
-		return nil, err
+	// update cache, failing over to each mirror in turn if the metadata of
+	// a mirror is unusable
+	if err := repocache.update(); err != nil {
+		repocache.Close()
+		return nil, c.wrapErr(err, "caching metadata")
 	}
 
 	return repocache, nil
 }
 
-// Sync syncronizes a local package repository with an upstream repository using
-// filter rules defined for the repository in its parent Yumfile. All repository
-// metadata is cached in the given cache directory.
-func (c *Repo) Sync(cachedir, packagedir string) error {
-	var err error
-
-	// load gpg keys
-	var keyring openpgp.KeyRing
-	if c.GPGCheck {
-		keyring, err = OpenKeyRing(c.GPGKey)
-		if err != nil {
-			return err
-		}
+// CacheAll caches the metadata of each of the given repos concurrently, using
+// CacheLocal with the repo's CachePath or the given cache directory. The
+// returned caches are in the same order as the given repos. If caching fails
+// for any repo, its cache is nil and an Errors value is returned listing every
+// failure.
+func CacheAll(repos []*Repo, cachedir string) ([]*RepoCache, error) {
+	workers := CacheThreads
+	if workers < 1 {
+		workers = defaultCacheThreads
 	}
 
-	// cache repo metadata locally to TmpYumCachePath
-	repocache, err := c.CacheLocal(cachedir)
-	if err != nil {
-		return fmt.Errorf("Failed to cache metadata for repo %v: %v", c, err)
+	caches := make([]*RepoCache, len(repos))
+	errs := make([]error, len(repos))
+
+	// start workers
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				repo := repos[i]
+				repocachedir := cachedir
+				if repo.CachePath != "" {
+					repocachedir = repo.CachePath
+				}
+
+				caches[i], errs[i] = repo.CacheLocal(repocachedir)
+			}
+		}()
 	}
 
-	// get primary db from cache
-	primarydb, err := repocache.PrimaryDB()
-	if err != nil {
-		return err
+	for i := range repos {
+		jobs <- i
 	}
+	close(jobs)
+	wg.Wait()
 
-	// create package directory
-	if err := os.MkdirAll(packagedir, 0750); err != nil && !os.IsExist(err) {
-		return fmt.Errorf("Error creating local package path %s: %v", packagedir, err)
+	// aggregate errors
+	failed := make(Errors, 0)
+	for _, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+		}
 	}
 
-	// list existing files
-	files, err := ioutil.ReadDir(packagedir)
-	if err != nil {
-		return fmt.Errorf("Error reading packages")
+	if len(failed) > 0 {
+		return caches, failed
 	}
 
-	// load packages from primary_db
-	Dprintf("Loading package metadata from primary_db...\n")
-	packages, err := primarydb.Packages()
-	if err != nil {
-		return fmt.Errorf("Error reading packages from primary_db: %v", err)
-	}
-
-	// filter list
-	packages = FilterPackages(c, packages)
-	Dprintf("Found %d packages in primary_db\n", len(packages))
-
-	// build a list of missing packages
-	Dprintf("Checking for existing packages in %s...\n", packagedir)
-	missing := make([]PackageEntry, 0)
-	var totalsize uint64 = 0
-	for _, p := range packages {
-		package_filename := filepath.Base(p.LocationHref())
-		package_path := filepath.Join(packagedir, filepath.Base(p.LocationHref()))
-
-		// search local files
-		found := false
-		for _, fi := range files {
-			// find file for package
-			if fi.Name() == package_filename {
-				// check file size
-				if fi.Size() == p.PackageSize() {
-					// validate checksum
-					sum, err := p.Checksum()
-					if err != nil {
-						Errorf(err, "Failed to compute checksum for package %v", p)
-						break
-					}
-
-					err = ValidateFileChecksum(package_path, sum, p.ChecksumType())
-					if err == ErrChecksumMismatch {
-						Errorf(err, "Existing file failed checksum validation for package %v", p)
-						break
-
-					} else if err != nil {
-						Errorf(err, "Error validating checksum for package %v", p)
-						break
-					}
-
-					// valid package found
-					found = true
-					break
-
-				} else if fi.Size() > p.PackageSize() {
-					// existing file is too large (smaller is okay)
-					Errorf(err, "Existing file is larger (%s) than expected (%s) for package %v", bytefmt.ByteSize(uint64(fi.Size())), bytefmt.ByteSize(uint64(p.PackageSize())), p)
-					break
-				} else {
-					Dprintf("Existing file is incomplete for package %v\n", p)
-				}
-			}
-		}
+	return caches, nil
+}
 
-		// TODO: filter packages according to Yumfile rules
+// datePattern matches a $date or $(date:format) placeholder.
+var datePattern = regexp.MustCompile(`\$date\b|\$\{date\}|\$\(date:([^)]*)\)`)
+
+// strftimeLayouts maps each supported strftime conversion to its time layout.
+var strftimeLayouts = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'H': "15",
+	'M': "04",
+	'S': "05",
+	'b': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'z': "-0700",
+	'Z': "MST",
+}
 
-		if !found {
-			missing = append(missing, p)
-			totalsize += uint64(p.PackageSize())
+// strftime formats the given time with the given strftime format. %j gives
+// the day of the year and %s the Unix time. Unsupported conversions are not
+// modified.
+func strftime(format string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
 		}
-	}
-
-	Dprintf("Scheduled %d packages for download (%s)\n", len(missing), bytefmt.ByteSize(totalsize))
 
-	// schedule download jobs
-	reqs := make([]*grab.Request, 0)
-	for i, p := range missing {
-		req, err := grab.NewRequest(urljoin(c.BaseURL, p.LocationHref()))
-		if err != nil {
-			Errorf(err, "Error requesting package %v", p)
-		} else {
-			req.Label = fmt.Sprintf("[ %d / %d ] %v", i+1, len(missing), p)
-			req.Filename = filepath.Join(packagedir, filepath.Base(p.LocationHref()))
-			req.Size = uint64(p.PackageSize())
-			sum, err := p.Checksum()
-			if err != nil {
-				Errorf(err, "Error reading checksum for package %v", p)
+		i++
+		verb := format[i]
+		switch verb {
+		case '%':
+			b.WriteByte('%')
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		default:
+			if layout, ok := strftimeLayouts[verb]; ok {
+				b.WriteString(t.Format(layout))
 			} else {
-				b, err := hex.DecodeString(sum)
-				if err != nil {
-					Errorf(err, "Error decoding checksum for package %v", p)
-				} else {
-					req.SetChecksum(p.ChecksumType(), b)
-					reqs = append(reqs, req)
-				}
+				b.WriteByte('%')
+				b.WriteByte(verb)
 			}
 		}
 	}
 
-	// download missing packages
-	responses := download(reqs, DownloadThreads)
-
-	// handle each finished package
-	for resp := range responses {
-		if resp.Error != nil {
-			Errorf(resp.Error, "Error downloading %s", resp.Request.Label)
-		} else {
-			// gpg check
-			// TODO: create more gpgcheck threads
-			if c.GPGCheck {
-				// open downloaded package for reading
-				f, err := os.Open(resp.Filename)
-				if err != nil {
-					Errorf(err, "Error reading %s for GPG check", resp.Request.Label)
-				} else {
-					defer f.Close()
-
-					// gpg check
-					_, err = rpm.GPGCheck(f, keyring)
-					if err != nil {
-						Errorf(err, "GPG check validation failed for %s", resp.Request.Label)
-
-						// delete bad package
-						if err := os.Remove(resp.Filename); err != nil {
-							Errorf(err, "Error deleting %v", resp.Request.Label)
-						}
-					}
-				}
-			}
+	return b.String()
+}
+
+// expandDate substitutes each $date placeholder in the given path with the
+// given time in the form 2006-01-02, and each $(date:format) placeholder with
+// the given time in the given strftime format.
+func expandDate(path string, t time.Time) string {
+	return datePattern.ReplaceAllStringFunc(path, func(ref string) string {
+		if strings.HasPrefix(ref, "$(") {
+			return strftime(datePattern.FindStringSubmatch(ref)[1], t)
 		}
+
+		return t.Format("2006-01-02")
+	})
+}
+
+// syncDirs returns the cache directory and package directory to which the
+// repo is synchronized by SyncAll: its CachePath or otherwise the given cache
+// directory, and its LocalPath or otherwise its ID. Date placeholders in the
+// package directory are expanded by Sync.
+func (c *Repo) syncDirs(cachedir string) (string, string) {
+	if c.CachePath != "" {
+		cachedir = c.CachePath
 	}
 
-	// TODO: createrepo
-	if w, err := createrepo(filepath.Join(packagedir, "/repodata")); err != nil {
-		PanicOn(err)
-	} else {
-		defer w.Close()
+	packagedir := c.LocalPath
+	if packagedir == "" {
+		packagedir = c.ID
+	}
 
-		// enumerate package dir
-		files, err := filepath.Glob(filepath.Join(packagedir, "/*.rpm"))
-		if err != nil {
-			PanicOn(err)
+	return cachedir, packagedir
+}
+
+// SyncAll validates and synchronizes each of the given repos to its LocalPath,
+// with any date placeholders expanded to the date on which its sync starts,
+// caching metadata in the repo's CachePath or the given cache directory.
+// Disabled repos are validated but not synchronized. A failure to synchronize
+// one repo does not prevent the remaining repos from being synchronized.
+func SyncAll(repos []*Repo, cachedir string) error {
+	// validate all repos before syncing any
+	for _, repo := range repos {
+		if err := repo.Validate(); err != nil {
+			return err
 		}
+	}
 
-		// add to primary db
-		Dprintf("Inserting %v packages\n", len(files))
-		for _, f := range files {
-			p, err := rpm.OpenPackageFile(f)
-			if err != nil {
-				PanicOn(err)
-			}
+	failed := 0
+	for _, repo := range repos {
+		if !repo.Enabled {
+			Dprintf("Skipping disabled repo %v\n", repo)
+			continue
+		}
 
-			w.Write(p)
+		repocachedir, packagedir := repo.syncDirs(cachedir)
+		if err := repo.Sync(repocachedir, packagedir); err != nil {
+			Errorf(err, "Error syncing repo %v", repo)
+			failed++
 		}
 	}
 
+	if failed > 0 {
+		return NewErrorf("%d of %d repos failed to sync", failed, len(repos))
+	}
+
 	return nil
 }
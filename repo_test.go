@@ -0,0 +1,403 @@
+package yum
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncAllSkipsDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewRepo()
+	repo.ID = "disabled"
+	repo.BaseURL = "http://127.0.0.1:0/disabled"
+	repo.LocalPath = filepath.Join(dir, "disabled")
+	repo.Enabled = false
+
+	if err := SyncAll([]*Repo{repo}, filepath.Join(dir, "cache")); err != nil {
+		t.Fatalf("Error syncing disabled repo: %v", err)
+	}
+
+	if _, err := os.Stat(repo.LocalPath); !os.IsNotExist(err) {
+		t.Errorf("Disabled repo was synced to %s", repo.LocalPath)
+	}
+
+	// disabled repos are still validated
+	repo.BaseURL = ""
+	if err := SyncAll([]*Repo{repo}, filepath.Join(dir, "cache")); err == nil {
+		t.Errorf("Expected validation error for disabled repo with no base URL")
+	}
+}
+
+func TestResolvePaths(t *testing.T) {
+	repo := NewRepo()
+	repo.YumfilePath = "/etc/go-yum/Yumfile"
+	repo.LocalPath = "mirror/base"
+	repo.CachePath = "/var/cache/go-yum"
+	repo.Groupfile = "comps.xml"
+	repo.GPGKey = "file://keys/RPM-GPG-KEY"
+	repo.ResolvePaths()
+
+	if repo.LocalPath != "/etc/go-yum/mirror/base" {
+		t.Errorf("Relative localpath was not resolved next to the Yumfile: %s", repo.LocalPath)
+	}
+
+	if repo.CachePath != "/var/cache/go-yum" {
+		t.Errorf("Absolute cachepath was modified: %s", repo.CachePath)
+	}
+
+	if repo.Groupfile != "/etc/go-yum/comps.xml" {
+		t.Errorf("Relative groupfile was not resolved: %s", repo.Groupfile)
+	}
+
+	if repo.GPGKey != "file:///etc/go-yum/keys/RPM-GPG-KEY" {
+		t.Errorf("Relative gpgkey was not resolved: %s", repo.GPGKey)
+	}
+
+	repo.GPGKey = "https://example.com/RPM-GPG-KEY"
+	repo.ResolvePaths()
+	if repo.GPGKey != "https://example.com/RPM-GPG-KEY" {
+		t.Errorf("Remote gpgkey was modified: %s", repo.GPGKey)
+	}
+}
+
+func TestURLRewriteFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	queries := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Path + "?" + r.URL.RawQuery
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL + "/centos/7/os/x86_64/"
+	repo.URLRewriteFunc = func(rawurl string) (string, error) {
+		return rawurl + "?Signature=abc123", nil
+	}
+
+	c := &RepoCache{Repo: repo, Path: dir}
+	c.updateMetadata()
+	if q := <-queries; q != "/centos/7/os/x86_64/repodata/repomd.xml?Signature=abc123" {
+		t.Errorf("Expected rewritten metadata URL, got %s", q)
+	}
+
+	// package URLs
+	url, err := repo.resolveURL(repo.BaseURL, "Packages/foo-1.0-1.x86_64.rpm")
+	if err != nil || url != ts.URL+"/centos/7/os/x86_64/Packages/foo-1.0-1.x86_64.rpm?Signature=abc123" {
+		t.Errorf("Unexpected package URL: %s: %v", url, err)
+	}
+
+	// query strings in the base URL are preserved
+	repo.URLRewriteFunc = nil
+	url, err = repo.resolveURL("https://cdn.example.com/repo/?token=xyz", "/Packages/foo-1.0-1.x86_64.rpm")
+	if err != nil || url != "https://cdn.example.com/repo/Packages/foo-1.0-1.x86_64.rpm?token=xyz" {
+		t.Errorf("Unexpected package URL: %s: %v", url, err)
+	}
+
+	// rewrite errors are returned
+	repo.URLRewriteFunc = func(rawurl string) (string, error) {
+		return "", errors.New("no credentials")
+	}
+
+	if _, err := c.updateMetadata(); err == nil || !strings.Contains(err.Error(), "no credentials") {
+		t.Errorf("Expected rewrite error, got: %v", err)
+	}
+}
+
+func TestValidateReachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/base/repodata/repomd.xml":
+			w.Write([]byte(testRepoMetadata))
+
+		case "/nohead/repodata/repomd.xml":
+			if r.Method == "HEAD" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte(testRepoMetadata))
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	for _, path := range []string{"/base", "/nohead"} {
+		repo := NewRepo()
+		repo.ID = "base"
+		repo.BaseURL = ts.URL + path
+		if err := repo.ValidateReachable(); err != nil {
+			t.Errorf("Expected %s to be reachable: %v", path, err)
+		}
+	}
+
+	for _, url := range []string{ts.URL + "/typo", "http://127.0.0.1:0/base", "file:///nonexistent/base"} {
+		repo := NewRepo()
+		repo.ID = "base"
+		repo.BaseURL = url
+		err := repo.ValidateReachable()
+		if !errors.Is(err, ErrRepoUnavailable) || !strings.Contains(err.Error(), "repo base") {
+			t.Errorf("Expected ErrRepoUnavailable for %s, got: %v", url, err)
+		}
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	repo := NewRepo()
+	repo.YumfilePath = "Yumfile"
+	repo.YumfileLineNo = 12
+	repo.Architecture = "x86-64"
+	repo.Exclude = []string{"kernel*", "[abc"}
+	repo.MinDate = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.MaxDate = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	errs := repo.ValidateAll()
+	expect := []string{
+		"no ID specified",
+		"no mirror list or base URL",
+		"Unknown architecture",
+		"Invalid exclude pattern",
+		"after its maximum date",
+	}
+
+	if len(errs) != len(expect) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expect), len(errs), errs)
+	}
+
+	for i, err := range errs {
+		if !strings.Contains(err.Error(), expect[i]) || !strings.Contains(err.Error(), "(in Yumfile:12)") {
+			t.Errorf("Expected error %d to contain '%s', got: %v", i, expect[i], err)
+		}
+	}
+
+	if err := repo.Validate(); err == nil || err.Error() != errs[0].Error() {
+		t.Errorf("Expected Validate to return the first error, got: %v", err)
+	}
+
+	repo = NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://example.com/base"
+	repo.Architecture = "x86_64"
+	repo.Exclude = []string{"kernel*", "[a-c]*", "foo\\*"}
+	if errs := repo.ValidateAll(); errs != nil {
+		t.Errorf("Expected no errors, got: %v", errs)
+	}
+}
+
+func TestValidateSemantics(t *testing.T) {
+	tests := []struct {
+		expect string
+		setup  func(repo *Repo)
+	}{
+		{"after its maximum date", func(repo *Repo) {
+			repo.MinDate = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+			repo.MaxDate = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+		}},
+		{"versions to keep for repo 'base' must not be negative", func(repo *Repo) {
+			repo.KeepVersions = -1
+		}},
+		{"download threads for repo 'base' must not be negative", func(repo *Repo) {
+			DownloadThreads = -1
+		}},
+		{"Invalid include_regex", func(repo *Repo) {
+			repo.IncludeRegex = "^(kernel"
+		}},
+		{"Invalid exclude_regex", func(repo *Repo) {
+			repo.ExcludeRegex = "*-debuginfo"
+		}},
+		{"no gpgkey is specified", func(repo *Repo) {
+			repo.GPGCheck = true
+		}},
+	}
+
+	defer func(n int) { DownloadThreads = n }(DownloadThreads)
+	for _, test := range tests {
+		DownloadThreads = 0
+		repo := NewRepo()
+		repo.ID = "base"
+		repo.BaseURL = "http://example.com/base"
+		repo.YumfilePath = "Yumfile"
+		repo.YumfileLineNo = 7
+		test.setup(repo)
+
+		err := repo.Validate()
+		if err == nil {
+			t.Errorf("Expected error containing '%s'", test.expect)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), test.expect) || !strings.Contains(err.Error(), "(in Yumfile:7)") {
+			t.Errorf("Expected error containing '%s', got: %v", test.expect, err)
+		}
+	}
+
+	// valid combinations
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://example.com/base"
+	repo.MinDate = time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo.MaxDate = repo.MinDate
+	repo.IncludeRegex = "^(kernel|glibc)"
+	repo.GPGCheck = true
+	repo.GPGKey = "RPM-GPG-KEY"
+	if err := repo.Validate(); err != nil {
+		t.Errorf("Expected valid repo, got: %v", err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	defer os.Unsetenv("GO_YUM_TEST_API_KEY")
+	os.Setenv("GO_YUM_TEST_API_KEY", "secret")
+
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := newTestRepoServer(t, "base")
+	defer upstream.Close()
+
+	headers := make(chan http.Header, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		upstream.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	repos, err := ParseYumfile(strings.NewReader(`[base]
+baseurl = `+ts.URL+`/base
+header = X-Api-Key: ${GO_YUM_TEST_API_KEY}
+header = accept: application/xml
+`), filepath.Join(dir, "Yumfile"))
+	if err != nil {
+		t.Fatalf("Error parsing headers: %v", err)
+	}
+
+	repo := repos[0]
+	if len(repo.Headers) != 2 || repo.Headers["X-Api-Key"] != "${GO_YUM_TEST_API_KEY}" {
+		t.Errorf("Unexpected headers: %v", repo.Headers)
+	}
+
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	repocache.Close()
+	close(headers)
+
+	// both repomd.xml and the primary database are requested with the headers
+	n := 0
+	for h := range headers {
+		n++
+		if h.Get("X-Api-Key") != "secret" || h.Get("Accept") != "application/xml" || h.Get("User-Agent") != repo.userAgent() {
+			t.Errorf("Expected configured headers on request, got: %v", h)
+		}
+	}
+
+	if n != 2 {
+		t.Errorf("Expected 2 requests, got %d", n)
+	}
+
+	// requests redirected to other hosts are made without the headers
+	cdn := make(chan http.Header, 2)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdn <- r.Header
+	}))
+	defer other.Close()
+
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirect.Close()
+
+	repo.BaseURL = redirect.URL + "/base"
+	for _, hosts := range [][]string{nil, {strings.TrimPrefix(other.URL, "http://")}} {
+		repo.HeaderHosts = hosts
+		body, err := openURL(repo.client(), redirect.URL+"/base/repodata/repomd.xml", repo.userAgent())
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+
+		if h := <-cdn; (h.Get("X-Api-Key") == "secret") != (hosts != nil) {
+			t.Errorf("Expected headers on redirected request only with header_hosts %v, got: %v", hosts, h)
+		}
+	}
+
+	// header values are not written to resolved Yumfiles
+	for _, opt := range repoOptions(repo) {
+		if opt[0] == "header" && strings.Contains(opt[1], "GO_YUM_TEST_API_KEY") {
+			t.Errorf("Expected header values to be redacted, got %s", opt[1])
+		}
+	}
+
+	// malformed headers are rejected
+	if _, err := ParseYumfile(strings.NewReader("[base]\nbaseurl = http://a/\nheader = X-Api-Key\n"), "Yumfile"); err == nil {
+		t.Errorf("Expected error parsing malformed header")
+	}
+}
+
+func TestExpandDate(t *testing.T) {
+	now := time.Date(2024, 6, 1, 13, 4, 5, 0, time.UTC)
+	tests := map[string]string{
+		"/mirror/base":                      "/mirror/base",
+		"/mirror/base/$date":                "/mirror/base/2024-06-01",
+		"/mirror/base/${date}/":             "/mirror/base/2024-06-01/",
+		"/mirror/base/$(date:%Y/%m/%d)":     "/mirror/base/2024/06/01",
+		"/mirror/base-$(date:%Y%m%dT%H%M)":  "/mirror/base-20240601T1304",
+		"/mirror/base/$(date:%j-%%-%q)":     "/mirror/base/153-%-%q",
+		"/mirror/$dated/$(date:%b)/$releas": "/mirror/$dated/Jun/$releas",
+	}
+
+	for path, expected := range tests {
+		if actual := expandDate(path, now); actual != expected {
+			t.Errorf("Expected %s to expand to %s, got %s", path, expected, actual)
+		}
+	}
+
+	// the current date is substituted when each sync starts
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://127.0.0.1:0/base"
+	repo.LocalPath = filepath.Join(dir, "$date")
+
+	today := time.Now().Format("2006-01-02")
+	cachedir, packagedir := repo.syncDirs(filepath.Join(dir, "cache"))
+	if err := repo.Sync(cachedir, packagedir); err == nil {
+		t.Fatalf("Expected an error syncing unavailable repo")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, today)); err != nil {
+		t.Errorf("Expected package directory for %s: %v", today, err)
+	}
+
+	if _, err := os.Stat(packagedir); !os.IsNotExist(err) {
+		t.Errorf("Expected date placeholder to be expanded: %v", err)
+	}
+}
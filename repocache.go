@@ -4,39 +4,79 @@ import (
 	"bytes"
 	"compress/bzip2"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 	"github.com/creachadair/xz"
 )
 
+// RepoCache is the cached metadata of a single repo in a subdirectory of a
+// Cache.
+//
+// The cache directory may be shared by several hosts, such as on an NFS
+// mount. Updates hold an exclusive lock on the cache directory and replace
+// each cached file atomically, while reads hold a shared lock, so that any
+// number of hosts may read the cache while one host updates it.
 type RepoCache struct {
 	Repo *Repo
 	Path string
+
+	// BaseURL is the URL from which the repo metadata is cached, after failing
+	// over to one of the repo's Mirrors, or an empty string for the repo's
+	// BaseURL.
+	BaseURL string
+
+	// Metadata is the repository metadata cached by the last call to Update.
+	Metadata *RepoMetadata
+
+	filelists string
+	groupfile string
+	modules   string
+	primary   string
+
+	// passthrough are the cached databases which are copied unmodified into
+	// the local repository metadata
+	passthrough []passthroughDatabase
+
+	// tempdir is the temporary directory to which databases are decompressed,
+	// if the repo has a TempDir, and which is removed by Close
+	tempdir string
+
+	// mirrors are the repo's Mirrors which have not yet been failed over to
+	mirrors []string
 }
 
+// Update downloads any repo metadata and databases which are missing from the
+// cache or have changed upstream. Only the primary database, the databases
+// required by the repo's features and the metadata copied to the local
+// repository are downloaded. Update blocks until no other process holds a lock
+// on the cache directory.
 func (c *RepoCache) Update() error {
+	// prevent concurrent updates and reads of a shared cache directory
+	lock, err := lockDir(c.Path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	// cache metadata file
 	repomd, err := c.updateMetadata()
 	if err != nil {
 		return err
 	}
 
-	// select primary db
-	var primarydb *RepoDatabase = nil
-	for _, db := range repomd.Databases {
-		if db.Type == "primary" {
-			primarydb = &db
-			break
-		}
-	}
+	c.Metadata = repomd
 
+	// select primary db, preferring sqlite over xml
+	primarydb := repomd.Database("primary_db", "primary")
 	if primarydb == nil {
-		return fmt.Errorf("No primary database found for repo %v", c)
+		return newError(ErrMetadataFetch, "No primary database found for repo %v", c.Repo)
 	}
 
 	// download primary database
@@ -45,7 +85,56 @@ func (c *RepoCache) Update() error {
 	}
 
 	// decompress primary database
-	if _, err = c.decompressDatabase(primarydb); err != nil {
+	if c.primary, err = c.decompressDatabase(primarydb); err != nil {
+		return err
+	}
+
+	// cache filelists to resolve file dependencies
+	c.filelists = ""
+	if c.Repo.CheckClosure || c.Repo.AutoSatisfyDeps {
+		if err := c.updateFilelists(repomd); err != nil {
+			return err
+		}
+	}
+
+	// cache groupfile
+	if len(c.Repo.IncludeGroups) > 0 && c.Repo.Groupfile == "" {
+		if err := c.updateGroupfile(repomd); err != nil {
+			return err
+		}
+	}
+
+	// cache modules
+	if len(c.Repo.IncludeModules) > 0 {
+		if err := c.updateModules(repomd); err != nil {
+			return err
+		}
+	}
+
+	// cache metadata which is copied to the local repository
+	c.passthrough = nil
+	passthrough := make([]string, 0)
+	for _, db := range repomd.Databases {
+		if db.Type == "productid" && c.Repo.PreserveProductID {
+			passthrough = append(passthrough, db.Type)
+		} else if db.isAppstream() {
+			if c.Repo.PreserveAppstream {
+				passthrough = append(passthrough, db.Type)
+			}
+		} else if c.Repo.regenerates(&db) {
+			continue
+		} else if !db.opaque() {
+			// known metadata which createrepo does not rebuild, such as
+			// updateinfo, is copied unmodified
+			passthrough = append(passthrough, db.Type)
+		} else if c.Repo.DropUnknownMetadata {
+			Dprintf("Ignoring unrecognized %v database in repo %v\n", &db, c.Repo)
+		} else {
+			passthrough = append(passthrough, db.Type)
+		}
+	}
+
+	if err := c.updatePassthrough(repomd, passthrough...); err != nil {
 		return err
 	}
 
@@ -53,36 +142,369 @@ func (c *RepoCache) Update() error {
 }
 
 func (c *RepoCache) PrimaryDB() (*PrimaryDatabase, error) {
-	path := filepath.Join(c.Path, "gen/primary_db.sqlite")
+	lock, err := rlockDir(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	return c.openPrimaryDB()
+}
+
+func (c *RepoCache) openPrimaryDB() (*PrimaryDatabase, error) {
+	path := c.primary
+	if !strings.HasSuffix(path, ".sqlite") {
+		path = filepath.Join(c.Path, "gen/primary_db.sqlite")
+	}
+
 	return OpenPrimaryDB(path)
 }
 
-// cacheMetadata downloads a repository's repomd.xml file to the given cache
-// directory.
-func (c *RepoCache) updateMetadata() (*RepoMetadata, error) {
-	// TODO: add support for repository mirror lists
-	repomd_url := urljoin(c.Repo.BaseURL, "/repodata/repomd.xml")
-	repomd_path := filepath.Join(c.Path, "repomd.xml")
+// Close removes the temporary files created while decompressing databases in
+// the repo's TempDir. Downloaded databases remain cached. Databases may not be
+// read once the RepoCache is closed.
+func (c *RepoCache) Close() error {
+	if c.tempdir == "" {
+		return nil
+	}
+
+	Dprintf("Removing temporary files in %s\n", c.tempdir)
+	err := os.RemoveAll(c.tempdir)
+	c.tempdir = ""
+	return err
+}
+
+// genPath returns the directory to which databases are decompressed. This is a
+// temporary directory in the repo's TempDir, or DefaultTempDir, if either is
+// set. Otherwise, it is the gen/ subdirectory of the cache directory.
+func (c *RepoCache) genPath() (string, error) {
+	if c.tempdir != "" {
+		return c.tempdir, nil
+	}
+
+	base := c.Repo.TempDir
+	if base == "" {
+		base = DefaultTempDir
+	}
+
+	if base == "" {
+		return filepath.Join(c.Path, "gen"), nil
+	}
+
+	if err := os.MkdirAll(base, 0750); err != nil {
+		return "", fmt.Errorf("Error creating temporary directory %s: %v", base, err)
+	}
+
+	dir, err := ioutil.TempDir(base, fmt.Sprintf("go-yum-%s-", c.Repo.ID))
+	if err != nil {
+		return "", fmt.Errorf("Error creating temporary directory in %s: %v", base, err)
+	}
+
+	c.tempdir = dir
+	return dir, nil
+}
+
+// Packages returns all packages in the cached primary database of the repo,
+// which may be either a primary_db sqlite database or a primary.xml file. If
+// the primary database cannot be read and the repo has Mirrors, the metadata
+// is cached from each mirror in turn instead, as by update.
+func (c *RepoCache) Packages() (PackageEntries, error) {
+	for {
+		packages, err := c.readPackages()
+		if err == nil || len(c.Repo.Mirrors) == 0 {
+			return packages, err
+		}
+
+		if err := c.failover(newError(ErrMetadataFetch, "Error reading primary database from %s: %w", c.baseURL(), err)); err != nil {
+			return nil, err
+		}
+
+		if err := c.update(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readPackages returns all packages in the cached primary database.
+func (c *RepoCache) readPackages() (PackageEntries, error) {
+	lock, err := rlockDir(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	if c.primary == "" || strings.HasSuffix(c.primary, ".sqlite") {
+		primarydb, err := c.openPrimaryDB()
+		if err != nil {
+			return nil, err
+		}
+		defer primarydb.Close()
+
+		return primarydb.Packages()
+	}
+
+	f, err := os.Open(c.primary)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	md, err := ReadPrimaryMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return md.Packages, nil
+}
+
+// updateGroupfile downloads the comps.xml groupfile referenced by the given
+// repo metadata.
+func (c *RepoCache) updateGroupfile(repomd *RepoMetadata) error {
+	for _, db := range repomd.Databases {
+		if db.Type != "group" && db.Type != "group_gz" {
+			continue
+		}
+
+		path, err := c.downloadDatabase(&db)
+		if err != nil {
+			return err
+		}
+
+		if db.Type == "group_gz" {
+			if path, err = c.decompressDatabase(&db); err != nil {
+				return err
+			}
+		}
+
+		c.groupfile = path
+		return nil
+	}
+
+	return newError(ErrMetadataFetch, "No groupfile found for repo %v", c.Repo)
+}
+
+// updateFilelists downloads and decompresses the filelists database
+// referenced by the given repo metadata, which lists the files of each package
+// which are not listed in the primary database. Repos without filelists are
+// checked against the primary database alone.
+func (c *RepoCache) updateFilelists(repomd *RepoMetadata) error {
+	db := repomd.Database("filelists_db", "filelists")
+	if db == nil {
+		Dprintf("No filelists database found for repo %v\n", c.Repo)
+		return nil
+	}
+
+	if _, err := c.downloadDatabase(db); err != nil {
+		return err
+	}
+
+	path, err := c.decompressDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	c.filelists = path
+	return nil
+}
+
+// updateModules downloads the modules.yaml file referenced by the given repo
+// metadata.
+func (c *RepoCache) updateModules(repomd *RepoMetadata) error {
+	db := repomd.Database("modules")
+	if db == nil {
+		return newError(ErrMetadataFetch, "No modules found for repo %v", c.Repo)
+	}
+
+	path, err := c.downloadDatabase(db)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(path, ".yaml") {
+		if path, err = c.decompressDatabase(db); err != nil {
+			return err
+		}
+	}
+
+	c.modules = path
+	return nil
+}
+
+// regenerates returns true if the given upstream database, or a variant of it,
+// is rebuilt by createrepo for the repo's selected packages, rather than copied
+// unmodified into the local repository: the primary, filelists and other
+// databases, the groupfile if IncludeGroups is set and the modules if
+// IncludeModules is set.
+func (c *Repo) regenerates(db *RepoDatabase) bool {
+	switch db.baseType() {
+	case "primary", "filelists", "other":
+		return true
+
+	case "group":
+		return len(c.IncludeGroups) > 0
+
+	case "modules":
+		return len(c.IncludeModules) > 0
+	}
+
+	return false
+}
+
+// passthroughDatabase is a database cached from the upstream repository which
+// is copied unmodified into the repository metadata built by createrepo.
+type passthroughDatabase struct {
+	db   RepoDatabase
+	path string
+}
+
+// updatePassthrough downloads each database of the given types referenced by
+// the given repo metadata, to be copied into the local repository metadata.
+// Types which the upstream repository does not provide are ignored.
+func (c *RepoCache) updatePassthrough(repomd *RepoMetadata, types ...string) error {
+	for _, typ := range types {
+		db := repomd.Database(typ)
+		if db == nil {
+			Dprintf("No %s database found for repo %v\n", typ, c.Repo)
+			continue
+		}
+
+		path, err := c.downloadDatabase(db)
+		if err != nil {
+			return err
+		}
+
+		c.passthrough = append(c.passthrough, passthroughDatabase{db: *db, path: path})
+	}
+
+	return nil
+}
 
-	// open repo metadata from URL
-	// TODO: Add support for non HTTP repositories
-	Dprintf("Downloading repo metadata from %s...\n", repomd_url)
-	resp, err := http.Get(repomd_url)
+// Modules returns the modules.yaml file cached from the upstream repository.
+func (c *RepoCache) Modules() (*Modules, error) {
+	if c.modules == "" {
+		return nil, fmt.Errorf("No modules cached for repo %v", c.Repo)
+	}
+
+	lock, err := rlockDir(c.Path)
 	if err != nil {
-		return nil, fmt.Errorf("Error retrieving repo metadata from URL: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer lock.Unlock()
+
+	f, err := os.Open(c.modules)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadModules(f)
+}
+
+// Comps returns the groupfile configured for the repo in Repo.Groupfile or
+// otherwise the groupfile cached from the upstream repository.
+func (c *RepoCache) Comps() (*Comps, error) {
+	path := c.Repo.Groupfile
+	if path == "" {
+		path = c.groupfile
+	}
+
+	if path == "" {
+		return nil, fmt.Errorf("No groupfile cached for repo %v", c.Repo)
+	}
+
+	lock, err := rlockDir(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadComps(f)
+}
+
+// repomdAttempts is the number of times repomd.xml is downloaded before a
+// truncated download, such as from a dropped connection, is reported as an
+// error.
+const repomdAttempts = 3
+
+// errTruncatedMetadata is wrapped by the error returned by fetchMetadata if
+// the downloaded repomd.xml is incomplete.
+var errTruncatedMetadata = errors.New("Truncated repo metadata")
+
+// fetchMetadata downloads the repomd.xml file at the given URL and returns its
+// content and decoded metadata.
+//
+// The HTTP client fails a response which ends before its Content-Length with
+// io.ErrUnexpectedEOF, but a mirror which drops the connection of a response
+// without a Content-Length may still serve a prefix of the file, so the file
+// is also required to be a complete XML document. Either failure wraps
+// errTruncatedMetadata so that the download may be retried.
+func (c *RepoCache) fetchMetadata(url string) ([]byte, *RepoMetadata, error) {
+	body, err := c.Repo.openMetadataURL(url)
+	if err != nil {
+		return nil, nil, newError(ErrRepoUnavailable, "Error retrieving repo metadata from URL: %w", err)
+	}
+	defer body.Close()
 
 	// read repometadata into byte buffer
-	b, err := ioutil.ReadAll(resp.Body)
+	b, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading repo metadata: %v", err)
+		return nil, nil, newError(ErrMetadataFetch, "Error reading repo metadata: %v: %w", err, errTruncatedMetadata)
+	}
+
+	if err := checkXMLComplete(b); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, newError(ErrMetadataFetch, "Repo metadata from %s ends after %d bytes: %w", url, len(b), errTruncatedMetadata)
+		}
+		return nil, nil, newError(ErrMetadataFetch, "Error decoding repo metadata: %w", err)
 	}
 
 	// decode repo metadata into struct
 	repomd, err := ReadRepoMetadata(bytes.NewReader(b))
 	if err != nil {
-		return nil, fmt.Errorf("Error decoding repo metadata: %v", err)
+		return nil, nil, newError(ErrMetadataFetch, "Error decoding repo metadata: %w", err)
+	}
+
+	return b, repomd, nil
+}
+
+// cacheMetadata downloads a repository's repomd.xml file to the given cache
+// directory.
+func (c *RepoCache) updateMetadata() (*RepoMetadata, error) {
+	repomd_url, err := c.Repo.resolveURL(c.Repo.repoURL(c.baseURL()), "/repodata/repomd.xml")
+	if err != nil {
+		return nil, err
+	}
+	repomd_path := filepath.Join(c.Path, "repomd.xml")
+
+	// use cached metadata if it has not expired
+	if repomd := c.freshMetadata(repomd_path); repomd != nil {
+		return repomd, nil
+	}
+
+	// download repo metadata, retrying if the download is truncated
+	var b []byte
+	var repomd *RepoMetadata
+	for attempt := 1; ; attempt++ {
+		Dprintf("Downloading repo metadata from %s...\n", repomd_url)
+		b, repomd, err = c.fetchMetadata(repomd_url)
+		if err == nil {
+			break
+		}
+
+		if !errors.Is(err, errTruncatedMetadata) || attempt >= repomdAttempts {
+			return nil, err
+		}
+		Printf("Repo metadata from %s is truncated, retrying (attempt %d of %d)\n", repomd_url, attempt+1, repomdAttempts)
+	}
+
+	if !c.Repo.pinnedRevision(repomd.Revision) {
+		return nil, newError(ErrMetadataFetch, "Repo metadata from %s is revision %d, expected pinned revision %s", repomd_url, repomd.Revision, c.Repo.PinRevision)
 	}
 
 	// read existing cache
@@ -97,13 +519,20 @@ func (c *RepoCache) updateMetadata() (*RepoMetadata, error) {
 			return nil, fmt.Errorf("Error decoding cached repo metadata: %v", err)
 		}
 
-		// update cache if online version is newer
-		if repomd.Revision > cache_repomd.Revision {
+		// update cache if online version is newer, or is another pinned
+		// revision
+		if repomd.Revision > cache_repomd.Revision || (c.Repo.PinRevision != "" && repomd.Revision != cache_repomd.Revision) {
 			Dprintf("Cached metadata revision %d requires an update to revision %d\n", cache_repomd.Revision, repomd.Revision)
 			update_mdcache = true
 		} else {
 			Dprintf("Cached metadata already at upstream revision %d\n", cache_repomd.Revision)
 			update_mdcache = false
+
+			// reset metadata expiry
+			now := time.Now()
+			if err := os.Chtimes(repomd_path, now, now); err != nil {
+				return nil, err
+			}
 		}
 	} else if err != nil && !os.IsNotExist(err) {
 		return nil, fmt.Errorf("Error reading precached repo metadata: %v", err)
@@ -118,7 +547,7 @@ func (c *RepoCache) updateMetadata() (*RepoMetadata, error) {
 			return nil, err
 		}
 
-		if err = ioutil.WriteFile(repomd_path, b, 0640); err != nil {
+		if err = writeCacheFile(repomd_path, bytes.NewReader(b)); err != nil {
 			return nil, err
 		}
 	}
@@ -126,19 +555,140 @@ func (c *RepoCache) updateMetadata() (*RepoMetadata, error) {
 	return repomd, nil
 }
 
+// baseURL returns the URL from which the repo metadata is cached.
+func (c *RepoCache) baseURL() string {
+	if c.BaseURL == "" {
+		return c.Repo.BaseURL
+	}
+
+	return c.BaseURL
+}
+
+// update calls Update, failing over to each of the repo's Mirrors in turn if
+// the metadata served by the BaseURL, or the mirror failed over to, cannot be
+// downloaded, validated or decompressed.
+func (c *RepoCache) update() error {
+	for {
+		err := c.Update()
+		if err == nil {
+			return nil
+		}
+
+		if err := c.failover(err); err != nil {
+			return err
+		}
+	}
+}
+
+// failover discards the cached metadata after the given error and sets the
+// BaseURL to the next of the repo's Mirrors, so that Update caches the metadata
+// from it instead. The given error is returned if there is no other mirror or
+// if it is not caused by the metadata served by the BaseURL.
+func (c *RepoCache) failover(err error) error {
+	if len(c.mirrors) == 0 || !(errors.Is(err, ErrMetadataFetch) || errors.Is(err, ErrChecksumMismatch)) {
+		return err
+	}
+
+	Errorf(err, "Error caching metadata for repo %v from %s", c.Repo, c.baseURL())
+	if err := c.discard(); err != nil {
+		return fmt.Errorf("Error discarding metadata from %s: %w", c.baseURL(), err)
+	}
+
+	c.BaseURL, c.mirrors = c.mirrors[0], c.mirrors[1:]
+	Printf("Retrying metadata for repo %v from mirror %s\n", c.Repo, c.BaseURL)
+	return nil
+}
+
+// discard removes the cached repo metadata and primary database, such as after
+// they could not be read, so that Update downloads them again, such as from
+// another mirror.
+func (c *RepoCache) discard() error {
+	lock, err := lockDir(c.Path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	paths := []string{filepath.Join(c.Path, "repomd.xml")}
+	if c.Metadata != nil {
+		for _, db := range c.Metadata.Databases {
+			if db.Type == "primary" || db.Type == "primary_db" {
+				paths = append(paths, filepath.Join(c.Path, filepath.Base(db.Location.Href)))
+			}
+		}
+	}
+
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	c.Metadata = nil
+	return nil
+}
+
+// freshMetadata returns the cached repo metadata at the given path if it has
+// not expired according to the repo's MetadataExpire option. If the metadata
+// has expired, is not cached, or ForceRefresh is set, nil is returned.
+func (c *RepoCache) freshMetadata(path string) *RepoMetadata {
+	if c.Repo.ForceRefresh || c.Repo.MetadataExpire == 0 {
+		return nil
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	age := time.Since(fi.ModTime())
+	if c.Repo.MetadataExpire > 0 && age >= c.Repo.MetadataExpire {
+		Dprintf("Cached metadata expired %v ago\n", age-c.Repo.MetadataExpire)
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		return nil
+	}
+
+	// the cache may hold another revision than is pinned, and snapshots
+	// pinned by date cannot be matched with a cached revision
+	if c.Repo.PinRevision != "" && strconv.Itoa(repomd.Revision) != c.Repo.PinRevision {
+		return nil
+	}
+
+	Dprintf("Cached metadata revision %d has not expired\n", repomd.Revision)
+	return repomd
+}
+
 // downloadDatabase downloads and caches the given repository database (E.g.
 // primary_db or filelists_db) to the given cache directory.
 func (c *RepoCache) downloadDatabase(db *RepoDatabase) (string, error) {
+	if err := c.Repo.checkChecksumType(db.Checksum.Type); err != nil {
+		return "", newError(ErrWeakChecksum, "Error validating %v database: %w", db, err)
+	}
+
 	// parse db paths
-	db_url := urljoin(c.Repo.BaseURL, db.Location.Href)
+	db_url, err := c.Repo.resolveURL(c.Repo.repoURL(c.baseURL()), db.Location.Href)
+	if err != nil {
+		return "", err
+	}
 	db_path := filepath.Join(c.Path, filepath.Base(db.Location.Href))
 
 	// check cached database
 	update_db := false
 	f, err := os.Open(db_path)
 	if err == nil {
-		err := db.Checksum.Check(f)
-		if err == ErrChecksumMismatch {
+		err := validateChecksum(f, db.Checksum.Hash, db.Checksum.Type)
+		f.Close()
+		if errors.Is(err, ErrChecksumMismatch) {
 			// checksum mismatch
 			update_db = true
 			Dprintf("Cached %v database requires an update\n", db)
@@ -158,60 +708,76 @@ func (c *RepoCache) downloadDatabase(db *RepoDatabase) (string, error) {
 	// download database
 	if update_db {
 		Dprintf("Downloading %v database from %s...\n", db, db_url)
-		resp, err := http.Get(db_url)
+		body, err := c.Repo.openMetadataURL(db_url)
 		if err != nil {
-			return "", fmt.Errorf("Error downloading %v database: %v", db, err)
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			return "", fmt.Errorf("Bad response code downloading %v database: %s", db, resp.Status)
+			return "", newError(ErrRepoUnavailable, "Error downloading %v database: %w", db, err)
 		}
+		defer body.Close()
 
-		// open output file for writing
+		// open a temporary output file for writing, so that readers of a
+		// shared cache never see a partial database
 		Dprintf("Caching %v database to %s...\n", db, db_path)
-		f, err := os.Create(db_path)
+		tmp := db_path + ".tmp"
+		f, err := os.Create(tmp)
 		if err != nil {
 			return "", fmt.Errorf("Error creating cache file for %v database: %v", db, err)
 		}
+		defer os.Remove(tmp)
 		defer f.Close()
 
 		// download
-		_, err = io.Copy(f, resp.Body)
+		_, err = io.Copy(f, body)
 		if err != nil {
-			return "", fmt.Errorf("Error downloading %v database: %v", db, err)
+			return "", newError(ErrMetadataFetch, "Error downloading %v database: %w", db, err)
+		}
+		body.Close()
+		if err := f.Close(); err != nil {
+			return "", fmt.Errorf("Error writing cache file for %v database: %v", db, err)
 		}
-		resp.Body.Close()
-		f.Close()
 
-		// validate checksum
-		if err := db.Checksum.CheckFile(db_path); err == ErrChecksumMismatch {
-			return "", fmt.Errorf("Database %v was download but failed checksum validation", db)
+		// validate size and checksum
+		if fi, err := os.Stat(tmp); err == nil && db.Size > 0 && fi.Size() != int64(db.Size) {
+			return "", newError(ErrChecksumMismatch, "Database %v was downloaded but is %d bytes, expected %d", db, fi.Size(), db.Size)
+		}
+
+		if err := validateFileChecksum(tmp, db.Checksum.Hash, db.Checksum.Type); errors.Is(err, ErrChecksumMismatch) {
+			return "", newError(ErrChecksumMismatch, "Database %v was download but failed checksum validation: %w", db, err)
 		} else if err != nil {
 			return "", fmt.Errorf("Error opening downloaded %v database: %v", db, err)
 		}
+
+		if err := os.Rename(tmp, db_path); err != nil {
+			return "", fmt.Errorf("Error caching %v database: %v", db, err)
+		}
 	}
 
 	return db_path, nil
 }
 
 // decompressDatabase decompresses a locally cached, compressed repository
-// database into the gen/ subdirectory of the given cache directory.
+// database into the gen/ subdirectory of the given cache directory, or the
+// temporary directory given by genPath.
 func (c *RepoCache) decompressDatabase(db *RepoDatabase) (string, error) {
-	basepath := filepath.Join(c.Path, "gen")
+	basepath, err := c.genPath()
+	if err != nil {
+		return "", err
+	}
 	path := filepath.Join(c.Path, filepath.Base(db.Location.Href))
 	dpath := ""
 
 	// determine output path
-	switch db.DatabaseVersion {
-	case 0: // XML files
-		dpath = filepath.Join(basepath, fmt.Sprintf("%s.xml", db.Type))
+	switch {
+	case db.DatabaseVersion != 0 && db.DatabaseVersion != 10:
+		return "", newError(ErrMetadataFetch, "Unsupported database version for %v: %d", db, db.DatabaseVersion)
 
-	case 10: // bzip2'd sqlite file
+	case db.IsSQLite(): // compressed sqlite file
 		dpath = filepath.Join(basepath, fmt.Sprintf("%s.sqlite", db.Type))
 
-	default:
-		return "", fmt.Errorf("Unsupported database version for %v: %d", db, db.DatabaseVersion)
+	case db.Type == "modules": // YAML files
+		dpath = filepath.Join(basepath, "modules.yaml")
+
+	default: // XML files
+		dpath = filepath.Join(basepath, fmt.Sprintf("%s.xml", db.Type))
 	}
 
 	// open the archive for decompression
@@ -222,47 +788,100 @@ func (c *RepoCache) decompressDatabase(db *RepoDatabase) (string, error) {
 	defer r.Close()
 
 	// select decompression type
-	var z io.Reader
-	if strings.HasSuffix(path, ".bz2") {
-		z = bzip2.NewReader(r)
+	z, err := decompressor(r, path)
+	if err != nil {
+		return "", newError(ErrMetadataFetch, "Error decompressing %v database: %w", db, err)
+	}
 
-	} else if strings.HasSuffix(path, ".xz") {
-		z, err = xz.NewReader(r, 0)
-		if err != nil {
-			return "", fmt.Errorf("Error initializing xz decompression: %v", err)
+	// open a temporary output file, so that readers of a shared cache never
+	// see a partial database
+	tmp := dpath + ".tmp"
+	w, err := os.Create(tmp)
+	if err != nil {
+		return "", fmt.Errorf("Error creating output file for %v database: %v", db, err)
+	}
+	defer os.Remove(tmp)
+	defer w.Close()
+
+	// decompress
+	n, err := io.Copy(w, z)
+	if err != nil {
+		return "", newError(ErrMetadataFetch, "Error decompressing %v database: %w", db, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("Error writing output file for %v database: %v", db, err)
+	}
+
+	// validate size and checksum
+	if db.OpenSize > 0 && n != int64(db.OpenSize) {
+		return "", newError(ErrChecksumMismatch, "Decompressed %v database is %d bytes, expected %d", db, n, db.OpenSize)
+	}
+
+	if db.OpenChecksum.Hash == "" {
+		Dprintf("No open-checksum to validate decompressed %v database\n", db)
+	} else {
+		if err := c.Repo.checkChecksumType(db.OpenChecksum.Type); err != nil {
+			return "", newError(ErrWeakChecksum, "Error validating decompressed %v database: %w", db, err)
 		}
 
-	} else if strings.HasSuffix(path, ".gz") {
-		z, err = gzip.NewReader(r)
+		if err := validateFileChecksum(tmp, db.OpenChecksum.Hash, db.OpenChecksum.Type); errors.Is(err, ErrChecksumMismatch) {
+			return "", newError(ErrChecksumMismatch, "Decompressed %v database failed checksum validation: %w", db, err)
+		} else if err != nil {
+			return "", fmt.Errorf("Error validating checksum for %v database: %v", db, err)
+		}
+	}
+
+	if err := os.Rename(tmp, dpath); err != nil {
+		return "", fmt.Errorf("Error writing decompressed %v database: %v", db, err)
+	}
+
+	return dpath, nil
+}
+
+// decompressor returns a reader which decompresses the given compressed
+// database, according to the file extension of the given path.
+func decompressor(r io.Reader, path string) (io.Reader, error) {
+	switch {
+	case strings.HasSuffix(path, ".bz2"):
+		return bzip2.NewReader(r), nil
+
+	case strings.HasSuffix(path, ".xz"):
+		z, err := xz.NewReader(r, 0)
 		if err != nil {
-			return "", fmt.Errorf("Error initializing gzip decompression: %v", err)
+			return nil, fmt.Errorf("Error initializing xz decompression: %v", err)
 		}
+		return z, nil
 
-	} else {
-		return "", fmt.Errorf("Unsupported compression format for %v database: %s", db, path)
+	case strings.HasSuffix(path, ".gz"):
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("Error initializing gzip decompression: %v", err)
+		}
+		return z, nil
 	}
 
-	// open output file
-	w, err := os.Create(dpath)
+	return nil, fmt.Errorf("Unsupported compression format: %s", path)
+}
+
+// writeCacheFile writes the contents of the given reader to a temporary file
+// and renames it to the given path, so that readers of a shared cache
+// directory see either the previous file or the complete new file.
+func writeCacheFile(path string, r io.Reader) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
-		return "", fmt.Errorf("Error creating output file for %v database: %v", db, err)
+		return err
 	}
-	defer w.Close()
+	defer os.Remove(tmp)
+	defer f.Close()
 
-	// decompress
-	_, err = io.Copy(w, z)
-	if err != nil {
-		return "", fmt.Errorf("Error decompressing %v database: %v", db, err)
+	if _, err := io.Copy(f, r); err != nil {
+		return err
 	}
-	w.Close()
 
-	// validate checksum
-	if err := db.OpenChecksum.CheckFile(dpath); err == ErrChecksumMismatch {
-		os.Remove(dpath)
-		return "", fmt.Errorf("Decompressed %v database failed checksum validation", db)
-	} else if err != nil {
-		return "", fmt.Errorf("Error validating checksum for %v database: %v", db, err)
+	if err := f.Close(); err != nil {
+		return err
 	}
 
-	return dpath, nil
+	return os.Rename(tmp, path)
 }
@@ -0,0 +1,993 @@
+package yum
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRepoMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo" xmlns:rpm="http://linux.duke.edu/metadata/rpm">
+  <revision>1483225200</revision>
+</repomd>`
+
+func TestMetadataExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(testRepoMetadata))
+	}))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL
+	repo.MetadataExpire = time.Hour
+	c := &RepoCache{Repo: repo, Path: dir}
+
+	// first update caches metadata
+	if _, err := c.updateMetadata(); err != nil {
+		t.Fatalf("Error updating metadata: %v", err)
+	}
+
+	// within the TTL
+	if _, err := c.updateMetadata(); err != nil {
+		t.Fatalf("Error updating metadata: %v", err)
+	}
+
+	if hits != 1 {
+		t.Errorf("Expected metadata within the TTL not to be downloaded, got %d requests", hits)
+	}
+
+	// forced refresh
+	repo.ForceRefresh = true
+	if _, err := c.updateMetadata(); err != nil {
+		t.Fatalf("Error updating metadata: %v", err)
+	}
+
+	if hits != 2 {
+		t.Errorf("Expected ForceRefresh to download metadata, got %d requests", hits)
+	}
+
+	// expired
+	repo.ForceRefresh = false
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "repomd.xml"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.updateMetadata(); err != nil {
+		t.Fatalf("Error updating metadata: %v", err)
+	}
+
+	if hits != 3 {
+		t.Errorf("Expected expired metadata to be downloaded, got %d requests", hits)
+	}
+}
+
+// gzipBytes returns the gzip compressed form of b.
+func gzipBytes(t *testing.T, b []byte) []byte {
+	buf := &bytes.Buffer{}
+	z := gzip.NewWriter(buf)
+	if _, err := z.Write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// checksumBytes returns the sha256 checksum of b.
+func checksumBytes(t *testing.T, b []byte) RepoDatabaseChecksum {
+	sum, err := ComputeChecksum(bytes.NewReader(b), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return RepoDatabaseChecksum{Type: "sha256", Hash: sum}
+}
+
+func TestCorruptCachedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	compressed := gzipBytes(t, primary)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressed)
+	}))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL
+	c := &RepoCache{Repo: repo, Path: dir}
+	if err := os.MkdirAll(filepath.Join(dir, "gen"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &RepoDatabase{
+		Type:         "primary",
+		Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+		Checksum:     checksumBytes(t, compressed),
+		OpenChecksum: checksumBytes(t, primary),
+	}
+
+	// corrupt cached database is downloaded again
+	path := filepath.Join(dir, "primary.xml.gz")
+	if err := ioutil.WriteFile(path, compressed[:len(compressed)/2], 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.downloadDatabase(db); err != nil {
+		t.Fatalf("Error downloading database: %v", err)
+	}
+
+	if err := db.Checksum.CheckFile(path); err != nil {
+		t.Errorf("Corrupt cached database was not replaced: %v", err)
+	}
+
+	if _, err := c.decompressDatabase(db); err != nil {
+		t.Errorf("Error decompressing database: %v", err)
+	}
+
+	// decompressed database is validated
+	db.OpenChecksum = checksumBytes(t, []byte("something else"))
+	if _, err := c.decompressDatabase(db); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+	}
+
+	// the previously decompressed database is kept
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "gen", "primary.xml")); err != nil || !bytes.Equal(b, primary) {
+		t.Errorf("Expected valid decompressed database to be kept: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "gen", "primary.xml.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Corrupt decompressed database was not removed")
+	}
+
+	// corrupt download is not cached
+	db.Checksum = checksumBytes(t, []byte("something else"))
+	if _, err := c.downloadDatabase(db); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", err)
+	}
+
+	// the previously cached database is kept
+	if b, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(b, compressed) {
+		t.Errorf("Expected valid cached database to be kept: %v", err)
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Corrupt downloaded database was not removed")
+	}
+}
+
+// newTestRepoServer starts a HTTP server which serves a repomd.xml and an
+// empty primary.xml.gz database for each of the given repo IDs at /<id>/.
+func newTestRepoServer(t *testing.T, ids ...string) *httptest.Server {
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	compressed := gzipBytes(t, primary)
+
+	repomd := &RepoMetadata{
+		Revision: 1,
+		Databases: []RepoDatabase{
+			{
+				Type:         "primary",
+				Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum:     checksumBytes(t, compressed),
+				OpenChecksum: checksumBytes(t, primary),
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := repomd.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	for _, id := range ids {
+		b := buf.Bytes()
+		mux.HandleFunc("/"+id+"/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(b)
+		})
+
+		mux.HandleFunc("/"+id+"/repodata/primary.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(compressed)
+		})
+	}
+
+	return httptest.NewServer(mux)
+}
+
+func TestCacheAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ids := []string{"base", "updates", "extras", "epel", "centosplus"}
+	ts := newTestRepoServer(t, ids...)
+	defer ts.Close()
+
+	repos := make([]*Repo, 0)
+	for _, id := range append(ids, "missing") {
+		repo := NewRepo()
+		repo.ID = id
+		repo.BaseURL = ts.URL + "/" + id
+		repos = append(repos, repo)
+	}
+
+	caches, err := CacheAll(repos, dir)
+	if errs, ok := err.(Errors); !ok || len(errs) != 1 || !errors.Is(errs[0], ErrRepoUnavailable) {
+		t.Errorf("Expected one ErrRepoUnavailable error, got: %v", err)
+	}
+
+	for i, id := range ids {
+		if caches[i] == nil || caches[i].Repo != repos[i] {
+			t.Errorf("Repo %s was not cached", id)
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, id, "gen", "primary.xml")); err != nil {
+			t.Errorf("Primary database not cached for repo %s: %v", id, err)
+		}
+	}
+
+	if caches[len(ids)] != nil {
+		t.Errorf("Expected no cache for missing repo")
+	}
+}
+
+func TestCacheOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// each cached repo uses 10 bytes of a 25 byte volume
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	defer func(f func(string) (uint64, error)) { diskFree = f }(diskFree)
+	diskFree = func(path string) (uint64, error) {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(25 - 10*len(files)), nil
+	}
+
+	ids := []string{"base", "updates", "extras", "epel"}
+	ts := newTestRepoServer(t, ids...)
+	defer ts.Close()
+
+	cached := make(map[string]string)
+	for _, id := range ids {
+		repo := NewRepo()
+		repo.ID = id
+		repo.BaseURL = ts.URL + "/" + id
+		repocache, err := repo.CacheLocal(a + string(os.PathListSeparator) + b)
+		if err != nil {
+			t.Fatalf("Error caching repo %s: %v", id, err)
+		}
+		repocache.Close()
+		cached[id] = filepath.Dir(repocache.Path)
+	}
+
+	// repos are cached in the directory with the most free space, and the
+	// first directory is preferred if they are equal
+	expect := map[string]string{"base": a, "updates": b, "extras": a, "epel": b}
+	for id, dir := range expect {
+		if cached[id] != dir {
+			t.Errorf("Expected repo %s to be cached in %s, got %s", id, dir, cached[id])
+		}
+	}
+
+	// an existing cache is reused regardless of free space
+	cache, err := NewCache(b + string(os.PathListSeparator) + a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repocache, err := cache.NewRepoCache(&Repo{ID: "base"})
+	if err != nil || repocache.Path != filepath.Join(a, "base") {
+		t.Errorf("Expected existing cache of repo base in %s, got %v: %v", a, repocache, err)
+	}
+}
+
+func TestPruneCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ids := []string{"base", "removed"}
+	ts := newTestRepoServer(t, ids...)
+	defer ts.Close()
+
+	repos := make([]*Repo, len(ids))
+	for i, id := range ids {
+		repos[i] = NewRepo()
+		repos[i].ID = id
+		repos[i].BaseURL = ts.URL + "/" + id
+		repocache, err := repos[i].CacheLocal(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repocache.Close()
+	}
+
+	// directories which are not repo caches are never pruned
+	if err := os.MkdirAll(filepath.Join(dir, "other"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	freed, err := PruneCache(dir, repos[:1])
+	if err != nil {
+		t.Fatalf("Error pruning cache: %v", err)
+	}
+
+	if freed == 0 {
+		t.Errorf("Expected bytes to be freed")
+	}
+
+	for name, exists := range map[string]bool{"base": true, "removed": false, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("Expected %s to exist: %v, got: %v", name, exists, err)
+		}
+	}
+}
+
+func TestPackagesFromPrimaryXML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "primary.xml")
+	primary := `<metadata xmlns="http://linux.duke.edu/metadata/common" xmlns:rpm="http://linux.duke.edu/metadata/rpm" packages="1">
+<package type="rpm">
+  <name>bash</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="4.2.46" rel="34.el7"/>
+  <checksum type="sha256" pkgid="YES">b9957fd3ebe1ebfe8b4d3ec51bc7fa4d4b46ff7b3a6dfa8e4fa6ab5e1b88cbbd</checksum>
+  <time file="1588350000" build="1588340000"/>
+  <size package="1037976" installed="3667773" archive="3688584"/>
+  <location href="Packages/bash-4.2.46-34.el7.x86_64.rpm"/>
+</package>
+</metadata>`
+	if err := ioutil.WriteFile(path, []byte(primary), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &RepoCache{Repo: NewRepo(), Path: dir, primary: path}
+	packages, err := c.Packages()
+	if err != nil {
+		t.Fatalf("Error reading packages from primary.xml: %v", err)
+	}
+
+	if len(packages) != 1 {
+		t.Fatalf("Expected 1 package, got %d", len(packages))
+	}
+
+	p := packages[0]
+	if p.String() != "bash-4.2.46-34.el7.x86_64" || p.PackageSize() != 1037976 || p.LocationHref() != "Packages/bash-4.2.46-34.el7.x86_64.rpm" {
+		t.Errorf("Unexpected package read from primary.xml: %v (%d bytes at %s)", p, p.PackageSize(), p.LocationHref())
+	}
+}
+
+func TestRepoCacheTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewCache(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.TempDir = filepath.Join(dir, "tmp")
+
+	c, err := cache.NewRepoCache(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	compressed := gzipBytes(t, primary)
+	if err := ioutil.WriteFile(filepath.Join(c.Path, "primary.xml.gz"), compressed, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	db := &RepoDatabase{
+		Type:         "primary",
+		Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+		Checksum:     checksumBytes(t, compressed),
+		OpenChecksum: checksumBytes(t, primary),
+	}
+
+	path, err := c.decompressDatabase(db)
+	if err != nil {
+		t.Fatalf("Error decompressing database: %v", err)
+	}
+
+	if rel, err := filepath.Rel(repo.TempDir, path); err != nil || strings.HasPrefix(rel, "..") {
+		t.Errorf("Expected database to be decompressed in %s, got %s", repo.TempDir, path)
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(c.Path, "gen")); len(files) != 0 {
+		t.Errorf("Expected no decompressed databases in the cache directory, found %d", len(files))
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("Error closing repo cache: %v", err)
+	}
+
+	if files, err := ioutil.ReadDir(repo.TempDir); err != nil || len(files) != 0 {
+		t.Errorf("Expected temporary files to be removed from %s: %v", repo.TempDir, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(c.Path, "primary.xml.gz")); err != nil {
+		t.Errorf("Expected downloaded database to remain cached: %v", err)
+	}
+
+	// the package default applies to repos without a TempDir
+	defer func(v string) { DefaultTempDir = v }(DefaultTempDir)
+	DefaultTempDir = filepath.Join(dir, "default")
+	repo.TempDir = ""
+
+	path, err = c.decompressDatabase(db)
+	if err != nil {
+		t.Fatalf("Error decompressing database: %v", err)
+	}
+	defer c.Close()
+
+	if rel, err := filepath.Rel(DefaultTempDir, path); err != nil || strings.HasPrefix(rel, "..") {
+		t.Errorf("Expected database to be decompressed in %s, got %s", DefaultTempDir, path)
+	}
+}
+
+func TestDatabaseOpenSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	compressed := gzipBytes(t, primary)
+	if err := ioutil.WriteFile(filepath.Join(dir, "primary.xml.gz"), compressed, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "gen"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &RepoCache{Repo: NewRepo(), Path: dir}
+	db := &RepoDatabase{
+		Type:         "primary",
+		Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+		Checksum:     checksumBytes(t, compressed),
+		OpenSize:     len(primary),
+		OpenChecksum: checksumBytes(t, primary),
+	}
+
+	if _, err := c.decompressDatabase(db); err != nil {
+		t.Fatalf("Error decompressing database: %v", err)
+	}
+
+	// the open-size is validated with the open-checksum
+	db.OpenSize = len(primary) + 1
+	if _, err := c.decompressDatabase(db); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch for wrong open-size, got: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "gen", "primary.xml.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Decompressed database with wrong open-size was not removed")
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "gen", "primary.xml")); err != nil || !bytes.Equal(b, primary) {
+		t.Errorf("Expected valid decompressed database to be kept: %v", err)
+	}
+
+	// databases without an open-checksum are accepted
+	db.OpenSize = 0
+	db.OpenChecksum = RepoDatabaseChecksum{}
+	if _, err := c.decompressDatabase(db); err != nil {
+		t.Errorf("Error decompressing database without open-checksum: %v", err)
+	}
+}
+
+func TestUpdateOpenChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the compressed primary database is valid but decompresses to different
+	// content than its open-checksum
+	upstream := filepath.Join(dir, "upstream")
+	primary := []byte(`<metadata packages="0"></metadata>`)
+	writeTestRepodata(t, upstream, 1, primary)
+
+	repomd := readRepodata(upstream)
+	if repomd == nil {
+		t.Fatal("Error reading test repository metadata")
+	}
+	repomd.Databases[0].OpenChecksum = checksumBytes(t, []byte("something else"))
+
+	buf := &bytes.Buffer{}
+	if err := repomd.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(upstream, repodataDirname, "repomd.xml"), buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	cachedir := filepath.Join(dir, "cache")
+	if _, err := repo.CacheLocal(cachedir); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch for a bad open-checksum, got: %v", err)
+	}
+
+	filepath.Walk(cachedir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && strings.HasPrefix(fi.Name(), "primary.xml") && !strings.HasSuffix(fi.Name(), ".gz") {
+			t.Errorf("Expected no decompressed database to be cached, got %s", path)
+		}
+		return nil
+	})
+
+	// the database is accepted once its open-checksum matches
+	writeTestRepodata(t, upstream, 2, primary)
+	repocache, err := repo.CacheLocal(cachedir)
+	if err != nil {
+		t.Fatalf("Error caching metadata with a valid open-checksum: %v", err)
+	}
+	defer repocache.Close()
+
+	if _, err := repocache.Packages(); err != nil {
+		t.Errorf("Error reading packages: %v", err)
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// serve a new revision of a large primary database for every update
+	upstream := filepath.Join(dir, "upstream")
+	var mu sync.Mutex
+	revision := 0
+	publish := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		revision++
+
+		b := &bytes.Buffer{}
+		fmt.Fprintf(b, `<metadata packages="%d">`, revision)
+		for i := 0; i < revision*20; i++ {
+			fmt.Fprintf(b, `<package type="rpm"><name>pkg%d</name><arch>x86_64</arch><version epoch="0" ver="1" rel="%d"/></package>`, i, revision)
+		}
+		b.WriteString(`</metadata>`)
+		writeTestRepodata(t, upstream, revision, b.Bytes())
+	}
+	publish()
+
+	files := http.FileServer(http.Dir(upstream))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// the writer keeps the cache up to date
+	writer := NewRepo()
+	writer.ID = "shared"
+	writer.BaseURL = ts.URL
+	writer.ForceRefresh = true
+	wcache, err := writer.CacheLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers use the metadata cached by the writer
+	readers := make([]*RepoCache, 4)
+	for i := range readers {
+		repo := NewRepo()
+		repo.ID = "shared"
+		repo.BaseURL = ts.URL
+		repo.MetadataExpire = MetadataNeverExpires
+		if readers[i], err = repo.CacheLocal(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, len(readers))
+	var wg sync.WaitGroup
+	for _, c := range readers {
+		wg.Add(1)
+		go func(c *RepoCache) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if _, err := c.Packages(); err != nil {
+					errs <- err
+					return
+				}
+
+				// shared locks are not fair, so leave gaps for the writer
+				time.Sleep(time.Millisecond)
+			}
+		}(c)
+	}
+
+	for i := 0; i < 10; i++ {
+		publish()
+		if err := wcache.Update(); err != nil {
+			t.Errorf("Error updating shared cache: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Error reading shared cache during update: %v", err)
+	}
+
+	packages, err := readers[0].Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packages) != revision*20 {
+		t.Errorf("Expected %d packages after update, got %d", revision*20, len(packages))
+	}
+}
+
+func TestPinRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// serve the latest revision and historical snapshots
+	upstream := filepath.Join(dir, "upstream")
+	for prefix, revision := range map[string]int{
+		"":                  300,
+		"snapshots/100":     100,
+		"snapshots/200":     200,
+		"snapshots/2020-01": 150,
+		"snapshots/999":     100,
+	} {
+		writeTestRepodata(t, filepath.Join(upstream, prefix), revision, []byte(`<metadata packages="0"></metadata>`))
+	}
+	ts := httptest.NewServer(http.FileServer(http.Dir(upstream)))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL
+	repo.MetadataExpire = MetadataNeverExpires
+
+	for _, test := range []struct {
+		pin      string
+		revision int
+	}{
+		{"", 300},
+		{"200", 200},
+		{"100", 100}, // older than the cached revision
+		{"2020-01", 150},
+	} {
+		repo.PinRevision = test.pin
+		c, err := repo.CacheLocal(dir)
+		if err != nil {
+			t.Errorf("Error caching pinned revision '%s': %v", test.pin, err)
+			continue
+		}
+		c.Close()
+
+		if c.Metadata.Revision != test.revision {
+			t.Errorf("Expected revision %d for pinned revision '%s', got %d", test.revision, test.pin, c.Metadata.Revision)
+		}
+	}
+
+	// a snapshot must have the pinned revision
+	repo.PinRevision = "999"
+	if _, err := repo.CacheLocal(dir); !errors.Is(err, ErrMetadataFetch) {
+		t.Errorf("Expected ErrMetadataFetch for a snapshot of another revision, got: %v", err)
+	}
+}
+
+func TestTruncatedRepoMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := newTestRepoServer(t, "chunked", "sized")
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/sized/repodata/repomd.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serve the first requests of repomd.xml truncated, either by ending a
+	// response without a Content-Length early or by closing the connection
+	// before Content-Length bytes are sent
+	var mu sync.Mutex
+	truncate, requests := 0, 0
+	mux := http.NewServeMux()
+	mux.Handle("/", ts.Config.Handler)
+	mux.HandleFunc("/chunked/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		truncated := requests <= truncate
+		mu.Unlock()
+
+		if truncated {
+			w.Write(b[:len(b)/2])
+		} else {
+			w.Write(b)
+		}
+	})
+	mux.HandleFunc("/sized/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		truncated := requests <= truncate
+		mu.Unlock()
+
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+		if !truncated {
+			w.Write(b)
+			return
+		}
+
+		w.Write(b[:len(b)/2])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	})
+	truncating := httptest.NewServer(mux)
+	defer truncating.Close()
+
+	for _, id := range []string{"chunked", "sized"} {
+		for _, test := range []struct {
+			truncate int
+			ok       bool
+		}{
+			{repomdAttempts - 1, true},
+			{repomdAttempts, false},
+		} {
+			mu.Lock()
+			truncate, requests = test.truncate, 0
+			mu.Unlock()
+
+			repo := NewRepo()
+			repo.ID = id
+			repo.BaseURL = truncating.URL + "/" + id
+			c, err := repo.CacheLocal(filepath.Join(dir, fmt.Sprintf("%s-%d", id, test.truncate)))
+			if test.ok {
+				if err != nil {
+					t.Errorf("Error caching %s repo after %d truncated downloads of repomd.xml: %v", id, test.truncate, err)
+					continue
+				}
+				c.Close()
+				if c.Metadata.Revision != 1 {
+					t.Errorf("Expected revision 1 of %s repo, got %d", id, c.Metadata.Revision)
+				}
+			} else if !errors.Is(err, ErrMetadataFetch) {
+				t.Errorf("Expected ErrMetadataFetch for %s repo after %d truncated downloads of repomd.xml, got: %v", id, test.truncate, err)
+			}
+
+			expected := test.truncate + 1
+			if expected > repomdAttempts {
+				expected = repomdAttempts
+			}
+			if requests != expected {
+				t.Errorf("Expected %d requests of repomd.xml for %s repo, got %d", expected, id, requests)
+			}
+		}
+	}
+}
+
+func TestUpdateSkipsUnneededFilelists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := newTestDependencyServer(t, []byte(`<metadata packages="0"></metadata>`), []byte(`<filelists packages="0"></filelists>`))
+	defer upstream.Close()
+
+	requests := make([]string, 0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		upstream.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = ts.URL
+
+	// filelists are not fetched unless a feature requires them
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "primary"))
+	if err != nil {
+		t.Fatalf("Error caching repo: %v", err)
+	}
+	repocache.Close()
+
+	expected := "/repodata/repomd.xml /repodata/primary.xml.gz"
+	if actual := strings.Join(requests, " "); actual != expected {
+		t.Errorf("Expected requests %s, got %s", expected, actual)
+	}
+
+	requests = requests[:0]
+	repo.CheckClosure = true
+	repocache, err = repo.CacheLocal(filepath.Join(dir, "closure"))
+	if err != nil {
+		t.Fatalf("Error caching repo with CheckClosure: %v", err)
+	}
+	repocache.Close()
+
+	expected = "/repodata/repomd.xml /repodata/primary.xml.gz /repodata/filelists.xml.gz"
+	if actual := strings.Join(requests, " "); actual != expected {
+		t.Errorf("Expected requests %s, got %s", expected, actual)
+	}
+}
+
+func TestMetadataFailover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	good := []byte(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">abc</checksum>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`)
+
+	// each broken mirror serves a primary database which passes checksum
+	// validation but cannot be read
+	primaries := map[string][]byte{
+		"corrupt":     []byte("not a gzip file"),
+		"unparseable": gzipBytes(t, []byte("<metadata packages=")),
+		"good":        gzipBytes(t, good),
+	}
+
+	mux := http.NewServeMux()
+	for name, compressed := range primaries {
+		compressed := compressed
+		repomd := &RepoMetadata{
+			Revision: 1,
+			Databases: []RepoDatabase{{
+				Type:     "primary",
+				Location: RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum: checksumBytes(t, compressed),
+			}},
+		}
+
+		buf := &bytes.Buffer{}
+		if err := repomd.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		mux.HandleFunc("/"+name+"/repodata/repomd.xml", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(buf.Bytes())
+		})
+		mux.HandleFunc("/"+name+"/repodata/primary.xml.gz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(compressed)
+		})
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	mux.HandleFunc("/mirrorlist", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%[1]s/corrupt/\n%[1]s/unparseable/\n%[1]s/good/\n", ts.URL)
+	})
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.MirrorURL = ts.URL + "/mirrorlist"
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Expected metadata to be cached from a good mirror: %v", err)
+	}
+	defer repocache.Close()
+
+	// the primary database is only read when packages are read
+	if repocache.baseURL() != ts.URL+"/unparseable/" {
+		t.Errorf("Expected metadata to be cached from the first decompressible mirror, got %s", repocache.baseURL())
+	}
+
+	packages, err := repocache.Packages()
+	if err != nil || len(packages) != 1 || packages[0].Name() != "foo" {
+		t.Errorf("Expected packages from the good mirror, got %v: %v", packages, err)
+	}
+
+	if repocache.baseURL() != ts.URL+"/good/" {
+		t.Errorf("Expected metadata to be cached from the good mirror, got %s", repocache.baseURL())
+	}
+
+	// the repo is not modified
+	if repo.BaseURL != ts.URL+"/corrupt/" || strings.Join(repo.Mirrors, " ") != ts.URL+"/unparseable/ "+ts.URL+"/good/" {
+		t.Errorf("Expected mirrors of the repo to be unchanged, got %s, mirrors %v", repo.BaseURL, repo.Mirrors)
+	}
+
+	// without a good mirror, caching fails
+	repo = NewRepo()
+	repo.ID = "broken"
+	repo.BaseURL = ts.URL + "/corrupt/"
+	repo.Mirrors = []string{ts.URL + "/unparseable/"}
+	repocache, err = repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Expected metadata to be cached from the unparseable mirror: %v", err)
+	}
+	defer repocache.Close()
+
+	if _, err := repocache.Packages(); !errors.Is(err, ErrMetadataFetch) {
+		t.Errorf("Expected ErrMetadataFetch without a good mirror, got: %v", err)
+	}
+}
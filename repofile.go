@@ -0,0 +1,636 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// iniSection is a named section of an INI formatted file such as a yum .repo
+// file.
+type iniSection struct {
+	Name   string
+	Path   string
+	LineNo int
+	Values map[string]string
+}
+
+// iniRepeatedKeys are the keys which may be given more than once in a
+// section. Each value is appended to the previous values, separated by a
+// newline, as for an indented line.
+var iniRepeatedKeys = map[string]bool{
+	"header": true,
+}
+
+// readIni parses the INI formatted content of the given io.Reader. Keys are
+// lower cased. Indented lines are appended to the value of the preceding key,
+// separated by a newline, as is permitted for multiple baseurl or gpgkey
+// values.
+func readIni(r io.Reader, path string) ([]*iniSection, error) {
+	sections := make([]*iniSection, 0)
+	var section *iniSection
+	key := ""
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		// skip blank lines and comments
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, ";") {
+			continue
+		}
+
+		// new section
+		if strings.HasPrefix(trimmed, "[") {
+			if !strings.HasSuffix(trimmed, "]") {
+				return nil, NewErrorf("Malformed section header (in %s:%d)", path, lineno)
+			}
+
+			section = &iniSection{
+				Name:   strings.TrimSpace(trimmed[1 : len(trimmed)-1]),
+				Path:   path,
+				LineNo: lineno,
+				Values: make(map[string]string),
+			}
+			sections = append(sections, section)
+			key = ""
+			continue
+		}
+
+		if section == nil {
+			return nil, NewErrorf("Option specified outside of a section (in %s:%d)", path, lineno)
+		}
+
+		// continuation of the previous value
+		if key != "" && (line[0] == ' ' || line[0] == '\t') {
+			section.Values[key] += "\n" + trimmed
+			continue
+		}
+
+		// key = value
+		i := strings.Index(trimmed, "=")
+		if i < 1 {
+			return nil, NewErrorf("Expected 'key = value' (in %s:%d)", path, lineno)
+		}
+
+		key = strings.ToLower(strings.TrimSpace(trimmed[:i]))
+		value := strings.TrimSpace(trimmed[i+1:])
+		if prev, ok := section.Values[key]; ok && iniRepeatedKeys[key] {
+			value = prev + "\n" + value
+		}
+		section.Values[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return sections, nil
+}
+
+// parseHeaders parses the HTTP headers of a header option value, with one
+// 'Name: value' header per line.
+func parseHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("Expected 'Name: value'")
+		}
+
+		name := http.CanonicalHeaderKey(strings.TrimSpace(line[:i]))
+		if strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("Invalid header name '%s'", name)
+		}
+		headers[name] = strings.TrimSpace(line[i+1:])
+	}
+
+	return headers, nil
+}
+
+// parseBool parses a boolean option value as accepted by yum.
+func parseBool(s string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "1", "yes", "true", "on":
+		return true, true
+
+	case "0", "no", "false", "off":
+		return false, true
+	}
+
+	return false, false
+}
+
+// parseSize parses a size option value in bytes, such as 500M or 2G. Plain
+// numbers are bytes.
+func parseSize(s string) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	return bytefmt.ToBytes(s)
+}
+
+// parseDuration parses a duration option value as accepted by yum for options
+// such as metadata_expire. Plain numbers are seconds and the suffixes s, m, h
+// and d are accepted. The value "never" returns MetadataNeverExpires.
+func parseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "never" || s == "-1" {
+		return MetadataNeverExpires, nil
+	}
+
+	if s == "" {
+		return 0, NewErrorf("Empty duration")
+	}
+
+	unit := time.Second
+	switch s[len(s)-1] {
+	case 's':
+		s = s[:len(s)-1]
+
+	case 'm':
+		unit = time.Minute
+		s = s[:len(s)-1]
+
+	case 'h':
+		unit = time.Hour
+		s = s[:len(s)-1]
+
+	case 'd':
+		unit = 24 * time.Hour
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, NewErrorf("Invalid duration: %s", s)
+	}
+
+	return time.Duration(n * float64(unit)), nil
+}
+
+// firstValue returns the first of multiple whitespace separated values.
+func firstValue(s string) string {
+	if fields := strings.Fields(s); len(fields) > 0 {
+		return fields[0]
+	}
+
+	return ""
+}
+
+// yumOptions are the options of the repository sections of yum.conf which
+// are not used by go-yum, such as client-side network settings. They are
+// ignored, so that the files in /etc/yum.repos.d/ may be read, while any other
+// unrecognized option, such as a misspelled one, is an error.
+var yumOptions = map[string]bool{
+	"async":                        true,
+	"bandwidth":                    true,
+	"cost":                         true,
+	"countme":                      true,
+	"deltarpm_metadata_percentage": true,
+	"deltarpm_percentage":          true,
+	"enablegroups":                 true,
+	"failovermethod":               true,
+	"gpgcakey":                     true,
+	"http_caching":                 true,
+	"ip_resolve":                   true,
+	"keepalive":                    true,
+	"metadata_timer_sync":          true,
+	"metalink":                     true,
+	"minrate":                      true,
+	"mirrorlist_expire":            true,
+	"module_hotfixes":              true,
+	"password":                     true,
+	"proxy":                        true,
+	"proxy_password":               true,
+	"proxy_username":               true,
+	"repo_gpgcheck":                true,
+	"retries":                      true,
+	"skip_if_unavailable":          true,
+	"ssl_check_cert_permissions":   true,
+	"sslcacert":                    true,
+	"sslclientcert":                true,
+	"sslclientkey":                 true,
+	"sslverify":                    true,
+	"timeout":                      true,
+	"type":                         true,
+	"ui_repoid_vars":               true,
+	"username":                     true,
+}
+
+// yumfileDateLayout is the layout of a date option value, such as min_date,
+// which is a date in UTC. Values may also be RFC 3339 timestamps.
+const yumfileDateLayout = "2006-01-02"
+
+// parseDate parses a date option value, in the form 2006-01-02 or as an RFC
+// 3339 timestamp.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(yumfileDateLayout, s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// repoFromSection maps the options of a .repo file section to a new Repo.
+// Options of yum which are not used by go-yum are ignored; see yumOptions. Any
+// other unrecognized option is an error. Variables such as $releasever and
+// $basearch are not expanded. Relative paths are resolved against the
+// directory of the given file path.
+func repoFromSection(s *iniSection, path string) (*Repo, error) {
+	repo := NewRepo()
+	repo.ID = s.Name
+	repo.YumfilePath = path
+	repo.YumfileLineNo = s.LineNo
+
+	for key, value := range s.Values {
+		switch key {
+		case "name":
+			repo.Name = value
+
+		case "architecture":
+			repo.Architecture = value
+
+		case "checksum":
+			repo.Checksum = value
+
+		case "checksum_policy":
+			repo.ChecksumPolicy = MinimumChecksumPolicy(strings.ToLower(value))
+
+		case "staging_dir":
+			repo.StagingDir = value
+
+		case "temp_dir":
+			repo.TempDir = value
+
+		case "sign_key":
+			repo.SignKey = value
+
+		case "sign_key_passphrase":
+			repo.SignKeyPassphrase = value
+
+		case "resign_key":
+			repo.ResignKey = value
+
+		case "resign_key_passphrase":
+			repo.ResignKeyPassphrase = value
+
+		case "vault_url":
+			repo.VaultURL = value
+
+		case "user_agent":
+			repo.UserAgent = value
+
+		case "notify_webhook":
+			repo.NotifyWebhook = value
+
+		case "include_groups":
+			repo.IncludeGroups = splitPatterns(value)
+
+		case "include_modules":
+			repo.IncludeModules = splitPatterns(value)
+
+		case "baseurl":
+			if urls := strings.Fields(value); len(urls) > 0 {
+				repo.BaseURL = urls[0]
+				repo.Mirrors = urls[1:]
+			}
+
+		case "mirrorlist":
+			repo.MirrorURL = value
+
+		case "localpath":
+			repo.LocalPath = value
+
+		case "cachepath":
+			repo.CachePath = strings.Join(strings.Split(value, "\n"), string(os.PathListSeparator))
+
+		case "groupfile":
+			repo.Groupfile = value
+
+		case "gpgkey":
+			if isInlineKey(value) {
+				repo.GPGKey = parseInlineKey(value)
+			} else {
+				repo.GPGKey = firstValue(value)
+			}
+
+		case "exclude":
+			repo.Exclude = splitPatterns(value)
+
+		case "includepkgs":
+			repo.IncludePackages = splitPatterns(value)
+
+		case "exclude_licenses":
+			repo.ExcludeLicenses = splitPatterns(value)
+
+		case "include_licenses":
+			repo.IncludeLicenses = splitPatterns(value)
+
+		case "include_regex":
+			repo.IncludeRegex = value
+
+		case "exclude_regex":
+			repo.ExcludeRegex = value
+
+		case "pin_revision":
+			repo.PinRevision = value
+
+		case "header":
+			headers, err := parseHeaders(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %v (in %s:%d)", key, repo.ID, err, path, s.LineNo)
+			}
+			repo.Headers = headers
+
+		case "header_hosts":
+			repo.HeaderHosts = strings.Fields(value)
+
+		case "package_lockfile":
+			repo.PackageLockFile = value
+
+		case "s3_region":
+			repo.S3Region = value
+
+		case "s3_endpoint":
+			repo.S3Endpoint = value
+
+		case "throttle":
+			rate, err := parseRate(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.MaxBytesPerSecond = rate
+
+		case "maxpkgsize":
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.MaxPackageSize = size
+
+		case "bandwidth_schedule":
+			schedule, err := ParseBandwidthSchedule(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %v (in %s:%d)", key, repo.ID, err, path, s.LineNo)
+			}
+			repo.BandwidthSchedule = schedule
+
+		case "metadata_threads":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.MetadataThreads = n
+
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < 1 || priority > 99 {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.Priority = priority
+
+		case "metadata_expire":
+			d, err := parseDuration(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.MetadataExpire = d
+
+		case "date_skew_tolerance", "delete_older_than":
+			d, err := parseDuration(value)
+			if err != nil || d < 0 {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+
+			if key == "date_skew_tolerance" {
+				repo.DateSkewTolerance = d
+			} else {
+				repo.DeleteOlderThan = d
+			}
+
+		case "keep_versions":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+			repo.KeepVersions = n
+
+		case "min_date", "max_date":
+			t, err := parseDate(value)
+			if err != nil {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+
+			if key == "min_date" {
+				repo.MinDate = t
+			} else {
+				repo.MaxDate = t
+			}
+
+		case "gpgcheck", "gpgcheck_local", "enabled", "frozen", "check_closure", "auto_satisfy_deps", "emit_sqlite", "follow_symlinks", "zsync", "check_magic", "reject_duplicates",
+			"allow_unsigned", "assume_yes", "delete_removed", "drop_unknown_metadata", "export_checksums", "fail_on_partial", "force_createrepo", "force_refresh", "full_resync", "generate_changelog",
+			"include_sources", "incremental_by_date", "incremental_by_mtime", "lock_wait", "new_only", "preserve_appstream", "preserve_productid", "preserve_repodata", "quarantine_on_gpg_fail",
+			"report_orphans", "require_sha256", "resume_state", "separate_debug_repo":
+			b, ok := parseBool(value)
+			if !ok {
+				return nil, NewErrorf("Invalid value for %s in repo '%s': %s (in %s:%d)", key, repo.ID, value, path, s.LineNo)
+			}
+
+			switch key {
+			case "gpgcheck":
+				repo.GPGCheck = b
+
+			case "gpgcheck_local":
+				repo.GPGCheckLocal = b
+
+			case "enabled":
+				repo.Enabled = b
+
+			case "frozen":
+				repo.Frozen = b
+
+			case "check_closure":
+				repo.CheckClosure = b
+
+			case "auto_satisfy_deps":
+				repo.AutoSatisfyDeps = b
+
+			case "emit_sqlite":
+				repo.EmitSQLite = b
+
+			case "follow_symlinks":
+				repo.FollowSymlinks = b
+
+			case "zsync":
+				repo.Zsync = b
+
+			case "check_magic":
+				repo.CheckMagic = b
+
+			case "reject_duplicates":
+				repo.RejectDuplicates = b
+
+			case "allow_unsigned":
+				repo.AllowUnsigned = b
+
+			case "assume_yes":
+				repo.AssumeYes = b
+
+			case "delete_removed":
+				repo.DeleteRemoved = b
+
+			case "drop_unknown_metadata":
+				repo.DropUnknownMetadata = b
+
+			case "export_checksums":
+				repo.ExportChecksums = b
+
+			case "fail_on_partial":
+				repo.FailOnPartial = b
+
+			case "force_createrepo":
+				repo.ForceCreaterepo = b
+
+			case "force_refresh":
+				repo.ForceRefresh = b
+
+			case "full_resync":
+				repo.FullResync = b
+
+			case "generate_changelog":
+				repo.GenerateChangelog = b
+
+			case "include_sources":
+				repo.IncludeSources = b
+
+			case "incremental_by_date":
+				repo.IncrementalByDate = b
+
+			case "incremental_by_mtime":
+				repo.IncrementalByMtime = b
+
+			case "lock_wait":
+				repo.LockWait = b
+
+			case "new_only":
+				repo.NewOnly = b
+
+			case "preserve_appstream":
+				repo.PreserveAppstream = b
+
+			case "preserve_productid":
+				repo.PreserveProductID = b
+
+			case "preserve_repodata":
+				repo.PreserveRepodata = b
+
+			case "quarantine_on_gpg_fail":
+				repo.QuarantineOnGPGFail = b
+
+			case "report_orphans":
+				repo.ReportOrphans = b
+
+			case "require_sha256":
+				repo.RequireSHA256 = b
+
+			case "resume_state":
+				repo.ResumeState = b
+
+			case "separate_debug_repo":
+				repo.SeparateDebugRepo = b
+			}
+
+		default:
+			if !yumOptions[key] {
+				return nil, NewErrorf("Unrecognized option %s in repo '%s' (in %s:%d)", key, repo.ID, path, s.LineNo)
+			}
+			Dprintf("Ignoring option %s in repo %s (in %s:%d)\n", key, repo.ID, path, s.LineNo)
+		}
+	}
+
+	repo.ResolvePaths()
+	return repo, nil
+}
+
+// readRepoFile parses the yum .repo file content of the given io.Reader and
+// returns a Repo for each enabled repository and the patterns of the exclude
+// option of its [main] section, which are excluded from each of the repos.
+func readRepoFile(r io.Reader, path string) ([]*Repo, []string, error) {
+	sections, err := readIni(r, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	repos := make([]*Repo, 0)
+	exclude := make([]string, 0)
+	for _, s := range sections {
+		// global options
+		if s.Name == "main" {
+			if v, ok := s.Values["exclude"]; ok {
+				exclude = append(exclude, splitPatterns(v)...)
+			}
+			continue
+		}
+
+		repo, err := repoFromSection(s, path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// skip disabled repos
+		if !repo.Enabled {
+			Dprintf("Skipping disabled repo %v (in %s:%d)\n", repo, path, s.LineNo)
+			continue
+		}
+
+		repos = append(repos, repo)
+	}
+
+	for _, repo := range repos {
+		repo.globalExclude = append([]string(nil), exclude...)
+	}
+
+	return repos, exclude, nil
+}
+
+// ImportRepoFiles parses the given yum .repo files, such as those found in
+// /etc/yum.repos.d/, and returns a Repo for each enabled repository, in the
+// order they are defined. Packages matching the exclude options of the [main]
+// sections of any of the files are excluded from every repo.
+func ImportRepoFiles(paths ...string) ([]*Repo, error) {
+	repos := make([]*Repo, 0)
+	exclude := make([]string, 0)
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		r, e, err := readRepoFile(f, path)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		repos = append(repos, r...)
+		exclude = append(exclude, e...)
+	}
+
+	for _, repo := range repos {
+		repo.globalExclude = exclude
+	}
+
+	return repos, nil
+}
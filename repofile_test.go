@@ -0,0 +1,287 @@
+package yum
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRepoFile = `# CentOS-Base.repo
+[base]
+name=CentOS-$releasever - Base
+mirrorlist=http://mirrorlist.centos.org/?release=$releasever&arch=$basearch&repo=os
+#baseurl=http://mirror.centos.org/centos/$releasever/os/$basearch/
+gpgcheck=1
+gpgkey=file:///etc/pki/rpm-gpg/RPM-GPG-KEY-CentOS-7
+
+[updates]
+name = CentOS-$releasever - Updates
+baseurl = http://mirror.centos.org/centos/$releasever/updates/$basearch/
+  http://mirror2.centos.org/centos/$releasever/updates/$basearch/
+gpgcheck = no
+
+[centosplus]
+name=CentOS-$releasever - Plus
+baseurl=http://mirror.centos.org/centos/$releasever/centosplus/$basearch/
+enabled=0
+`
+
+func TestImportRepoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "CentOS-Base.repo")
+	if err := ioutil.WriteFile(path, []byte(testRepoFile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := ImportRepoFiles(path)
+	if err != nil {
+		t.Fatalf("Error importing repo file: %v", err)
+	}
+
+	if len(repos) != 2 {
+		t.Fatalf("Expected 2 enabled repos, got %d", len(repos))
+	}
+
+	base, updates := repos[0], repos[1]
+	if base.ID != "base" || base.YumfileLineNo != 2 {
+		t.Errorf("Unexpected first repo: %s (line %d)", base.ID, base.YumfileLineNo)
+	}
+
+	if base.MirrorURL != "http://mirrorlist.centos.org/?release=$releasever&arch=$basearch&repo=os" {
+		t.Errorf("Unexpected mirrorlist: %s", base.MirrorURL)
+	}
+
+	if base.BaseURL != "" || !base.GPGCheck || base.GPGKey != "file:///etc/pki/rpm-gpg/RPM-GPG-KEY-CentOS-7" {
+		t.Errorf("Unexpected options for repo %v: %#v", base, base)
+	}
+
+	if updates.ID != "updates" || updates.Name != "CentOS-$releasever - Updates" {
+		t.Errorf("Unexpected second repo: %s (%s)", updates.ID, updates.Name)
+	}
+
+	if updates.BaseURL != "http://mirror.centos.org/centos/$releasever/updates/$basearch/" {
+		t.Errorf("Unexpected baseurl: %s", updates.BaseURL)
+	}
+
+	if updates.GPGCheck {
+		t.Errorf("Expected gpgcheck to be disabled for repo %v", updates)
+	}
+
+	for _, repo := range repos {
+		if err := repo.Validate(); err != nil {
+			t.Errorf("Imported repo failed validation: %v", err)
+		}
+	}
+}
+
+func TestRepoFromSection(t *testing.T) {
+	tests := []struct {
+		key    string
+		value  string
+		expect func(repo *Repo)
+	}{
+		{"allow_unsigned", "1", func(repo *Repo) { repo.AllowUnsigned = true }},
+		{"architecture", "x86_64", func(repo *Repo) { repo.Architecture = "x86_64" }},
+		{"assume_yes", "yes", func(repo *Repo) { repo.AssumeYes = true }},
+		{"auto_satisfy_deps", "1", func(repo *Repo) { repo.AutoSatisfyDeps = true }},
+		{"bandwidth_schedule", "08:00-18:00=5M", func(repo *Repo) {
+			repo.BandwidthSchedule = []BandwidthWindow{{Start: 8 * time.Hour, End: 18 * time.Hour, BytesPerSecond: 5 << 20}}
+		}},
+		{"baseurl", "http://a/ http://b/", func(repo *Repo) { repo.BaseURL, repo.Mirrors = "http://a/", []string{"http://b/"} }},
+		{"cachepath", "cache\n/var/cache/go-yum", func(repo *Repo) {
+			repo.CachePath = "/etc/go-yum/cache" + string(os.PathListSeparator) + "/var/cache/go-yum"
+		}},
+		{"check_closure", "1", func(repo *Repo) { repo.CheckClosure = true }},
+		{"check_magic", "1", func(repo *Repo) { repo.CheckMagic = true }},
+		{"checksum", "sha256", func(repo *Repo) { repo.Checksum = "sha256" }},
+		{"checksum_policy", "SHA512", func(repo *Repo) { repo.ChecksumPolicy = MinimumChecksumPolicy("sha512") }},
+		{"date_skew_tolerance", "5m", func(repo *Repo) { repo.DateSkewTolerance = 5 * time.Minute }},
+		{"delete_older_than", "30d", func(repo *Repo) { repo.DeleteOlderThan = 30 * 24 * time.Hour }},
+		{"delete_removed", "1", func(repo *Repo) { repo.DeleteRemoved = true }},
+		{"drop_unknown_metadata", "1", func(repo *Repo) { repo.DropUnknownMetadata = true }},
+		{"emit_sqlite", "0", func(repo *Repo) { repo.EmitSQLite = false }},
+		{"enabled", "0", func(repo *Repo) { repo.Enabled = false }},
+		{"exclude", "zsh, tcsh", func(repo *Repo) { repo.Exclude = []string{"zsh", "tcsh"} }},
+		{"exclude_licenses", "GPL*", func(repo *Repo) { repo.ExcludeLicenses = []string{"GPL*"} }},
+		{"exclude_regex", "^foo", func(repo *Repo) { repo.ExcludeRegex = "^foo" }},
+		{"export_checksums", "1", func(repo *Repo) { repo.ExportChecksums = true }},
+		{"fail_on_partial", "0", func(repo *Repo) { repo.FailOnPartial = false }},
+		{"follow_symlinks", "1", func(repo *Repo) { repo.FollowSymlinks = true }},
+		{"force_createrepo", "1", func(repo *Repo) { repo.ForceCreaterepo = true }},
+		{"force_refresh", "1", func(repo *Repo) { repo.ForceRefresh = true }},
+		{"frozen", "1", func(repo *Repo) { repo.Frozen = true }},
+		{"full_resync", "1", func(repo *Repo) { repo.FullResync = true }},
+		{"generate_changelog", "1", func(repo *Repo) { repo.GenerateChangelog = true }},
+		{"gpgcheck", "1", func(repo *Repo) { repo.GPGCheck = true }},
+		{"gpgcheck_local", "1", func(repo *Repo) { repo.GPGCheckLocal = true }},
+		{"gpgkey", "keys/RPM-GPG-KEY", func(repo *Repo) { repo.GPGKey = "/etc/go-yum/keys/RPM-GPG-KEY" }},
+		{"groupfile", "comps.xml", func(repo *Repo) { repo.Groupfile = "/etc/go-yum/comps.xml" }},
+		{"header", "x-api-key: secret", func(repo *Repo) { repo.Headers = map[string]string{"X-Api-Key": "secret"} }},
+		{"header_hosts", "cdn.example.com", func(repo *Repo) { repo.HeaderHosts = []string{"cdn.example.com"} }},
+		{"include_groups", "core base", func(repo *Repo) { repo.IncludeGroups = []string{"core", "base"} }},
+		{"include_licenses", "MIT", func(repo *Repo) { repo.IncludeLicenses = []string{"MIT"} }},
+		{"include_modules", "nodejs:12", func(repo *Repo) { repo.IncludeModules = []string{"nodejs:12"} }},
+		{"include_regex", "^bar", func(repo *Repo) { repo.IncludeRegex = "^bar" }},
+		{"include_sources", "1", func(repo *Repo) { repo.IncludeSources = true }},
+		{"includepkgs", "kernel", func(repo *Repo) { repo.IncludePackages = []string{"kernel"} }},
+		{"incremental_by_date", "1", func(repo *Repo) { repo.IncrementalByDate = true }},
+		{"incremental_by_mtime", "1", func(repo *Repo) { repo.IncrementalByMtime = true }},
+		{"keep_versions", "3", func(repo *Repo) { repo.KeepVersions = 3 }},
+		{"localpath", "base", func(repo *Repo) { repo.LocalPath = "/etc/go-yum/base" }},
+		{"lock_wait", "1", func(repo *Repo) { repo.LockWait = true }},
+		{"max_date", "2020-06-30T12:00:00Z", func(repo *Repo) { repo.MaxDate = time.Date(2020, 6, 30, 12, 0, 0, 0, time.UTC) }},
+		{"maxpkgsize", "500M", func(repo *Repo) { repo.MaxPackageSize = 500 << 20 }},
+		{"metadata_expire", "6h", func(repo *Repo) { repo.MetadataExpire = 6 * time.Hour }},
+		{"metadata_threads", "4", func(repo *Repo) { repo.MetadataThreads = 4 }},
+		{"min_date", "2020-01-01", func(repo *Repo) { repo.MinDate = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC) }},
+		{"mirrorlist", "http://mirrorlist/", func(repo *Repo) { repo.MirrorURL = "http://mirrorlist/" }},
+		{"name", "Base", func(repo *Repo) { repo.Name = "Base" }},
+		{"new_only", "1", func(repo *Repo) { repo.NewOnly = true }},
+		{"notify_webhook", "https://hooks.example.com/", func(repo *Repo) { repo.NotifyWebhook = "https://hooks.example.com/" }},
+		{"package_lockfile", "packages.lock", func(repo *Repo) { repo.PackageLockFile = "/etc/go-yum/packages.lock" }},
+		{"pin_revision", "1500000000", func(repo *Repo) { repo.PinRevision = "1500000000" }},
+		{"preserve_appstream", "1", func(repo *Repo) { repo.PreserveAppstream = true }},
+		{"preserve_productid", "1", func(repo *Repo) { repo.PreserveProductID = true }},
+		{"preserve_repodata", "1", func(repo *Repo) { repo.PreserveRepodata = true }},
+		{"priority", "10", func(repo *Repo) { repo.Priority = 10 }},
+		{"quarantine_on_gpg_fail", "1", func(repo *Repo) { repo.QuarantineOnGPGFail = true }},
+		{"reject_duplicates", "1", func(repo *Repo) { repo.RejectDuplicates = true }},
+		{"report_orphans", "1", func(repo *Repo) { repo.ReportOrphans = true }},
+		{"require_sha256", "1", func(repo *Repo) { repo.RequireSHA256 = true }},
+		{"resign_key", "resign.asc", func(repo *Repo) { repo.ResignKey = "/etc/go-yum/resign.asc" }},
+		{"resign_key_passphrase", "secret", func(repo *Repo) { repo.ResignKeyPassphrase = "secret" }},
+		{"resume_state", "1", func(repo *Repo) { repo.ResumeState = true }},
+		{"s3_endpoint", "http://minio:9000", func(repo *Repo) { repo.S3Endpoint = "http://minio:9000" }},
+		{"s3_region", "eu-west-1", func(repo *Repo) { repo.S3Region = "eu-west-1" }},
+		{"separate_debug_repo", "1", func(repo *Repo) { repo.SeparateDebugRepo = true }},
+		{"sign_key", "sign.asc", func(repo *Repo) { repo.SignKey = "/etc/go-yum/sign.asc" }},
+		{"sign_key_passphrase", "secret", func(repo *Repo) { repo.SignKeyPassphrase = "secret" }},
+		{"staging_dir", "staging", func(repo *Repo) { repo.StagingDir = "/etc/go-yum/staging" }},
+		{"temp_dir", "/tmp/go-yum", func(repo *Repo) { repo.TempDir = "/tmp/go-yum" }},
+		{"throttle", "1M", func(repo *Repo) { repo.MaxBytesPerSecond = 1 << 20 }},
+		{"user_agent", "mirror/1.0", func(repo *Repo) { repo.UserAgent = "mirror/1.0" }},
+		{"vault_url", "http://vault/", func(repo *Repo) { repo.VaultURL = "http://vault/" }},
+		{"zsync", "1", func(repo *Repo) { repo.Zsync = true }},
+
+		// yum options which go-yum does not use are ignored
+		{"skip_if_unavailable", "1", func(repo *Repo) {}},
+	}
+
+	path := "/etc/go-yum/Yumfile"
+	for _, test := range tests {
+		s := &iniSection{Name: "base", Path: path, LineNo: 1, Values: map[string]string{test.key: test.value}}
+		repo, err := repoFromSection(s, path)
+		if err != nil {
+			t.Errorf("Error parsing %s = %s: %v", test.key, test.value, err)
+			continue
+		}
+
+		expect := NewRepo()
+		expect.ID = "base"
+		expect.YumfilePath = path
+		expect.YumfileLineNo = 1
+		test.expect(expect)
+		if !reflect.DeepEqual(repo, expect) {
+			t.Errorf("Unexpected repo for %s = %s:\nexpected: %#v\ngot:      %#v", test.key, test.value, expect, repo)
+		}
+	}
+
+	// misspelled and invalid options are errors
+	for key, value := range map[string]string{
+		"arch":              "x86_64",
+		"keep_versions":     "-1",
+		"delete_older_than": "never",
+		"min_date":          "yesterday",
+		"new_only":          "maybe",
+	} {
+		s := &iniSection{Name: "base", Path: path, LineNo: 1, Values: map[string]string{key: value}}
+		if _, err := repoFromSection(s, path); err == nil {
+			t.Errorf("Expected an error parsing %s = %s", key, value)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90":    90 * time.Second,
+		"6h":    6 * time.Hour,
+		"30m":   30 * time.Minute,
+		"1d":    24 * time.Hour,
+		"never": MetadataNeverExpires,
+	}
+
+	for s, expect := range tests {
+		if d, err := parseDuration(s); err != nil || d != expect {
+			t.Errorf("Expected %s to parse as %v, got %v (%v)", s, expect, d, err)
+		}
+	}
+
+	if _, err := parseDuration("6 hours"); err == nil {
+		t.Errorf("Expected an error parsing an invalid duration")
+	}
+}
+
+const testExcludeRepoFile = `[main]
+exclude=kernel* redhat-release*
+
+[base]
+baseurl=http://mirror.centos.org/centos/7/os/x86_64/
+exclude=zsh, tcsh
+includepkgs=kernel
+`
+
+func TestRepoFileExclude(t *testing.T) {
+	repos, exclude, err := readRepoFile(strings.NewReader(testExcludeRepoFile), "test.repo")
+	if err != nil {
+		t.Fatalf("Error reading repo file: %v", err)
+	}
+
+	if len(repos) != 1 {
+		t.Fatalf("Expected [main] not to be read as a repo, got %d repos", len(repos))
+	}
+
+	if fmt.Sprint(exclude) != "[kernel* redhat-release*]" {
+		t.Errorf("Unexpected global excludes: %v", exclude)
+	}
+
+	if fmt.Sprint(repos[0].globalExclude) != "[kernel* redhat-release*]" {
+		t.Errorf("Unexpected global excludes for repo %v: %v", repos[0], repos[0].globalExclude)
+	}
+
+	if fmt.Sprint(repos[0].Exclude) != "[zsh tcsh]" || fmt.Sprint(repos[0].IncludePackages) != "[kernel]" {
+		t.Errorf("Unexpected excludes for repo %v: %v %v", repos[0], repos[0].Exclude, repos[0].IncludePackages)
+	}
+
+	// importing the same file again does not accumulate the global excludes
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "test.repo")
+	if err := ioutil.WriteFile(path, []byte(testExcludeRepoFile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		repos, err = ImportRepoFiles(path)
+		if err != nil {
+			t.Fatalf("Error importing repo file: %v", err)
+		}
+	}
+
+	if fmt.Sprint(repos[0].globalExclude) != "[kernel* redhat-release*]" {
+		t.Errorf("Unexpected global excludes: %v", repos[0].globalExclude)
+	}
+}
@@ -1,6 +1,7 @@
 package yum
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -35,6 +36,54 @@ func ReadRepoMetadata(r io.Reader) (*RepoMetadata, error) {
 	return &md, nil
 }
 
+// checkXMLComplete returns io.ErrUnexpectedEOF if the given XML document ends
+// before its root element is closed, such as if it was truncated during
+// download, or an error if the document is otherwise not well formed.
+func checkXMLComplete(b []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(b))
+	depth, root := 0, false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			if depth > 0 || !root {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if serr, ok := err.(*xml.SyntaxError); ok && serr.Msg == "unexpected EOF" {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+			root = true
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// Database returns the first database in the repository metadata of any of
+// the given types, in order of preference. For example, Database("primary_db",
+// "primary") returns the sqlite primary database, or the XML primary database
+// of a repository which has no sqlite databases. If no database is found, nil
+// is returned.
+func (c *RepoMetadata) Database(types ...string) *RepoDatabase {
+	for _, typ := range types {
+		for i := range c.Databases {
+			if c.Databases[i].Type == typ {
+				return &c.Databases[i]
+			}
+		}
+	}
+
+	return nil
+}
+
 // Write encodes a RepoMetadata struct in the repomd.xml format to the given
 // io.Writer stream.
 func (c *RepoMetadata) Write(w io.Writer) error {
@@ -0,0 +1,123 @@
+package yum
+
+import (
+	"strings"
+	"testing"
+)
+
+// testOldRepoMetadata is a repomd.xml created by createrepo 0.4 which
+// references XML databases only.
+const testOldRepoMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo">
+  <data type="other">
+    <location href="repodata/other.xml.gz"/>
+    <checksum type="sha">a1e2dfbc1a0d7e59d35bd5971b47e3fa8a0ab0ef</checksum>
+    <timestamp>1209999999</timestamp>
+    <open-checksum type="sha">5a8e7a7b3b0e4dbf5f0d66a0a1db6fdc3adbb9d8</open-checksum>
+  </data>
+  <data type="filelists">
+    <location href="repodata/filelists.xml.gz"/>
+    <checksum type="sha">6bd5a1e2d9a0c0f6bc3d8ad5c6e4ec5df3ca1ef3</checksum>
+    <timestamp>1209999999</timestamp>
+    <open-checksum type="sha">0e7e7ab9a4e9bbf3d19c0c0d5c6a8e0f7d5de1c4</open-checksum>
+  </data>
+  <data type="primary">
+    <location href="repodata/primary.xml.gz"/>
+    <checksum type="sha">d08ad1ed00f3b7f8b4c6b3e0bcb6f03a8c62c5ee</checksum>
+    <timestamp>1209999999</timestamp>
+    <open-checksum type="sha">94d8c4d7d5b3b253d7fbd2f5a9a81b8f823c2f31</open-checksum>
+  </data>
+  <data type="group">
+    <location href="repodata/comps.xml"/>
+    <checksum type="sha">4d0fcf3b8f1e5c6bbd5e0e78a4fb3ee0c8e4b1d5</checksum>
+    <timestamp>1209999999</timestamp>
+  </data>
+</repomd>`
+
+// testNewRepoMetadata is a repomd.xml created by createrepo_c which
+// references both XML and sqlite databases and a database type which is not
+// recognized by this package.
+const testNewRepoMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<repomd xmlns="http://linux.duke.edu/metadata/repo" xmlns:rpm="http://linux.duke.edu/metadata/rpm">
+  <revision>1587512243</revision>
+  <data type="primary">
+    <checksum type="sha256">6cd8a3b5e4e8e6b10bb9d6b0d8e4e4f652a0a6e8c3f5a5f5d5c2b1a0f9e8d7c6</checksum>
+    <open-checksum type="sha256">0a1b2c3d4e5f60718293a4b5c6d7e8f90112233445566778899aabbccddeeff0</open-checksum>
+    <location href="repodata/6cd8a3b5-primary.xml.gz"/>
+    <timestamp>1587512243</timestamp>
+    <size>2184</size>
+    <open-size>14811</open-size>
+  </data>
+  <data type="primary_db">
+    <checksum type="sha256">ffeeddccbbaa99887766554433221100ffeeddccbbaa99887766554433221100</checksum>
+    <open-checksum type="sha256">00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff</open-checksum>
+    <location href="repodata/ffeeddcc-primary.sqlite.bz2"/>
+    <timestamp>1587512244</timestamp>
+    <size>5820</size>
+    <open-size>106496</open-size>
+    <database_version>10</database_version>
+  </data>
+  <data type="updateinfo">
+    <checksum type="sha256">1111111111111111111111111111111111111111111111111111111111111111</checksum>
+    <location href="repodata/11111111-updateinfo.xml.gz"/>
+    <timestamp>1587512245</timestamp>
+  </data>
+  <data type="modules">
+    <checksum type="sha256">2222222222222222222222222222222222222222222222222222222222222222</checksum>
+    <location href="repodata/22222222-modules.yaml.gz"/>
+    <timestamp>1587512245</timestamp>
+  </data>
+  <data type="primary_zck">
+    <checksum type="sha256">3333333333333333333333333333333333333333333333333333333333333333</checksum>
+    <location href="repodata/33333333-primary.xml.zck"/>
+    <timestamp>1587512246</timestamp>
+  </data>
+</repomd>`
+
+func TestRepoMetadataLayouts(t *testing.T) {
+	tests := []struct {
+		name     string
+		repomd   string
+		primary  string
+		sqlite   bool
+		count    int
+		unknowns int
+	}{
+		{"old", testOldRepoMetadata, "primary", false, 4, 0},
+		{"new", testNewRepoMetadata, "primary_db", true, 5, 1},
+	}
+
+	for _, test := range tests {
+		md, err := ReadRepoMetadata(strings.NewReader(test.repomd))
+		if err != nil {
+			t.Errorf("Error reading %s repo metadata: %v", test.name, err)
+			continue
+		}
+
+		// unknown databases are preserved
+		if len(md.Databases) != test.count {
+			t.Errorf("Expected %d databases in %s repo metadata, got %d", test.count, test.name, len(md.Databases))
+		}
+
+		unknowns := 0
+		for _, db := range md.Databases {
+			if !db.Known() {
+				unknowns++
+			}
+		}
+
+		if unknowns != test.unknowns {
+			t.Errorf("Expected %d unknown databases in %s repo metadata, got %d", test.unknowns, test.name, unknowns)
+		}
+
+		db := md.Database("primary_db", "primary")
+		if db == nil {
+			t.Errorf("No primary database found in %s repo metadata", test.name)
+			continue
+		}
+
+		if db.Type != test.primary || db.IsSQLite() != test.sqlite {
+			t.Errorf("Expected %s primary database in %s repo metadata, got %s", test.primary, test.name, db.Type)
+		}
+	}
+}
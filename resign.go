@@ -0,0 +1,443 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Header tags written to the signature header of a re-signed package.
+const (
+	rpmTagHeaderSignatures = 62   // region tag of the signature header
+	rpmSigTagDSA           = 267  // header only, DSA key
+	rpmSigTagRSA           = 268  // header only, RSA key
+	rpmSigTagPGP           = 1002 // header and payload, RSA key
+	rpmSigTagGPG           = 1005 // header and payload, DSA key
+)
+
+// Data types of RPM header entries.
+const (
+	rpmTypeNull        = 0
+	rpmTypeChar        = 1
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeInt64       = 5
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// rpmHeaderEntry is an index entry of a RPM header and its data.
+type rpmHeaderEntry struct {
+	Tag   uint32
+	Type  uint32
+	Count uint32
+	Data  []byte
+}
+
+// readRPMHeader reads a header structure, such as the signature header or the
+// main header of a RPM package, from the given io.Reader. It returns the
+// entries of the header and the raw bytes of the header. Any padding which
+// follows the header is not read.
+func readRPMHeader(r io.Reader) ([]rpmHeaderEntry, []byte, error) {
+	// header intro: magic, reserved, index length, store length
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, nil, fmt.Errorf("Error reading package header: %v", err)
+	}
+
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, nil, fmt.Errorf("Bad package header")
+	}
+
+	n := binary.BigEndian.Uint32(intro[8:12])
+	size := binary.BigEndian.Uint32(intro[12:16])
+	if n > 0xFFFF || size > 256*1024*1024 {
+		return nil, nil, fmt.Errorf("Bad package header length: %d entries, %d bytes", n, size)
+	}
+
+	b := make([]byte, 16*int(n)+int(size))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, nil, fmt.Errorf("Error reading package header: %v", err)
+	}
+
+	index, store := b[:16*n], b[16*n:]
+	entries := make([]rpmHeaderEntry, n)
+	for i := range entries {
+		e := &entries[i]
+		e.Tag = binary.BigEndian.Uint32(index[16*i:])
+		e.Type = binary.BigEndian.Uint32(index[16*i+4:])
+		offset := binary.BigEndian.Uint32(index[16*i+8:])
+		e.Count = binary.BigEndian.Uint32(index[16*i+12:])
+		if offset > size {
+			return nil, nil, fmt.Errorf("Bad package header entry offset for tag %d: %d", e.Tag, offset)
+		}
+
+		length, err := rpmEntryLength(e.Type, e.Count, store[offset:])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Bad package header entry for tag %d: %v", e.Tag, err)
+		}
+		e.Data = store[offset : int(offset)+length]
+	}
+
+	return entries, append(intro, b...), nil
+}
+
+// rpmEntryLength returns the length in bytes of the data of a header entry of
+// the given type and count, which begins at the start of the given store.
+func rpmEntryLength(typ, count uint32, store []byte) (int, error) {
+	length := 0
+	switch typ {
+	case rpmTypeNull:
+	case rpmTypeChar, rpmTypeInt8, rpmTypeBin:
+		length = int(count)
+
+	case rpmTypeInt16:
+		length = 2 * int(count)
+
+	case rpmTypeInt32:
+		length = 4 * int(count)
+
+	case rpmTypeInt64:
+		length = 8 * int(count)
+
+	case rpmTypeString, rpmTypeStringArray, rpmTypeI18NString:
+		// a string is a single nul terminated string
+		if typ == rpmTypeString {
+			count = 1
+		}
+		for i := uint32(0); i < count; i++ {
+			j := bytes.IndexByte(store[length:], 0)
+			if j < 0 {
+				return 0, fmt.Errorf("unterminated string")
+			}
+			length += j + 1
+		}
+
+	default:
+		return 0, fmt.Errorf("unknown type %d", typ)
+	}
+
+	if length > len(store) {
+		return 0, fmt.Errorf("data exceeds header")
+	}
+
+	return length, nil
+}
+
+// rpmTypeAlignment returns the alignment in bytes of header data of the given
+// type.
+func rpmTypeAlignment(typ uint32) int {
+	switch typ {
+	case rpmTypeInt16:
+		return 2
+	case rpmTypeInt32:
+		return 4
+	case rpmTypeInt64:
+		return 8
+	}
+
+	return 1
+}
+
+// encodeRPMHeader returns a header structure containing the given entries,
+// sorted by tag. If region is not zero, the header is a region with the given
+// region tag, as required of the signature header by rpm 4.
+func encodeRPMHeader(entries []rpmHeaderEntry, region uint32) []byte {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Tag < entries[j].Tag })
+
+	n := len(entries)
+	if region != 0 {
+		n++
+	}
+
+	index := &bytes.Buffer{}
+	store := &bytes.Buffer{}
+	writeIndex := func(tag, typ, offset, count uint32) {
+		binary.Write(index, binary.BigEndian, []uint32{tag, typ, offset, count})
+	}
+
+	for _, e := range entries {
+		for store.Len()%rpmTypeAlignment(e.Type) != 0 {
+			store.WriteByte(0)
+		}
+
+		writeIndex(e.Tag, e.Type, uint32(store.Len()), e.Count)
+		store.Write(e.Data)
+	}
+
+	// the region entry is first and its trailer, which is the last data in the
+	// store, references the index entries in the region
+	if region != 0 {
+		trailer := &bytes.Buffer{}
+		binary.Write(trailer, binary.BigEndian, []uint32{region, rpmTypeBin, uint32(int32(-16 * n)), 16})
+		regionIndex := &bytes.Buffer{}
+		binary.Write(regionIndex, binary.BigEndian, []uint32{region, rpmTypeBin, uint32(store.Len()), 16})
+		store.Write(trailer.Bytes())
+		index = bytes.NewBuffer(append(regionIndex.Bytes(), index.Bytes()...))
+	}
+
+	b := &bytes.Buffer{}
+	b.Write(rpmHeaderMagic)
+	binary.Write(b, binary.BigEndian, []uint32{0, uint32(n), uint32(store.Len())})
+	b.Write(index.Bytes())
+	b.Write(store.Bytes())
+	return b.Bytes()
+}
+
+// rpmSignaturePadding returns the number of bytes of padding which follow a
+// signature header of the given length, so that the main header is aligned
+// to eight bytes.
+func rpmSignaturePadding(length int) int {
+	return (8 - length%8) % 8
+}
+
+// resignPackage replaces every GPG and PGP signature in the signature header
+// of the given package file with signatures made by the given key, as per
+// `rpm --resign`. A header only signature and a header and payload signature
+// are written. The package file is replaced atomically.
+func resignPackage(path string, signer *openpgp.Entity) error {
+	if signer == nil || signer.PrivateKey == nil {
+		return fmt.Errorf("Signing key has no private key")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	headers, err := readRPMHeaders(r)
+	if err != nil {
+		return err
+	}
+	header := headers.rawHeader
+
+	// sign the header, then the header and payload
+	headerSig := &bytes.Buffer{}
+	if err := openpgp.DetachSign(headerSig, signer, bytes.NewReader(header), nil); err != nil {
+		return fmt.Errorf("Error signing package header: %v", err)
+	}
+
+	payloadSig := &bytes.Buffer{}
+	if err := openpgp.DetachSign(payloadSig, signer, io.MultiReader(bytes.NewReader(header), r), nil); err != nil {
+		return fmt.Errorf("Error signing package payload: %v", err)
+	}
+
+	headerTag, payloadTag := uint32(rpmSigTagRSA), uint32(rpmSigTagPGP)
+	if signer.PrivateKey.PubKeyAlgo == packet.PubKeyAlgoDSA {
+		headerTag, payloadTag = rpmSigTagDSA, rpmSigTagGPG
+	}
+
+	// replace existing signatures, retaining sizes and digests
+	var region uint32
+	entries := make([]rpmHeaderEntry, 0, len(headers.signature)+2)
+	for _, e := range headers.signature {
+		if e.Tag == rpmTagHeaderSignatures {
+			region = e.Tag
+			continue
+		}
+
+		signature := false
+		for _, tag := range rpmSignatureTags {
+			if e.Tag == uint32(tag) {
+				signature = true
+			}
+		}
+
+		if !signature {
+			entries = append(entries, e)
+		}
+	}
+
+	entries = append(entries,
+		rpmHeaderEntry{Tag: headerTag, Type: rpmTypeBin, Count: uint32(headerSig.Len()), Data: headerSig.Bytes()},
+		rpmHeaderEntry{Tag: payloadTag, Type: rpmTypeBin, Count: uint32(payloadSig.Len()), Data: payloadSig.Bytes()},
+	)
+
+	sigHeader := encodeRPMHeader(entries, region)
+	sigHeader = append(sigHeader, make([]byte, rpmSignaturePadding(len(sigHeader)))...)
+
+	// write the re-signed package beside the original
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".resign")
+	w, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer w.Close()
+
+	for _, b := range [][]byte{headers.lead, sigHeader, header} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if _, err := f.Seek(headers.payloadOffset(), io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// resignedFilename is the name of the file in a package directory which
+// records each package which was re-signed after download, so that it is not
+// mistaken for a corrupt copy of the upstream package.
+const resignedFilename = ".resigned"
+
+// resignedPackage records the upstream checksum of a re-signed package and
+// the size and SHA256 checksum of the re-signed file.
+type resignedPackage struct {
+	Upstream string
+	Checksum string
+	Size     int64
+}
+
+// readResignedPackages returns the re-signed packages recorded in the given
+// package directory, by filename.
+func readResignedPackages(packagedir string) map[string]resignedPackage {
+	resigned := make(map[string]resignedPackage)
+	f, err := os.Open(filepath.Join(packagedir, resignedFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Errorf(err, "Error reading re-signed packages in %s", packagedir)
+		}
+		return resigned
+	}
+	defer f.Close()
+
+	// each line is: upstream checksum, checksum, size, filename
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 4 {
+			continue
+		}
+
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		resigned[fields[3]] = resignedPackage{Upstream: fields[0], Checksum: fields[1], Size: size}
+	}
+
+	return resigned
+}
+
+// writeResignedPackages records the given re-signed packages in the given
+// package directory, replacing the previous records, so that each package is
+// listed once however often it is re-signed.
+func writeResignedPackages(packagedir string, resigned map[string]resignedPackage) error {
+	filenames := make([]string, 0, len(resigned))
+	for filename := range resigned {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	path := filepath.Join(packagedir, resignedFilename)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, filename := range filenames {
+		r := resigned[filename]
+		fmt.Fprintf(w, "%s %s %d %s\n", r.Upstream, r.Checksum, r.Size, filename)
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// localPackageFile returns the expected size, checksum and checksum type of
+// the local file of the given package. If the package was re-signed, these
+// are of the re-signed file rather than the upstream package.
+func localPackageFile(p PackageEntry, resigned map[string]resignedPackage) (int64, string, string, error) {
+	sum, err := p.Checksum()
+	if err != nil {
+		return 0, "", "", err
+	}
+
+	if r, ok := resigned[p.filename()]; ok && r.Upstream == sum {
+		return r.Size, r.Checksum, "sha256", nil
+	}
+
+	return p.PackageSize(), sum, p.ChecksumType(), nil
+}
+
+// packageResigner re-signs downloaded packages with a local key and records
+// them in a package directory. A nil packageResigner does nothing.
+type packageResigner struct {
+	signer     *openpgp.Entity
+	packagedir string
+
+	// mu serializes updates of the re-signed packages in packagedir
+	mu sync.Mutex
+}
+
+// Resign re-signs the given downloaded file of the given package.
+func (c *packageResigner) Resign(p PackageEntry, filename string) error {
+	if c == nil {
+		return nil
+	}
+
+	Dprintf("Re-signing %v\n", p)
+	upstream, err := p.Checksum()
+	if err != nil {
+		return err
+	}
+
+	if err := resignPackage(filename, c.signer); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	sum, err := ComputeFileChecksum(filename, "sha256")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resigned := readResignedPackages(c.packagedir)
+	resigned[filepath.Base(filename)] = resignedPackage{Upstream: upstream, Checksum: sum, Size: fi.Size()}
+	return writeResignedPackages(c.packagedir, resigned)
+}
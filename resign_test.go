@@ -0,0 +1,45 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteResignedPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a package which is re-signed again is listed once
+	for _, sum := range []string{"aaaa", "bbbb"} {
+		resigned := readResignedPackages(dir)
+		resigned["foo-1.0-1.x86_64.rpm"] = resignedPackage{Upstream: "upstream", Checksum: sum, Size: 10}
+		resigned["bar-1.0-1.x86_64.rpm"] = resignedPackage{Upstream: "upstream", Checksum: "cccc", Size: 20}
+		if err := writeResignedPackages(dir, resigned); err != nil {
+			t.Fatalf("Error writing re-signed packages: %v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, resignedFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "upstream cccc 20 bar-1.0-1.x86_64.rpm\nupstream bbbb 10 foo-1.0-1.x86_64.rpm\n"
+	if string(b) != expected {
+		t.Errorf("Expected compacted re-signed packages:\n%s\ngot:\n%s", expected, b)
+	}
+
+	if r := readResignedPackages(dir)["foo-1.0-1.x86_64.rpm"]; r.Checksum != "bbbb" || r.Size != 10 {
+		t.Errorf("Expected the latest record of a re-signed package, got %+v", r)
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Errorf("Expected temporary files to be removed, got %s", strings.Join(matches, ", "))
+	}
+}
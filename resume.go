@@ -0,0 +1,207 @@
+package yum
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// syncStateFilename is the name of the file in the cache directory of a repo
+// which records the packages completed by an interrupted sync, if ResumeState
+// is set.
+const syncStateFilename = "sync-state"
+
+// syncState records each package completed during a sync so that a sync which
+// is interrupted, or killed, may be resumed without downloading the completed
+// packages again. Packages are identified by their filename and checksum so
+// that a package which is replaced upstream is synchronized again, and the
+// size and modification time of each completed file are recorded so that a
+// file which changes after it was completed is validated again.
+//
+// A nil syncState records nothing.
+type syncState struct {
+	path string
+	f    *os.File
+	done map[string]syncStateFile
+}
+
+// syncStateFile is the size and modification time of a completed package
+// file, as recorded in a sync state file. Both are zero for packages recorded
+// by older versions of this package, which are always validated again.
+type syncStateFile struct {
+	size    int64
+	modTime int64
+}
+
+// matches returns true if the given file is unchanged since it was recorded.
+func (c syncStateFile) matches(fi os.FileInfo) bool {
+	return c.modTime != 0 && c.size == fi.Size() && c.modTime == fi.ModTime().UnixNano()
+}
+
+// openSyncState reads the sync state at the given path, if it exists, and
+// opens it so further completed packages may be recorded.
+func openSyncState(path string) (*syncState, error) {
+	c := &syncState{
+		path: path,
+		done: make(map[string]syncStateFile),
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			key, file := parseSyncStateLine(line)
+			c.done[key] = file
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c.f = f
+	return c, nil
+}
+
+// syncStateKey returns the checksum and filename which identify the given
+// package in a sync state file.
+func syncStateKey(p PackageEntry) string {
+	sum, _ := p.Checksum()
+	return fmt.Sprintf("%s %s", sum, p.filename())
+}
+
+// parseSyncStateLine returns the key and completed file of the given line of
+// a sync state file, in the form 'checksum size mtime filename', or in the
+// form 'checksum filename' written by older versions of this package.
+func parseSyncStateLine(line string) (string, syncStateFile) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) == 4 {
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		modTime, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err == nil && err2 == nil {
+			return fields[0] + " " + fields[3], syncStateFile{size: size, modTime: modTime}
+		}
+	}
+
+	return line, syncStateFile{}
+}
+
+// Done returns true, and the recorded size and modification time of its file,
+// if the given package was completed by a previous sync.
+func (c *syncState) Done(p PackageEntry) (syncStateFile, bool) {
+	if c == nil {
+		return syncStateFile{}, false
+	}
+
+	file, ok := c.done[syncStateKey(p)]
+	return file, ok
+}
+
+// Add records the given package, whose file is at the given path, as
+// completed. Each package is written to the state file as it completes so
+// that progress survives the process being killed.
+func (c *syncState) Add(p PackageEntry, path string) {
+	if c == nil || c.f == nil {
+		return
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		Errorf(err, "Error recording sync state of package %v", p)
+		return
+	}
+
+	key := syncStateKey(p)
+	if file, ok := c.done[key]; ok && file.matches(fi) {
+		return
+	}
+
+	sum, _ := p.Checksum()
+	file := syncStateFile{size: fi.Size(), modTime: fi.ModTime().UnixNano()}
+	if _, err := fmt.Fprintf(c.f, "%s %d %d %s\n", sum, file.size, file.modTime, p.filename()); err != nil {
+		Errorf(err, "Error writing sync state %s", c.path)
+		return
+	}
+	c.done[key] = file
+}
+
+// Close closes the state file so that it may be resumed by a later sync.
+func (c *syncState) Close() error {
+	if c == nil || c.f == nil {
+		return nil
+	}
+
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// Remove closes and deletes the state file once a sync has completed and need
+// not be resumed.
+func (c *syncState) Remove() error {
+	if c == nil {
+		return nil
+	}
+
+	c.Close()
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// resumePackages returns the given packages which must still be audited and
+// downloaded, and the packages which were completed by a previous sync and
+// are still present with the expected size in one of the given directories.
+// Completed packages whose files have the size and modification time recorded
+// when they completed are not validated again; any other completed package
+// file is validated against its checksum.
+func (c *syncRun) resumePackages(packages PackageEntries, dirs ...string) (pending, resumed PackageEntries) {
+	pending = make(PackageEntries, 0, len(packages))
+	resumed = make(PackageEntries, 0)
+	for _, p := range packages {
+		complete := false
+		if file, ok := c.state.Done(p); ok {
+			for _, dir := range dirs {
+				if dir == "" {
+					continue
+				}
+
+				path := filepath.Join(dir, p.filename())
+				fi, err := os.Stat(path)
+				if err != nil || fi.Size() != p.PackageSize() {
+					continue
+				}
+
+				if file.matches(fi) {
+					complete = true
+					break
+				}
+
+				Dprintf("Validating %s, which changed since it was completed\n", path)
+				sum, _ := p.Checksum()
+				if err := validateFileChecksum(path, sum, p.ChecksumType()); err == nil {
+					complete = true
+					break
+				}
+			}
+		}
+
+		if complete {
+			resumed = append(resumed, p)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+
+	return pending, resumed
+}
@@ -0,0 +1,124 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create a local upstream repo with two packages
+	upstream := filepath.Join(dir, "upstream")
+	packages := make(PackageEntries, 0)
+	for _, name := range []string{"foo", "bar"} {
+		content := []byte(name + " package")
+		p := newTestPackage(name, "1.0", "x86_64", 0)
+		sum := checksumBytes(t, content)
+		p.Checksums = PackageEntryChecksum{Type: sum.Type, Hash: sum.Hash}
+		p.Size.Package = int64(len(content))
+		packages = append(packages, p)
+
+		path := filepath.Join(upstream, p.LocationHref())
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.ResumeState = true
+
+	// download the first package, then kill the sync before the second
+	statepath := filepath.Join(dir, syncStateFilename)
+	run := newSyncRun(repo)
+	run.state, err = openSyncState(statepath)
+	if err != nil {
+		t.Fatalf("Error opening sync state: %v", err)
+	}
+
+	report := &SyncReport{}
+	run.downloadPackages(packages[:1], packagedir, nil, report)
+	if report.Downloaded != 1 {
+		t.Fatalf("Expected 1 package to be downloaded, got: %+v", report)
+	}
+	run.state.Close()
+
+	// restart the sync
+	run.state, err = openSyncState(statepath)
+	if err != nil {
+		t.Fatalf("Error reopening sync state: %v", err)
+	}
+	defer run.state.Close()
+
+	pending, resumed := run.resumePackages(packages, packagedir)
+	if len(resumed) != 1 || resumed[0].Name() != "foo" || len(pending) != 1 || pending[0].Name() != "bar" {
+		t.Fatalf("Expected foo to be resumed and bar to be pending, got %v and %v", resumed, pending)
+	}
+
+	// completed packages are not downloaded again
+	if err := os.Remove(filepath.Join(upstream, packages[0].LocationHref())); err != nil {
+		t.Fatal(err)
+	}
+
+	report = &SyncReport{}
+	run.downloadPackages(pending, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 {
+		t.Errorf("Expected only bar to be downloaded, got: %+v", report)
+	}
+
+	// packages which have changed size are synchronized again
+	if err := ioutil.WriteFile(filepath.Join(packagedir, filepath.Base(packages[1].LocationHref())), []byte("bar"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, resumed = run.resumePackages(packages, packagedir)
+	if len(resumed) != 1 || len(pending) != 1 || pending[0].Name() != "bar" {
+		t.Errorf("Expected truncated package bar to be pending, got %v", pending)
+	}
+
+	// completed packages which are touched are validated again
+	foo := filepath.Join(packagedir, filepath.Base(packages[0].LocationHref()))
+	if err := os.Chtimes(foo, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, resumed = run.resumePackages(packages, packagedir); len(resumed) != 1 || resumed[0].Name() != "foo" {
+		t.Errorf("Expected valid touched package foo to be resumed, got %v", resumed)
+	}
+
+	// completed packages which are modified in place are synchronized again
+	if err := ioutil.WriteFile(foo, []byte("oof package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if pending, _ = run.resumePackages(packages, packagedir); len(pending) != 2 {
+		t.Errorf("Expected modified package foo to be pending, got %v", pending)
+	}
+
+	// a complete sync removes the state
+	if err := run.state.Remove(); err != nil {
+		t.Fatalf("Error removing sync state: %v", err)
+	}
+
+	if _, err := os.Stat(statepath); !os.IsNotExist(err) {
+		t.Errorf("Expected sync state to be removed: %v", err)
+	}
+}
@@ -0,0 +1,411 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Lengths and magic numbers of the RPM file format, which are read directly
+// to inspect packages without parsing them completely.
+const rpmLeadSize = 96
+
+var (
+	rpmLeadMagic   = []byte{0xED, 0xAB, 0xEE, 0xDB}
+	rpmHeaderMagic = []byte{0x8E, 0xAD, 0xE8, 0x01}
+)
+
+// Signature header tags which contain a GPG or PGP signature.
+var rpmSignatureTags = []int{
+	267,  // RPMSIGTAG_DSA
+	268,  // RPMSIGTAG_RSA
+	1002, // RPMSIGTAG_PGP
+	1005, // RPMSIGTAG_GPG
+}
+
+// checkPackageMagic returns an ErrInvalidPackage error if the file at the
+// given path does not begin with the magic numbers of a RPM lead and
+// signature header. Only the first bytes of the file are read.
+func checkPackageMagic(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	b := make([]byte, rpmLeadSize+len(rpmHeaderMagic))
+	if _, err := io.ReadFull(f, b); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return newError(ErrInvalidPackage, "Package file %s is too short", path)
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(b[:len(rpmLeadMagic)], rpmLeadMagic) {
+		return newError(ErrInvalidPackage, "Package file %s has no RPM lead", path)
+	}
+
+	if !bytes.Equal(b[rpmLeadSize:], rpmHeaderMagic) {
+		return newError(ErrInvalidPackage, "Package file %s has no RPM signature header", path)
+	}
+
+	return nil
+}
+
+// readSignatureTags reads the lead and signature header of a RPM package from
+// the given io.Reader and returns the tags present in the signature header.
+func readSignatureTags(r io.Reader) ([]int, error) {
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(r, lead); err != nil {
+		return nil, fmt.Errorf("Error reading package lead: %v", err)
+	}
+
+	if !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return nil, fmt.Errorf("File is not a RPM package")
+	}
+
+	// header intro: magic, reserved, index length, store length
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, fmt.Errorf("Error reading package signature header: %v", err)
+	}
+
+	if !bytes.Equal(intro[:4], rpmHeaderMagic) {
+		return nil, fmt.Errorf("Bad package signature header")
+	}
+
+	n := binary.BigEndian.Uint32(intro[8:12])
+	if n > 0xFFFF {
+		return nil, fmt.Errorf("Bad package signature header index length: %d", n)
+	}
+
+	// each index entry is: tag, type, offset, count
+	index := make([]byte, 16*n)
+	if _, err := io.ReadFull(r, index); err != nil {
+		return nil, fmt.Errorf("Error reading package signature header: %v", err)
+	}
+
+	tags := make([]int, n)
+	for i := range tags {
+		tags[i] = int(binary.BigEndian.Uint32(index[16*i:]))
+	}
+
+	return tags, nil
+}
+
+// isSigned returns true if the signature header of the RPM package read from
+// the given io.Reader contains a GPG or PGP signature.
+func isSigned(r io.Reader) (bool, error) {
+	tags, err := readSignatureTags(r)
+	if err != nil {
+		return false, err
+	}
+
+	for _, tag := range tags {
+		for _, sigtag := range rpmSignatureTags {
+			if tag == sigtag {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Header tags which record the sizes and payload format of a package. Since
+// rpm 4.14, the archive size is stored only in the signature header, and
+// packages larger than 4GB store only 64-bit sizes.
+const (
+	rpmSigTagLongArchiveSize = 271
+	rpmSigTagPayloadSize     = 1007
+	rpmTagSize               = 1009
+	rpmTagLicense            = 1014
+	rpmTagArchiveSize        = 1046
+	rpmTagPayloadCompressor  = 1125
+	rpmTagLongSize           = 5009
+)
+
+// rpmPayloadCompressors are the payload compression formats written by
+// rpmbuild. The payload is never decompressed to build repository metadata,
+// so any of these is supported.
+var rpmPayloadCompressors = map[string]bool{
+	"gzip":  true,
+	"bzip2": true,
+	"xz":    true,
+	"lzma":  true,
+	"zstd":  true,
+}
+
+// rpmPackageInfo describes the payload of a RPM package.
+type rpmPackageInfo struct {
+	PayloadCompressor string
+	InstalledSize     uint64
+	ArchiveSize       uint64
+}
+
+// rpmHeaders are the lead, signature header and main header of a RPM package
+// and the raw bytes of each header, without padding.
+type rpmHeaders struct {
+	lead         []byte
+	signature    []rpmHeaderEntry
+	rawSignature []byte
+	header       []rpmHeaderEntry
+	rawHeader    []byte
+}
+
+// payloadOffset returns the offset of the payload in the package file.
+func (c *rpmHeaders) payloadOffset() int64 {
+	return int64(len(c.lead) + len(c.rawSignature) + rpmSignaturePadding(len(c.rawSignature)) + len(c.rawHeader))
+}
+
+// readRPMHeaders reads the lead, signature header and main header of the RPM
+// package read from the given io.Reader. The payload is not read.
+func readRPMHeaders(r io.Reader) (*rpmHeaders, error) {
+	h := &rpmHeaders{lead: make([]byte, rpmLeadSize)}
+	if _, err := io.ReadFull(r, h.lead); err != nil {
+		return nil, fmt.Errorf("Error reading package lead: %v", err)
+	}
+
+	if !bytes.Equal(h.lead[:4], rpmLeadMagic) {
+		return nil, fmt.Errorf("File is not a RPM package")
+	}
+
+	var err error
+	h.signature, h.rawSignature, err = readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading package signature header: %v", err)
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, r, int64(rpmSignaturePadding(len(h.rawSignature)))); err != nil {
+		return nil, fmt.Errorf("Error reading package signature header: %v", err)
+	}
+
+	h.header, h.rawHeader, err = readRPMHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// readPackageHeaders reads the lead, signature header and main header of the
+// RPM package read from the given io.Reader and returns the entries of the
+// signature header and the main header. The payload is not read.
+func readPackageHeaders(r io.Reader) (signature, header []rpmHeaderEntry, err error) {
+	h, err := readRPMHeaders(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return h.signature, h.header, nil
+}
+
+// readPackageInfo reads the sizes and payload compression format of the RPM
+// package at the given path from its signature header and main header.
+func readPackageInfo(path string) (*rpmPackageInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	signature, header, err := readPackageHeaders(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+
+	info := &rpmPackageInfo{
+		PayloadCompressor: rpmHeaderString(header, rpmTagPayloadCompressor),
+		InstalledSize:     rpmHeaderInt(header, rpmTagSize, rpmTagLongSize),
+		ArchiveSize:       rpmHeaderInt(header, rpmTagArchiveSize, rpmSigTagLongArchiveSize),
+	}
+
+	if info.ArchiveSize == 0 {
+		info.ArchiveSize = rpmHeaderInt(signature, rpmSigTagPayloadSize, rpmSigTagLongArchiveSize)
+	}
+
+	// packages built before payload compression was recorded use gzip
+	if info.PayloadCompressor == "" {
+		info.PayloadCompressor = "gzip"
+	}
+
+	if !rpmPayloadCompressors[info.PayloadCompressor] {
+		return nil, fmt.Errorf("Unsupported package payload compression: %s", info.PayloadCompressor)
+	}
+
+	return info, nil
+}
+
+// rpmHeaderInt returns the first integer value of the first of the given tags
+// which is present in the given header entries, or zero.
+func rpmHeaderInt(entries []rpmHeaderEntry, tags ...uint32) uint64 {
+	for _, tag := range tags {
+		for _, e := range entries {
+			if e.Tag != tag || e.Count == 0 {
+				continue
+			}
+
+			switch e.Type {
+			case rpmTypeInt32:
+				return uint64(binary.BigEndian.Uint32(e.Data))
+			case rpmTypeInt64:
+				return binary.BigEndian.Uint64(e.Data)
+			}
+		}
+	}
+
+	return 0
+}
+
+// rpmHeaderString returns the value of the given string tag in the given
+// header entries, or an empty string.
+func rpmHeaderString(entries []rpmHeaderEntry, tag uint32) string {
+	for _, e := range entries {
+		if e.Tag == tag && e.Type == rpmTypeString && len(e.Data) > 0 {
+			return string(e.Data[:len(e.Data)-1])
+		}
+	}
+
+	return ""
+}
+
+// readPackageLicense reads the license of the RPM package read from the given
+// io.Reader from its main header. Only the headers of the package are read.
+func readPackageLicense(r io.Reader) (string, error) {
+	_, header, err := readPackageHeaders(bufio.NewReader(r))
+	if err != nil {
+		return "", err
+	}
+
+	return rpmHeaderString(header, rpmTagLicense), nil
+}
+
+// Header tags which list the files and changelog entries of a package. Older
+// packages list the full path of each file in OLDFILENAMES rather than its
+// basename and the index of its directory.
+const (
+	rpmTagOldFilenames  = 1027
+	rpmTagFileModes     = 1030
+	rpmTagFileFlags     = 1037
+	rpmTagChangelogTime = 1080
+	rpmTagChangelogName = 1081
+	rpmTagChangelogText = 1082
+	rpmTagDirIndexes    = 1116
+	rpmTagBasenames     = 1117
+	rpmTagDirnames      = 1118
+)
+
+// rpmFileGhost is the file flag of a file which is owned by a package but not
+// included in its payload.
+const rpmFileGhost = 1 << 6
+
+// rpmPackageFile is a file listed in the header of a RPM package. Type is
+// "dir" for directories, "ghost" for ghost files and empty for other files, as
+// listed in filelists.xml.
+type rpmPackageFile struct {
+	Path string
+	Type string
+}
+
+// rpmChangelog is a changelog entry in the header of a RPM package.
+type rpmChangelog struct {
+	Author string
+	Date   int64
+	Text   string
+}
+
+// rpmPackageContents lists the files and changelog entries of a RPM package,
+// newest changelog entry first, as in its header.
+type rpmPackageContents struct {
+	Files      []rpmPackageFile
+	Changelogs []rpmChangelog
+}
+
+// readPackageContents reads the files and changelog entries of the RPM package
+// at the given path from its main header.
+func readPackageContents(path string) (*rpmPackageContents, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, header, err := readPackageHeaders(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+
+	paths := rpmHeaderStrings(header, rpmTagOldFilenames)
+	if paths == nil {
+		dirnames := rpmHeaderStrings(header, rpmTagDirnames)
+		indexes := rpmHeaderInts(header, rpmTagDirIndexes)
+		for i, name := range rpmHeaderStrings(header, rpmTagBasenames) {
+			if i >= len(indexes) || indexes[i] >= uint64(len(dirnames)) {
+				return nil, fmt.Errorf("Bad directory index of file %s in package %s", name, path)
+			}
+			paths = append(paths, dirnames[indexes[i]]+name)
+		}
+	}
+
+	contents := &rpmPackageContents{Files: make([]rpmPackageFile, len(paths))}
+	modes, flags := rpmHeaderInts(header, rpmTagFileModes), rpmHeaderInts(header, rpmTagFileFlags)
+	for i, path := range paths {
+		contents.Files[i].Path = path
+		if i < len(flags) && flags[i]&rpmFileGhost != 0 {
+			contents.Files[i].Type = "ghost"
+		} else if i < len(modes) && modes[i]&0170000 == 0040000 {
+			contents.Files[i].Type = "dir"
+		}
+	}
+
+	times := rpmHeaderInts(header, rpmTagChangelogTime)
+	names := rpmHeaderStrings(header, rpmTagChangelogName)
+	texts := rpmHeaderStrings(header, rpmTagChangelogText)
+	for i := range times {
+		if i >= len(names) || i >= len(texts) {
+			break
+		}
+		contents.Changelogs = append(contents.Changelogs, rpmChangelog{Author: names[i], Date: int64(times[i]), Text: texts[i]})
+	}
+
+	return contents, nil
+}
+
+// rpmHeaderInts returns the values of the given 16-bit or 32-bit integer tag
+// in the given header entries, or nil.
+func rpmHeaderInts(entries []rpmHeaderEntry, tag uint32) []uint64 {
+	for _, e := range entries {
+		if e.Tag != tag {
+			continue
+		}
+
+		values := make([]uint64, 0, e.Count)
+		for i := 0; i < int(e.Count); i++ {
+			switch e.Type {
+			case rpmTypeInt16:
+				values = append(values, uint64(binary.BigEndian.Uint16(e.Data[2*i:])))
+			case rpmTypeInt32:
+				values = append(values, uint64(binary.BigEndian.Uint32(e.Data[4*i:])))
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+// rpmHeaderStrings returns the values of the given string array tag in the
+// given header entries, or nil.
+func rpmHeaderStrings(entries []rpmHeaderEntry, tag uint32) []string {
+	for _, e := range entries {
+		if e.Tag == tag && (e.Type == rpmTypeStringArray || e.Type == rpmTypeString) && len(e.Data) > 0 {
+			return strings.Split(string(e.Data[:len(e.Data)-1]), "\x00")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,436 @@
+package yum
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3DefaultRegion is the AWS region of S3 buckets for repos which set no
+// S3Region, if the AWS_REGION and AWS_DEFAULT_REGION environment variables are
+// not set.
+const s3DefaultRegion = "us-east-1"
+
+// s3InstanceMetadataEndpoint is the EC2 instance metadata service, from which
+// the credentials of the instance's IAM role are read, unless
+// AWS_EC2_METADATA_SERVICE_ENDPOINT is set.
+const s3InstanceMetadataEndpoint = "http://169.254.169.254"
+
+// s3ContainerEndpoint is the ECS credentials endpoint, at which
+// AWS_CONTAINER_CREDENTIALS_RELATIVE_URI gives the credentials of the task's
+// IAM role.
+const s3ContainerEndpoint = "http://169.254.170.2"
+
+// s3MetadataTimeout is the time to wait for a credentials endpoint, which is
+// unreachable if not running on EC2 or ECS.
+const s3MetadataTimeout = 2 * time.Second
+
+// s3CredentialsExpiryWindow is how long before they expire that temporary
+// credentials are loaded again.
+const s3CredentialsExpiryWindow = 5 * time.Minute
+
+// s3EmptyPayloadHash is the SHA256 checksum of an empty request body.
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// isS3URL returns true if the given URL is a s3://bucket/key URL.
+func isS3URL(rawurl string) bool {
+	return strings.HasPrefix(strings.ToLower(rawurl), "s3://")
+}
+
+// usesS3 returns true if the repo or any of its mirrors is a S3 bucket.
+func (c *Repo) usesS3() bool {
+	for _, rawurl := range append([]string{c.BaseURL}, c.Mirrors...) {
+		if isS3URL(rawurl) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// s3Region returns the AWS region of the repo's S3 buckets.
+func (c *Repo) s3Region() string {
+	if c.S3Region != "" {
+		return c.S3Region
+	}
+
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(name); region != "" {
+			return region
+		}
+	}
+
+	return s3DefaultRegion
+}
+
+// s3Credentials are the AWS credentials with which S3 requests are signed.
+// Temporary credentials, such as those of an IAM role, have an Expiration.
+type s3Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+}
+
+// s3CredentialsCache loads the AWS credentials once, when they are first
+// needed, and again only when they are about to expire.
+type s3CredentialsCache struct {
+	mu     sync.Mutex
+	creds  *s3Credentials
+	loaded bool
+}
+
+// sharedS3Credentials caches the AWS credentials for the S3 requests of every
+// repo.
+var sharedS3Credentials = &s3CredentialsCache{}
+
+// get returns the cached credentials, loading them if required.
+func (c *s3CredentialsCache) get() (*s3Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded && (c.creds == nil || c.creds.Expiration.IsZero() || time.Now().Add(s3CredentialsExpiryWindow).Before(c.creds.Expiration)) {
+		return c.creds, nil
+	}
+
+	creds, err := loadS3Credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	c.creds, c.loaded = creds, true
+	return creds, nil
+}
+
+// loadS3Credentials returns the AWS credentials given by the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment
+// variables or, if not set, by the profile named by AWS_PROFILE, or the
+// default profile, of the shared credentials file given by
+// AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials.
+//
+// Without a shared credentials file, the credentials of the IAM role of the
+// ECS task, if AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// AWS_CONTAINER_CREDENTIALS_FULL_URI is set, or of the EC2 instance are read
+// from the instance metadata service, unless AWS_EC2_METADATA_DISABLED is
+// true. Other sources, such as SSO, process and web identity credentials, are
+// not supported. If no credentials are found, nil is returned and requests are
+// made anonymously, as for public buckets.
+func loadS3Credentials() (*s3Credentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &s3Credentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".aws", "credentials")
+		}
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) || path == "" {
+		return loadS3RoleCredentials()
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sections, err := readIni(f, path)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	for _, s := range sections {
+		if s.Name == profile {
+			return &s3Credentials{
+				AccessKeyID:     s.Values["aws_access_key_id"],
+				SecretAccessKey: s.Values["aws_secret_access_key"],
+				SessionToken:    s.Values["aws_session_token"],
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No AWS profile '%s' found in %s", profile, path)
+}
+
+// loadS3RoleCredentials returns the temporary credentials of the IAM role of
+// the ECS task or EC2 instance, or nil if there is no role or the metadata
+// service is unreachable.
+func loadS3RoleCredentials() (*s3Credentials, error) {
+	client := &http.Client{Transport: &http.Transport{}, Timeout: s3MetadataTimeout}
+
+	// ECS task role
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		uri = s3ContainerEndpoint + relative
+	}
+
+	if uri != "" {
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ECS credentials URI %s: %v", uri, err)
+		}
+
+		if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+			req.Header.Set("Authorization", token)
+		}
+
+		return readS3RoleCredentials(client, req)
+	}
+
+	// EC2 instance role, with IMDSv2
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, nil
+	}
+
+	endpoint := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = s3InstanceMetadataEndpoint
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+
+	req, err := http.NewRequest("PUT", endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid instance metadata endpoint %s: %v", endpoint, err)
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		Dprintf("No instance metadata service at %s: %v\n", endpoint, err)
+		return nil, nil
+	}
+	token, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		Dprintf("No instance metadata token from %s: %s\n", endpoint, resp.Status)
+		return nil, nil
+	}
+
+	rolesURL := endpoint + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest("GET", rolesURL, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading instance roles from %s: %v", rolesURL, err)
+	}
+	roles, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Error reading instance roles from %s: %v", rolesURL, err)
+	} else if resp.StatusCode == http.StatusNotFound {
+		Dprintf("No IAM role for instance at %s\n", endpoint)
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error reading instance roles from %s: %s", rolesURL, resp.Status)
+	}
+
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return nil, nil
+	}
+
+	req, _ = http.NewRequest("GET", rolesURL+url.PathEscape(role), nil)
+	req.Header.Set("X-aws-ec2-metadata-token", string(token))
+	return readS3RoleCredentials(client, req)
+}
+
+// readS3RoleCredentials returns the temporary credentials in the JSON
+// response to the given request to a credentials endpoint.
+func readS3RoleCredentials(client *http.Client, req *http.Request) (*s3Credentials, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading role credentials from %s: %v", req.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error reading role credentials from %s: %s", req.URL, resp.Status)
+	}
+
+	var v struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&v); err != nil {
+		return nil, fmt.Errorf("Error decoding role credentials from %s: %v", req.URL, err)
+	}
+
+	return &s3Credentials{
+		AccessKeyID:     v.AccessKeyID,
+		SecretAccessKey: v.SecretAccessKey,
+		SessionToken:    v.Token,
+		Expiration:      v.Expiration,
+	}, nil
+}
+
+// s3Escape escapes the given string as required for the canonical request of
+// an AWS signature. If slash is false, '/' is escaped too.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && slash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// s3Transport is a http.RoundTripper which makes requests for s3://bucket/key
+// URLs with the S3 REST API, signed with AWS Signature Version 4. Requests for
+// other URLs are made unmodified.
+//
+// If endpoint is set, such as for MinIO or another S3-compatible store, the
+// bucket is addressed as the first element of the path at the endpoint.
+// Otherwise, the bucket is addressed at its virtual host on AWS.
+type s3Transport struct {
+	transport   http.RoundTripper
+	region      string
+	endpoint    string
+	credentials func() (*s3Credentials, error)
+	now         func() time.Time
+}
+
+func (c *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "s3" {
+		return c.transport.RoundTrip(req)
+	}
+
+	bucket, key := req.URL.Host, req.URL.Path
+	if bucket == "" {
+		return nil, fmt.Errorf("No bucket in S3 URL %s", req.URL)
+	}
+
+	// a RoundTripper must not modify the given request
+	s3req := req.Clone(req.Context())
+	u := s3req.URL
+	if c.endpoint != "" {
+		endpoint, err := url.Parse(c.endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid S3 endpoint %s: %v", c.endpoint, err)
+		}
+		u.Scheme, u.Host = endpoint.Scheme, endpoint.Host
+		u.Path = strings.TrimRight(endpoint.Path, "/") + "/" + bucket + key
+	} else if strings.Contains(bucket, ".") {
+		// virtual hosts of buckets with dots fail TLS validation
+		u.Scheme, u.Host = "https", fmt.Sprintf("s3.%s.amazonaws.com", c.region)
+		u.Path = "/" + bucket + key
+	} else {
+		u.Scheme, u.Host = "https", fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket, c.region)
+		u.Path = key
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	s3req.Host = u.Host
+
+	creds, err := c.credentials()
+	if err != nil {
+		return nil, fmt.Errorf("Error loading AWS credentials: %v", err)
+	}
+
+	if creds != nil {
+		signS3Request(s3req, creds, c.region, c.now())
+	}
+
+	return c.transport.RoundTrip(s3req)
+}
+
+// signS3Request signs the given S3 request without a body with the given
+// credentials for the given region at the given time, as per AWS Signature
+// Version 4. The Host and Range headers and each X-Amz- header are signed.
+func signS3Request(req *http.Request, creds *s3Credentials, region string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	// canonical headers
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// canonical query string
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", req.Header.Get("X-Amz-Date"), scope, hex.EncodeToString(sum[:]))
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, s := range []string{date, region, "s3", "aws4_request"} {
+		key = mac(key, s)
+	}
+	signature := hex.EncodeToString(mac(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
@@ -0,0 +1,105 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// readPackageDir returns the files in the given package directory, as with
+// ioutil.ReadDir. If follow is true, each symlink is described by the file it
+// links to, so that a symlinked package is validated by the size and checksum
+// of its target. Otherwise, and for symlinks whose target does not exist,
+// symlinks are omitted, so that each symlinked package is downloaded again in
+// place of the symlink.
+func readPackageDir(packagedir string, follow bool) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(packagedir)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make([]os.FileInfo, 0, len(files))
+	for _, fi := range files {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if !follow {
+				Dprintf("Ignoring symlink %s\n", filepath.Join(packagedir, fi.Name()))
+				continue
+			}
+
+			target, err := os.Stat(filepath.Join(packagedir, fi.Name()))
+			if err != nil {
+				Dprintf("Ignoring broken symlink %s: %v\n", filepath.Join(packagedir, fi.Name()), err)
+				continue
+			}
+			fi = target
+		}
+
+		resolved = append(resolved, fi)
+	}
+
+	return resolved, nil
+}
+
+// packageFiles returns the given package files which createrepo should index.
+// If follow is true, symlinks are resolved and each symlink to a file which is
+// already listed, such as another package in the same directory, is omitted,
+// so that each package is indexed once, as the regular file if there is one.
+// Otherwise, symlinks are omitted.
+func packageFiles(paths []string, follow bool) []string {
+	canonical := make([]string, len(paths))
+	symlink := make([]bool, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for i, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+
+		symlink[i] = fi.Mode()&os.ModeSymlink != 0
+		if symlink[i] && !follow {
+			continue
+		}
+
+		if canonical[i], err = filepath.EvalSymlinks(path); err != nil {
+			Dprintf("Ignoring broken symlink %s: %v\n", path, err)
+			canonical[i] = ""
+			continue
+		}
+
+		if !symlink[i] {
+			seen[canonical[i]] = true
+		}
+	}
+
+	files := make([]string, 0, len(paths))
+	for i, path := range paths {
+		if canonical[i] == "" {
+			continue
+		}
+
+		if symlink[i] {
+			if seen[canonical[i]] {
+				Dprintf("Ignoring symlink %s to package %s indexed already\n", path, canonical[i])
+				continue
+			}
+			seen[canonical[i]] = true
+		}
+
+		files = append(files, path)
+	}
+
+	return files
+}
+
+// removeSymlink removes the given path if it is a symlink, so that a package
+// downloaded to the path replaces the symlink rather than overwriting the file
+// which it links to.
+func removeSymlink(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	Dprintf("Replacing symlink %s\n", path)
+	return os.Remove(path)
+}
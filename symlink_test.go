@@ -0,0 +1,107 @@
+package yum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFollowSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("foo package")
+	if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := []byte(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">` + checksumBytes(t, content).Hash + `</checksum>
+  <size package="11" installed="11" archive="11"/>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`)
+	writeTestRepodata(t, upstream, 1, primary)
+
+	// the local package is a symlink to a shared package store, and a second
+	// symlink links to the same package
+	store := filepath.Join(dir, "store")
+	if err := os.MkdirAll(store, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := filepath.Join(store, "foo-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(stored, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 2, primary)
+	link := filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")
+	if err := os.Symlink(stored, link); err != nil {
+		t.Fatal(err)
+	}
+
+	alias := filepath.Join(packagedir, "foo-latest.x86_64.rpm")
+	if err := os.Symlink(link, alias); err != nil {
+		t.Fatal(err)
+	}
+
+	files := packageFiles([]string{alias, link}, true)
+	if len(files) != 1 || files[0] != alias {
+		t.Errorf("Expected symlinked package to be indexed once, got %v", files)
+	}
+
+	if files := packageFiles([]string{alias, link}, false); len(files) != 0 {
+		t.Errorf("Expected symlinks not to be indexed, got %v", files)
+	}
+
+	// symlinked packages are validated by their targets
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.PreserveRepodata = true
+	repo.FollowSymlinks = true
+
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+
+	if report.Downloaded != 0 || report.Missing != 0 || report.Corrupt != 0 {
+		t.Errorf("Expected symlinked package to be valid, got: %+v", report)
+	}
+
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected symlink to be kept: %v", err)
+	}
+
+	// otherwise, symlinks are replaced by downloaded packages
+	repo.FollowSymlinks = false
+	if report, err = repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); err != nil {
+		t.Fatalf("Error syncing without FollowSymlinks: %v", err)
+	}
+
+	if report.Downloaded != 1 {
+		t.Errorf("Expected symlinked package to be downloaded, got: %+v", report)
+	}
+
+	if fi, err := os.Lstat(link); err != nil || !fi.Mode().IsRegular() {
+		t.Errorf("Expected symlink to be replaced by the package: %v", err)
+	}
+
+	if fi, err := os.Lstat(stored); err != nil || fi.Size() != int64(len(content)) {
+		t.Errorf("Expected symlink target to be unmodified: %v", err)
+	}
+}
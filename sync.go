@@ -0,0 +1,1437 @@
+package yum
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cavaliercoder/go-rpm"
+	"github.com/cavaliercoder/grab"
+	"code.cloudfoundry.org/bytefmt"
+	"golang.org/x/crypto/openpgp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SyncReport summarizes the outcome of synchronizing a repo.
+type SyncReport struct {
+	Repo     string
+	Started  time.Time
+	Finished time.Time
+
+	// Packages is the number of upstream packages selected by the repo's
+	// filter rules.
+	Packages int
+
+	// Missing is the number of selected packages which were not found, or
+	// were incomplete, in the package directory.
+	Missing int
+
+	// Corrupt is the number of selected packages which were found in the
+	// package directory but failed validation.
+	Corrupt int
+
+	Downloaded      int
+	BytesDownloaded uint64
+
+	// Deleted is the number of local packages deleted during cleanup.
+	Deleted int
+
+	// Orphans are the paths of files in the package directory which are
+	// neither packages nor repository metadata, if ReportOrphans is set.
+	Orphans []string
+
+	// BrokenDependencies describes each requirement of the selected packages
+	// which no selected package provides, if CheckClosure is set.
+	BrokenDependencies []string
+
+	// Duplicates describes each NEVRA which the upstream repository metadata
+	// lists more than once, and the location of the package which was kept.
+	Duplicates []string
+
+	// Drift describes each inconsistency between the existing repository
+	// metadata and the packages, if the metadata was preserved because
+	// PreserveRepodata is set.
+	Drift []string
+
+	Failed int
+	Errors []error
+}
+
+// SyncPlan describes the changes which a sync is about to make to a package
+// directory. It is given to the repo's ConfirmFunc before any package is
+// downloaded.
+type SyncPlan struct {
+	Repo string
+
+	// Packages is the number of packages to be downloaded and Bytes is their
+	// total size.
+	Packages int
+	Bytes    uint64
+
+	// Delete is the number of local packages to be deleted.
+	Delete int
+}
+
+func (c SyncPlan) String() string {
+	return fmt.Sprintf("%d packages to download (%s) and %d packages to delete for repo %s", c.Packages, bytefmt.ByteSize(c.Bytes), c.Delete, c.Repo)
+}
+
+// confirm returns an ErrSyncDeclined error if the repo has a ConfirmFunc which
+// declines the given plan. Plans which change nothing, and every plan if
+// AssumeYes is set, need not be confirmed.
+func (c *Repo) confirm(plan SyncPlan) error {
+	if c.ConfirmFunc == nil || c.AssumeYes || (plan.Packages == 0 && plan.Delete == 0) {
+		return nil
+	}
+
+	Printf("Sync plan: %v\n", plan)
+	if !c.ConfirmFunc(plan) {
+		return newError(ErrSyncDeclined, "Sync plan was declined: %v", plan)
+	}
+
+	return nil
+}
+
+// Duration returns how long the sync took.
+func (c *SyncReport) Duration() time.Duration {
+	return c.Finished.Sub(c.Started)
+}
+
+// addError records a failed package in the report.
+func (c *SyncReport) addError(err error) {
+	c.Failed++
+	c.Errors = append(c.Errors, err)
+}
+
+// add records in the report the downloads, deletions, drift and failures of
+// the given report of another package directory of the same sync.
+func (c *SyncReport) add(other *SyncReport) {
+	c.Downloaded += other.Downloaded
+	c.BytesDownloaded += other.BytesDownloaded
+	c.Deleted += other.Deleted
+	c.Drift = append(c.Drift, other.Drift...)
+	c.Failed += other.Failed
+	c.Errors = append(c.Errors, other.Errors...)
+}
+
+// Sync syncronizes a local package repository with an upstream repository using
+// filter rules defined for the repository in its parent Yumfile. All repository
+// metadata is cached in the given cache directory.
+//
+// If any selected package fails to download or validate, the remaining
+// packages are still synchronized and the repository metadata is built with
+// the packages which succeeded. If FailOnPartial is set, as it is by NewRepo,
+// an error listing each failed package is then returned.
+//
+// An advisory lock is held on the package directory for the duration of the
+// sync. If another process holds the lock, Sync blocks if LockWait is set or
+// otherwise returns an ErrRepoLocked error.
+//
+// If ResumeState is set, each package is recorded in the repo's cache
+// directory as it is validated or downloaded, so that a sync which is
+// interrupted resumes where it left off when it is restarted. Completed
+// packages whose files have not changed size or modification time since are
+// not validated again, packages whose files were modified are validated
+// against their checksum, and packages which are missing or have changed size
+// are synchronized again. The state is removed once a sync completes without
+// errors.
+//
+// If IncrementalByMtime is set, packages which were listed in the manifest of
+// the previous sync, are present with the same size and whose package file
+// time in the upstream primary database is no later than the previous sync
+// are skipped without being validated, so that a daily sync of a large repo
+// only validates and downloads the packages which changed upstream since.
+//
+// If GPGCheck is set, the signature of each downloaded package is validated.
+// If GPGCheckLocal is also set, the signature of each existing package is
+// validated too, and existing packages which fail validation are replaced.
+// The size and modification time of each package which passes validation are
+// recorded in the repo's cache directory with the keyring, so that later
+// syncs only validate existing packages which have changed, or every package
+// if the keyring has changed.
+//
+// If FullResync is set, such as to recover a mirror in an unknown state,
+// every selected package is deleted and downloaded again, even if it passes
+// validation, and neither IncrementalByDate, IncrementalByMtime, ResumeState
+// nor the record of packages which passed GPG validation is used to skip any
+// package. Unlike Repair, which replaces only the packages which fail
+// validation, this also replaces packages whose upstream checksum matches
+// content which cannot be trusted. The existing packages are only replaced
+// once every package has been downloaded, so the mirror remains complete for
+// the whole resync. If StagingDir is not set, the packages are staged in a
+// .resync subdirectory of the package directory.
+//
+// StagingDir must be on the same filesystem as the package directory, as staged
+// packages are moved into place by renaming them. This is checked before any
+// package is downloaded, and the sync fails with an ErrCrossDevice error if it
+// is not. Packages of a file:// upstream repository on another filesystem are
+// copied rather than hardlinked.
+//
+// If ResignKey is set, each downloaded package is re-signed with the private
+// key in the ResignKey file once its upstream signature has been verified, as
+// with `rpm --resign`. This rewrites every mirrored package, so clients must
+// trust the local key rather than the upstream key. Re-signed packages are
+// recorded in the package directory so they are not downloaded again.
+//
+// If GenerateChangelog is set, each sync which completes without errors
+// writes a CHANGES-<timestamp>.txt file to the package directory listing the
+// packages added, updated and removed since the previous sync, as recorded in
+// the previous sync manifest. The manifest is only replaced by a sync which
+// completes without errors, so the changes made by a sync which fails are
+// listed in the changelog of the next sync which completes.
+//
+// The repository metadata lists the packages in a primary.xml database, which
+// every client reads, and, if EmitSQLite is set, as it is by NewRepo, in a
+// primary_db sqlite database too, which older yum clients prefer.
+//
+// The repository metadata is only rebuilt if packages were added or removed
+// since it was last built, if it is incomplete or if upstream metadata which
+// is copied into it has changed, unless ForceCreaterepo, IncludeGroups or
+// IncludeModules is set.
+//
+// Each database of the upstream repository metadata which createrepo does not
+// rebuild, such as updateinfo, prestodelta, or the groupfile unless
+// IncludeGroups is set, is validated against its checksum and copied
+// unmodified into the local repository metadata. Databases of types which this
+// package does not recognize, such as pkgtags, suseinfo or productid, are
+// copied too, unless DropUnknownMetadata is set. If PreserveProductID is set,
+// the productid database, used by subscription-manager on RHEL-derived
+// systems, is copied even if DropUnknownMetadata is set.
+//
+// AppStream metadata, such as the appstream and appstream-icons databases read
+// by GNOME Software, is only copied if PreserveAppstream is set, as the icon
+// tarballs of desktop repositories may be large. Each database is validated
+// against its upstream size and checksum before it is copied.
+//
+// If PreserveRepodata is set and the package directory has repository
+// metadata, such as built by an external createrepo_c, which is no older than
+// the upstream metadata, packages are downloaded and validated but no package
+// is deleted and the metadata is not rebuilt. Instead, any drift between the
+// metadata, the package directory and the upstream packages is logged and
+// recorded in the SyncReport.
+//
+// If PinRevision is set, the repo is synchronized from the snapshot of that
+// revision, which the upstream repository and each of its mirrors must serve
+// from snapshots/<revision>/. An integer PinRevision must match the revision
+// of the snapshot's repomd.xml. Repos without snapshots may instead be pinned
+// with a sync manifest; see SyncFromManifest.
+//
+// If the repo has a FilenameFunc, each package is saved in the package
+// directory with the filename it returns, such as the NEVRA of the package,
+// and is located by that filename in the repository metadata. Otherwise, the
+// upstream filename of the package is used.
+//
+// If Frozen is set, no metadata or package is fetched from the upstream
+// repository. Instead, every package listed in the existing repository
+// metadata is validated, and each package which is missing or fails
+// validation is recorded in the SyncReport. Unlike a disabled repo, which
+// SyncAll skips, a frozen repo therefore fails to sync if its content is
+// damaged.
+//
+// If Zsync is set and the upstream repository publishes a zsync control file
+// beside a package, at the package URL with a .zsync suffix, the package is
+// reconstructed from any existing file for the package or from another
+// version of the package in the package directory, and only the blocks which
+// differ are downloaded, with HTTP range requests. If there is no control
+// file or the reconstructed package fails validation, the package is
+// downloaded in full.
+//
+// If PackageLockFile is set, exactly the packages whose NEVRAs are listed in
+// the lockfile are synchronized, such as to reproduce the packages installed
+// on a known-good host, and the repo's filter rules and KeepVersions and
+// DeleteOlderThan retention policy are ignored, so locked packages are never
+// deleted. The sync fails if any listed NEVRA is not found upstream.
+//
+// If SeparateDebugRepo is set, debuginfo and debugsource packages are
+// synchronized to the debug subdirectory of the package directory, with their
+// own repository metadata and sync manifest, and are excluded from the main
+// repository, as most distributions publish a separate debuginfo repository.
+// The debug packages are planned and confirmed together with the main
+// packages, and are staged in the debug subdirectory of StagingDir.
+//
+// If AutoSatisfyDeps is set, the packages which provide the requirements of
+// the selected packages are selected too, even if they were filtered out by
+// NewOnly, includepkgs, IncludeRegex, MinDate or MaxDate or would expire by
+// KeepVersions or DeleteOlderThan, so that the local repository is
+// self-consistent. Packages excluded by name or of another architecture are
+// never selected this way.
+//
+// If CheckClosure is set, the requirements of every selected package are
+// resolved against the capabilities and files of the selected packages, as
+// listed in the upstream primary and filelists databases, and each
+// requirement which no selected package provides is logged and recorded in
+// the SyncReport, as clients would fail to install the package. Broken
+// dependencies do not fail the sync.
+//
+// If the repo has a ConfirmFunc, it is called with the number and total size
+// of the packages to be downloaded before any is downloaded, unless AssumeYes
+// is set. If it returns false, the sync is aborted with an ErrSyncDeclined
+// error.
+//
+// Date placeholders in the given package directory, such as $date, are
+// expanded to the date on which the sync starts, as for LocalPath.
+//
+// The outcome of every sync, successful or not, is sent to the repo's
+// Notifier or NotifyWebhook, if set.
+func (c *Repo) Sync(cachedir, packagedir string) error {
+	_, err := c.notify(c.sync(cachedir, packagedir, syncOptions{}))
+	return err
+}
+
+// Repair audits a local package repository against its upstream repository
+// and downloads only the packages which are missing or which fail validation,
+// before rebuilding the repository metadata. Valid packages are not modified.
+// Unlike Sync, corrupt packages are deleted before they are downloaded again
+// and IncrementalByDate and IncrementalByMtime are ignored so every selected
+// package is audited. Date placeholders in the given package directory are
+// expanded as per Sync.
+func (c *Repo) Repair(cachedir, packagedir string) (*SyncReport, error) {
+	return c.notify(c.sync(cachedir, packagedir, syncOptions{repair: true}))
+}
+
+// syncOptions change how sync selects and audits packages.
+type syncOptions struct {
+	// repair deletes corrupt packages before they are downloaded again and
+	// ignores IncrementalByDate and IncrementalByMtime.
+	repair bool
+
+	// manifest, if set, selects exactly the packages it lists in place of
+	// the repo's filter rules, and no local package is deleted.
+	manifest *SyncManifest
+
+	// merge lists the other repos whose selected packages are merged with
+	// those of the repo, as per MergeSync.
+	merge []*Repo
+}
+
+// syncRun holds the state of a single sync of a repo, so that the Repo itself
+// is not modified by a sync and may be synced, exported or cached
+// concurrently.
+type syncRun struct {
+	*Repo
+
+	// stagedir is the directory packages are downloaded to before they are
+	// moved into the package directory, if any.
+	stagedir string
+
+	// seeddir is the package directory whose packages seed zsync downloads.
+	seeddir string
+
+	// mirror is the mirror which served the repo metadata, from which
+	// packages are downloaded first.
+	mirror string
+
+	state       *syncState
+	gpgCache    *gpgCache
+	resigner    *packageResigner
+	retained    map[string]bool
+	duplicates  []string
+	comps       *Comps
+	modules     *Modules
+	passthrough []passthroughDatabase
+	merged      []*mergeSource
+}
+
+// newSyncRun returns the state of a new sync of the given repo.
+func newSyncRun(repo *Repo) *syncRun {
+	return &syncRun{Repo: repo, stagedir: repo.StagingDir}
+}
+
+func (c *Repo) sync(cachedir, packagedir string, opts syncOptions) (*SyncReport, error) {
+	return newSyncRun(c).run(cachedir, packagedir, opts)
+}
+
+func (c *syncRun) run(cachedir, packagedir string, opts syncOptions) (*SyncReport, error) {
+	var err error
+	report := &SyncReport{
+		Repo:    c.ID,
+		Started: time.Now(),
+		Errors:  make([]error, 0),
+	}
+	defer func() { report.Finished = time.Now() }()
+
+	// target the dated package directory of this sync
+	packagedir = expandDate(packagedir, report.Started)
+
+	// create package directory
+	if err := os.MkdirAll(packagedir, 0750); err != nil && !os.IsExist(err) {
+		return report, c.wrapErr(err, "creating local package path %s", packagedir)
+	}
+
+	// prevent concurrent syncs of the package directory
+	lock, err := lockDir(packagedir, c.LockWait)
+	if err != nil {
+		return report, c.wrapErr(err, "locking local package path %s", packagedir)
+	}
+	defer lock.Unlock()
+
+	// clean up after any interrupted createrepo
+	if _, err := recoverRepodata(packagedir); err != nil {
+		return report, c.wrapErr(err, "recovering repository metadata")
+	}
+
+	// validate existing content without contacting the upstream repository
+	if c.Frozen {
+		if err := c.verifyFrozen(packagedir, report); err != nil {
+			return report, err
+		}
+		return report, c.partialError(report)
+	}
+
+	// fail early if staged packages cannot be moved into place
+	if err := c.checkFilesystems(packagedir); err != nil {
+		return report, err
+	}
+
+	// load gpg keys
+	var keyring openpgp.KeyRing
+	if c.GPGCheck {
+		keyring, err = OpenKeyRing(c.GPGKey)
+		if err != nil {
+			return report, c.wrapErr(err, "loading GPG keys")
+		}
+	}
+
+	// load repomd.xml signing key
+	var signer *openpgp.Entity
+	if c.SignKey != "" {
+		signer, err = OpenSigningKey(c.SignKey, c.SignKeyPassphrase)
+		if err != nil {
+			return report, c.wrapErr(err, "loading signing key")
+		}
+	}
+
+	// load package re-signing key
+	if c.ResignKey != "" {
+		key, err := OpenSigningKey(c.ResignKey, c.ResignKeyPassphrase)
+		if err != nil {
+			return report, c.wrapErr(err, "loading package re-signing key")
+		}
+
+		c.resigner = &packageResigner{signer: key, packagedir: packagedir}
+	}
+
+	// cache repo metadata locally to TmpYumCachePath
+	repocache, err := c.CacheLocal(cachedir)
+	if err != nil {
+		return report, err
+	}
+	defer repocache.Close()
+
+	// resume an interrupted sync
+	if c.ResumeState {
+		c.state, err = openSyncState(filepath.Join(repocache.Path, syncStateFilename))
+		if err != nil {
+			return report, c.wrapErr(err, "reading sync state")
+		}
+		defer c.state.Close()
+	}
+
+	// skip GPG validation of packages which are unchanged since the last sync
+	if c.GPGCheck && !c.FullResync {
+		c.gpgCache, err = openGPGCache(filepath.Join(repocache.Path, gpgCacheFilename), keyring)
+		if err != nil {
+			return report, c.wrapErr(err, "reading GPG cache")
+		}
+		defer func() {
+			if err := c.gpgCache.Save(); err != nil {
+				Errorf(err, "Error writing GPG cache for repo %v", c)
+			}
+		}()
+	}
+
+	// select upstream packages, or the packages pinned by a manifest
+	var selected PackageEntries
+	if opts.manifest != nil {
+		selected, err = c.selectManifest(repocache, opts.manifest)
+	} else if len(opts.merge) > 0 {
+		defer c.closeMerged()
+		selected, err = c.selectMerged(repocache, opts.merge, cachedir, packagedir)
+	} else {
+		selected, err = c.selectPackages(repocache, packagedir)
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Duplicates = c.duplicates
+
+	// download packages first from the mirror which served the metadata, and
+	// reconstruct packages with zsync from the package directory, even when
+	// they are downloaded to the staging directory
+	c.mirror, c.seeddir = repocache.baseURL(), packagedir
+
+	if c.CheckClosure {
+		if err := c.checkClosure(repocache, selected, report); err != nil {
+			return report, err
+		}
+	}
+
+	// debug packages are synchronized to a separate debug repo, which is
+	// planned, confirmed and updated with the main repo
+	dirs := []*syncDir{{path: packagedir, selected: selected}}
+	if c.SeparateDebugRepo {
+		main, debug := splitDebugPackages(selected)
+		dirs = []*syncDir{
+			{path: packagedir, selected: main},
+			{path: filepath.Join(packagedir, debugRepoDirname), selected: debug, debug: true},
+		}
+	}
+
+	// confirm the download size before downloading anything
+	plan := SyncPlan{Repo: c.ID}
+	for _, dir := range dirs {
+		if err := c.planDir(dir, repocache, opts, keyring, report); err != nil {
+			return report, err
+		}
+
+		for _, p := range append(dir.missing, dir.corrupt...) {
+			plan.Bytes += uint64(p.PackageSize())
+		}
+		plan.Packages += len(dir.missing) + len(dir.corrupt)
+		if dir.repomd == nil {
+			plan.Delete += len(dir.remove)
+		}
+	}
+
+	if err := c.confirm(plan); err != nil {
+		return report, c.wrapErr(err, "confirming sync")
+	}
+
+	for _, dir := range dirs {
+		err := c.updateDir(dir, repocache, keyring, signer)
+		report.add(dir.report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	if c.ReportOrphans {
+		if err := c.reportOrphans(packagedir, report); err != nil {
+			return report, c.wrapErr(err, "reading files in %s", packagedir)
+		}
+	}
+
+	// a complete sync need not be resumed
+	if report.Failed == 0 {
+		if err := c.state.Remove(); err != nil {
+			Errorf(err, "Error removing sync state for repo %v", c)
+		}
+	}
+
+	return report, c.partialError(report)
+}
+
+// syncDir is a package directory updated by sync, such as the package
+// directory of a repo or its debug subdirectory, with the changes planned for
+// it by planDir.
+type syncDir struct {
+	path  string
+	debug bool
+
+	// selected are the upstream packages selected for the directory.
+	selected PackageEntries
+
+	// missing and corrupt are the selected packages to be downloaded, and
+	// remove are the paths of the local packages to be deleted.
+	missing PackageEntries
+	corrupt PackageEntries
+	remove  []string
+
+	// stagedir is the directory in which packages are staged, if any.
+	stagedir string
+
+	// repomd is the existing repository metadata, if it is preserved.
+	repomd *RepoMetadata
+
+	// report records the outcome of updateDir.
+	report *SyncReport
+}
+
+// planDir audits the selected packages of the given package directory against
+// the packages in the directory and plans the packages to be downloaded to it
+// and deleted from it, recording the audit in the given report.
+func (c *syncRun) planDir(dir *syncDir, repocache *RepoCache, opts syncOptions, keyring openpgp.KeyRing, report *SyncReport) error {
+	packagedir := dir.path
+	dir.report = &SyncReport{Errors: make([]error, 0)}
+
+	// the debug repo is created within the locked package directory
+	if dir.debug {
+		if err := os.MkdirAll(packagedir, 0750); err != nil && !os.IsExist(err) {
+			return c.wrapErr(err, "creating debug package path %s", packagedir)
+		}
+
+		if _, err := recoverRepodata(packagedir); err != nil {
+			return c.wrapErr(err, "recovering debug repository metadata")
+		}
+	}
+
+	// list existing files
+	files, err := readPackageDir(packagedir, c.FollowSymlinks)
+	if err != nil {
+		return c.wrapErr(err, "reading packages in %s", packagedir)
+	}
+
+	packages := dir.selected
+	if c.IncrementalByDate && !opts.repair && !c.FullResync {
+		packages = FilterNewerThanLocal(packages, files)
+	}
+
+	// skip packages unchanged since the previous sync
+	if c.IncrementalByMtime && !opts.repair && !c.FullResync {
+		manifest, err := ReadSyncManifest(filepath.Join(packagedir, manifestFilename))
+		if err == nil {
+			packages = FilterModifiedSince(packages, manifest, files)
+		} else if !os.IsNotExist(err) {
+			Errorf(err, "Error reading previous sync manifest for repo %v, validating all packages", c)
+		}
+	}
+	Dprintf("Found %d packages in primary_db for %s\n", len(packages), packagedir)
+
+	// debug packages are staged in the debug subdirectory of StagingDir
+	dir.stagedir = c.stagedir
+	if dir.debug && c.stagedir != "" {
+		dir.stagedir = filepath.Join(c.stagedir, debugRepoDirname)
+	}
+
+	// skip packages completed by an interrupted sync
+	pending, resumed := packages, PackageEntries{}
+	if !c.FullResync {
+		pending, resumed = c.resumePackages(packages, packagedir, dir.stagedir)
+	}
+	if len(resumed) > 0 {
+		Printf("Resuming sync of %v with %d of %d packages complete in %s\n", c, len(resumed), len(packages), packagedir)
+	}
+
+	// build a list of missing packages
+	Dprintf("Checking for existing packages in %s...\n", packagedir)
+	missing, corrupt := auditPackages(pending, packagedir, files)
+	report.Packages += len(packages)
+
+	// replace every existing package, however it validates
+	if c.FullResync {
+		existing := existingPackages(pending, missing, corrupt)
+		Printf("Replacing %d existing packages of %v in %s for full resync\n", len(existing), c, packagedir)
+		report.Missing += len(missing)
+		report.Corrupt += len(corrupt)
+		corrupt = append(corrupt, existing...)
+	} else {
+		// validate the signatures of existing packages, unless they are
+		// re-signed
+		if c.GPGCheck && c.GPGCheckLocal && c.resigner == nil {
+			corrupt = append(corrupt, c.gpgCheckLocal(existingPackages(pending, missing, corrupt), packagedir, keyring)...)
+		}
+
+		// record valid packages so they are not validated again on resume
+		if c.state != nil {
+			for _, p := range existingPackages(pending, missing, corrupt) {
+				c.state.Add(p, filepath.Join(packagedir, p.filename()))
+			}
+		}
+		report.Missing += len(missing)
+		report.Corrupt += len(corrupt)
+	}
+	dir.missing, dir.corrupt = missing, corrupt
+
+	// existing packages are only replaced once every package has been
+	// downloaded, so the mirror remains complete for the whole resync
+	if c.FullResync && dir.stagedir == "" {
+		dir.stagedir = filepath.Join(packagedir, resyncDirname)
+	}
+
+	// corrupt packages are replaced when staged packages are promoted
+	if (opts.repair || c.FullResync) && dir.stagedir == "" {
+		for _, p := range corrupt {
+			path := filepath.Join(packagedir, p.filename())
+			Dprintf("Deleting corrupt package %s\n", path)
+			if err := os.Remove(path); err != nil {
+				Errorf(err, "Error deleting corrupt package %v", p)
+			}
+		}
+	}
+
+	// find local packages to delete during cleanup, unless the packages are
+	// pinned by a manifest
+	if len(c.merged) > 0 {
+		dir.remove, err = c.expiredMerged(packagedir, dir.selected)
+	} else if opts.manifest == nil {
+		dir.remove, err = c.expiredPackages(packagedir, dir.selected)
+	}
+	if err != nil {
+		return c.wrapErr(err, "reading packages in %s", packagedir)
+	}
+
+	// verify existing metadata built by another tool, unless it is older than
+	// the upstream metadata
+	if c.PreserveRepodata {
+		dir.repomd = readRepodata(packagedir)
+		if dir.repomd != nil && dir.repomd.Revision < repocache.Metadata.Revision {
+			Printf("Repository metadata in %s is older than upstream revision %d and will be rebuilt\n", packagedir, repocache.Metadata.Revision)
+			dir.repomd = nil
+		}
+	}
+
+	return nil
+}
+
+// updateDir downloads the packages planned for the given package directory,
+// deletes its expired packages and rebuilds or verifies its repository
+// metadata, recording the outcome in the directory's report. Once every
+// package has been synchronized, the packages present are recorded in the
+// directory's sync manifest, and in a changelog if GenerateChangelog is set.
+func (c *syncRun) updateDir(dir *syncDir, repocache *RepoCache, keyring openpgp.KeyRing, signer *openpgp.Entity) error {
+	packagedir, report := dir.path, dir.report
+
+	// download to the staging directory of the package directory
+	run := *c
+	run.stagedir = dir.stagedir
+	if dir.stagedir == filepath.Join(packagedir, resyncDirname) {
+		defer os.Remove(dir.stagedir)
+	}
+
+	if dir.debug {
+		Dprintf("Syncing %d debug packages to %s\n", len(dir.selected), packagedir)
+
+		// reconstruct debug packages with zsync from the debug repo
+		run.seeddir = packagedir
+
+		// re-signed debug packages are recorded in the debug repo
+		if c.resigner != nil {
+			run.resigner = &packageResigner{signer: c.resigner.signer, packagedir: packagedir}
+		}
+
+		// the debug repo has no groups, modules or passthrough metadata
+		run.comps, run.modules, run.passthrough = nil, nil, nil
+	}
+
+	// download missing packages, cleanup and createrepo
+	packages := append(dir.missing, dir.corrupt...)
+	if dir.repomd != nil {
+		if err := run.verifyRepodata(packages, dir.selected, packagedir, dir.repomd, keyring, report); err != nil {
+			return err
+		}
+	} else if err := run.updatePackages(packages, dir.remove, packagedir, keyring, signer, report); err != nil {
+		return err
+	}
+
+	// record the packages present after a complete sync, so that the changes
+	// of a failed sync are listed in the next changelog
+	if report.Failed > 0 {
+		Dprintf("Keeping previous sync manifest of repo %v in %s after %d failures\n", c, packagedir, report.Failed)
+		return nil
+	}
+
+	manifestPath := filepath.Join(packagedir, manifestFilename)
+	previous, err := ReadSyncManifest(manifestPath)
+	if err != nil && !os.IsNotExist(err) {
+		Errorf(err, "Error reading previous sync manifest for repo %v", c)
+	}
+
+	manifest, err := newSyncManifest(c.Repo, repocache.Metadata.Revision, dir.selected, packagedir)
+	if err != nil {
+		return c.wrapErr(err, "creating sync manifest")
+	}
+
+	if err := manifest.WriteFile(manifestPath); err != nil {
+		return c.wrapErr(err, "writing sync manifest")
+	}
+
+	if c.GenerateChangelog && previous != nil {
+		if err := c.writeChangelog(packagedir, previous, manifest); err != nil {
+			return c.wrapErr(err, "writing changelog")
+		}
+	}
+
+	return nil
+}
+
+// partialError returns an error listing each package which failed to sync, if
+// any failed and FailOnPartial is set.
+func (c *Repo) partialError(report *SyncReport) error {
+	if !c.FailOnPartial || report.Failed == 0 {
+		return nil
+	}
+
+	return c.wrapErr(Errors(report.Errors), "syncing %d of %d packages", report.Failed, report.Missing+report.Corrupt)
+}
+
+// selectPackages returns the packages in the cached primary database of the
+// given repo cache which are selected by the repo's filter rules. Licenses are
+// read from packages in the given package directory, if any, where possible.
+func (c *syncRun) selectPackages(repocache *RepoCache, packagedir string) (PackageEntries, error) {
+	// load packages from the cached primary database
+	Dprintf("Loading package metadata from primary database...\n")
+	packages, err := repocache.Packages()
+	if err != nil {
+		return nil, c.wrapErr(err, "reading packages from primary database")
+	}
+
+	if c.RejectDuplicates {
+		if duplicates := duplicatePackages(packages); len(duplicates) > 0 {
+			nevras := make([]string, 0, len(duplicates))
+			for nevra := range duplicates {
+				nevras = append(nevras, nevra)
+			}
+			sort.Strings(nevras)
+
+			return nil, c.wrapErr(newError(ErrDuplicatePackage, "Upstream repository lists %d packages more than once: %s", len(nevras), strings.Join(nevras, ", ")), "selecting packages")
+		}
+	}
+
+	// keep one package of each NEVRA which is listed more than once, before
+	// the lockfile or filter rules select any
+	packages, c.duplicates = dedupPackages(packages, func(p PackageEntry, kept bool, reason string) {
+		if c.FilterAuditFunc != nil {
+			c.FilterAuditFunc(p, kept, reason)
+		}
+	})
+	for _, duplicate := range c.duplicates {
+		Warnf("%s\n", duplicate)
+	}
+
+	upstream := packages
+	c.retained = make(map[string]bool)
+	if c.PackageLockFile != "" {
+		// select exactly the locked packages, which are never expired
+		packages, err = c.lockedPackages(packages)
+		if err != nil {
+			return nil, c.wrapErr(err, "reading package lockfile %s", c.PackageLockFile)
+		}
+
+		for _, p := range packages {
+			c.retained[p.NEVRA()] = true
+		}
+	} else {
+		// filter list, reading any licenses missing from the metadata first
+		c.resolveLicenses(packages, repocache, packagedir)
+		packages = FilterPackages(c.Repo, packages)
+
+		// filter by package group and keep the selected groups for createrepo
+		if len(c.IncludeGroups) > 0 {
+			comps, err := repocache.Comps()
+			if err != nil {
+				return nil, c.wrapErr(err, "reading groupfile")
+			}
+
+			names, err := comps.PackageNames(c.IncludeGroups...)
+			if err != nil {
+				return nil, c.wrapErr(err, "expanding package groups")
+			}
+
+			if c.comps, err = comps.Filter(c.IncludeGroups...); err != nil {
+				return nil, c.wrapErr(err, "expanding package groups")
+			}
+
+			packages = FilterPackagesByName(packages, names)
+		}
+
+		// filter by module stream and keep the selected streams for createrepo
+		if len(c.IncludeModules) > 0 {
+			modules, err := repocache.Modules()
+			if err != nil {
+				return nil, c.wrapErr(err, "reading modules")
+			}
+
+			c.modules = modules.Filter(c.IncludeModules...)
+			packages = FilterModularPackages(packages, modules, c.modules)
+		}
+
+		// exclude packages which would be deleted during cleanup
+		packages, _ = retainPackages(c.Repo, packages, time.Now())
+
+		// add the filtered packages which the selected packages require,
+		// which are never expired
+		if c.AutoSatisfyDeps {
+			selected := len(packages)
+			packages, err = c.autoSatisfyDependencies(repocache, upstream, packages)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, p := range packages[selected:] {
+				c.retained[p.NEVRA()] = true
+			}
+		}
+	}
+
+	// keep upstream metadata such as productid for createrepo
+	c.passthrough = repocache.passthrough
+
+	// packages must be validated with a permitted checksum
+	for _, p := range packages {
+		if err := c.checkChecksumType(p.ChecksumType()); err != nil {
+			return nil, c.wrapErr(err, "validating checksum of package %v", p)
+		}
+	}
+
+	if err := c.nameFiles(packages); err != nil {
+		return nil, c.wrapErr(err, "naming packages")
+	}
+
+	return packages, nil
+}
+
+// nameFiles names the local file of each of the given packages with the
+// repo's FilenameFunc, if set. An error is returned if a name is not the
+// filename of a rpm package, or if two packages would have the same name.
+func (c *Repo) nameFiles(packages PackageEntries) error {
+	if c.FilenameFunc == nil {
+		return nil
+	}
+
+	names := make(map[string]PackageEntry, len(packages))
+	for i, p := range packages {
+		name := c.FilenameFunc(p)
+		if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".rpm") {
+			return fmt.Errorf("Invalid filename for package %v: '%s'", p, name)
+		}
+
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("Packages %v and %v have the same filename: %s", other, p, name)
+		}
+
+		names[name] = p
+		packages[i].localName = name
+	}
+
+	return nil
+}
+
+// existingPackages returns the given packages which are not in the given
+// missing or corrupt packages.
+func existingPackages(packages, missing, corrupt PackageEntries) PackageEntries {
+	invalid := make(map[string]bool, len(missing)+len(corrupt))
+	for _, p := range append(missing, corrupt...) {
+		invalid[p.LocationHref()] = true
+	}
+
+	existing := make(PackageEntries, 0, len(packages))
+	for _, p := range packages {
+		if !invalid[p.LocationHref()] {
+			existing = append(existing, p)
+		}
+	}
+
+	return existing
+}
+
+// auditPackages compares the given packages with the given files in a package
+// directory. It returns the packages which are missing from the directory or
+// incomplete, and the packages which exist but fail size or checksum
+// validation.
+func auditPackages(packages PackageEntries, packagedir string, files []os.FileInfo) (missing PackageEntries, corrupt PackageEntries) {
+	missing = make(PackageEntries, 0)
+	corrupt = make(PackageEntries, 0)
+	resigned := readResignedPackages(packagedir)
+	for _, p := range packages {
+		package_filename := p.filename()
+		package_path := filepath.Join(packagedir, package_filename)
+
+		// search local files
+		found := false
+		bad := false
+		for _, fi := range files {
+			// find file for package
+			if fi.Name() == package_filename {
+				// re-signed packages differ from upstream
+				size, sum, sumtype, err := localPackageFile(p, resigned)
+				if err != nil {
+					Errorf(err, "Failed to compute checksum for package %v", p)
+					break
+				}
+
+				// check file size
+				if fi.Size() == size {
+					// validate checksum
+					err = validateFileChecksum(package_path, sum, sumtype)
+					if errors.Is(err, ErrChecksumMismatch) {
+						Errorf(err, "Existing file failed checksum validation for package %v", p)
+						bad = true
+						break
+
+					} else if err != nil {
+						Errorf(err, "Error validating checksum for package %v", p)
+						break
+					}
+
+					// valid package found
+					found = true
+					break
+
+				} else if fi.Size() > size {
+					// existing file is too large (smaller is okay)
+					Errorf(nil, "Existing file is larger (%s) than expected (%s) for package %v", bytefmt.ByteSize(uint64(fi.Size())), bytefmt.ByteSize(uint64(size)), p)
+					bad = true
+					break
+				} else {
+					Dprintf("Existing file is incomplete for package %v\n", p)
+				}
+			}
+		}
+
+		if bad {
+			corrupt = append(corrupt, p)
+		} else if !found {
+			missing = append(missing, p)
+		}
+	}
+
+	return missing, corrupt
+}
+
+// downloadPackages downloads the given packages to the given package
+// directory and validates their GPG signatures if the repo requires it.
+// Packages which fail to download or fail GPG validation are recorded in the
+// given report. During a sync, packages are downloaded first from the mirror
+// which served the repo metadata.
+//
+// Packages which fail checksum validation were likely served by a corrupt
+// mirror, and packages which are redirected in a loop or too many times were
+// likely requested from a misconfigured mirror. Either are downloaded again
+// from each of the repo's alternate Mirrors in turn, until a valid package is
+// downloaded or every mirror has failed.
+func (c *syncRun) downloadPackages(packages PackageEntries, packagedir string, keyring openpgp.KeyRing, report *SyncReport) {
+	// packages merged from other repos are downloaded from those repos
+	if len(c.merged) > 0 {
+		packages = c.downloadMerged(packages, packagedir, report)
+	}
+
+	var totalsize uint64 = 0
+	for _, p := range packages {
+		totalsize += uint64(p.PackageSize())
+	}
+
+	Dprintf("Scheduled %d packages for download (%s)\n", len(packages), bytefmt.ByteSize(totalsize))
+
+	// start with the mirror which served the metadata of the current sync
+	first := c.BaseURL
+	if c.mirror != "" {
+		first = c.mirror
+	}
+
+	mirrors := []string{c.repoURL(first)}
+	for _, mirror := range append([]string{c.BaseURL}, c.Mirrors...) {
+		if mirror != first {
+			mirrors = append(mirrors, c.repoURL(mirror))
+		}
+	}
+
+	for i, mirror := range mirrors {
+		if i > 0 {
+			Printf("Retrying %d failed packages from %s\n", len(packages), mirror)
+		}
+
+		packages = c.fetchPackages(packages, mirror, i == len(mirrors)-1, packagedir, keyring, report)
+		if len(packages) == 0 {
+			break
+		}
+	}
+}
+
+// fetchPackages downloads the given packages from the given base URL and
+// returns the packages which failed checksum validation or were redirected too
+// many times, so they may be downloaded from another mirror. These failures
+// are recorded in the given report instead if last is true or if the package
+// has its own location base, as it is never retried. Other failures are always
+// recorded in the report.
+func (c *syncRun) fetchPackages(packages PackageEntries, baseurl string, last bool, packagedir string, keyring openpgp.KeyRing, report *SyncReport) PackageEntries {
+	retry := make(PackageEntries, 0)
+	failover := func(p PackageEntry, filename, label string, err error) {
+		os.Remove(filename)
+		if last || p.LocationBase() != "" {
+			Errorf(err, "Error downloading %s", label)
+			report.addError(err)
+			return
+		}
+
+		Errorf(err, "Error downloading %s from %s", label, baseurl)
+		retry = append(retry, p)
+	}
+
+	// schedule download jobs
+	reqs := make([]*grab.Request, 0)
+	for i, p := range packages {
+		label := fmt.Sprintf("[ %d / %d ] %v", i+1, len(packages), p)
+		filename := filepath.Join(packagedir, p.filename())
+		if err := removeSymlink(filename); err != nil {
+			Errorf(err, "Error replacing symlink for package %v", p)
+			report.addError(err)
+			continue
+		}
+
+		url, err := c.packageURL(p, baseurl)
+		if err != nil {
+			Errorf(err, "Error requesting package %v", p)
+			report.addError(err)
+			continue
+		}
+
+		// copy packages from local repositories
+		if isFileURL(url) {
+			n, err := copyPackage(p, fileURLPath(url), filename)
+			if errors.Is(err, ErrChecksumMismatch) {
+				failover(p, filename, label, err)
+				continue
+			} else if err != nil {
+				Errorf(err, "Error copying %s", label)
+				report.addError(err)
+				continue
+			}
+
+			if c.checkPackage(p, filename, label, n, keyring, report) {
+				c.state.Add(p, filename)
+			}
+			continue
+		}
+
+		// fetch only the changed blocks of packages published with zsync
+		if c.Zsync {
+			if seed := zsyncSeed(p, packagedir, c.seeddir); seed != "" {
+				n, err := c.zsyncPackage(p, url, seed, filename)
+				if err == nil {
+					if c.checkPackage(p, filename, label, n, keyring, report) {
+						c.state.Add(p, filename)
+					}
+					continue
+				}
+				Dprintf("Downloading %s in full: %v\n", label, err)
+			}
+		}
+
+		req, err := grab.NewRequest(url)
+		if err != nil {
+			Errorf(err, "Error requesting package %v", p)
+			report.addError(err)
+		} else {
+			req.Label = label
+			req.Tag = i
+			req.Filename = filename
+			req.Size = uint64(p.PackageSize())
+			sum, err := p.Checksum()
+			if err != nil {
+				Errorf(err, "Error reading checksum for package %v", p)
+				report.addError(err)
+			} else if h, b, err := decodeChecksum(sum, p.ChecksumType()); err != nil {
+				// never download a package which cannot be validated
+				Errorf(err, "Error reading checksum for package %v", p)
+				report.addError(err)
+			} else {
+				// grab validates the download with any hash.Hash, including
+				// algorithms which SetChecksum does not name
+				req.Hash = h
+				req.Checksum = b
+				reqs = append(reqs, req)
+			}
+		}
+	}
+
+	// download missing packages
+	responses := download(reqs, DownloadThreads, c.downloadClient(), c.userAgent())
+
+	// handle each finished package
+	for resp := range responses {
+		if resp.Error != nil {
+			if grab.IsChecksumMismatch(resp.Error) || errors.Is(resp.Error, ErrTooManyRedirects) {
+				failover(packages[resp.Request.Tag.(int)], resp.Filename, resp.Request.Label, resp.Error)
+				continue
+			}
+
+			Errorf(resp.Error, "Error downloading %s", resp.Request.Label)
+			report.addError(resp.Error)
+			continue
+		}
+
+		p := packages[resp.Request.Tag.(int)]
+		if c.checkPackage(p, resp.Filename, resp.Request.Label, resp.BytesTransferred(), keyring, report) {
+			c.state.Add(p, resp.Filename)
+		}
+	}
+
+	return retry
+}
+
+// packageURL returns the URL from which the given package is downloaded from
+// the given base URL, or from the package's own location base, if it has one.
+func (c *Repo) packageURL(p PackageEntry, baseurl string) (string, error) {
+	if p.LocationBase() != "" {
+		baseurl = p.LocationBase()
+	}
+
+	return c.resolveURL(baseurl, p.LocationHref())
+}
+
+// checkPackage validates the RPM magic numbers of a downloaded package if
+// CheckMagic is set and its GPG signature if the repo requires it, re-signs it
+// if ResignKey is set and records the package in the given report. Packages
+// which fail GPG validation are rejected and packages which are not RPM files
+// or cannot be re-signed are deleted, and false is returned.
+func (c *syncRun) checkPackage(p PackageEntry, filename, label string, size uint64, keyring openpgp.KeyRing, report *SyncReport) bool {
+	// reject files which are not packages before reading them as packages
+	if c.CheckMagic {
+		if err := checkPackageMagic(filename); err != nil {
+			Errorf(err, "Invalid package downloaded for %s", label)
+			report.addError(err)
+			os.Remove(filename)
+			return false
+		}
+	}
+
+	// gpg check
+	// TODO: create more gpgcheck threads
+	if c.GPGCheck {
+		if err := c.gpgCheck(filename, keyring); errors.Is(err, ErrGPGFailed) || errors.Is(err, ErrPackageUnsigned) {
+			Errorf(err, "GPG check validation failed for %s", label)
+			report.addError(err)
+
+			// delete or quarantine bad package
+			if err := c.rejectPackage(filename); err != nil {
+				Errorf(err, "Error rejecting %v", label)
+			}
+			return false
+		} else if err != nil {
+			Errorf(err, "Error reading %s for GPG check", label)
+		}
+	}
+
+	// replace upstream signatures only once they have been verified
+	if err := c.resigner.Resign(p, filename); err != nil {
+		Errorf(err, "Error re-signing %s", label)
+		report.addError(err)
+		os.Remove(filename)
+		return false
+	}
+
+	report.Downloaded++
+	report.BytesDownloaded += size
+	return true
+}
+
+// copyPackage hardlinks or copies the given package from the given path in a
+// local repository to the given filename and validates its checksum. The size
+// of the package is returned. Hardlinked packages share storage with the local
+// repository, so packages in the local repository should be replaced rather
+// than modified in place.
+func copyPackage(p PackageEntry, src, dst string) (uint64, error) {
+	Dprintf("Copying %v from %s\n", p, src)
+	n, err := copyFile(dst, src)
+	if err != nil {
+		return 0, err
+	}
+
+	sum, _ := p.Checksum()
+	if err := validateFileChecksum(dst, sum, p.ChecksumType()); err != nil {
+		os.Remove(dst)
+		if errors.Is(err, ErrChecksumMismatch) {
+			return 0, newError(ErrChecksumMismatch, "Package %v copied from %s failed checksum validation: %w", p, src, err)
+		}
+		return 0, err
+	}
+
+	return uint64(n), nil
+}
+
+// updatePackages downloads the given packages, deletes the given package
+// files and rebuilds the repository metadata of the given package directory.
+//
+// If StagingDir is set, the packages are downloaded to the staging directory
+// instead and are only moved into the package directory, along with the new
+// metadata, once every package has been downloaded and validated and the
+// metadata has been created. If any step fails, the package directory is not
+// modified and the staging directory is left for inspection.
+func (c *syncRun) updatePackages(packages PackageEntries, remove []string, packagedir string, keyring openpgp.KeyRing, signer *openpgp.Entity, report *SyncReport) error {
+	if c.stagedir == "" {
+		c.downloadPackages(packages, packagedir, keyring, report)
+		report.Deleted = removePackages(remove)
+
+		changed := report.Downloaded > 0 || report.Deleted > 0 || report.Failed > 0
+		if c.skipCreaterepo(packagedir, changed, signer) {
+			return nil
+		}
+
+		return c.updateRepodata(packagedir, nil, nil, signer)
+	}
+
+	if err := os.MkdirAll(c.stagedir, 0750); err != nil && !os.IsExist(err) {
+		return c.wrapErr(err, "creating staging path %s", c.stagedir)
+	}
+
+	c.downloadPackages(packages, c.stagedir, keyring, report)
+	if report.Failed > 0 {
+		return c.wrapErr(Errors(report.Errors), "staging %d of %d packages in %s", report.Failed, len(packages), c.stagedir)
+	}
+
+	// packages left in the staging directory by a previous sync which failed
+	// are not promoted, as they may no longer be selected upstream
+	staged := stagedPackages(c.stagedir, packages)
+	if c.skipCreaterepo(packagedir, len(staged) > 0 || len(remove) > 0, signer) {
+		return nil
+	}
+
+	if err := c.updateRepodata(packagedir, staged, remove, signer); err != nil {
+		os.RemoveAll(filepath.Join(packagedir, repodataTmpDirname))
+		return err
+	}
+
+	if err := promoteStaged(staged, packagedir); err != nil {
+		return c.wrapErr(err, "promoting staged packages from %s", c.stagedir)
+	}
+
+	report.Deleted = removePackages(remove)
+
+	if err := promoteRepodata(packagedir); err != nil {
+		return c.wrapErr(err, "replacing repository metadata")
+	}
+
+	if err := writeRepodataStamp(packagedir); err != nil {
+		Errorf(err, "Error recording packages in repository metadata for repo %v", c)
+	}
+
+	return nil
+}
+
+// skipCreaterepo returns true if the repository metadata of the given package
+// directory need not be rebuilt, because no packages were changed by the sync
+// and the existing metadata is complete and describes the packages which are
+// in the package directory.
+func (c *syncRun) skipCreaterepo(packagedir string, changed bool, signer *openpgp.Entity) bool {
+	if c.ForceCreaterepo || changed {
+		return false
+	}
+
+	// groups and module metadata may change upstream without any package
+	// changing, as may passthrough metadata, which is compared with the
+	// existing metadata
+	if c.comps != nil || c.modules != nil {
+		return false
+	}
+
+	if !repodataCurrent(packagedir, signer != nil, c.passthrough) {
+		return false
+	}
+
+	Dprintf("No packages changed in %s, skipping createrepo\n", packagedir)
+	return true
+}
+
+// stagedPackages returns the path of each of the given packages which was
+// downloaded to the given staging directory. The result is never nil.
+func stagedPackages(stagedir string, packages PackageEntries) []string {
+	staged := make([]string, 0, len(packages))
+	for _, p := range packages {
+		path := filepath.Join(stagedir, p.filename())
+		if _, err := os.Lstat(path); err == nil {
+			staged = append(staged, path)
+		}
+	}
+
+	return staged
+}
+
+// promoteStaged moves each of the given staged package files into the given
+// package directory, replacing any existing package of the same name. The
+// staging directory must be on the same filesystem as the package directory.
+func promoteStaged(staged []string, packagedir string) error {
+	Dprintf("Promoting %d staged packages to %s\n", len(staged), packagedir)
+	for _, path := range staged {
+		if err := os.Rename(path, filepath.Join(packagedir, filepath.Base(path))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resyncDirname is the subdirectory of a package directory in which packages
+// are staged by a full resync of a repo which has no StagingDir.
+const resyncDirname = ".resync"
+
+// quarantineDirname is the subdirectory of a package directory to which
+// packages are moved when they fail GPG validation and QuarantineOnGPGFail is
+// set.
+const quarantineDirname = ".quarantine"
+
+// rejectPackage removes a package which failed validation from its package
+// directory so it is excluded from the repository metadata. If
+// QuarantineOnGPGFail is set, the package is moved to the quarantine
+// subdirectory for inspection instead of being deleted.
+func (c *Repo) rejectPackage(path string) error {
+	if !c.QuarantineOnGPGFail {
+		return os.Remove(path)
+	}
+
+	dir := filepath.Join(filepath.Dir(path), quarantineDirname)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	Dprintf("Moving %s to %s\n", path, dir)
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
+
+// updateRepodata rebuilds the repository metadata for all packages in the
+// given package directory. If staged is not nil, the given staged package
+// files are included, in place of any package of the same name in the package
+// directory, the given packages to be removed are excluded, and the new
+// metadata is not promoted; the caller must promote the staged packages and
+// remove the excluded packages before calling promoteRepodata.
+func (c *syncRun) updateRepodata(packagedir string, staged, remove []string, signer *openpgp.Entity) error {
+	w, err := createrepo(filepath.Join(packagedir, repodataTmpDirname), signer, c.EmitSQLite)
+	if err != nil {
+		return c.wrapErr(err, "creating repository metadata")
+	}
+	w.comps = c.comps
+	w.modules = c.modules
+	w.passthrough = c.passthrough
+
+	// enumerate package dir
+	rpms, err := filepath.Glob(filepath.Join(packagedir, "/*.rpm"))
+	if err != nil {
+		w.Close()
+		return c.wrapErr(err, "enumerating packages in %s", packagedir)
+	}
+
+	if staged != nil {
+		replaced := make(map[string]bool, len(staged)+len(remove))
+		for _, f := range staged {
+			replaced[filepath.Base(f)] = true
+		}
+
+		for _, f := range remove {
+			replaced[filepath.Base(f)] = true
+		}
+
+		live := rpms
+		rpms = append([]string(nil), staged...)
+		for _, f := range live {
+			if !replaced[filepath.Base(f)] {
+				rpms = append(rpms, f)
+			}
+		}
+	}
+
+	// add to primary db
+	rpms = packageFiles(rpms, c.FollowSymlinks)
+	Dprintf("Inserting %v packages\n", len(rpms))
+	readPackageFiles(rpms, func(_ string, p *rpm.PackageFile) {
+		w.Write(p)
+	})
+
+	if err := w.Close(); err != nil {
+		return c.wrapErr(err, "writing repository metadata")
+	}
+
+	if staged != nil {
+		return nil
+	}
+
+	if err := promoteRepodata(packagedir); err != nil {
+		return c.wrapErr(err, "replacing repository metadata")
+	}
+
+	if err := writeRepodataStamp(packagedir); err != nil {
+		Errorf(err, "Error recording packages in repository metadata for repo %v", c)
+	}
+
+	return nil
+}
@@ -0,0 +1,1884 @@
+package yum
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/cavaliercoder/grab"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncErrorsIncludeRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://127.0.0.1:0/base"
+	repo.GPGCheck = true
+	repo.YumfilePath = "Yumfile"
+	repo.YumfileLineNo = 12
+
+	err = repo.Sync(filepath.Join(dir, "cache"), filepath.Join(dir, "base"))
+	if err == nil {
+		t.Fatalf("Expected an error syncing repo with no GPG key")
+	}
+
+	if !strings.Contains(err.Error(), "repo base (in Yumfile:12)") {
+		t.Errorf("Error does not identify the repo: %v", err)
+	}
+
+	// metadata errors are wrapped with the repo too
+	repo.GPGCheck = false
+	err = repo.Sync(filepath.Join(dir, "cache"), filepath.Join(dir, "base"))
+	if !errors.Is(err, ErrRepoUnavailable) || !strings.Contains(err.Error(), "repo base") {
+		t.Errorf("Expected ErrRepoUnavailable for repo base, got: %v", err)
+	}
+}
+
+func TestSyncLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://127.0.0.1:0/base"
+
+	packagedir := filepath.Join(dir, "base")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := lockDir(packagedir, false)
+	if err != nil {
+		t.Fatalf("Error locking %s: %v", packagedir, err)
+	}
+
+	// fail fast
+	if err := repo.Sync(filepath.Join(dir, "cache"), packagedir); !errors.Is(err, ErrRepoLocked) {
+		t.Errorf("Expected ErrRepoLocked, got: %v", err)
+	}
+
+	// block until the lock is released
+	unlocked := make(chan bool, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlocked <- true
+		lock.Unlock()
+	}()
+
+	repo.LockWait = true
+	err = repo.Sync(filepath.Join(dir, "cache"), packagedir)
+	select {
+	case <-unlocked:
+	default:
+		t.Errorf("Sync did not wait for the lock to be released")
+	}
+
+	if errors.Is(err, ErrRepoLocked) {
+		t.Errorf("Unexpected lock error after lock was released: %v", err)
+	}
+}
+
+func TestAuditPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// write test packages with valid checksums
+	packages := PackageEntries{
+		newTestPackage("valid", "1.0", "x86_64", 0),
+		newTestPackage("corrupt", "1.0", "x86_64", 0),
+		newTestPackage("missing", "1.0", "x86_64", 0),
+		newTestPackage("partial", "1.0", "x86_64", 0),
+	}
+
+	for i := range packages {
+		p := &packages[i]
+		b := []byte(p.String())
+		p.Size.Package = int64(len(b))
+		p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: checksumBytes(t, b).Hash}
+
+		switch p.Name() {
+		case "missing":
+			continue
+
+		case "corrupt":
+			b = []byte(strings.ToUpper(p.String()))
+
+		case "partial":
+			b = b[:4]
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(p.LocationHref())), b, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, corrupt := auditPackages(packages, dir, files)
+	if len(corrupt) != 1 || corrupt[0].Name() != "corrupt" {
+		t.Errorf("Expected only the corrupt package to fail validation, got: %v", corrupt)
+	}
+
+	if len(missing) != 2 || missing[0].Name() != "missing" || missing[1].Name() != "partial" {
+		t.Errorf("Expected the missing and partial packages, got: %v", missing)
+	}
+}
+
+func TestRejectPackage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bad-1.0-1.x86_64.rpm")
+	writeBad := func() {
+		if err := ioutil.WriteFile(path, []byte("bad signature"), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// quarantine
+	writeBad()
+	repo := NewRepo()
+	repo.QuarantineOnGPGFail = true
+	if err := repo.rejectPackage(path); err != nil {
+		t.Fatalf("Error quarantining package: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Quarantined package was not moved out of the package directory")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, quarantineDirname, filepath.Base(path))); err != nil {
+		t.Errorf("Package was not moved to quarantine: %v", err)
+	}
+
+	// delete by default
+	writeBad()
+	repo.QuarantineOnGPGFail = false
+	if err := repo.rejectPackage(path); err != nil {
+		t.Fatalf("Error deleting package: %v", err)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Rejected package was not deleted")
+	}
+}
+
+func TestStagingFailureLeavesPackagesUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagedir := filepath.Join(dir, "base")
+	if err := os.MkdirAll(filepath.Join(packagedir, repodataDirname), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	live := []string{"foo-1.0-1.x86_64.rpm", filepath.Join(repodataDirname, "repomd.xml")}
+	for _, name := range live {
+		if err := ioutil.WriteFile(filepath.Join(packagedir, name), []byte(name), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a package which cannot be requested fails the staged sync
+	p := newTestPackage("bar", "1.0", "x86_64", 0)
+	p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: "not hex"}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "http://127.0.0.1:0/base"
+	repo.StagingDir = filepath.Join(dir, "staging")
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	if err := run.updatePackages(PackageEntries{p}, nil, packagedir, nil, nil, report); err == nil {
+		t.Fatalf("Expected an error staging packages")
+	}
+
+	if report.Failed != 1 {
+		t.Errorf("Expected 1 failed package, got %d", report.Failed)
+	}
+
+	files, err := ioutil.ReadDir(packagedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Errorf("Expected package directory to be unchanged, found %d files", len(files))
+	}
+
+	for _, name := range live {
+		if b, err := ioutil.ReadFile(filepath.Join(packagedir, name)); err != nil || string(b) != name {
+			t.Errorf("Expected %s to be unchanged: %v", name, err)
+		}
+	}
+
+	if _, err := os.Stat(repo.StagingDir); err != nil {
+		t.Errorf("Expected staging directory to be left for inspection: %v", err)
+	}
+}
+
+func TestStagingLeftoversNotPromoted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	packagedir := filepath.Join(dir, "local")
+	for _, path := range []string{filepath.Join(upstream, "Packages"), packagedir} {
+		if err := os.MkdirAll(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// publish writes the given packages upstream, listing each with the
+	// checksum of the given content
+	publish := func(revision int, versions map[string]string, listed map[string][]byte) {
+		primary := fmt.Sprintf(`<metadata packages="%d">`, len(versions))
+		for name, version := range versions {
+			filename := fmt.Sprintf("%s-%s-1.x86_64.rpm", name, version)
+			content := []byte(name + " " + version)
+			if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", filename), content, 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			sum := content
+			if b, ok := listed[name]; ok {
+				sum = b
+			}
+
+			primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="%s" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s"/>
+</package>`, name, version, checksumBytes(t, sum).Hash, len(content), len(content), len(content), filename)
+		}
+		writeTestRepodata(t, upstream, revision, []byte(primary+`</metadata>`))
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.StagingDir = filepath.Join(dir, "staging")
+	repo.EmitSQLite = false
+	repo.ForceRefresh = true
+
+	// bar is corrupt upstream, so the staged sync fails after staging foo
+	publish(1, map[string]string{"foo": "1.0", "bar": "1.0"}, map[string][]byte{"bar": []byte("corrupt")})
+	if err := repo.Sync(filepath.Join(dir, "cache"), packagedir); err == nil {
+		t.Fatalf("Expected an error syncing a corrupt package")
+	}
+
+	if _, err := os.Stat(filepath.Join(repo.StagingDir, "foo-1.0-1.x86_64.rpm")); err != nil {
+		t.Fatalf("Expected foo to be left in the staging directory: %v", err)
+	}
+
+	// foo is updated upstream before the next sync
+	os.Remove(filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm"))
+	publish(2, map[string]string{"foo": "2.0", "bar": "1.0"}, nil)
+	if err := repo.Sync(filepath.Join(dir, "cache"), packagedir); err != nil {
+		t.Fatalf("Error syncing repo: %v", err)
+	}
+
+	for _, name := range []string{"foo-2.0-1.x86_64.rpm", "bar-1.0-1.x86_64.rpm"} {
+		if _, err := os.Stat(filepath.Join(packagedir, name)); err != nil {
+			t.Errorf("Expected %s to be promoted: %v", name, err)
+		}
+	}
+
+	// the leftover of the failed sync is not promoted
+	if _, err := os.Stat(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")); !os.IsNotExist(err) {
+		t.Errorf("Expected package left by the failed sync not to be promoted, got: %v", err)
+	}
+}
+
+func TestSyncFromFileURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// create a local upstream repo
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "repodata"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("foo package")
+	sum := checksumBytes(t, content)
+	if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := []byte(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">` + sum.Hash + `</checksum>
+  <size package="11" installed="11" archive="11"/>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`)
+	compressed := gzipBytes(t, primary)
+	if err := ioutil.WriteFile(filepath.Join(upstream, "repodata", "primary.xml.gz"), compressed, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repomd := &RepoMetadata{
+		Revision: 1,
+		Databases: []RepoDatabase{
+			{
+				Type:         "primary",
+				Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum:     checksumBytes(t, compressed),
+				OpenChecksum: checksumBytes(t, primary),
+			},
+		},
+	}
+
+	f, err := os.Create(filepath.Join(upstream, "repodata", "repomd.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repomd.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// cache metadata and copy packages from the local repo
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatalf("Error caching file:// repo: %v", err)
+	}
+
+	run := newSyncRun(repo)
+	packages, err := run.selectPackages(repocache, "")
+	if err != nil {
+		t.Fatalf("Error reading packages from file:// repo: %v", err)
+	}
+
+	if len(packages) != 1 {
+		t.Fatalf("Expected 1 package, got %d", len(packages))
+	}
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &SyncReport{}
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 || report.BytesDownloaded != uint64(len(content)) {
+		t.Errorf("Unexpected sync report: %+v", report)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")); err != nil || string(b) != string(content) {
+		t.Errorf("Package was not copied from file:// repo: %v", err)
+	}
+
+	// corrupt upstream packages are rejected
+	if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm"), []byte("bar package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	report = &SyncReport{}
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Failed != 1 || !errors.Is(report.Errors[0], ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch, got: %v", report.Errors)
+	}
+}
+
+func TestRetryChecksumMismatchFromMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("foo package")
+	p := newTestPackage("foo", "1.0", "x86_64", 0)
+	sum := checksumBytes(t, content)
+	p.Checksums = PackageEntryChecksum{Type: sum.Type, Hash: sum.Hash}
+	p.Size.Package = int64(len(content))
+
+	// mirror a serves a corrupt package
+	mirrors := make([]string, 0)
+	for mirror, b := range map[string][]byte{"a": []byte("bad package"), "b": content} {
+		path := filepath.Join(dir, mirror, p.LocationHref())
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, b, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		mirrors = append(mirrors, "file://"+filepath.ToSlash(filepath.Join(dir, mirror)))
+	}
+	sort.Strings(mirrors)
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = mirrors[0]
+	repo.Mirrors = mirrors[1:]
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 {
+		t.Errorf("Expected package to be downloaded from mirror b, got: %+v", report)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(packagedir, filepath.Base(p.LocationHref()))); err != nil || string(b) != string(content) {
+		t.Errorf("Expected valid package from mirror b: %v", err)
+	}
+
+	// packages are downloaded first from the mirror which served the metadata
+	os.Remove(filepath.Join(packagedir, filepath.Base(p.LocationHref())))
+	run.mirror = mirrors[1]
+	report = &SyncReport{}
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 || len(report.Errors) != 0 {
+		t.Errorf("Expected package to be downloaded from mirror b only, got: %+v", report)
+	}
+	run.mirror = ""
+
+	// fail once all mirrors are corrupt
+	repo.Mirrors = nil
+	report = &SyncReport{}
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Failed != 1 || !errors.Is(report.Errors[0], ErrChecksumMismatch) {
+		t.Errorf("Expected a checksum mismatch from mirror a, got: %v", report.Errors)
+	}
+}
+
+func TestRetryChecksumMismatchOverHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("foo package")
+	p := newTestPackage("foo", "1.0", "x86_64", 0)
+	sum := checksumBytes(t, content)
+	p.Checksums = PackageEntryChecksum{Type: sum.Type, Hash: sum.Hash}
+	p.Size.Package = int64(len(content))
+
+	// mirror a serves a corrupt package, which fails grab's checksum
+	// validation, and mirror b serves the package
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a/"+p.LocationHref(), func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, "a")
+		w.Write([]byte("bad package"))
+	})
+	mux.HandleFunc("/b/"+p.LocationHref(), func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, "b")
+		w.Write(content)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = srv.URL + "/a"
+	repo.Mirrors = []string{srv.URL + "/b"}
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 {
+		t.Errorf("Expected package to be downloaded from mirror b, got: %+v", report)
+	}
+
+	if strings.Join(requests, ",") != "a,b" {
+		t.Errorf("Expected the package to be requested from mirror a and then mirror b, got: %v", requests)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(packagedir, p.filename())); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("Expected valid package from mirror b: %v", err)
+	}
+}
+
+func TestRetryRedirectLoopFromMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("foo package")
+	p := newTestPackage("foo", "1.0", "x86_64", 0)
+	sum := checksumBytes(t, content)
+	p.Checksums = PackageEntryChecksum{Type: sum.Type, Hash: sum.Hash}
+	p.Size.Package = int64(len(content))
+
+	// mirror a redirects in a loop and mirror b serves the package
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	})
+	mux.HandleFunc("/b/"+p.LocationHref(), func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = srv.URL + "/a"
+	repo.Mirrors = []string{srv.URL + "/b"}
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Downloaded != 1 || report.Failed != 0 {
+		t.Errorf("Expected package to be downloaded from mirror b, got: %+v", report)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(packagedir, filepath.Base(p.LocationHref()))); err != nil || string(b) != string(content) {
+		t.Errorf("Expected valid package from mirror b: %v", err)
+	}
+
+	// fail once every mirror redirects in a loop
+	repo.Mirrors = nil
+	report = &SyncReport{}
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Failed != 1 || !errors.Is(report.Errors[0], ErrTooManyRedirects) {
+		t.Errorf("Expected too many redirects from mirror a, got: %v", report.Errors)
+	}
+}
+
+func TestMixedChecksumTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// upstream packages checksummed with different algorithms
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := `<metadata packages="3">`
+	for _, test := range []struct {
+		name         string
+		checksumType string
+	}{
+		{"foo", "sha"},
+		{"bar", "sha1"},
+		{"baz", "sha256"},
+	} {
+		content := []byte(test.name + " package")
+		sum, err := ComputeChecksum(bytes.NewReader(content), test.checksumType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		filename := test.name + "-1.0-1.x86_64.rpm"
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", filename), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="%s" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s"/>
+</package>`, test.name, test.checksumType, sum, len(content), len(content), len(content), filename)
+	}
+	primary += `</metadata>`
+
+	md, err := ReadPrimaryMetadata(strings.NewReader(primary))
+	if err != nil {
+		t.Fatalf("Error reading primary metadata: %v", err)
+	}
+
+	packages := md.Packages
+	for i, checksumType := range []string{"sha", "sha1", "sha256"} {
+		if packages[i].ChecksumType() != checksumType {
+			t.Errorf("Expected checksum type %s for package %v, got %s", checksumType, packages[i], packages[i].ChecksumType())
+		}
+	}
+
+	// each package is validated with its own checksum type
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Downloaded != 3 || report.Failed != 0 {
+		t.Errorf("Expected all packages to validate, got: %+v", report)
+	}
+
+	files, err := ioutil.ReadDir(packagedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing, corrupt := auditPackages(packages, packagedir, files)
+	if len(missing) != 0 || len(corrupt) != 0 {
+		t.Errorf("Expected all packages to pass audit, got missing: %v, corrupt: %v", missing, corrupt)
+	}
+}
+
+func TestDownloadChecksumTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// packages checksummed with different algorithms are downloaded over HTTP
+	// and validated by grab, and baz is corrupt upstream
+	mux := http.NewServeMux()
+	packages := make(PackageEntries, 0)
+	for _, test := range []struct {
+		name         string
+		checksumType string
+		content      string
+	}{
+		{"foo", "sha", "foo package"},
+		{"bar", "sha1", "bar package"},
+		{"baz", "sha256", "corrupt"},
+		{"qux", "sha512", "qux package"},
+	} {
+		content := []byte(test.name + " package")
+		sum, err := ComputeChecksum(bytes.NewReader(content), test.checksumType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := newTestPackage(test.name, "1.0", "x86_64", 0)
+		p.Checksums = PackageEntryChecksum{Type: test.checksumType, Hash: sum}
+		p.Size.Package = int64(len(content))
+		packages = append(packages, p)
+
+		served := []byte(test.content)
+		mux.HandleFunc("/"+p.LocationHref(), func(w http.ResponseWriter, r *http.Request) {
+			w.Write(served)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = srv.URL
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Downloaded != 3 || report.Failed != 1 {
+		t.Fatalf("Expected 3 packages to validate and 1 to fail, got: %+v", report)
+	}
+
+	if !grab.IsChecksumMismatch(report.Errors[0]) {
+		t.Errorf("Expected a checksum mismatch for the corrupt package, got: %v", report.Errors[0])
+	}
+
+	for _, p := range packages {
+		_, err := os.Stat(filepath.Join(packagedir, p.filename()))
+		if p.Name() == "baz" && !os.IsNotExist(err) {
+			t.Errorf("Expected corrupt package %v to be removed", p)
+		} else if p.Name() != "baz" && err != nil {
+			t.Errorf("Expected package %v to be downloaded: %v", p, err)
+		}
+	}
+}
+
+func TestFailOnPartial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upstream package does not exist
+	p := newTestPackage("foo", "1.0", "x86_64", 0)
+	p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: checksumBytes(t, []byte("foo")).Hash}
+	p.Size.Package = 3
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "file://" + filepath.ToSlash(filepath.Join(dir, "upstream"))
+	if !repo.FailOnPartial {
+		t.Fatalf("Expected FailOnPartial to be set by default")
+	}
+
+	report := &SyncReport{Missing: 1}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, packagedir, nil, report)
+	if report.Failed != 1 {
+		t.Fatalf("Expected 1 failed package, got: %+v", report)
+	}
+
+	err = repo.partialError(report)
+	if err == nil {
+		t.Fatalf("Expected an error for a partial sync")
+	}
+
+	if !strings.Contains(err.Error(), "syncing 1 of 1 packages for repo base") {
+		t.Errorf("Unexpected error for a partial sync: %v", err)
+	}
+
+	repo.FailOnPartial = false
+	if err := repo.partialError(report); err != nil {
+		t.Errorf("Expected no error for a partial sync without FailOnPartial: %v", err)
+	}
+}
+
+func TestSkipCreaterepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	packagedir := filepath.Join(dir, "base")
+	if err := os.MkdirAll(filepath.Join(packagedir, repodataDirname), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm"), []byte("foo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// existing metadata built from the packages in the package directory
+	repomd := []byte(testRepoMetadata)
+	repomdPath := filepath.Join(packagedir, repodataDirname, "repomd.xml")
+	if err := ioutil.WriteFile(repomdPath, repomd, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeRepodataStamp(packagedir); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+
+	// a sync which changes no packages does not rebuild the metadata
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	if err := run.updatePackages(nil, nil, packagedir, nil, nil, report); err != nil {
+		t.Fatalf("Error syncing unchanged packages: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(repomdPath); err != nil || !bytes.Equal(b, repomd) {
+		t.Errorf("Expected repository metadata to be unchanged: %v", err)
+	}
+
+	if !run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo to be skipped for unchanged packages")
+	}
+
+	if run.skipCreaterepo(packagedir, true, nil) {
+		t.Errorf("Expected createrepo for changed packages")
+	}
+
+	repo.ForceCreaterepo = true
+	if run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo with ForceCreaterepo")
+	}
+	repo.ForceCreaterepo = false
+
+	// passthrough metadata is compared with the existing metadata
+	updateinfo := gzipBytes(t, []byte("<updates/>"))
+	if err := ioutil.WriteFile(filepath.Join(packagedir, repodataDirname, "updateinfo.xml.gz"), updateinfo, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	db := RepoDatabase{
+		Type:     "updateinfo",
+		Location: RepoDatabaseLocation{Href: "repodata/updateinfo.xml.gz"},
+		Checksum: checksumBytes(t, updateinfo),
+	}
+
+	buf := &bytes.Buffer{}
+	if err := (&RepoMetadata{Revision: 1, Databases: []RepoDatabase{db}}).Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(repomdPath, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	run.passthrough = []passthroughDatabase{{db: db}}
+	if !run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo to be skipped for unchanged passthrough metadata")
+	}
+
+	run.passthrough[0].db.Checksum = checksumBytes(t, []byte("<updates>changed</updates>"))
+	if run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo for changed passthrough metadata")
+	}
+	run.passthrough = nil
+
+	// packages added outside of the sync are detected
+	if err := ioutil.WriteFile(filepath.Join(packagedir, "bar-1.0-1.x86_64.rpm"), []byte("bar"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo after a package was added")
+	}
+
+	if err := writeRepodataStamp(packagedir); err != nil {
+		t.Fatal(err)
+	}
+
+	// incomplete metadata is rebuilt
+	if err := os.Remove(repomdPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if run.skipCreaterepo(packagedir, false, nil) {
+		t.Errorf("Expected createrepo without a repomd.xml")
+	}
+}
+
+// writeTestRepodata writes a repomd.xml of the given revision and the given
+// primary.xml to the repodata directory of the given repo.
+func writeTestRepodata(t *testing.T, root string, revision int, primary []byte) {
+	writeTestRepodataWith(t, root, revision, primary, func(b []byte) RepoDatabaseChecksum {
+		return checksumBytes(t, b)
+	})
+}
+
+// writeTestRepodataWith writes a repomd.xml and primary.xml as per
+// writeTestRepodata, with the database checksums returned by the given
+// function.
+func writeTestRepodataWith(t *testing.T, root string, revision int, primary []byte, checksum func(b []byte) RepoDatabaseChecksum) {
+	if err := os.MkdirAll(filepath.Join(root, repodataDirname), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := gzipBytes(t, primary)
+	if err := ioutil.WriteFile(filepath.Join(root, repodataDirname, "primary.xml.gz"), compressed, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repomd := &RepoMetadata{
+		Revision: revision,
+		Databases: []RepoDatabase{
+			{
+				Type:         "primary",
+				Location:     RepoDatabaseLocation{Href: "repodata/primary.xml.gz"},
+				Checksum:     checksum(compressed),
+				OpenChecksum: checksum(primary),
+			},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := repomd.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(root, repodataDirname, "repomd.xml"), buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPreserveRepodata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testPrimaryPackage := func(name string, sum string) string {
+		return `<package type="rpm">
+  <name>` + name + `</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">` + sum + `</checksum>
+  <size package="3" installed="3" archive="3"/>
+  <location href="Packages/` + name + `-1.0-1.x86_64.rpm"/>
+</package>`
+	}
+
+	// upstream provides foo and bar
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	sums := make(map[string]string)
+	for _, name := range []string{"foo", "bar"} {
+		content := []byte(name)
+		sums[name] = checksumBytes(t, content).Hash
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestRepodata(t, upstream, 1, []byte(`<metadata packages="2">`+testPrimaryPackage("foo", sums["foo"])+testPrimaryPackage("bar", sums["bar"])+`</metadata>`))
+
+	// the local metadata, built by another tool, is newer but lists only foo
+	// and baz, which has been deleted
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 2, []byte(`<metadata packages="2">`+testPrimaryPackage("foo", sums["foo"])+testPrimaryPackage("baz", sums["foo"])+`</metadata>`))
+
+	before := make(map[string][]byte)
+	for _, name := range []string{"repomd.xml", "primary.xml.gz"} {
+		b, err := ioutil.ReadFile(filepath.Join(packagedir, repodataDirname, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[name] = b
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.PreserveRepodata = true
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err != nil {
+		t.Fatalf("Error syncing with PreserveRepodata: %v", err)
+	}
+
+	if report.Downloaded != 2 {
+		t.Errorf("Expected 2 packages to be downloaded, got %d", report.Downloaded)
+	}
+
+	// the existing metadata is left untouched
+	for name, b := range before {
+		if after, err := ioutil.ReadFile(filepath.Join(packagedir, repodataDirname, name)); err != nil || !bytes.Equal(after, b) {
+			t.Errorf("Expected %s to be unchanged: %v", name, err)
+		}
+	}
+
+	expect := []string{
+		"Package baz-1.0-1.x86_64 is listed in the repository metadata but is missing",
+		"Package file bar-1.0-1.x86_64.rpm is not listed in the repository metadata",
+		"Upstream package bar-1.0-1.x86_64 is not listed in the repository metadata",
+	}
+
+	if strings.Join(report.Drift, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("Unexpected drift:\n%s", strings.Join(report.Drift, "\n"))
+	}
+}
+
+func TestRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	packagedir := filepath.Join(dir, "local")
+	for _, path := range []string{filepath.Join(upstream, "Packages"), packagedir} {
+		if err := os.MkdirAll(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	primary := `<metadata packages="2">`
+	for _, name := range []string{"foo", "bar"} {
+		content := []byte(name + " package")
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, checksumBytes(t, content).Hash, len(content), len(content), len(content), name)
+	}
+	writeTestRepodata(t, upstream, 1, []byte(primary+`</metadata>`))
+
+	// foo is valid and bar is corrupt on disk
+	valid := filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")
+	corrupt := filepath.Join(packagedir, "bar-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(valid, []byte("foo package"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(corrupt, []byte("bar pXckage"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(valid, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.EmitSQLite = false
+
+	report, err := repo.Repair(filepath.Join(dir, "cache"), packagedir)
+	if err != nil {
+		t.Fatalf("Error repairing repo: %v", err)
+	}
+
+	if report.Corrupt != 1 || report.Missing != 0 || report.Downloaded != 1 {
+		t.Errorf("Expected only the corrupt package to be downloaded, got: %+v", report)
+	}
+
+	if b, err := ioutil.ReadFile(corrupt); err != nil || string(b) != "bar package" {
+		t.Errorf("Expected corrupt package to be replaced, got %q: %v", b, err)
+	}
+
+	// the valid package is left untouched
+	after, err := os.Stat(valid)
+	if err != nil {
+		t.Fatalf("Valid package was removed by repair: %v", err)
+	}
+
+	if !os.SameFile(before, after) || !after.ModTime().Equal(mtime) {
+		t.Errorf("Expected valid package not to be replaced or modified by repair")
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, repodataDirname, "repomd.xml")); err != nil {
+		t.Errorf("Expected repository metadata to be rebuilt: %v", err)
+	}
+}
+
+func TestConfirmFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("foo package")
+	if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestRepodata(t, upstream, 1, []byte(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">`+checksumBytes(t, content).Hash+`</checksum>
+  <size package="11" installed="11" archive="11"/>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`))
+
+	var plans []SyncPlan
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.ConfirmFunc = func(plan SyncPlan) bool {
+		plans = append(plans, plan)
+		return false
+	}
+
+	// a declined plan aborts the sync before any download
+	packagedir := filepath.Join(dir, "local")
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if !errors.Is(err, ErrSyncDeclined) {
+		t.Fatalf("Expected ErrSyncDeclined, got: %v", err)
+	}
+
+	if len(plans) != 1 || plans[0].Packages != 1 || plans[0].Bytes != uint64(len(content)) {
+		t.Errorf("Unexpected sync plans: %+v", plans)
+	}
+
+	if report.Downloaded != 0 {
+		t.Errorf("Expected no packages to be downloaded, got %d", report.Downloaded)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")); !os.IsNotExist(err) {
+		t.Errorf("Expected package not to be downloaded after the plan was declined")
+	}
+
+	// AssumeYes skips confirmation (the metadata is preserved so that the
+	// sync completes without createrepo)
+	repo.AssumeYes = true
+	repo.PreserveRepodata = true
+	writeTestRepodata(t, packagedir, 2, []byte(`<metadata packages="0"></metadata>`))
+	if report, err = repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); err != nil {
+		t.Fatalf("Error syncing with AssumeYes: %v", err)
+	}
+
+	if len(plans) != 1 || report.Downloaded != 1 {
+		t.Errorf("Expected package to be downloaded without confirmation, got %d plans and %d downloads", len(plans), report.Downloaded)
+	}
+}
+
+func TestFullResync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(upstream, "Packages", "foo-1.0-1.x86_64.rpm")
+	writeTestPackage(t, path, []rpmHeaderEntry{
+		testHeaderInt(1000, 4, 32),
+	}, []rpmHeaderEntry{
+		testHeaderString(1000, "foo"),
+		testHeaderString(1001, "1.0"),
+		testHeaderString(1002, "1"),
+		testHeaderString(1022, "x86_64"),
+		testHeaderString(1124, "cpio"),
+		testHeaderString(rpmTagPayloadCompressor, "gzip"),
+	}, []byte{0x1f, 0x8b, 0x08, 0x00})
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestRepodata(t, upstream, 1, []byte(fmt.Sprintf(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="4" archive="4"/>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`, checksumBytes(t, content).Hash, len(content))))
+
+	// the local repo already has the valid package
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	local := filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(local, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := os.Stat(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.EmitSQLite = false
+	repo.FullResync = true
+
+	// the existing package is kept if its replacement fails to download
+	if err := ioutil.WriteFile(path, []byte("corrupt"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err == nil || report.Failed != 1 {
+		t.Fatalf("Expected full resync with a corrupt upstream package to fail, got %v: %+v", err, report)
+	}
+
+	if b, err := ioutil.ReadFile(local); err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("Expected existing package to be kept after a failed full resync: %v", err)
+	}
+
+	if repo.StagingDir != "" {
+		t.Errorf("Expected implicit staging directory to be cleared, got %s", repo.StagingDir)
+	}
+
+	// valid packages are replaced by a full resync
+	if err := ioutil.WriteFile(path, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err = repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); err != nil {
+		t.Fatalf("Error syncing with FullResync: %v", err)
+	}
+
+	if report.Downloaded != 1 || report.Corrupt != 0 || report.Missing != 0 {
+		t.Errorf("Expected valid package to be downloaded again, got: %+v", report)
+	}
+
+	after, err := os.Stat(local)
+	if err != nil {
+		t.Fatalf("Package was not replaced by full resync: %v", err)
+	}
+
+	if os.SameFile(before, after) {
+		t.Errorf("Expected package to be replaced by full resync")
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, resyncDirname)); !os.IsNotExist(err) {
+		t.Errorf("Expected staging directory of the full resync to be removed, got %v", err)
+	}
+}
+
+func TestFilenameFunc(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// an upstream package which is not named by its NEVRA
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(upstream, "Packages", "test.rpm")
+	writeTestPackage(t, path, []rpmHeaderEntry{
+		testHeaderInt(1000, 4, 32),
+	}, []rpmHeaderEntry{
+		testHeaderString(1000, "test"),
+		testHeaderString(1001, "1.0"),
+		testHeaderString(1002, "1"),
+		testHeaderString(1022, "x86_64"),
+		testHeaderString(1124, "cpio"),
+		testHeaderString(rpmTagPayloadCompressor, "gzip"),
+	}, []byte{0x1f, 0x8b, 0x08, 0x00})
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestRepodata(t, upstream, 1, []byte(fmt.Sprintf(`<metadata packages="1"><package type="rpm">
+  <name>test</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="4" archive="4"/>
+  <location href="Packages/test.rpm"/>
+</package></metadata>`, checksumBytes(t, b).Hash, len(b))))
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.FilenameFunc = func(p PackageEntry) string {
+		return p.String() + ".rpm"
+	}
+
+	repocache, err := repo.CacheLocal(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repocache.Close()
+
+	run := newSyncRun(repo)
+	packages, err := run.selectPackages(repocache, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packagedir := filepath.Join(dir, "local")
+	if err := os.MkdirAll(packagedir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	report := &SyncReport{}
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Downloaded != 1 {
+		t.Fatalf("Expected 1 package to be downloaded: %+v", report)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "test-1.0-1.x86_64.rpm")); err != nil {
+		t.Fatalf("Expected package to be saved by NEVRA: %v", err)
+	}
+
+	// the generated metadata locates the package by its new filename
+	if err := run.updateRepodata(packagedir, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenPrimaryDB(filepath.Join(packagedir, repodataDirname, "gen", "primary_db.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	listed, err := db.Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 1 || listed[0].LocationHref() != "test-1.0-1.x86_64.rpm" {
+		t.Errorf("Expected package to be located at test-1.0-1.x86_64.rpm, got %v", listed)
+	}
+
+	// a sync of the renamed package downloads nothing
+	files, err := ioutil.ReadDir(packagedir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if missing, corrupt := auditPackages(packages, packagedir, files); len(missing) != 0 || len(corrupt) != 0 {
+		t.Errorf("Expected renamed package to be found, got %d missing and %d corrupt", len(missing), len(corrupt))
+	}
+}
+
+func TestFilenameFuncCollision(t *testing.T) {
+	repo := NewRepo()
+	repo.FilenameFunc = func(p PackageEntry) string {
+		return p.Name() + ".rpm"
+	}
+
+	packages := PackageEntries{
+		newTestPackage("foo", "1.0", "x86_64", 0),
+		newTestPackage("foo", "1.1", "x86_64", 0),
+	}
+
+	if err := repo.nameFiles(packages); err == nil || !strings.Contains(err.Error(), "have the same filename: foo.rpm") {
+		t.Errorf("Expected an error for packages with the same filename, got: %v", err)
+	}
+
+	repo.FilenameFunc = func(p PackageEntry) string {
+		return "../" + p.String() + ".rpm"
+	}
+
+	if err := repo.nameFiles(packages[:1]); err == nil {
+		t.Errorf("Expected an error for a filename outside of the package directory")
+	}
+
+	repo.FilenameFunc = func(p PackageEntry) string {
+		return p.String() + ".rpm"
+	}
+
+	if err := repo.nameFiles(packages); err != nil {
+		t.Fatal(err)
+	}
+
+	if name := packages[1].filename(); name != "foo-1.1-1.x86_64.rpm" {
+		t.Errorf("Expected package to be named foo-1.1-1.x86_64.rpm, got %s", name)
+	}
+}
+
+func TestFrozen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("foo")
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 1, []byte(`<metadata packages="1"><package type="rpm">
+  <name>foo</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">`+checksumBytes(t, content).Hash+`</checksum>
+  <size package="3" installed="3" archive="3"/>
+  <location href="Packages/foo-1.0-1.x86_64.rpm"/>
+</package></metadata>`))
+
+	path := filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(path, content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upstream repository does not exist, so any request fails
+	repo := NewRepo()
+	repo.ID = "frozen"
+	repo.BaseURL = "file://" + filepath.ToSlash(filepath.Join(dir, "upstream"))
+	repo.Frozen = true
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err != nil {
+		t.Fatalf("Error syncing frozen repo: %v", err)
+	}
+
+	if report.Packages != 1 || report.Downloaded != 0 {
+		t.Errorf("Expected 1 package to be verified and none downloaded, got %d and %d", report.Packages, report.Downloaded)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "cache")); !os.IsNotExist(err) {
+		t.Errorf("Expected no metadata to be cached for a frozen repo")
+	}
+
+	// a corrupt package fails verification but is neither deleted nor
+	// downloaded again
+	if err := ioutil.WriteFile(path, []byte("bar"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err == nil {
+		t.Fatalf("Expected an error verifying a corrupt package")
+	}
+
+	if len(report.Errors) != 1 || !errors.Is(report.Errors[0], ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch, got: %v", report.Errors)
+	}
+
+	if report.Corrupt != 1 || report.Downloaded != 0 {
+		t.Errorf("Expected 1 corrupt package and none downloaded, got %d and %d", report.Corrupt, report.Downloaded)
+	}
+
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "bar" {
+		t.Errorf("Expected corrupt package to be left in place: %v", err)
+	}
+
+	// a frozen repo without metadata cannot be verified
+	if _, err := repo.sync(filepath.Join(dir, "cache"), filepath.Join(dir, "empty"), syncOptions{}); err == nil {
+		t.Errorf("Expected an error verifying a frozen repo without metadata")
+	}
+}
+
+func TestSeparateDebugRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := `<metadata packages="2">`
+	for _, name := range []string{"test", "test-debuginfo"} {
+		path := filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm")
+		writeTestPackage(t, path, []rpmHeaderEntry{
+			testHeaderInt(1000, 4, 32),
+		}, []rpmHeaderEntry{
+			testHeaderString(1000, name),
+			testHeaderString(1001, "1.0"),
+			testHeaderString(1002, "1"),
+			testHeaderString(1022, "x86_64"),
+			testHeaderString(1124, "cpio"),
+			testHeaderString(rpmTagPayloadCompressor, "gzip"),
+		}, []byte{0x1f, 0x8b, 0x08, 0x00})
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="4" archive="4"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, checksumBytes(t, b).Hash, len(b), name)
+	}
+	writeTestRepodata(t, upstream, 1, []byte(primary+`</metadata>`))
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.SeparateDebugRepo = true
+
+	packagedir := filepath.Join(dir, "local")
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err != nil {
+		t.Fatalf("Error syncing with SeparateDebugRepo: %v", err)
+	}
+
+	if report.Packages != 2 || report.Downloaded != 2 {
+		t.Errorf("Expected 2 packages to be downloaded, got %d of %d", report.Downloaded, report.Packages)
+	}
+
+	// each repo lists only its own packages
+	for _, test := range []struct {
+		dir  string
+		name string
+	}{
+		{packagedir, "test"},
+		{filepath.Join(packagedir, debugRepoDirname), "test-debuginfo"},
+	} {
+		if _, err := os.Stat(filepath.Join(test.dir, test.name+"-1.0-1.x86_64.rpm")); err != nil {
+			t.Errorf("Expected package %s in %s: %v", test.name, test.dir, err)
+		}
+
+		db, err := OpenPrimaryDB(filepath.Join(test.dir, repodataDirname, "gen", "primary_db.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listed, err := db.Packages()
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(listed) != 1 || listed[0].Name() != test.name {
+			t.Errorf("Expected only %s in the repository metadata of %s, got %v", test.name, test.dir, listed)
+		}
+	}
+}
+
+func TestSeparateDebugRepoPlan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := `<metadata packages="2">`
+	for _, name := range []string{"test", "test-debuginfo"} {
+		content := []byte(name + " package")
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), content, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, checksumBytes(t, content).Hash, len(content), len(content), len(content), name)
+	}
+	writeTestRepodata(t, upstream, 1, []byte(primary+`</metadata>`))
+
+	var plans []SyncPlan
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.EmitSQLite = false
+	repo.SeparateDebugRepo = true
+	repo.StagingDir = filepath.Join(dir, "staging")
+	repo.ConfirmFunc = func(plan SyncPlan) bool {
+		plans = append(plans, plan)
+		return true
+	}
+
+	packagedir := filepath.Join(dir, "local")
+	report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{})
+	if err != nil {
+		t.Fatalf("Error syncing with SeparateDebugRepo: %v", err)
+	}
+
+	// one plan covers the packages of both repos
+	if len(plans) != 1 || plans[0].Packages != 2 {
+		t.Errorf("Expected one plan for 2 packages, got %+v", plans)
+	}
+
+	if report.Packages != 2 || report.Downloaded != 2 {
+		t.Errorf("Expected 2 packages to be downloaded, got %d of %d", report.Downloaded, report.Packages)
+	}
+
+	// each repo is staged, and has its own metadata and manifest
+	debugdir := filepath.Join(packagedir, debugRepoDirname)
+	for _, test := range []struct {
+		dir      string
+		stagedir string
+		name     string
+	}{
+		{packagedir, repo.StagingDir, "test"},
+		{debugdir, filepath.Join(repo.StagingDir, debugRepoDirname), "test-debuginfo"},
+	} {
+		if _, err := os.Stat(filepath.Join(test.dir, test.name+"-1.0-1.x86_64.rpm")); err != nil {
+			t.Errorf("Expected package %s in %s: %v", test.name, test.dir, err)
+		}
+
+		if staged, _ := filepath.Glob(filepath.Join(test.stagedir, "*.rpm")); len(staged) != 0 {
+			t.Errorf("Expected staged packages to be promoted from %s, got %v", test.stagedir, staged)
+		}
+
+		if _, err := os.Stat(filepath.Join(test.dir, repodataDirname, "repomd.xml")); err != nil {
+			t.Errorf("Expected repository metadata in %s: %v", test.dir, err)
+		}
+
+		manifest, err := ReadSyncManifest(filepath.Join(test.dir, manifestFilename))
+		if err != nil {
+			t.Fatalf("Error reading sync manifest: %v", err)
+		}
+
+		if len(manifest.Packages) != 1 || manifest.Packages[0].Name != test.name {
+			t.Errorf("Expected only %s in the sync manifest of %s, got %v", test.name, test.dir, manifest.Packages)
+		}
+	}
+}
+
+func TestCheckMagic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	packagedir := filepath.Join(dir, "local")
+	for _, path := range []string{upstream, packagedir} {
+		if err := os.MkdirAll(path, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the error page is listed with its own size and checksum
+	writeTestPackage(t, filepath.Join(upstream, "foo-1.0-1.x86_64.rpm"), nil, nil, []byte("foo package"))
+	if err := ioutil.WriteFile(filepath.Join(upstream, "bar-1.0-1.x86_64.rpm"), bytes.Repeat([]byte("<html>Not Found</html>\n"), 10), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	packages := make(PackageEntries, 0)
+	for _, name := range []string{"foo", "bar"} {
+		p := newTestPackage(name, "1.0", "x86_64", 0)
+		b, err := ioutil.ReadFile(filepath.Join(upstream, p.filename()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := checksumBytes(t, b)
+		p.Checksums = PackageEntryChecksum{Type: sum.Type, Hash: sum.Hash}
+		p.Size.Package = int64(len(b))
+		p.Location.Href = p.filename()
+		packages = append(packages, p)
+	}
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.CheckMagic = true
+
+	report := &SyncReport{}
+	run := newSyncRun(repo)
+	run.downloadPackages(packages, packagedir, nil, report)
+	if report.Downloaded != 1 || len(report.Errors) != 1 || !errors.Is(report.Errors[0], ErrInvalidPackage) {
+		t.Errorf("Expected file which is not a package to be rejected, got: %+v", report)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "foo-1.0-1.x86_64.rpm")); err != nil {
+		t.Errorf("Expected valid package to be kept: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(packagedir, "bar-1.0-1.x86_64.rpm")); !os.IsNotExist(err) {
+		t.Errorf("Expected file which is not a package to be removed: %v", err)
+	}
+}
+
+func TestCheckFilesystems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the staging directory is mounted from another device
+	staging := filepath.Join(dir, "staging")
+	defer func(f func(string) (uint64, error)) { pathDevice = f }(pathDevice)
+	pathDevice = func(path string) (uint64, error) {
+		if strings.HasPrefix(path, staging) {
+			return 2, nil
+		}
+		return 1, nil
+	}
+
+	if err := os.MkdirAll(staging, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "test"
+	repo.BaseURL = "file://" + filepath.ToSlash(filepath.Join(dir, "upstream"))
+	repo.StagingDir = filepath.Join(staging, "test")
+
+	// the staging directory need not exist yet
+	if same, err := sameFilesystem(repo.StagingDir, filepath.Join(dir, "packages")); err != nil || same {
+		t.Fatalf("Expected staging directory on another filesystem, got %v, %v", same, err)
+	}
+
+	// the sync fails before the upstream repository is read
+	packagedir := filepath.Join(dir, "packages")
+	if err := repo.Sync(filepath.Join(dir, "cache"), packagedir); !errors.Is(err, ErrCrossDevice) {
+		t.Errorf("Expected ErrCrossDevice error, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "cache")); !os.IsNotExist(err) {
+		t.Errorf("Expected sync to fail before caching metadata, got %v", err)
+	}
+
+	// packages on the same filesystem may be staged
+	repo.StagingDir = filepath.Join(dir, "staging-local")
+	if err := repo.checkFilesystems(packagedir); err != nil {
+		t.Errorf("Expected staging directory on the same filesystem to be accepted, got %v", err)
+	}
+
+	// file:// upstream repositories on another filesystem are copied
+	repo.BaseURL = "file://" + filepath.ToSlash(staging)
+	if err := repo.checkFilesystems(packagedir); err != nil {
+		t.Errorf("Expected upstream repository on another filesystem to be accepted, got %v", err)
+	}
+}
+
+func TestManifestAfterFailedSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	if err := os.MkdirAll(filepath.Join(upstream, "Packages"), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	primary := `<metadata packages="2">`
+	for _, name := range []string{"foo", "bar"} {
+		content := []byte(name + " package")
+		primary += fmt.Sprintf(`<package type="rpm">
+  <name>%s</name>
+  <arch>x86_64</arch>
+  <version epoch="0" ver="1.0" rel="1"/>
+  <checksum type="sha256" pkgid="YES">%s</checksum>
+  <size package="%d" installed="%d" archive="%d"/>
+  <location href="Packages/%s-1.0-1.x86_64.rpm"/>
+</package>`, name, checksumBytes(t, content).Hash, len(content), len(content), len(content), name)
+	}
+	primary += `</metadata>`
+	writeTestRepodata(t, upstream, 1, []byte(primary))
+
+	// foo is valid but bar is corrupt upstream
+	writePackage := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(upstream, "Packages", name+"-1.0-1.x86_64.rpm"), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePackage("foo", "foo package")
+	writePackage("bar", "corrupt")
+
+	// the metadata is preserved so that the sync completes without createrepo
+	packagedir := filepath.Join(dir, "local")
+	writeTestRepodata(t, packagedir, 2, []byte(primary))
+
+	manifestPath := filepath.Join(packagedir, manifestFilename)
+	previous := &SyncManifest{Repo: "local", Created: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), Packages: []ManifestPackage{}}
+	if err := previous.WriteFile(manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := NewRepo()
+	repo.ID = "local"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.PreserveRepodata = true
+	repo.GenerateChangelog = true
+
+	if report, _ := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); report.Failed != 1 {
+		t.Fatalf("Expected sync with a corrupt package to fail, got: %+v", report)
+	}
+
+	// the previous manifest is kept and no changelog is written
+	if manifest, err := ReadSyncManifest(manifestPath); err != nil || !manifest.Created.Equal(previous.Created) {
+		t.Fatalf("Expected previous manifest to be kept after a failed sync, got %v: %v", manifest, err)
+	}
+
+	if changes, _ := filepath.Glob(filepath.Join(packagedir, changelogPrefix+"*")); len(changes) != 0 {
+		t.Errorf("Expected no changelog after a failed sync, got %v", changes)
+	}
+
+	// the next complete sync lists the packages added by both syncs
+	writePackage("bar", "bar package")
+	if report, err := repo.sync(filepath.Join(dir, "cache"), packagedir, syncOptions{}); err != nil || report.Failed != 0 {
+		t.Fatalf("Error syncing: %v: %+v", err, report)
+	}
+
+	changes, _ := filepath.Glob(filepath.Join(packagedir, changelogPrefix+"*"))
+	if len(changes) != 1 {
+		t.Fatalf("Expected one changelog, got %v", changes)
+	}
+
+	b, err := ioutil.ReadFile(changes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(b), "0 updated, 2 added, 0 removed") {
+		t.Errorf("Expected both packages to be listed as added, got:\n%s", b)
+	}
+}
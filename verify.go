@@ -0,0 +1,218 @@
+package yum
+
+import (
+	"fmt"
+	"golang.org/x/crypto/openpgp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// readRepodata returns the repository metadata in the given package
+// directory, or nil if the package directory has no valid metadata.
+func readRepodata(packagedir string) *RepoMetadata {
+	f, err := os.Open(filepath.Join(packagedir, repodataDirname, "repomd.xml"))
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	repomd, err := ReadRepoMetadata(f)
+	if err != nil {
+		return nil
+	}
+
+	return repomd
+}
+
+// repodataPackages returns the packages listed in the primary database of the
+// given repository metadata in the given package directory, preferring the XML
+// primary database, which need not be decompressed to a file.
+func repodataPackages(packagedir string, repomd *RepoMetadata) (PackageEntries, error) {
+	db := repomd.Database("primary", "primary_db")
+	if db == nil {
+		return nil, fmt.Errorf("No primary database found in %s", filepath.Join(packagedir, repodataDirname))
+	}
+
+	path := filepath.Join(packagedir, filepath.FromSlash(db.Location.Href))
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z, err := decompressor(f, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !db.IsSQLite() {
+		md, err := ReadPrimaryMetadata(z)
+		if err != nil {
+			return nil, err
+		}
+
+		return md.Packages, nil
+	}
+
+	// sqlite databases must be decompressed to a temporary file to be read
+	tmp, err := ioutil.TempFile(DefaultTempDir, "go-yum-primary-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, z); err != nil {
+		return nil, fmt.Errorf("Error decompressing %v database: %v", db, err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	primarydb, err := OpenPrimaryDB(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	defer primarydb.Close()
+
+	return primarydb.Packages()
+}
+
+// repodataDrift compares the given repository metadata in the given package
+// directory with the packages in the package directory and the given packages
+// selected from the upstream repository. It returns a description of each
+// inconsistency, such as a package which is listed in the metadata but missing
+// from the package directory, or a selected package which the metadata does
+// not list.
+func repodataDrift(packagedir string, repomd *RepoMetadata, selected PackageEntries) ([]string, error) {
+	listed, err := repodataPackages(packagedir, repomd)
+	if err != nil {
+		return nil, err
+	}
+
+	drift := make([]string, 0)
+	index := make(map[string]PackageEntry, len(listed))
+	for _, p := range listed {
+		filename := p.filename()
+		index[filename] = p
+
+		fi, err := os.Stat(filepath.Join(packagedir, filename))
+		if os.IsNotExist(err) {
+			drift = append(drift, fmt.Sprintf("Package %v is listed in the repository metadata but is missing", p))
+		} else if err != nil {
+			return nil, err
+		} else if p.PackageSize() > 0 && fi.Size() != p.PackageSize() {
+			drift = append(drift, fmt.Sprintf("Package %v is %d bytes but is listed in the repository metadata as %d bytes", p, fi.Size(), p.PackageSize()))
+		}
+	}
+
+	rpms, err := filepath.Glob(filepath.Join(packagedir, "*.rpm"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range rpms {
+		if _, ok := index[filepath.Base(path)]; !ok {
+			drift = append(drift, fmt.Sprintf("Package file %s is not listed in the repository metadata", filepath.Base(path)))
+		}
+	}
+
+	for _, p := range selected {
+		l, ok := index[p.filename()]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("Upstream package %v is not listed in the repository metadata", p))
+			continue
+		}
+
+		sum, _ := p.Checksum()
+		lsum, _ := l.Checksum()
+		if p.ChecksumType() == l.ChecksumType() && sum != lsum {
+			drift = append(drift, fmt.Sprintf("Upstream package %v has a different checksum in the repository metadata", p))
+		}
+	}
+
+	sort.Strings(drift)
+	return drift, nil
+}
+
+// verifyRepodata downloads and validates the given missing and corrupt
+// packages without deleting any package or modifying the existing repository
+// metadata in the given package directory, and records each inconsistency
+// between the existing metadata, the package directory and the given packages
+// selected from the upstream repository in the given report. If StagingDir is
+// set, the packages are only moved into the package directory once every
+// package has been downloaded.
+func (c *syncRun) verifyRepodata(packages, selected PackageEntries, packagedir string, repomd *RepoMetadata, keyring openpgp.KeyRing, report *SyncReport) error {
+	if c.stagedir == "" {
+		c.downloadPackages(packages, packagedir, keyring, report)
+	} else {
+		if err := os.MkdirAll(c.stagedir, 0750); err != nil && !os.IsExist(err) {
+			return c.wrapErr(err, "creating staging path %s", c.stagedir)
+		}
+
+		c.downloadPackages(packages, c.stagedir, keyring, report)
+		if report.Failed > 0 {
+			return c.wrapErr(Errors(report.Errors), "staging %d of %d packages in %s", report.Failed, len(packages), c.stagedir)
+		}
+
+		if err := promoteStaged(stagedPackages(c.stagedir, packages), packagedir); err != nil {
+			return c.wrapErr(err, "promoting staged packages from %s", c.stagedir)
+		}
+	}
+
+	drift, err := repodataDrift(packagedir, repomd, selected)
+	if err != nil {
+		return c.wrapErr(err, "comparing repository metadata")
+	}
+
+	for _, d := range drift {
+		Printf("Repository metadata drift in repo %v: %s\n", c, d)
+	}
+	report.Drift = drift
+
+	return nil
+}
+
+// verifyFrozen validates each package listed in the existing repository
+// metadata in the given package directory against the checksum in the
+// metadata, and records each package which is missing or corrupt in the given
+// report. Nothing is downloaded or deleted.
+func (c *Repo) verifyFrozen(packagedir string, report *SyncReport) error {
+	repomd := readRepodata(packagedir)
+	if repomd == nil {
+		return c.wrapErr(fmt.Errorf("No repository metadata found in %s", filepath.Join(packagedir, repodataDirname)), "verifying frozen repo")
+	}
+
+	listed, err := repodataPackages(packagedir, repomd)
+	if err != nil {
+		return c.wrapErr(err, "reading packages from repository metadata")
+	}
+
+	files, err := readPackageDir(packagedir, c.FollowSymlinks)
+	if err != nil {
+		return c.wrapErr(err, "reading packages in %s", packagedir)
+	}
+
+	Dprintf("Verifying %d packages in frozen repo %v\n", len(listed), c)
+	missing, corrupt := auditPackages(listed, packagedir, files)
+	report.Packages = len(listed)
+	report.Missing = len(missing)
+	report.Corrupt = len(corrupt)
+
+	for _, p := range missing {
+		err := fmt.Errorf("Package %v is missing from frozen repo %v", p, c)
+		Errorf(err, "Error verifying package %v", p)
+		report.addError(err)
+	}
+	for _, p := range corrupt {
+		err := newError(ErrChecksumMismatch, "Package %v failed validation in frozen repo %v", p, c)
+		Errorf(err, "Error verifying package %v", p)
+		report.addError(err)
+	}
+
+	return nil
+}
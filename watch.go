@@ -0,0 +1,159 @@
+package yum
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// WatchSync validates the given repos and then, until the given context is
+// done, checks the repomd.xml of each enabled repo upstream at the given
+// interval and synchronizes the repo, as with SyncAll, whenever the revision
+// or content of its repomd.xml changes. Each repo is synchronized when it is
+// first checked.
+//
+// A repo is checked no more often than its MetadataExpire, and a repo whose
+// metadata never expires is synchronized only once. Syncs triggered by a change
+// upstream refresh the metadata, as with ForceRefresh, so that the changed
+// revision is synchronized rather than the cached metadata. A repo which cannot
+// be checked or fails to synchronize is logged and checked again at the next
+// interval, without stopping the other repos from being watched.
+//
+// WatchSync returns the error of the context once it is done.
+func WatchSync(repos []*Repo, cachedir string, interval time.Duration, ctx context.Context) error {
+	for _, repo := range repos {
+		if err := repo.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if interval <= 0 {
+		return NewErrorf("Watch interval must be positive: %v", interval)
+	}
+
+	w := newWatcher(repos, cachedir)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// watcher records the upstream revision of each repo watched by WatchSync
+// when it was last synchronized.
+type watcher struct {
+	repos     []*Repo
+	cachedir  string
+	revisions map[*Repo]string
+	checked   map[*Repo]time.Time
+
+	now  func() time.Time
+	sync func(repo *Repo, cachedir, packagedir string) error
+}
+
+func newWatcher(repos []*Repo, cachedir string) *watcher {
+	return &watcher{
+		repos:     repos,
+		cachedir:  cachedir,
+		revisions: make(map[*Repo]string),
+		checked:   make(map[*Repo]time.Time),
+		now:       time.Now,
+		sync:      (*Repo).Sync,
+	}
+}
+
+// poll checks each enabled repo whose metadata has expired since it was last
+// checked successfully and synchronizes each repo whose upstream revision has
+// changed since it was last synchronized.
+func (c *watcher) poll(ctx context.Context) {
+	now := c.now()
+	for _, repo := range c.repos {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if !repo.Enabled {
+			continue
+		}
+
+		if checked, ok := c.checked[repo]; ok {
+			if repo.MetadataExpire < 0 || now.Sub(checked) < repo.MetadataExpire {
+				continue
+			}
+		}
+
+		revision, err := repo.upstreamRevision()
+		if err != nil {
+			Errorf(err, "Error checking repo %v for changes", repo)
+			continue
+		}
+
+		if previous, ok := c.revisions[repo]; ok && previous == revision {
+			Dprintf("Repo %v is unchanged upstream\n", repo)
+			c.checked[repo] = now
+			continue
+		}
+
+		Printf("Repo %v changed upstream, syncing\n", repo)
+		repocachedir, packagedir := repo.syncDirs(c.cachedir)
+		if err := c.forceSync(repo, repocachedir, packagedir); err != nil {
+			Errorf(err, "Error syncing repo %v", repo)
+			continue
+		}
+
+		c.revisions[repo] = revision
+		c.checked[repo] = now
+	}
+}
+
+// forceSync synchronizes the given repo with ForceRefresh set, so that the
+// revision found by poll is not masked by cached metadata.
+func (c *watcher) forceSync(repo *Repo, cachedir, packagedir string) error {
+	forceRefresh := repo.ForceRefresh
+	repo.ForceRefresh = true
+	defer func() { repo.ForceRefresh = forceRefresh }()
+
+	return c.sync(repo, cachedir, packagedir)
+}
+
+// upstreamRevision returns a string which identifies the revision and the
+// content of the repomd.xml of the upstream repository, so that a change of
+// either may be detected.
+func (c *Repo) upstreamRevision() (string, error) {
+	if err := c.ResolveMirrors(); err != nil {
+		return "", err
+	}
+
+	url, err := c.resolveURL(c.repoURL(c.BaseURL), "/repodata/repomd.xml")
+	if err != nil {
+		return "", err
+	}
+
+	body, err := c.openMetadataURL(url)
+	if err != nil {
+		return "", newError(ErrRepoUnavailable, "Error retrieving repo metadata from URL: %w", err)
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", newError(ErrMetadataFetch, "Error reading repo metadata: %w", err)
+	}
+
+	repomd, err := ReadRepoMetadata(bytes.NewReader(b))
+	if err != nil {
+		return "", newError(ErrMetadataFetch, "Error decoding repo metadata: %w", err)
+	}
+
+	return fmt.Sprintf("%d %x", repomd.Revision, sha256.Sum256(b)), nil
+}
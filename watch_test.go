@@ -0,0 +1,101 @@
+package yum
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	upstream := filepath.Join(dir, "upstream")
+	writeTestRepodata(t, upstream, 1, []byte(`<metadata packages="0"></metadata>`))
+
+	repo := NewRepo()
+	repo.ID = "base"
+	repo.BaseURL = "file://" + filepath.ToSlash(upstream)
+	repo.LocalPath = filepath.Join(dir, "local")
+	repo.MetadataExpire = time.Hour
+
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	synced := 0
+	w := newWatcher([]*Repo{repo}, dir)
+	w.now = func() time.Time { return now }
+	w.sync = func(r *Repo, cachedir, packagedir string) error {
+		if r != repo || packagedir != repo.LocalPath {
+			t.Errorf("Unexpected sync of repo %v to %s", r, packagedir)
+		}
+		if !r.ForceRefresh {
+			t.Errorf("Expected cached metadata to be refreshed by sync")
+		}
+		synced++
+		return nil
+	}
+
+	// the repo is synced when it is first checked, and not again until it
+	// changes upstream
+	ctx := context.Background()
+	w.poll(ctx)
+	now = now.Add(time.Hour)
+	w.poll(ctx)
+	if synced != 1 {
+		t.Fatalf("Expected one sync of unchanged repo, got %d", synced)
+	}
+
+	if repo.ForceRefresh {
+		t.Errorf("Expected ForceRefresh to be restored after sync")
+	}
+
+	// changes are not checked until the metadata expires
+	writeTestRepodata(t, upstream, 2, []byte(`<metadata packages="0"></metadata>`))
+	now = now.Add(30 * time.Minute)
+	w.poll(ctx)
+	if synced != 1 {
+		t.Fatalf("Expected no sync before metadata expires, got %d", synced)
+	}
+
+	now = now.Add(30 * time.Minute)
+	w.poll(ctx)
+	now = now.Add(time.Hour)
+	w.poll(ctx)
+	if synced != 2 {
+		t.Errorf("Expected exactly one sync of changed revision, got %d", synced)
+	}
+
+	// failed syncs are retried at the next interval
+	writeTestRepodata(t, upstream, 3, []byte(`<metadata packages="0"></metadata>`))
+	w.sync = func(r *Repo, cachedir, packagedir string) error {
+		synced++
+		if synced == 3 {
+			return errors.New("Sync failed")
+		}
+		return nil
+	}
+
+	now = now.Add(time.Hour)
+	w.poll(ctx)
+	now = now.Add(time.Minute)
+	w.poll(ctx)
+	now = now.Add(time.Minute)
+	w.poll(ctx)
+	if synced != 4 {
+		t.Errorf("Expected failed sync to be retried once, got %d syncs", synced)
+	}
+
+	// the watch stops once the context is done
+	repo.Enabled = false
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := WatchSync([]*Repo{repo}, dir, time.Millisecond, ctx); err != context.Canceled {
+		t.Errorf("Expected context error from WatchSync, got: %v", err)
+	}
+}
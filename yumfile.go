@@ -0,0 +1,578 @@
+package yum
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"code.cloudfoundry.org/bytefmt"
+)
+
+// Yumfile sections with special meaning. Options in the main section are
+// inherited by every repo which does not override them, except for include,
+// which lists other Yumfiles to load, and exclude, which excludes packages
+// from every repo unless the repo's includepkgs matches them. Options in the vars section define variables which may be
+// substituted into any option value as $name or ${name}.
+const (
+	yumfileMainSection = "main"
+	yumfileVarsSection = "vars"
+)
+
+// yumfile is a parsed Yumfile, including any included Yumfiles, with
+// inherited options and variables resolved.
+type yumfile struct {
+	Repos   []*Repo
+	Exclude []string
+
+	// inherited lists the options of each repo which were inherited from the
+	// main section.
+	inherited map[*Repo]map[string]bool
+}
+
+// readYumfileSections reads the sections of the Yumfile at the given path,
+// followed by the sections of each Yumfile it includes. Relative includes are
+// resolved against the directory of the including Yumfile.
+//
+// The given map records the absolute path of each Yumfile which was read, and
+// is true for each Yumfile on the include stack, which is still being read. A
+// Yumfile which includes itself, directly or indirectly, is an error, while a
+// Yumfile which was already read, such as one included by two others, is
+// skipped.
+func readYumfileSections(path string, seen map[string]bool) ([]*iniSection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseYumfileSections(f, path, seen)
+}
+
+// parseYumfileSections reads the sections of a Yumfile from the given
+// io.Reader, followed by the sections of each Yumfile it includes, as per
+// readYumfileSections.
+func parseYumfileSections(r io.Reader, path string, seen map[string]bool) ([]*iniSection, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if reading, ok := seen[abs]; ok {
+		if reading {
+			return nil, NewErrorf("Yumfile %s includes itself", path)
+		}
+		return nil, nil
+	}
+	seen[abs] = true
+	defer func() { seen[abs] = false }()
+
+	sections, err := readIni(r, path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range sections {
+		if s.Name != yumfileMainSection {
+			continue
+		}
+
+		for _, include := range strings.Fields(s.Values["include"]) {
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+
+			included, err := readYumfileSections(include, seen)
+			if err != nil {
+				return nil, fmt.Errorf("Error including %s (in %s:%d): %v", include, path, s.LineNo, err)
+			}
+
+			sections = append(sections, included...)
+		}
+	}
+
+	return sections, nil
+}
+
+// varPattern matches a $name or ${name} variable reference.
+var varPattern = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+// expandVars substitutes each $name or ${name} in the given string with the
+// value of the named variable. Unknown variables are not modified.
+func expandVars(s string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return s
+	}
+
+	return varPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		if v, ok := vars[name]; ok {
+			return v
+		}
+
+		return ref
+	})
+}
+
+// loadYumfile parses the Yumfile at the given path and returns its repos,
+// including disabled repos, in the order they are defined.
+func loadYumfile(path string) (*yumfile, error) {
+	sections, err := readYumfileSections(path, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	return newYumfile(sections)
+}
+
+// parseYumfile parses a Yumfile from the given io.Reader, as per loadYumfile.
+func parseYumfile(r io.Reader, path string) (*yumfile, error) {
+	sections, err := parseYumfileSections(r, path, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+
+	return newYumfile(sections)
+}
+
+// newYumfile resolves the repos defined by the given sections of a Yumfile and
+// the Yumfiles it includes.
+func newYumfile(sections []*iniSection) (*yumfile, error) {
+	// merge main and vars sections; options of earlier sections, in the
+	// including Yumfile, take precedence
+	main := make(map[string]string)
+	vars := make(map[string]string)
+	y := &yumfile{
+		Repos:     make([]*Repo, 0),
+		Exclude:   make([]string, 0),
+		inherited: make(map[*Repo]map[string]bool),
+	}
+
+	for _, s := range sections {
+		switch s.Name {
+		case yumfileMainSection:
+			for k, v := range s.Values {
+				switch k {
+				case "include":
+				case "exclude":
+					y.Exclude = append(y.Exclude, splitPatterns(v)...)
+				default:
+					if _, ok := main[k]; !ok {
+						main[k] = v
+					}
+				}
+			}
+
+		case yumfileVarsSection:
+			for k, v := range s.Values {
+				if _, ok := vars[k]; !ok {
+					vars[k] = v
+				}
+			}
+		}
+	}
+
+	for _, s := range sections {
+		if s.Name == yumfileMainSection || s.Name == yumfileVarsSection {
+			continue
+		}
+
+		// inherit options and substitute variables
+		inherited := make(map[string]bool)
+		resolved := &iniSection{
+			Name:   s.Name,
+			Path:   s.Path,
+			LineNo: s.LineNo,
+			Values: make(map[string]string, len(s.Values)+len(main)),
+		}
+
+		for k, v := range main {
+			if _, ok := s.Values[k]; !ok {
+				resolved.Values[k] = expandVars(v, vars)
+				inherited[k] = true
+			}
+		}
+
+		for k, v := range s.Values {
+			resolved.Values[k] = expandVars(v, vars)
+		}
+
+		repo, err := repoFromSection(resolved, s.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		repo.globalExclude = append([]string(nil), y.Exclude...)
+		y.Repos = append(y.Repos, repo)
+		y.inherited[repo] = inherited
+	}
+
+	return y, nil
+}
+
+// LoadYumfile parses the Yumfile at the given path, and any Yumfiles it
+// includes, and returns each repo it defines in the order they are defined.
+// Disabled repos are included so they may be validated; see Repo.Enabled.
+//
+// Options of the main section are inherited by each repo and variables of the
+// vars section are substituted. Packages matching the exclude option of the
+// main section are excluded from every repo. Relative paths are resolved against the directory
+// of the Yumfile which defines them. An error is returned if any repo is
+// invalid or if two repos have the same ID.
+func LoadYumfile(path string) ([]*Repo, error) {
+	y, err := loadYumfile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return y.validate()
+}
+
+// yumfileDirMain is the name of the Yumfile in a directory loaded by
+// LoadYumfileDir whose main and vars sections are shared by every Yumfile in
+// the directory.
+const yumfileDirMain = "main.yumfile"
+
+// LoadYumfileDir parses each *.yumfile and *.repo file in the given directory,
+// such as /etc/yum.repos.d/, as per LoadYumfile and returns the repos they
+// define, in the sorted order of the filenames.
+//
+// The main and vars sections of every file are merged, with those of
+// main.yumfile, if present, taking precedence over those of the remaining
+// files in sorted order. An error is returned if two files define a repo with
+// the same ID.
+func LoadYumfileDir(dir string) ([]*Repo, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, pattern := range []string{"*.yumfile", "*.repo"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := filepath.Base(paths[i]), filepath.Base(paths[j])
+		if (a == yumfileDirMain) != (b == yumfileDirMain) {
+			return a == yumfileDirMain
+		}
+		return a < b
+	})
+
+	seen := make(map[string]bool)
+	sections := make([]*iniSection, 0)
+	for _, path := range paths {
+		// skip files already included by another file in the directory
+		if abs, err := filepath.Abs(path); err == nil {
+			if _, ok := seen[abs]; ok {
+				continue
+			}
+		}
+
+		s, err := readYumfileSections(path, seen)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, s...)
+	}
+
+	y, err := newYumfile(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	return y.validate()
+}
+
+// ParseYumfile parses a Yumfile from the given io.Reader, as per LoadYumfile.
+// The given path is the location of the Yumfile, against which relative paths
+// and includes are resolved, and is used in error messages.
+func ParseYumfile(r io.Reader, path string) ([]*Repo, error) {
+	y, err := parseYumfile(r, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return y.validate()
+}
+
+// validate validates each repo of the Yumfile and returns the repos.
+func (c *yumfile) validate() ([]*Repo, error) {
+	defined := make(map[string]*Repo, len(c.Repos))
+	for _, repo := range c.Repos {
+		if err := repo.Validate(); err != nil {
+			return nil, err
+		}
+
+		if prev, ok := defined[repo.ID]; ok {
+			return nil, NewErrorf("Repo '%s' is defined more than once (in %s:%d and %s:%d)", repo.ID, prev.YumfilePath, prev.YumfileLineNo, repo.YumfilePath, repo.YumfileLineNo)
+		}
+		defined[repo.ID] = repo
+	}
+
+	return c.Repos, nil
+}
+
+// formatDuration formats a duration option value as accepted by
+// parseDuration.
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		return "never"
+	}
+
+	return fmt.Sprintf("%d", int64(d/time.Second))
+}
+
+// formatSize formats a size option value as accepted by parseSize, in bytes
+// unless it is a whole number of a larger unit.
+func formatSize(n uint64) string {
+	if size := bytefmt.ByteSize(n); size != "" {
+		if m, err := parseSize(size); err == nil && m == n {
+			return size
+		}
+	}
+
+	return strconv.FormatUint(n, 10)
+}
+
+// formatDate formats a date option value as accepted by parseDate, as a date
+// if it is midnight UTC.
+func formatDate(t time.Time) string {
+	if u := t.UTC(); u.Equal(time.Date(u.Year(), u.Month(), u.Day(), 0, 0, 0, 0, time.UTC)) {
+		return u.Format(yumfileDateLayout)
+	}
+
+	return t.Format(time.RFC3339Nano)
+}
+
+// redactedValue is written by repoOptions in place of each header value and
+// passphrase.
+const redactedValue = "<redacted>"
+
+// repoOptions returns the Yumfile options of the given repo, as parsed by
+// repoFromSection, in canonical order. Unset options and those which have
+// their default value are omitted, and header values and passphrases are
+// redacted. Settings which cannot be given in a Yumfile, such as functions and
+// checksum policies other than MinimumChecksumPolicy, are omitted.
+func repoOptions(repo *Repo) [][2]string {
+	opts := make([][2]string, 0)
+	add := func(key, value string) {
+		if value != "" {
+			opts = append(opts, [2]string{key, value})
+		}
+	}
+
+	bool01 := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+
+	add("name", repo.Name)
+	add("architecture", repo.Architecture)
+	add("baseurl", strings.Join(append([]string{repo.BaseURL}, repo.Mirrors...), "\n  "))
+	add("mirrorlist", repo.MirrorURL)
+	add("localpath", repo.LocalPath)
+	add("cachepath", strings.Join(filepath.SplitList(repo.CachePath), "\n  "))
+	add("groupfile", repo.Groupfile)
+	if isInlineKey(repo.GPGKey) {
+		// option values cannot contain blank lines
+		lines := make([]string, 0)
+		for _, line := range strings.Split(repo.GPGKey, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		add("gpgkey", strings.Join(lines, "\n  "))
+	} else {
+		add("gpgkey", repo.GPGKey)
+	}
+	add("gpgcheck", bool01(repo.GPGCheck))
+	if repo.GPGCheckLocal {
+		add("gpgcheck_local", bool01(repo.GPGCheckLocal))
+	}
+	add("enabled", bool01(repo.Enabled))
+	if repo.Frozen {
+		add("frozen", bool01(repo.Frozen))
+	}
+	if repo.CheckClosure {
+		add("check_closure", bool01(repo.CheckClosure))
+	}
+	if repo.CheckMagic {
+		add("check_magic", bool01(repo.CheckMagic))
+	}
+	if repo.RejectDuplicates {
+		add("reject_duplicates", bool01(repo.RejectDuplicates))
+	}
+	if repo.AutoSatisfyDeps {
+		add("auto_satisfy_deps", bool01(repo.AutoSatisfyDeps))
+	}
+	if !repo.EmitSQLite {
+		add("emit_sqlite", bool01(repo.EmitSQLite))
+	}
+	if repo.FollowSymlinks {
+		add("follow_symlinks", bool01(repo.FollowSymlinks))
+	}
+	if repo.Zsync {
+		add("zsync", bool01(repo.Zsync))
+	}
+	if !repo.FailOnPartial {
+		add("fail_on_partial", bool01(repo.FailOnPartial))
+	}
+	for _, opt := range []struct {
+		key   string
+		value bool
+	}{
+		{"allow_unsigned", repo.AllowUnsigned},
+		{"assume_yes", repo.AssumeYes},
+		{"delete_removed", repo.DeleteRemoved},
+		{"drop_unknown_metadata", repo.DropUnknownMetadata},
+		{"export_checksums", repo.ExportChecksums},
+		{"force_createrepo", repo.ForceCreaterepo},
+		{"force_refresh", repo.ForceRefresh},
+		{"full_resync", repo.FullResync},
+		{"generate_changelog", repo.GenerateChangelog},
+		{"include_sources", repo.IncludeSources},
+		{"incremental_by_date", repo.IncrementalByDate},
+		{"incremental_by_mtime", repo.IncrementalByMtime},
+		{"lock_wait", repo.LockWait},
+		{"new_only", repo.NewOnly},
+		{"preserve_appstream", repo.PreserveAppstream},
+		{"preserve_productid", repo.PreserveProductID},
+		{"preserve_repodata", repo.PreserveRepodata},
+		{"quarantine_on_gpg_fail", repo.QuarantineOnGPGFail},
+		{"report_orphans", repo.ReportOrphans},
+		{"require_sha256", repo.RequireSHA256},
+		{"resume_state", repo.ResumeState},
+		{"separate_debug_repo", repo.SeparateDebugRepo},
+	} {
+		if opt.value {
+			add(opt.key, bool01(opt.value))
+		}
+	}
+	if repo.Priority > 0 && repo.Priority != DefaultPriority {
+		add("priority", strconv.Itoa(repo.Priority))
+	}
+	if repo.MetadataExpire != 0 {
+		add("metadata_expire", formatDuration(repo.MetadataExpire))
+	}
+	if repo.DateSkewTolerance != 0 {
+		add("date_skew_tolerance", formatDuration(repo.DateSkewTolerance))
+	}
+	if !repo.MinDate.IsZero() {
+		add("min_date", formatDate(repo.MinDate))
+	}
+	if !repo.MaxDate.IsZero() {
+		add("max_date", formatDate(repo.MaxDate))
+	}
+	if repo.KeepVersions != 0 {
+		add("keep_versions", strconv.Itoa(repo.KeepVersions))
+	}
+	if repo.DeleteOlderThan != 0 {
+		add("delete_older_than", formatDuration(repo.DeleteOlderThan))
+	}
+	if repo.MetadataThreads != 0 {
+		add("metadata_threads", strconv.Itoa(repo.MetadataThreads))
+	}
+	if repo.MaxBytesPerSecond != 0 {
+		add("throttle", formatRate(repo.MaxBytesPerSecond))
+	}
+	if repo.MaxPackageSize != 0 {
+		add("maxpkgsize", formatSize(repo.MaxPackageSize))
+	}
+	if len(repo.BandwidthSchedule) > 0 {
+		windows := make([]string, len(repo.BandwidthSchedule))
+		for i, window := range repo.BandwidthSchedule {
+			windows[i] = window.String()
+		}
+		add("bandwidth_schedule", strings.Join(windows, " "))
+	}
+	add("exclude", strings.Join(repo.Exclude, " "))
+	add("includepkgs", strings.Join(repo.IncludePackages, " "))
+	add("exclude_licenses", strings.Join(repo.ExcludeLicenses, " "))
+	add("include_licenses", strings.Join(repo.IncludeLicenses, " "))
+	add("include_regex", repo.IncludeRegex)
+	add("exclude_regex", repo.ExcludeRegex)
+	add("include_groups", strings.Join(repo.IncludeGroups, " "))
+	add("include_modules", strings.Join(repo.IncludeModules, " "))
+	add("pin_revision", repo.PinRevision)
+	add("checksum", repo.Checksum)
+	if policy, ok := repo.ChecksumPolicy.(MinimumChecksumPolicy); ok {
+		add("checksum_policy", string(policy))
+	}
+	if len(repo.Headers) > 0 {
+		names := make([]string, 0, len(repo.Headers))
+		for name := range repo.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// header values are often secrets, such as API keys
+		headers := make([]string, len(names))
+		for i, name := range names {
+			headers[i] = name + ": " + redactedValue
+		}
+		add("header", strings.Join(headers, "\n  "))
+	}
+	add("header_hosts", strings.Join(repo.HeaderHosts, " "))
+	add("package_lockfile", repo.PackageLockFile)
+	add("s3_region", repo.S3Region)
+	add("s3_endpoint", repo.S3Endpoint)
+	add("staging_dir", repo.StagingDir)
+	add("temp_dir", repo.TempDir)
+	add("sign_key", repo.SignKey)
+	if repo.SignKeyPassphrase != "" {
+		add("sign_key_passphrase", redactedValue)
+	}
+	add("resign_key", repo.ResignKey)
+	if repo.ResignKeyPassphrase != "" {
+		add("resign_key_passphrase", redactedValue)
+	}
+	add("vault_url", repo.VaultURL)
+	add("user_agent", repo.UserAgent)
+	add("notify_webhook", repo.NotifyWebhook)
+	return opts
+}
+
+// DumpResolvedYumfile parses the Yumfile at the given path, including any
+// included Yumfiles, and writes every repo it defines to the given io.Writer
+// as a canonical Yumfile, with inherited options and variables resolved and
+// relative paths made absolute. Options inherited from the main section are
+// marked with a comment.
+func DumpResolvedYumfile(path string, w io.Writer) error {
+	y, err := loadYumfile(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "# Resolved from %s\n", path)
+	if len(y.Exclude) > 0 {
+		fmt.Fprintf(w, "\n[%s]\nexclude = %s\n", yumfileMainSection, strings.Join(y.Exclude, " "))
+	}
+
+	for _, repo := range y.Repos {
+		fmt.Fprintf(w, "\n# defined in %s:%d\n[%s]\n", repo.YumfilePath, repo.YumfileLineNo, repo.ID)
+
+		inherited := y.inherited[repo]
+		for _, opt := range repoOptions(repo) {
+			if inherited[opt[0]] {
+				fmt.Fprintf(w, "# %s inherited from [%s]\n", opt[0], yumfileMainSection)
+			}
+
+			if _, err := fmt.Fprintf(w, "%s = %s\n", opt[0], opt[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
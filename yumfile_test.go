@@ -0,0 +1,419 @@
+package yum
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testYumfile = `[main]
+include = extras.yumfile
+gpgcheck = 1
+gpgkey = keys/RPM-GPG-KEY-CentOS-$releasever
+metadata_expire = 6h
+exclude = kernel*
+
+[vars]
+releasever = 7
+basearch = x86_64
+
+[base]
+name = CentOS-$releasever - Base
+baseurl = http://mirror.centos.org/centos/$releasever/os/$basearch/
+  http://mirror2.centos.org/centos/$releasever/os/$basearch/
+localpath = base
+date_skew_tolerance = 5m
+
+[updates]
+name = CentOS-${releasever} - Updates
+baseurl = http://mirror.centos.org/centos/$releasever/updates/$basearch/
+gpgcheck = 0
+enabled = 0
+`
+
+const testExtrasYumfile = `[extras]
+mirrorlist = http://mirrorlist.centos.org/?release=$releasever&arch=$basearch&repo=extras
+exclude = foo bar
+`
+
+func TestDumpResolvedYumfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "Yumfile")
+	if err := ioutil.WriteFile(path, []byte(testYumfile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "extras.yumfile"), []byte(testExtrasYumfile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	y, err := loadYumfile(path)
+	if err != nil {
+		t.Fatalf("Error loading Yumfile: %v", err)
+	}
+
+	if len(y.Repos) != 3 {
+		t.Fatalf("Expected 3 repos, got %d", len(y.Repos))
+	}
+
+	base, updates, extras := y.Repos[0], y.Repos[1], y.Repos[2]
+	if base.BaseURL != "http://mirror.centos.org/centos/7/os/x86_64/" || len(base.Mirrors) != 1 {
+		t.Errorf("Variables were not substituted in baseurl: %s %v", base.BaseURL, base.Mirrors)
+	}
+
+	if !base.GPGCheck || base.GPGKey != filepath.Join(dir, "keys/RPM-GPG-KEY-CentOS-7") || base.LocalPath != filepath.Join(dir, "base") || base.DateSkewTolerance != 5*time.Minute {
+		t.Errorf("Unexpected options for repo %v: %#v", base, base)
+	}
+
+	if updates.GPGCheck || updates.Enabled || updates.Name != "CentOS-7 - Updates" {
+		t.Errorf("Unexpected options for repo %v: %#v", updates, updates)
+	}
+
+	if extras.YumfilePath != filepath.Join(dir, "extras.yumfile") || extras.MirrorURL != "http://mirrorlist.centos.org/?release=7&arch=x86_64&repo=extras" {
+		t.Errorf("Unexpected options for included repo %v: %#v", extras, extras)
+	}
+
+	// dump the resolved Yumfile
+	buf := &bytes.Buffer{}
+	if err := DumpResolvedYumfile(path, buf); err != nil {
+		t.Fatalf("Error dumping Yumfile: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "# gpgkey inherited from [main]\ngpgkey = "+filepath.Join(dir, "keys/RPM-GPG-KEY-CentOS-7")) {
+		t.Errorf("Inherited values are not marked in dump:\n%s", buf.String())
+	}
+
+	// the dump round-trips to equivalent repos
+	dumped := filepath.Join(dir, "resolved", "Yumfile")
+	if err := os.MkdirAll(filepath.Dir(dumped), 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(dumped, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	y2, err := loadYumfile(dumped)
+	if err != nil {
+		t.Fatalf("Error loading dumped Yumfile: %v\n%s", err, buf.String())
+	}
+
+	if !reflect.DeepEqual(y.Exclude, y2.Exclude) {
+		t.Errorf("Expected global excludes %v, got %v", y.Exclude, y2.Exclude)
+	}
+
+	if len(y2.Repos) != len(y.Repos) {
+		t.Fatalf("Expected %d repos in dumped Yumfile, got %d", len(y.Repos), len(y2.Repos))
+	}
+
+	for i, repo := range y2.Repos {
+		repo.YumfilePath = y.Repos[i].YumfilePath
+		repo.YumfileLineNo = y.Repos[i].YumfileLineNo
+		if !reflect.DeepEqual(repo, y.Repos[i]) {
+			t.Errorf("Dumped repo does not match:\nexpected: %#v\ngot:      %#v", y.Repos[i], repo)
+		}
+	}
+}
+
+const testOptionsYumfile = `[base]
+name = Base
+architecture = x86_64
+baseurl = http://a/
+  http://b/
+mirrorlist = http://mirrorlist/
+localpath = base
+cachepath = cache
+  /var/cache/go-yum
+groupfile = comps.xml
+gpgkey = keys/RPM-GPG-KEY
+gpgcheck = 1
+gpgcheck_local = 1
+enabled = 1
+frozen = 1
+check_closure = 1
+check_magic = 1
+reject_duplicates = 1
+auto_satisfy_deps = 1
+emit_sqlite = 0
+follow_symlinks = 1
+zsync = 1
+fail_on_partial = 0
+allow_unsigned = 1
+assume_yes = 1
+delete_removed = 1
+drop_unknown_metadata = 1
+export_checksums = 1
+force_createrepo = 1
+force_refresh = 1
+full_resync = 1
+generate_changelog = 1
+include_sources = 1
+incremental_by_date = 1
+incremental_by_mtime = 1
+lock_wait = 1
+new_only = 1
+preserve_appstream = 1
+preserve_productid = 1
+preserve_repodata = 1
+quarantine_on_gpg_fail = 1
+report_orphans = 1
+require_sha256 = 1
+resume_state = 1
+separate_debug_repo = 1
+priority = 10
+metadata_expire = 6h
+date_skew_tolerance = 5m
+min_date = 2020-01-01
+max_date = 2020-06-30T12:00:00Z
+keep_versions = 3
+delete_older_than = 30d
+metadata_threads = 4
+throttle = 1M
+maxpkgsize = 500M
+bandwidth_schedule = 08:00-18:00=5M
+exclude = zsh tcsh
+includepkgs = kernel*
+exclude_licenses = GPL*
+include_licenses = MIT
+include_regex = ^k
+exclude_regex = ^kernel-debug
+include_groups = core
+include_modules = nodejs:12
+pin_revision = 1500000000
+checksum = sha256
+checksum_policy = sha512
+header = X-Api-Key: secret
+header_hosts = cdn.example.com
+package_lockfile = packages.lock
+s3_region = eu-west-1
+s3_endpoint = http://minio:9000
+staging_dir = staging
+temp_dir = tmp
+sign_key = sign.asc
+sign_key_passphrase = secret
+resign_key = resign.asc
+resign_key_passphrase = secret
+vault_url = http://vault/
+user_agent = mirror/1.0
+notify_webhook = https://hooks.example.com/
+`
+
+func TestDumpResolvedYumfileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "Yumfile")
+	if err := ioutil.WriteFile(path, []byte(testOptionsYumfile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := LoadYumfile(path)
+	if err != nil {
+		t.Fatalf("Error loading Yumfile: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := DumpResolvedYumfile(path, buf); err != nil {
+		t.Fatalf("Error dumping Yumfile: %v", err)
+	}
+
+	// every option is dumped
+	for _, line := range strings.Split(testOptionsYumfile, "\n") {
+		if i := strings.Index(line, " = "); i > 0 {
+			if key := line[:i]; !strings.Contains(buf.String(), "\n"+key+" = ") {
+				t.Errorf("Option %s is missing from dump:\n%s", key, buf.String())
+			}
+		}
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Secrets are not redacted in dump:\n%s", buf.String())
+	}
+
+	dumped, err := ParseYumfile(bytes.NewReader(buf.Bytes()), path)
+	if err != nil {
+		t.Fatalf("Error parsing dumped Yumfile: %v\n%s", err, buf.String())
+	}
+
+	if len(dumped) != 1 {
+		t.Fatalf("Expected 1 repo in dumped Yumfile, got %d", len(dumped))
+	}
+
+	// the dump round-trips to an equal repo, but for redacted values
+	expect := repos[0]
+	expect.Headers = map[string]string{"X-Api-Key": redactedValue}
+	expect.SignKeyPassphrase = redactedValue
+	expect.ResignKeyPassphrase = redactedValue
+	dumped[0].YumfileLineNo = expect.YumfileLineNo
+	if !reflect.DeepEqual(dumped[0], expect) {
+		t.Errorf("Dumped repo does not match:\nexpected: %#v\ngot:      %#v", expect, dumped[0])
+	}
+}
+
+func TestLoadYumfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "Yumfile")
+	if err := ioutil.WriteFile(path, []byte(testYumfile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "extras.yumfile"), []byte(testExtrasYumfile), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := LoadYumfile(path)
+	if err != nil {
+		t.Fatalf("Error loading Yumfile: %v", err)
+	}
+
+	ids := make([]string, len(repos))
+	for i, repo := range repos {
+		ids[i] = repo.ID
+	}
+
+	if !reflect.DeepEqual(ids, []string{"base", "updates", "extras"}) {
+		t.Errorf("Unexpected repos: %v", ids)
+	}
+
+	for _, repo := range repos {
+		if !reflect.DeepEqual(repo.globalExclude, []string{"kernel*"}) {
+			t.Errorf("Unexpected global excludes for repo %v: %v", repo, repo.globalExclude)
+		}
+	}
+
+	// includes are resolved against the given path
+	repos, err = ParseYumfile(strings.NewReader(testYumfile), path)
+	if err != nil || len(repos) != 3 {
+		t.Fatalf("Error parsing Yumfile: %v", err)
+	}
+
+	if !reflect.DeepEqual(repos[0].globalExclude, []string{"kernel*"}) {
+		t.Errorf("Expected global excludes not to accumulate, got: %v", repos[0].globalExclude)
+	}
+
+	// global excludes apply only to the repos of the Yumfile which sets them
+	other, err := ParseYumfile(strings.NewReader("[other]\nbaseurl = http://a/\n"), path)
+	if err != nil {
+		t.Fatalf("Error parsing Yumfile: %v", err)
+	}
+
+	if len(other[0].globalExclude) != 0 || len(repos[0].globalExclude) != 1 {
+		t.Errorf("Expected global excludes of each Yumfile to be independent, got %v and %v", other[0].globalExclude, repos[0].globalExclude)
+	}
+
+	// invalid repos are rejected
+	for _, s := range []string{
+		"[base]\nname = no URL\n",
+		"[base]\nbaseurl = http://a/\n\n[base]\nbaseurl = http://b/\n",
+	} {
+		if _, err := ParseYumfile(strings.NewReader(s), path); err == nil {
+			t.Errorf("Expected error parsing invalid Yumfile:\n%s", s)
+		}
+	}
+}
+
+func TestLoadYumfileDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"main.yumfile":    "[main]\nlocalpath = /srv/$release\n\n[vars]\nrelease = 7\n",
+		"updates.yumfile": "[updates]\nbaseurl = http://mirror/updates/\n",
+		"base.repo":       "[base]\nbaseurl = http://mirror/base/\nlocalpath = /srv/base\n",
+		"README":          "not a Yumfile\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repos, err := LoadYumfileDir(dir)
+	if err != nil {
+		t.Fatalf("Error loading Yumfile directory: %v", err)
+	}
+
+	paths := make([]string, len(repos))
+	for i, repo := range repos {
+		paths[i] = repo.ID + "=" + repo.LocalPath
+	}
+
+	// the main section of main.yumfile is shared by every file
+	if !reflect.DeepEqual(paths, []string{"base=/srv/base", "updates=/srv/7"}) {
+		t.Errorf("Unexpected repos: %v", paths)
+	}
+
+	// a repo defined in two files is rejected
+	if err := ioutil.WriteFile(filepath.Join(dir, "updates.repo"), []byte("[updates]\nbaseurl = http://other/updates/\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadYumfileDir(dir); err == nil || !strings.Contains(err.Error(), "defined more than once") {
+		t.Errorf("Expected duplicate repo error, got: %v", err)
+	}
+
+	if _, err := LoadYumfileDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected error loading a missing directory")
+	}
+}
+
+func TestYumfileIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"Yumfile":      "[main]\ninclude = b.yumfile c.yumfile\n",
+		"b.yumfile":    "[main]\ninclude = d.yumfile\n\n[b]\nbaseurl = http://mirror/b/\n",
+		"c.yumfile":    "[main]\ninclude = d.yumfile\n\n[c]\nbaseurl = http://mirror/c/\n",
+		"d.yumfile":    "[d]\nbaseurl = http://mirror/d/\n",
+		"loop.yumfile": "[main]\ninclude = next.yumfile\n",
+		"next.yumfile": "[main]\ninclude = loop.yumfile\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a Yumfile included by two others is read once
+	repos, err := LoadYumfile(filepath.Join(dir, "Yumfile"))
+	if err != nil {
+		t.Fatalf("Error loading Yumfile with shared include: %v", err)
+	}
+
+	ids := make([]string, len(repos))
+	for i, repo := range repos {
+		ids[i] = repo.ID
+	}
+
+	if !reflect.DeepEqual(ids, []string{"b", "d", "c"}) {
+		t.Errorf("Unexpected repos: %v", ids)
+	}
+
+	// include cycles are rejected
+	if _, err := LoadYumfile(filepath.Join(dir, "loop.yumfile")); err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("Expected include cycle error, got: %v", err)
+	}
+}
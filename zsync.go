@@ -0,0 +1,445 @@
+package yum
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// zsyncBlock is the checksums of a block of a file in a zsync control file.
+type zsyncBlock struct {
+	rsum     uint32
+	checksum []byte
+}
+
+// zsyncControl is a zsync control file, as written by zsyncmake, which
+// describes the blocks of a file so that it may be reconstructed from an
+// older copy of the file by downloading only the blocks which differ.
+type zsyncControl struct {
+	Blocksize int
+	Length    int64
+	SHA1      string
+
+	// rsumBytes and checksumBytes are the number of bytes of the rolling
+	// checksum and the MD4 checksum of each block in the control file.
+	rsumBytes     int
+	checksumBytes int
+
+	blocks []zsyncBlock
+}
+
+// readZsyncControl parses the zsync control file read from the given
+// io.Reader.
+func readZsyncControl(r io.Reader) (*zsyncControl, error) {
+	br := bufio.NewReader(r)
+	c := &zsyncControl{rsumBytes: 4, checksumBytes: 16}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("Error reading zsync header: %v", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid zsync header: %s", line)
+		}
+
+		key, value := line[:i], strings.TrimSpace(line[i+1:])
+		switch key {
+		case "Blocksize":
+			c.Blocksize, err = strconv.Atoi(value)
+
+		case "Length":
+			c.Length, err = strconv.ParseInt(value, 10, 64)
+
+		case "SHA-1":
+			c.SHA1 = strings.ToLower(value)
+
+		case "Hash-Lengths":
+			// seq_matches,rsum_bytes,checksum_bytes
+			fields := strings.Split(value, ",")
+			if len(fields) != 3 {
+				return nil, fmt.Errorf("Invalid zsync Hash-Lengths: %s", value)
+			}
+
+			if c.rsumBytes, err = strconv.Atoi(fields[1]); err == nil {
+				c.checksumBytes, err = strconv.Atoi(fields[2])
+			}
+
+		case "Z-URL", "Z-Map2", "Recompress":
+			return nil, fmt.Errorf("Compressed zsync targets are not supported")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid zsync %s: %s", key, value)
+		}
+	}
+
+	if c.Blocksize <= 0 || c.Length < 0 {
+		return nil, fmt.Errorf("Invalid zsync Blocksize or Length")
+	}
+
+	if c.rsumBytes < 1 || c.rsumBytes > 4 || c.checksumBytes < 3 || c.checksumBytes > 16 {
+		return nil, fmt.Errorf("Invalid zsync Hash-Lengths")
+	}
+
+	n := (c.Length + int64(c.Blocksize) - 1) / int64(c.Blocksize)
+	c.blocks = make([]zsyncBlock, n)
+	entry := make([]byte, c.rsumBytes+c.checksumBytes)
+	for i := range c.blocks {
+		if _, err := io.ReadFull(br, entry); err != nil {
+			return nil, fmt.Errorf("Error reading zsync block checksums: %v", err)
+		}
+
+		// the rolling checksum is stored big endian, truncated to its
+		// least significant bytes
+		var rsum uint32
+		for _, b := range entry[:c.rsumBytes] {
+			rsum = rsum<<8 | uint32(b)
+		}
+
+		c.blocks[i] = zsyncBlock{
+			rsum:     rsum,
+			checksum: append([]byte(nil), entry[c.rsumBytes:]...),
+		}
+	}
+
+	return c, nil
+}
+
+// rsumMask returns the mask of the bits of a rolling checksum which are
+// recorded in the control file.
+func (c *zsyncControl) rsumMask() uint32 {
+	if c.rsumBytes == 4 {
+		return 0xffffffff
+	}
+
+	return 1<<(8*uint(c.rsumBytes)) - 1
+}
+
+// blockLength returns the length of the given block of the target file, which
+// is shorter than Blocksize for the last block.
+func (c *zsyncControl) blockLength(i int) int64 {
+	start := int64(i) * int64(c.Blocksize)
+	if start+int64(c.Blocksize) > c.Length {
+		return c.Length - start
+	}
+
+	return int64(c.Blocksize)
+}
+
+// zsyncRsum returns the zsync rolling checksum of the given block, with the
+// sum of its bytes in the high 16 bits and the sum weighted by the distance of
+// each byte from the end of the block in the low 16 bits.
+func zsyncRsum(block []byte) (a, b uint16) {
+	n := len(block)
+	for i, c := range block {
+		a += uint16(c)
+		b += uint16(n-i) * uint16(c)
+	}
+
+	return a, b
+}
+
+// zsyncChecksum returns the MD4 checksum of the given block, truncated to the
+// given number of bytes.
+func zsyncChecksum(block []byte, n int) []byte {
+	h := md4.New()
+	h.Write(block)
+	return h.Sum(nil)[:n]
+}
+
+// match returns the offset in the given seed file of each block of the target
+// file which is found in the seed, by comparing the rolling checksum of every
+// window of the seed with the checksums of the blocks. Blocks which are not
+// found are absent from the returned map.
+func (c *zsyncControl) match(seed io.Reader) (map[int]int64, error) {
+	mask := c.rsumMask()
+	index := make(map[uint32][]int, len(c.blocks))
+	for i, b := range c.blocks {
+		index[b.rsum] = append(index[b.rsum], i)
+	}
+
+	found := make(map[int]int64)
+	blocksize := c.Blocksize
+	buf := make([]byte, 0, 4*blocksize)
+	var offset int64 // offset in the seed of buf[0]
+	start := 0       // offset in buf of the window
+	eof := false
+	var length int64 // length of the seed, once it has been read
+	fill := func() error {
+		// discard the bytes before the window
+		offset += int64(start)
+		buf = append(buf[:0], buf[start:]...)
+		start = 0
+
+		n, err := io.ReadFull(seed, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the last block is padded with zeros, as for its checksum
+			eof = true
+			length = offset + int64(len(buf))
+			buf = append(buf, make([]byte, blocksize-1)...)
+			return nil
+		}
+		return err
+	}
+
+	var a, b uint16
+	rolling := false
+	for {
+		// the window and the byte after it must be buffered
+		if len(buf)-start <= blocksize && !eof {
+			if err := fill(); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(buf)-start < blocksize {
+			break
+		}
+
+		window := buf[start : start+blocksize]
+		if !rolling {
+			a, b = zsyncRsum(window)
+			rolling = true
+		}
+
+		matched := false
+		var sum []byte
+		for _, i := range index[(uint32(a)<<16|uint32(b))&mask] {
+			if _, ok := found[i]; ok {
+				continue
+			}
+
+			if sum == nil {
+				sum = zsyncChecksum(window, c.checksumBytes)
+			}
+
+			// blocks matched in the padding must not extend beyond the seed
+			pos := offset + int64(start)
+			if eof && pos+c.blockLength(i) > length {
+				continue
+			}
+
+			if bytes.Equal(sum, c.blocks[i].checksum) {
+				found[i] = pos
+				matched = true
+			}
+		}
+
+		if matched {
+			// continue after the matched block
+			start += blocksize
+			rolling = false
+			continue
+		}
+
+		if len(buf)-start == blocksize {
+			break
+		}
+
+		// roll the window on by one byte
+		out, in := uint16(buf[start]), uint16(buf[start+blocksize])
+		a = a - out + in
+		b = b - uint16(blocksize)*out + a
+		start++
+	}
+
+	return found, nil
+}
+
+// zsyncDownload reconstructs the file at the given HTTP URL at the given
+// filename from the given seed file, such as an older version of the same
+// package, using the zsync control file published beside it at url.zsync.
+// Blocks found in the seed are copied from the seed and only the remaining
+// blocks are downloaded, with HTTP range requests. The number of bytes
+// downloaded, excluding the control file, is returned.
+func zsyncDownload(client *http.Client, url, seed, filename, useragent string) (uint64, error) {
+	body, err := openURL(client, url+".zsync", useragent)
+	if err != nil {
+		return 0, fmt.Errorf("Error downloading zsync control file: %v", err)
+	}
+	control, err := readZsyncControl(body)
+	body.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	seedf, err := os.Open(seed)
+	if err != nil {
+		return 0, err
+	}
+	defer seedf.Close()
+
+	found, err := control.match(seedf)
+	if err != nil {
+		return 0, fmt.Errorf("Error reading zsync seed %s: %v", seed, err)
+	}
+	Dprintf("Found %d of %d blocks of %s in %s\n", len(found), len(control.blocks), url, seed)
+
+	tmp := filename + ".zsync.tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	h := sha1.New()
+	w := io.MultiWriter(f, h)
+	blocksize := int64(control.Blocksize)
+	var downloaded uint64
+	for i := 0; i < len(control.blocks); {
+		start := int64(i) * blocksize
+		if offset, ok := found[i]; ok {
+			n := control.blockLength(i)
+			if _, err := io.CopyN(w, io.NewSectionReader(seedf, offset, n), n); err != nil {
+				return 0, err
+			}
+			i++
+			continue
+		}
+
+		// download each run of missing blocks with a single request
+		j := i + 1
+		for j < len(control.blocks) {
+			if _, ok := found[j]; ok {
+				break
+			}
+			j++
+		}
+
+		end := int64(j) * blocksize
+		if end > control.Length {
+			end = control.Length
+		}
+
+		n, err := downloadRange(client, url, useragent, start, end, w)
+		downloaded += uint64(n)
+		if err != nil {
+			return downloaded, err
+		}
+		i = j
+	}
+
+	if control.SHA1 != "" && hex.EncodeToString(h.Sum(nil)) != control.SHA1 {
+		return downloaded, fmt.Errorf("File reconstructed with zsync failed SHA-1 validation")
+	}
+
+	if err := f.Close(); err != nil {
+		return downloaded, err
+	}
+
+	return downloaded, os.Rename(tmp, filename)
+}
+
+// downloadRange writes the bytes from start up to end of the file at the given
+// HTTP URL to the given io.Writer and returns the number of bytes written.
+func downloadRange(client *http.Client, url, useragent string, start, end int64, w io.Writer) (int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", useragent)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		// drain the body so the connection may be reused
+		io.Copy(ioutil.Discard, resp.Body)
+		return 0, fmt.Errorf("Bad response code for range request: %s", resp.Status)
+	}
+
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", start)) {
+		return 0, fmt.Errorf("Unexpected Content-Range for range request: %s", resp.Header.Get("Content-Range"))
+	}
+
+	n, err := io.CopyN(w, resp.Body, end-start)
+	if err != nil {
+		return n, fmt.Errorf("Error downloading bytes %d-%d: %v", start, end-1, err)
+	}
+
+	return n, nil
+}
+
+// zsyncSeed returns the local file from which the given package may be
+// reconstructed with zsync: any existing file for the package in the given
+// package directories, such as one which failed validation, or otherwise the
+// most recently modified file in any of them of another version of the same
+// package and architecture. If there is no such file, an empty string is
+// returned.
+func zsyncSeed(p PackageEntry, packagedirs ...string) string {
+	for _, packagedir := range packagedirs {
+		if packagedir == "" {
+			continue
+		}
+
+		filename := filepath.Join(packagedir, p.filename())
+		if fi, err := os.Stat(filename); err == nil && fi.Mode().IsRegular() && fi.Size() > 0 {
+			return filename
+		}
+	}
+
+	seed := ""
+	var modtime int64
+	for _, packagedir := range packagedirs {
+		if packagedir == "" {
+			continue
+		}
+
+		// versions are assumed to begin with a digit, so that packages such
+		// as foo-devel are not mistaken for other versions of foo
+		matches, _ := filepath.Glob(filepath.Join(packagedir, p.Name()+"-[0-9]*."+p.Architecture()+".rpm"))
+		for _, path := range matches {
+			fi, err := os.Stat(path)
+			if err != nil || !fi.Mode().IsRegular() {
+				continue
+			}
+
+			if t := fi.ModTime().UnixNano(); seed == "" || t > modtime {
+				seed, modtime = path, t
+			}
+		}
+	}
+
+	return seed
+}
+
+// zsyncPackage reconstructs the given package at the given filename from the
+// given seed file with zsync and validates its checksum. The number of bytes
+// downloaded is returned.
+func (c *Repo) zsyncPackage(p PackageEntry, url, seed, filename string) (uint64, error) {
+	n, err := zsyncDownload(c.downloadClient(), url, seed, filename, c.userAgent())
+	if err != nil {
+		return n, err
+	}
+
+	sum, _ := p.Checksum()
+	if err := validateFileChecksum(filename, sum, p.ChecksumType()); err != nil {
+		os.Remove(filename)
+		return n, err
+	}
+
+	return n, nil
+}
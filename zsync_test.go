@@ -0,0 +1,244 @@
+package yum
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeTestZsync returns a zsync control file for the given content in the
+// zsync 0.6.2 format, with the given block size and Hash-Lengths.
+func writeTestZsync(content []byte, blocksize, rsumBytes, checksumBytes int) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "zsync: 0.6.2\nFilename: foo.rpm\nMTime: Fri, 01 May 2020 12:00:00 +0000\n")
+	fmt.Fprintf(buf, "Blocksize: %d\nLength: %d\nHash-Lengths: 2,%d,%d\n", blocksize, len(content), rsumBytes, checksumBytes)
+	fmt.Fprintf(buf, "URL: foo.rpm\nSHA-1: %x\n\n", sha1.Sum(content))
+
+	for start := 0; start < len(content); start += blocksize {
+		block := make([]byte, blocksize)
+		copy(block, content[start:])
+
+		var a, b uint16
+		for i, c := range block {
+			a += uint16(c)
+			b += uint16(blocksize-i) * uint16(c)
+		}
+
+		rsum := make([]byte, 4)
+		binary.BigEndian.PutUint16(rsum, a)
+		binary.BigEndian.PutUint16(rsum[2:], b)
+		buf.Write(rsum[4-rsumBytes:])
+
+		h := md4.New()
+		h.Write(block)
+		buf.Write(h.Sum(nil)[:checksumBytes])
+	}
+
+	return buf.Bytes()
+}
+
+// newTestZsyncServer serves the given content and its zsync control file at
+// /Packages/foo.rpm and /Packages/foo.rpm.zsync and counts the bytes of the
+// content served.
+func newTestZsyncServer(content, control []byte, served *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/Packages/foo.rpm":
+			cw := &countingResponseWriter{ResponseWriter: w, n: served}
+			http.ServeContent(cw, r, "foo.rpm", time.Time{}, bytes.NewReader(content))
+
+		case "/Packages/foo.rpm.zsync":
+			w.Write(control)
+
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(b)))
+	return w.ResponseWriter.Write(b)
+}
+
+func TestZsyncDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the new version inserts, modifies and appends data
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+
+	old := random(100000)
+	content := append([]byte(nil), old[:30000]...)
+	content = append(content, random(500)...)
+	content = append(content, old[30000:80000]...)
+	content = append(content, random(100)...)
+	content = append(content, old[80100:]...)
+	content = append(content, random(300)...)
+
+	seed := filepath.Join(dir, "foo-1.0-1.x86_64.rpm")
+	if err := ioutil.WriteFile(seed, old, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lengths := range [][2]int{{4, 16}, {2, 3}, {3, 6}} {
+		var served int64
+		ts := newTestZsyncServer(content, writeTestZsync(content, 1024, lengths[0], lengths[1]), &served)
+
+		filename := filepath.Join(dir, "foo-2.0-1.x86_64.rpm")
+		n, err := zsyncDownload(http.DefaultClient, ts.URL+"/Packages/foo.rpm", seed, filename, UserAgent)
+		ts.Close()
+		if err != nil {
+			t.Errorf("Error reconstructing file with Hash-Lengths %v: %v", lengths, err)
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(b, content) {
+			t.Errorf("Reconstructed file with Hash-Lengths %v does not match", lengths)
+		}
+
+		// only the blocks with inserted or modified data are downloaded
+		if n != uint64(served) || n == 0 || n > 6*1024 {
+			t.Errorf("Expected only changed blocks to be downloaded with Hash-Lengths %v, got %d bytes (%d served)", lengths, n, served)
+		}
+	}
+
+	// files without a control file are not reconstructed
+	ts := newTestZsyncServer(content, nil, new(int64))
+	defer ts.Close()
+	if _, err := zsyncDownload(http.DefaultClient, ts.URL+"/Packages/bar.rpm", seed, filepath.Join(dir, "bar.rpm"), UserAgent); err == nil {
+		t.Errorf("Expected an error for a package without a zsync control file")
+	}
+}
+
+func TestZsyncPackages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := bytes.Repeat([]byte("foo package version 1\n"), 2000)
+	content := append(bytes.Repeat([]byte("foo package version 1\n"), 1900), []byte("foo package version 2\n")...)
+	content = append(content, bytes.Repeat([]byte("foo package version 1\n"), 99)...)
+
+	// the seed is the older version, not another package with the same prefix
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo-1.0-1.x86_64.rpm"), old, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo-devel-2.0-1.x86_64.rpm"), content, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	p := newTestPackage("foo", "2.0", "x86_64", 0)
+	p.Location.Href = "Packages/foo.rpm"
+	p.Checksums = PackageEntryChecksum{Type: "sha256", Hash: checksumBytes(t, content).Hash}
+	if seed := zsyncSeed(p, dir); seed != filepath.Join(dir, "foo-1.0-1.x86_64.rpm") {
+		t.Fatalf("Expected older version as zsync seed, got %s", seed)
+	}
+
+	// packages downloaded to a staging directory are seeded from the package
+	// directory
+	if seed := zsyncSeed(p, filepath.Join(dir, "staging"), dir); seed != filepath.Join(dir, "foo-1.0-1.x86_64.rpm") {
+		t.Fatalf("Expected older version in the package directory as zsync seed, got %s", seed)
+	}
+
+	var served int64
+	ts := newTestZsyncServer(content, writeTestZsync(content, 2048, 4, 16), &served)
+	defer ts.Close()
+
+	repo := NewRepo()
+	repo.ID = "test"
+	repo.BaseURL = ts.URL
+	repo.Zsync = true
+	report := &SyncReport{Errors: make([]error, 0)}
+	run := newSyncRun(repo)
+	run.downloadPackages(PackageEntries{p}, dir, nil, report)
+
+	if report.Downloaded != 1 || len(report.Errors) != 0 {
+		t.Fatalf("Expected package to be reconstructed, got: %+v", report)
+	}
+
+	if served == 0 || served > 2*2048 || report.BytesDownloaded != uint64(served) {
+		t.Errorf("Expected only the changed block to be downloaded, got %d bytes (%d served)", report.BytesDownloaded, served)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, p.filename())); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("Reconstructed package does not match: %v", err)
+	}
+
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(matches) != 0 {
+		t.Errorf("Expected temporary files to be removed, got %s", strings.Join(matches, ", "))
+	}
+}
+
+// TestZsyncControlFile reconstructs a text file from a control file kept in
+// testdata rather than written by writeTestZsync, with a block size of 2048
+// bytes and Hash-Lengths of 2,2,3. The control file was written by hand in
+// the zsync 0.6.2 format, not generated by zsyncmake.
+func TestZsyncControlFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-yum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile("testdata/zsync/foo-2.0.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	control, err := ioutil.ReadFile("testdata/zsync/foo-2.0.txt.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served int64
+	ts := newTestZsyncServer(content, control, &served)
+	defer ts.Close()
+
+	filename := filepath.Join(dir, "foo-2.0.txt")
+	n, err := zsyncDownload(http.DefaultClient, ts.URL+"/Packages/foo.rpm", "testdata/zsync/foo-1.0.txt", filename, UserAgent)
+	if err != nil {
+		t.Fatalf("Error reconstructing file: %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(filename); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("Reconstructed file does not match: %v", err)
+	}
+
+	if n != uint64(served) || n == 0 || n >= uint64(len(content)) {
+		t.Errorf("Expected only changed blocks to be downloaded, got %d of %d bytes (%d served)", n, len(content), served)
+	}
+}